@@ -0,0 +1,224 @@
+package cam
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+import "errors"
+
+// Settings for pocketing. Lengths are in mm.
+type PocketSettings struct {
+	ToolDiameter   float64
+	Tool           int     // Tool to change to (<= 0 to not change tool)
+	Stepover       float64 // Distance between passes
+	Stepdown       float64 // Maximum depth of each level
+	Top            float64 // Z of the top of the pocket
+	Depth          float64 // Depth of the pocket below the top
+	Allowance      float64 // Material to leave on the walls for finishing
+	SafetyHeight   float64 // Height above the top of the pocket to move at
+	Feedrate       float64 // Cutting feedrate (mm/min)
+	PlungeFeedrate float64 // Plunge feedrate (mm/min)
+	SpindleSpeed   float64 // Spindle speed (RPM, <= 0 to leave the spindle as it is)
+}
+
+// Returns the intersection of two sorted, non-overlapping lists of intervals.
+func intersectIntervals(a, b []interval) []interval {
+	var res []interval
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		lo, hi := math.Max(a[i].lo, b[j].lo), math.Min(a[i].hi, b[j].hi)
+		if hi > lo {
+			res = append(res, interval{lo, hi})
+		}
+		if a[i].hi < b[j].hi {
+			i++
+		} else {
+			j++
+		}
+	}
+	return res
+}
+
+// Returns the intervals of a scanline where a tool of the given radius fits
+// inside the boundary. Scanlines within the radius are sampled, and their
+// inside intervals narrowed by the width of the tool at their distance. The
+// vertices within the radius are kept clear of as well, as for
+// blockedIntervals.
+func pocketIntervals(boundary []Contour, y, radius float64) []interval {
+	free := []interval{{math.Inf(-1), math.Inf(1)}}
+	for i := -radiusSamples; i <= radiusSamples; i++ {
+		dy := radius * float64(i) / radiusSamples
+		w := math.Sqrt(radius*radius - dy*dy)
+		var narrowed []interval
+		for _, in := range insideIntervals(boundary, y+dy) {
+			if in.hi-in.lo > 2*w {
+				narrowed = append(narrowed, interval{in.lo + w, in.hi - w})
+			}
+		}
+		free = intersectIntervals(free, narrowed)
+	}
+
+	var vertices []interval
+	for _, c := range boundary {
+		for _, v := range c {
+			if dy := v.Y - y; dy > -radius && dy < radius {
+				w := math.Sqrt(radius*radius - dy*dy)
+				vertices = append(vertices, interval{v.X - w, v.X + w})
+			}
+		}
+	}
+	vertices = mergeIntervals(vertices)
+
+	var res []interval
+	for _, f := range free {
+		res = append(res, freeIntervals(f.lo, f.hi, vertices)...)
+	}
+	return res
+}
+
+// Returns the boundary of a closed contour of the position stack, with its
+// arc moves split into lines deviating at most maxDeviation from them.
+func ContourBoundary(m *vm.Machine, c vm.Contour, maxDeviation float64) Contour {
+	var boundary Contour
+	for idx := c.Start; idx < c.End; idx++ {
+		start, pos := m.Positions[idx-1], m.Positions[idx]
+		if pos.State.MoveMode == vm.MoveModeCWArc || pos.State.MoveMode == vm.MoveModeCCWArc {
+			for _, p := range vm.InterpolateArc(start, pos, maxDeviation) {
+				boundary = append(boundary, vector.Vector{p.X, p.Y, 0})
+			}
+			continue
+		}
+		boundary = append(boundary, vector.Vector{pos.X, pos.Y, 0})
+	}
+	return boundary
+}
+
+// Generates a pocket clearing toolpath for the area inside the boundary,
+// level by level from the top, with zigzag passes along X. Contours inside
+// other contours are islands, by even-odd rule. The tool keeps clear of the
+// walls by the allowance, and retracts to safety height between passes
+// unless it can link them inside the pocket.
+//
+// Walls not along X are left with scallops of up to the stepover, which a
+// finishing pass around them removes.
+func Pocket(m *vm.Machine, boundary []Contour, s PocketSettings) error {
+	if s.ToolDiameter <= 0 || s.Stepover <= 0 || s.Stepdown <= 0 || s.Depth <= 0 {
+		return errors.New("Tool diameter, stepover, stepdown and depth must be positive")
+	}
+	radius := s.ToolDiameter/2 + s.Allowance
+	if radius < 0 {
+		return errors.New("Allowance cannot be below the tool radius")
+	}
+
+	var (
+		min = vector.Vector{math.Inf(1), math.Inf(1), 0}
+		max = vector.Vector{math.Inf(-1), math.Inf(-1), 0}
+	)
+	for _, c := range boundary {
+		for _, v := range c {
+			min.X, min.Y = math.Min(min.X, v.X), math.Min(min.Y, v.Y)
+			max.X, max.Y = math.Max(max.X, v.X), math.Max(max.Y, v.Y)
+		}
+	}
+
+	// The passes of each scanline, which are the same at every level
+	var (
+		scanlines []float64
+		passes    [][]interval
+	)
+	for y := min.Y + radius; y < max.Y-radius; y += s.Stepover {
+		scanlines = append(scanlines, y)
+	}
+	scanlines = append(scanlines, max.Y-radius)
+	found := false
+	for _, y := range scanlines {
+		p := pocketIntervals(boundary, y, radius)
+		passes = append(passes, p)
+		found = found || len(p) > 0
+	}
+	if !found {
+		return errors.New("Pocket is too small for the tool")
+	}
+
+	var levels []float64
+	bottom := s.Top - s.Depth
+	for z := s.Top - s.Stepdown; z > bottom; z -= s.Stepdown {
+		levels = append(levels, z)
+	}
+	levels = append(levels, bottom)
+	safety := s.Top + s.SafetyHeight
+
+	if s.Tool > 0 && m.State.ToolIndex != s.Tool {
+		m.State.NextToolIndex = s.Tool
+		m.State.ToolIndex = s.Tool
+		if _, ok := m.GetTool(s.Tool); !ok {
+			m.SetTool(s.Tool, vm.Tool{Diameter: s.ToolDiameter})
+		}
+	}
+	if s.SpindleSpeed > 0 {
+		m.State.SpindleEnabled = true
+		m.State.SpindleClockwise = true
+		m.State.SpindleSpeed = s.SpindleSpeed
+	}
+
+	cur := m.Positions[len(m.Positions)-1]
+	move(m, vm.MoveModeRapid, 0, cur.X, cur.Y, math.Max(cur.Z, safety))
+
+	// Checks if a link between adjacent scanlines stays inside the pocket, by
+	// checking scanlines along it
+	linkable := func(x1, y1, x2, y2 float64) bool {
+		for i := 1; i < radiusSamples; i++ {
+			t := float64(i) / radiusSamples
+			x, y := x1+(x2-x1)*t, y1+(y2-y1)*t
+			if !contains(pocketIntervals(boundary, y, radius), x) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, z := range levels {
+		atDepth := false
+		last := 0
+		for j, y := range scanlines {
+			line := append([]interval(nil), passes[j]...)
+
+			// Alternate direction for every scanline
+			if j%2 == 1 {
+				for i, k := 0, len(line)-1; i < k; i, k = i+1, k-1 {
+					line[i], line[k] = line[k], line[i]
+				}
+				for i := range line {
+					line[i].lo, line[i].hi = line[i].hi, line[i].lo
+				}
+			}
+
+			for _, p := range line {
+				cur := m.Positions[len(m.Positions)-1]
+				if atDepth && last == j-1 && linkable(cur.X, cur.Y, p.lo, y) {
+					move(m, vm.MoveModeLinear, s.Feedrate, p.lo, y, z)
+				} else {
+					if atDepth {
+						move(m, vm.MoveModeRapid, 0, cur.X, cur.Y, safety)
+					}
+					move(m, vm.MoveModeRapid, 0, p.lo, y, safety)
+					move(m, vm.MoveModeLinear, s.PlungeFeedrate, p.lo, y, z)
+				}
+				move(m, vm.MoveModeLinear, s.Feedrate, p.hi, y, z)
+				atDepth = true
+				last = j
+			}
+		}
+
+		if atDepth {
+			cur := m.Positions[len(m.Positions)-1]
+			move(m, vm.MoveModeRapid, 0, cur.X, cur.Y, safety)
+		}
+	}
+
+	// Stop the spindle
+	if s.SpindleSpeed > 0 {
+		cur := m.Positions[len(m.Positions)-1]
+		m.State.SpindleEnabled = false
+		move(m, vm.MoveModeNone, 0, cur.X, cur.Y, cur.Z)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package cam
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+import "sort"
+import "errors"
+
+const (
+	// Offset from the bottom of the model to slice the last level at, as faces
+	// lying in a level are not part of its slice
+	sliceEpsilon = 1e-6
+
+	// Number of scanlines sampled per tool radius when keeping clear of the
+	// model, on each side of a pass
+	radiusSamples = 8
+)
+
+// Settings for roughing. Lengths are in mm.
+type RoughingSettings struct {
+	ToolDiameter   float64
+	Tool           int     // Tool to change to (<= 0 to not change tool)
+	Stepover       float64 // Distance between passes
+	Stepdown       float64 // Maximum depth of each level
+	Allowance      float64 // Material to leave on the model for finishing
+	SafetyHeight   float64 // Height above the top of the model to move at
+	Feedrate       float64 // Cutting feedrate (mm/min)
+	PlungeFeedrate float64 // Plunge feedrate (mm/min)
+	SpindleSpeed   float64 // Spindle speed (RPM, <= 0 to leave the spindle off)
+}
+
+// A closed interval along a scanline.
+type interval struct {
+	lo, hi float64
+}
+
+// Merges intervals into sorted, non-overlapping intervals.
+func mergeIntervals(in []interval) []interval {
+	sort.Slice(in, func(i, j int) bool { return in[i].lo < in[j].lo })
+	var res []interval
+	for _, i := range in {
+		if len(res) > 0 && i.lo <= res[len(res)-1].hi {
+			res[len(res)-1].hi = math.Max(res[len(res)-1].hi, i.hi)
+			continue
+		}
+		res = append(res, i)
+	}
+	return res
+}
+
+// Returns the intervals of a scanline inside the contours, by even-odd rule.
+func insideIntervals(contours []Contour, y float64) []interval {
+	var xs []float64
+	for _, c := range contours {
+		for i := range c {
+			a, b := c[i], c[(i+1)%len(c)]
+			if (a.Y > y) != (b.Y > y) {
+				xs = append(xs, a.X+(y-a.Y)*(b.X-a.X)/(b.Y-a.Y))
+			}
+		}
+	}
+	sort.Float64s(xs)
+	var res []interval
+	for i := 0; i+1 < len(xs); i += 2 {
+		res = append(res, interval{xs[i], xs[i+1]})
+	}
+	return res
+}
+
+// Returns the intervals of a scanline where a tool of the given radius would
+// cut into the contours. Scanlines within the radius are sampled, and their
+// inside intervals widened by the width of the tool at their distance. The
+// vertices within the radius are added as well, so corners are kept clear of
+// between samples.
+func blockedIntervals(contours []Contour, y, radius float64) []interval {
+	var res []interval
+	for _, c := range contours {
+		for _, v := range c {
+			if dy := v.Y - y; dy > -radius && dy < radius {
+				w := math.Sqrt(radius*radius - dy*dy)
+				res = append(res, interval{v.X - w, v.X + w})
+			}
+		}
+	}
+	for i := -radiusSamples; i <= radiusSamples; i++ {
+		dy := radius * float64(i) / radiusSamples
+		w := math.Sqrt(radius*radius - dy*dy)
+		for _, in := range insideIntervals(contours, y+dy) {
+			res = append(res, interval{in.lo - w, in.hi + w})
+		}
+	}
+	return mergeIntervals(res)
+}
+
+// Returns the parts of [lo, hi] not covered by the sorted intervals.
+func freeIntervals(lo, hi float64, blocked []interval) []interval {
+	var res []interval
+	for _, b := range blocked {
+		if b.lo > lo+sliceEpsilon {
+			res = append(res, interval{lo, math.Min(b.lo, hi)})
+		}
+		lo = math.Max(lo, b.hi)
+		if lo >= hi {
+			return res
+		}
+	}
+	if hi > lo+sliceEpsilon {
+		res = append(res, interval{lo, hi})
+	}
+	return res
+}
+
+func contains(intervals []interval, x float64) bool {
+	for _, i := range intervals {
+		if x >= i.lo && x <= i.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Appends a position to the stack.
+func move(m *vm.Machine, mode int, feed, x, y, z float64) {
+	m.State.MoveMode = mode
+	if mode == vm.MoveModeLinear {
+		m.State.Feedrate = feed
+	}
+	m.Positions = append(m.Positions, vm.Position{State: m.State, X: x, Y: y, Z: z})
+}
+
+// Generates a 2.5D roughing toolpath, clearing the material between the model
+// and its bounding box level by level from the top, with zigzag passes along
+// X. The tool keeps clear of the model at and above each level, plus the
+// allowance, and retracts to safety height between passes unless it can link
+// them at depth.
+//
+// Only the slices at each level are considered, so material between levels
+// that extends beyond the slices above and below it may be cut into. Keep the
+// stepdown small for models with such features.
+func Rough(m *vm.Machine, mesh *Mesh, s RoughingSettings) error {
+	if len(mesh.Triangles) == 0 {
+		return errors.New("Model is empty")
+	}
+	if s.ToolDiameter <= 0 || s.Stepover <= 0 || s.Stepdown <= 0 {
+		return errors.New("Tool diameter, stepover and stepdown must be positive")
+	}
+
+	min, max := mesh.Bounds()
+	radius := s.ToolDiameter/2 + s.Allowance
+	safety := max.Z + s.SafetyHeight
+
+	var scanlines []float64
+	for y := min.Y; y < max.Y; y += s.Stepover {
+		scanlines = append(scanlines, y)
+	}
+	scanlines = append(scanlines, max.Y)
+
+	var levels []float64
+	for z := max.Z - s.Stepdown; z > min.Z; z -= s.Stepdown {
+		levels = append(levels, z)
+	}
+	levels = append(levels, min.Z)
+
+	if s.Tool > 0 && m.State.ToolIndex != s.Tool {
+		m.State.NextToolIndex = s.Tool
+		m.State.ToolIndex = s.Tool
+		if _, ok := m.GetTool(s.Tool); !ok {
+			m.SetTool(s.Tool, vm.Tool{Diameter: s.ToolDiameter})
+		}
+	}
+	if s.SpindleSpeed > 0 {
+		m.State.SpindleEnabled = true
+		m.State.SpindleClockwise = true
+		m.State.SpindleSpeed = s.SpindleSpeed
+	}
+
+	cur := m.Positions[len(m.Positions)-1]
+	move(m, vm.MoveModeRapid, 0, cur.X, cur.Y, safety)
+
+	// The tool must keep clear of the slices of all levels cut so far
+	var slices [][]Contour
+	blocked := make([][]interval, len(scanlines))
+
+	// Checks if a link between adjacent scanlines stays clear of the model,
+	// by checking scanlines along it
+	linkable := func(x1, y1, x2, y2 float64) bool {
+		for i := 1; i < radiusSamples; i++ {
+			t := float64(i) / radiusSamples
+			x, y := x1+(x2-x1)*t, y1+(y2-y1)*t
+			for _, contours := range slices {
+				if contains(blockedIntervals(contours, y, radius), x) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	for _, z := range levels {
+		contours := mesh.Slice(math.Max(z, min.Z+sliceEpsilon))
+		slices = append(slices, contours)
+
+		atDepth := false
+		last := 0
+		for j, y := range scanlines {
+			blocked[j] = mergeIntervals(append(blocked[j], blockedIntervals(contours, y, radius)...))
+			passes := freeIntervals(min.X, max.X, blocked[j])
+
+			// Alternate direction for every scanline
+			if j%2 == 1 {
+				for i, k := 0, len(passes)-1; i < k; i, k = i+1, k-1 {
+					passes[i], passes[k] = passes[k], passes[i]
+				}
+				for i := range passes {
+					passes[i].lo, passes[i].hi = passes[i].hi, passes[i].lo
+				}
+			}
+
+			for _, p := range passes {
+				cur := m.Positions[len(m.Positions)-1]
+				if atDepth && last == j-1 && linkable(cur.X, cur.Y, p.lo, y) {
+					move(m, vm.MoveModeLinear, s.Feedrate, p.lo, y, z)
+				} else {
+					if atDepth {
+						move(m, vm.MoveModeRapid, 0, cur.X, cur.Y, safety)
+					}
+					move(m, vm.MoveModeRapid, 0, p.lo, y, safety)
+					move(m, vm.MoveModeLinear, s.PlungeFeedrate, p.lo, y, z)
+				}
+				move(m, vm.MoveModeLinear, s.Feedrate, p.hi, y, z)
+				atDepth = true
+				last = j
+			}
+		}
+
+		if atDepth {
+			cur := m.Positions[len(m.Positions)-1]
+			move(m, vm.MoveModeRapid, 0, cur.X, cur.Y, safety)
+		}
+	}
+
+	// Stop the spindle
+	if s.SpindleSpeed > 0 {
+		cur := m.Positions[len(m.Positions)-1]
+		m.State.SpindleEnabled = false
+		move(m, vm.MoveModeNone, 0, cur.X, cur.Y, cur.Z)
+	}
+	return nil
+}
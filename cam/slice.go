@@ -0,0 +1,92 @@
+package cam
+
+import "github.com/kennylevinsen/gocnc/vector"
+
+// A contour of a slice. The last point connects to the first.
+type Contour []vector.Vector
+
+// Returns the point where an edge crosses a Z-level. The endpoints are
+// ordered first, so that triangles sharing the edge get the exact same point.
+func crossEdge(a, b vector.Vector, z float64) vector.Vector {
+	if b.X < a.X || (b.X == a.X && (b.Y < a.Y || (b.Y == a.Y && b.Z < a.Z))) {
+		a, b = b, a
+	}
+	p := a.Sum(b.Diff(a).Multiply((z - a.Z) / (b.Z - a.Z)))
+	p.Z = z
+	return p
+}
+
+// Returns the contours of the mesh at a Z-level. Vertices on the level count
+// as above it, so faces lying in the level are not part of the slice.
+//
+// Contours of a closed mesh are closed. Chains left open by gaps in the mesh
+// are returned as well, as they are closed implicitly.
+func (mesh *Mesh) Slice(z float64) []Contour {
+	var segments [][2]vector.Vector
+	for _, tri := range mesh.Triangles {
+		var points []vector.Vector
+		for i := range tri {
+			a, b := tri[i], tri[(i+1)%3]
+			if (a.Z >= z) != (b.Z >= z) {
+				points = append(points, crossEdge(a, b, z))
+			}
+		}
+		if len(points) == 2 && points[0] != points[1] {
+			segments = append(segments, [2]vector.Vector{points[0], points[1]})
+		}
+	}
+
+	// Chain the segments by their shared endpoints
+	ends := make(map[vector.Vector][]int)
+	for idx, seg := range segments {
+		ends[seg[0]] = append(ends[seg[0]], idx)
+		ends[seg[1]] = append(ends[seg[1]], idx)
+	}
+
+	used := make([]bool, len(segments))
+
+	// Follows unused segments from a point, returning the points passed
+	walk := func(p vector.Vector) []vector.Vector {
+		var points []vector.Vector
+		for {
+			next := -1
+			for _, n := range ends[p] {
+				if !used[n] {
+					next = n
+					break
+				}
+			}
+			if next == -1 {
+				return points
+			}
+			used[next] = true
+			if segments[next][0] == p {
+				p = segments[next][1]
+			} else {
+				p = segments[next][0]
+			}
+			points = append(points, p)
+		}
+	}
+
+	var contours []Contour
+	for idx, seg := range segments {
+		if used[idx] {
+			continue
+		}
+		used[idx] = true
+		contour := append(Contour{seg[0], seg[1]}, walk(seg[1])...)
+		if contour[len(contour)-1] == seg[0] {
+			contour = contour[:len(contour)-1]
+		} else {
+			// Open, so extend backwards as well
+			back := walk(seg[0])
+			for i, j := 0, len(back)-1; i < j; i, j = i+1, j-1 {
+				back[i], back[j] = back[j], back[i]
+			}
+			contour = append(Contour(back), contour...)
+		}
+		contours = append(contours, contour)
+	}
+	return contours
+}
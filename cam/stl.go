@@ -0,0 +1,121 @@
+package cam
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "encoding/binary"
+import "io"
+import "io/ioutil"
+import "bufio"
+import "bytes"
+import "math"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+//
+// Computer aided manufacturing
+//
+// Generates position stacks from models, ready for the optimize and export
+// packages like any processed G-code
+//
+// Notes:
+//   Models are used in their own coordinates and units, which are assumed to
+//   be mm. Position the model so its top is where the work zero should be.
+//
+
+// A triangle of a mesh.
+type Triangle [3]vector.Vector
+
+// A triangle mesh, as loaded from an STL file.
+type Mesh struct {
+	Triangles []Triangle
+}
+
+// Loads an ASCII or binary STL file.
+func LoadSTL(r io.Reader) (*Mesh, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Binary files may also start with "solid", so the size is checked first
+	if len(data) >= 84 {
+		count := binary.LittleEndian.Uint32(data[80:84])
+		if uint64(len(data)) == 84+50*uint64(count) {
+			return loadBinarySTL(data[84:], int(count)), nil
+		}
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("solid")) {
+		return loadASCIISTL(data)
+	}
+	return nil, errors.New("Not an STL file")
+}
+
+func loadBinarySTL(data []byte, count int) *Mesh {
+	mesh := &Mesh{Triangles: make([]Triangle, count)}
+	for idx := range mesh.Triangles {
+		// Skip the normal, and ignore the attribute byte count
+		rec := data[idx*50+12:]
+		for v := range mesh.Triangles[idx] {
+			f := func(n int) float64 {
+				return float64(math.Float32frombits(binary.LittleEndian.Uint32(rec[v*12+n*4:])))
+			}
+			mesh.Triangles[idx][v] = vector.Vector{f(0), f(1), f(2)}
+		}
+	}
+	return mesh
+}
+
+func loadASCIISTL(data []byte) (*Mesh, error) {
+	mesh := &Mesh{}
+	var tri Triangle
+	vertices := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "facet":
+			vertices = 0
+		case "vertex":
+			if len(fields) != 4 || vertices == 3 {
+				return nil, errors.New(fmt.Sprintf("line %d: Invalid vertex", lineNum))
+			}
+			var c [3]float64
+			for i := range c {
+				v, err := strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("line %d: Invalid vertex", lineNum))
+				}
+				c[i] = v
+			}
+			tri[vertices] = vector.Vector{c[0], c[1], c[2]}
+			vertices++
+		case "endfacet":
+			if vertices != 3 {
+				return nil, errors.New(fmt.Sprintf("line %d: Facet without 3 vertices", lineNum))
+			}
+			mesh.Triangles = append(mesh.Triangles, tri)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mesh, nil
+}
+
+// Returns the bounds of the mesh.
+func (mesh *Mesh) Bounds() (min, max vector.Vector) {
+	min = vector.Vector{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max = vector.Vector{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for _, tri := range mesh.Triangles {
+		for _, v := range tri {
+			min = vector.Vector{math.Min(min.X, v.X), math.Min(min.Y, v.Y), math.Min(min.Z, v.Z)}
+			max = vector.Vector{math.Max(max.X, v.X), math.Max(max.Y, v.Y), math.Max(max.Z, v.Z)}
+		}
+	}
+	return
+}
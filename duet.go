@@ -0,0 +1,85 @@
+package main
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/export"
+import "github.com/kennylevinsen/gocnc/streaming"
+
+import "path/filepath"
+import "bufio"
+import "time"
+import "fmt"
+import "os"
+
+// Uploads the job to a Duet board, starts it, and waits for it to finish.
+// Interrupting stops the board, and suspending pauses the job until <ENTER>
+// is pressed, as when streaming.
+func runDuet(m *vm.Machine, format *export.Format, macros export.Macros, name string) {
+	d := &streaming.DuetStreamer{
+		Password:  *duetPassword,
+		Timeout:   time.Duration(*timeout) * time.Second,
+		Macros:    macros,
+		Precision: *precision,
+		Format:    format,
+
+		CoolantCodes: m.CoolantCodes,
+	}
+	d.Macros.Tools = m.Tools
+	name = filepath.Base(name)
+
+	if err := d.Check(m); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Incompatibility: %s\n", err)
+		os.Exit(3)
+	}
+
+	if !*autoStart {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Fprintf(os.Stderr, "Run code? (y/n) ")
+		text, _ := reader.ReadString('\n')
+		if text != "y\n" {
+			fmt.Fprintf(os.Stderr, "Aborting\n")
+			os.Exit(5)
+		}
+	}
+
+	if err := d.Connect(*duet, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Unable to connect to board: %s\n", err)
+		os.Exit(2)
+	}
+	defer d.Disconnect()
+
+	fmt.Fprintf(os.Stderr, "Uploading %s...\n", name)
+	if err := d.Upload(m, name); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Unable to upload job: %s\n", err)
+		os.Exit(4)
+	}
+	if err := d.Run(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Unable to start job: %s\n", err)
+		os.Exit(4)
+	}
+
+	sigchan := make(chan string, 1)
+	registerSignals(sigchan)
+	go func() {
+		for sig := range sigchan {
+			switch sig {
+			case "interrupt":
+				fmt.Fprintf(os.Stderr, "\nStopping...\n")
+				d.Stop()
+				os.Exit(5)
+			case "stop":
+				d.Pause()
+				fmt.Fprintf(os.Stderr, "\nPaused. Press <ENTER> to continue")
+				reader := bufio.NewReader(os.Stdin)
+				_, _ = reader.ReadString('\n')
+				d.Start()
+			}
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "Running %s...\n", name)
+	if err := d.Wait(time.Second); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(4)
+	}
+	fmt.Fprintf(os.Stderr, "Done\n")
+}
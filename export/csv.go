@@ -0,0 +1,84 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "encoding/csv"
+import "strconv"
+import "io"
+
+//
+// CSV generator
+//
+// Used for exporting a move log with one row per position, for analyzing
+// feeds and dwells in a spreadsheet
+//
+// Notes:
+//   Segment times are based on vm.Machine.PositionETAs, and include the time
+//   estimated for toolchanges
+//   Spindle speed is 0 while disabled, and negative for counter clockwise
+//   rotation
+//
+
+// Names of the move modes, as written to the log
+var csvMoveModes = map[int]string{
+	vm.MoveModeNone:   "none",
+	vm.MoveModeRapid:  "rapid",
+	vm.MoveModeLinear: "linear",
+	vm.MoveModeCWArc:  "cw-arc",
+	vm.MoveModeCCWArc: "ccw-arc",
+	vm.MoveModeDwell:  "dwell",
+}
+
+type CSVGenerator struct {
+	BaseGenerator
+	Precision int
+	positions []vm.Position
+}
+
+// Initializes state.
+func (s *CSVGenerator) Init() {
+	s.Position = vm.Position{State: vm.NewState()}
+	s.positions = nil
+}
+
+// Records a position, once the steps towards it are made.
+func (s *CSVGenerator) RecordPosition(pos vm.Position) {
+	s.positions = append(s.positions, pos)
+}
+
+// Writes the move log, with a header row.
+func (s *CSVGenerator) WriteCSV(w io.Writer) error {
+	m := vm.Machine{Positions: s.positions}
+	etas := m.PositionETAs()
+
+	c := csv.NewWriter(w)
+	if err := c.Write([]string{"index", "move", "x", "y", "z", "feed", "spindle", "tool", "dwell", "time"}); err != nil {
+		return err
+	}
+	for idx, pos := range s.positions {
+		spindle := 0.0
+		if pos.State.SpindleEnabled {
+			spindle = pos.State.SpindleSpeed
+			if !pos.State.SpindleClockwise {
+				spindle = -spindle
+			}
+		}
+
+		row := []string{
+			strconv.Itoa(idx),
+			csvMoveModes[pos.State.MoveMode],
+			floatToString(pos.X, s.Precision),
+			floatToString(pos.Y, s.Precision),
+			floatToString(pos.Z, s.Precision),
+			floatToString(pos.State.Feedrate, s.Precision),
+			floatToString(spindle, s.Precision),
+			strconv.Itoa(pos.State.ToolIndex),
+			floatToString(pos.State.DwellTime, s.Precision),
+			floatToString(etas[idx].Seconds(), s.Precision),
+		}
+		if err := c.Write(row); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	return c.Error()
+}
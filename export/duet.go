@@ -0,0 +1,87 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "fmt"
+
+//
+// RepRapFirmware code generator
+//
+// Used for exporting VM state as gcode for RepRapFirmware, such as on Duet
+// boards in CNC mode. The output is that of the StringCodeGenerator, except
+// for where the dialect differs:
+//
+//   Tools are selected with Tn alone, which runs the tool change macros of
+//   the firmware (tfree, tpre and tpost), and their offsets are applied with
+//   them rather than by G43
+//   Dwells are given in seconds with S
+//   Only units per minute feed mode (G94) is supported
+//   Cutter compensation is not supported
+//
+
+type DuetGenerator struct {
+	StringCodeGenerator
+}
+
+// Selects a tool (Tn), between the tool change macros.
+func (s *DuetGenerator) ToolChange(t int) {
+	old := s.Position.State.ToolIndex
+	for _, l := range s.Macros.Expand(s.Macros.BeforeToolChange, old, t, s.Precision) {
+		s.put(l)
+	}
+	s.put(fmt.Sprintf("T%d", t))
+	for _, l := range s.Macros.Expand(s.Macros.AfterToolChange, old, t, s.Precision) {
+		s.put(l)
+	}
+	if len(s.Macros.BeforeToolChange) > 0 || len(s.Macros.AfterToolChange) > 0 {
+		forgetPosition(&s.Position)
+	}
+	s.Tool = t
+	s.ForceModeWrite = true
+}
+
+// Selects a tool without running the tool change macros (Tn P0).
+func (s *DuetGenerator) ToolSet(t int) {
+	s.put(fmt.Sprintf("T%d P0", t))
+	s.Tool = t
+}
+
+// A no-op, as selecting a tool changes it.
+func (s *DuetGenerator) ToolChangeSuggestion(t int) {}
+
+// Checks that the tool length offset is that of the selected tool, which the
+// firmware applies along with the tool.
+func (s *DuetGenerator) ToolLengthChange(h int) {
+	if h != 0 && h != s.Tool {
+		panic(fmt.Sprintf("Tool length offset H%d of another tool than T%d not supported by RepRapFirmware", h, s.Tool))
+	}
+}
+
+// Dynamic tool length offsets are not supported, as the firmware takes them
+// from the tool.
+func (s *DuetGenerator) DynamicToolLength(z float64) {
+	panic("Dynamic tool length offset (G43.1) not supported by RepRapFirmware")
+}
+
+// Checks the feed mode, as only units per minute is supported.
+func (s *DuetGenerator) FeedMode(feedMode int) {
+	switch feedMode {
+	case vm.FeedModeUnitsMin:
+	case vm.FeedModeInvTime:
+		panic("Inverse time feed mode (G93) not supported by RepRapFirmware")
+	case vm.FeedModeUnitsRev:
+		panic("Units per revolution feed mode (G95) not supported by RepRapFirmware")
+	default:
+		panic("Unknown feed mode")
+	}
+}
+
+// Checks the cutter compensation, as it is not supported.
+func (s *DuetGenerator) CutterCompensation(cutComp int) {
+	if cutComp != vm.CutCompModeNone {
+		panic("Cutter compensation not supported by RepRapFirmware")
+	}
+}
+
+func (s *DuetGenerator) Dwell(seconds float64) {
+	s.put("G4" + s.word('S', seconds))
+}
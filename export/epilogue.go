@@ -0,0 +1,77 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "fmt"
+import "strings"
+
+//
+// Epilogue
+//
+// A shutdown sequence put in at the end of a program, before the footer, so
+// that every program leaves the machine the same way: with the spindle and
+// coolant stopped, parked at a position in machine coordinates, and ended
+// with M2 or M30, optionally signalling a pallet change first.
+//
+
+type Epilogue struct {
+	StopSpindle bool
+	StopCoolant bool
+	Park        *vector.Vector // Machine coordinates (G53) to rapid to, Z first, if set
+	Pallet      int            // M code signalling a pallet change, such as 60, 0 for none
+	End         int            // M code ending the program, 2 or 30, 0 for none
+}
+
+// Returns the G and M codes of the epilogue, such as "G53". A post used with
+// it must support them, as it is put in outside HandlePosition.
+func (e *Epilogue) Codes() []string {
+	var codes []string
+	if e.StopSpindle {
+		codes = append(codes, "M5")
+	}
+	if e.StopCoolant {
+		codes = append(codes, "M9")
+	}
+	if e.Park != nil {
+		codes = append(codes, "G53", "G0")
+	}
+	if e.Pallet != 0 {
+		codes = append(codes, fmt.Sprintf("M%d", e.Pallet))
+	}
+	if e.End != 0 {
+		codes = append(codes, fmt.Sprintf("M%d", e.End))
+	}
+	return codes
+}
+
+// Returns the blocks of the epilogue, written in the dialect of the
+// configuration.
+func (e *Epilogue) Blocks(c *PostConfig) []string {
+	var blocks []string
+	put := func(words ...string) {
+		blocks = append(blocks, strings.Join(words, c.Separator))
+	}
+	word := func(address rune, v float64) string {
+		if c.Imperial {
+			v /= mmPerInch
+		}
+		return c.Word(address, v)
+	}
+
+	if e.StopSpindle {
+		put(c.Code('M', 5))
+	}
+	if e.StopCoolant {
+		put(c.Code('M', 9))
+	}
+	if e.Park != nil {
+		put(c.Code('G', 53), c.Code('G', 0), word('Z', e.Park.Z))
+		put(c.Code('G', 53), c.Code('G', 0), word('X', e.Park.X), word('Y', e.Park.Y))
+	}
+	if e.Pallet != 0 {
+		put(c.Code('M', float64(e.Pallet)))
+	}
+	if e.End != 0 {
+		put(c.Code('M', float64(e.End)))
+	}
+	return blocks
+}
@@ -0,0 +1,129 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "github.com/kennylevinsen/gocnc/vm"
+import "strings"
+import "testing"
+
+// Exports positions, starting from a fresh state at the origin, and returns
+// the lines of the output after the header.
+func exportLines(t *testing.T, positions ...vm.Position) []string {
+	t.Helper()
+	m := vm.Machine{Positions: append([]vm.Position{{State: vm.NewState()}}, positions...)}
+	g := StringCodeGenerator{Precision: 4}
+	g.Init()
+	if err := HandleAllPositions(&m, &g); err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+
+	var lines []string
+	for _, l := range strings.Split(g.Retrieve(), "\n")[3:] {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// Returns the index of the first line from from on containing s, failing if
+// there is none.
+func lineWith(t *testing.T, lines []string, from int, s string) int {
+	t.Helper()
+	for idx := from; idx < len(lines); idx++ {
+		if strings.Contains(lines[idx], s) {
+			return idx
+		}
+	}
+	t.Fatalf("No line with %s from line %d in %q", s, from, lines)
+	return -1
+}
+
+// Returns a state with tool, spindle and coolant set up for cutting.
+func cuttingState(tool int, mode int) vm.State {
+	s := vm.NewState()
+	s.MoveMode = mode
+	s.ToolIndex = tool
+	s.SpindleEnabled = true
+	s.SpindleClockwise = true
+	s.SpindleSpeed = 10000
+	s.FloodCoolant = true
+	s.Feedrate = 100
+	return s
+}
+
+func TestSafeOrderingToolChange(t *testing.T) {
+	lines := exportLines(t,
+		vm.Position{State: cuttingState(1, vm.MoveModeLinear), Z: -1},
+		vm.Position{State: cuttingState(2, vm.MoveModeRapid), Z: 5},
+	)
+
+	// Retract, stop coolant and spindle, change tools, and start over
+	idx := lineWith(t, lines, 0, "G0Z5")
+	for _, s := range []string{"M9", "M5", "M6 T2", "M3", "M8"} {
+		idx = lineWith(t, lines, idx, s)
+	}
+}
+
+func TestSafeOrderingPlunge(t *testing.T) {
+	// The spindle is started before moving into the stock
+	lines := exportLines(t, vm.Position{State: cuttingState(1, vm.MoveModeLinear), Z: -1})
+	if lineWith(t, lines, 0, "M3") > lineWith(t, lines, 0, "Z-1") {
+		t.Errorf("Spindle started after plunging: %q", lines)
+	}
+}
+
+func TestFixedOrdering(t *testing.T) {
+	cur := vm.Position{State: cuttingState(1, vm.MoveModeLinear), Z: -1}
+	next := vm.Position{State: cuttingState(2, vm.MoveModeRapid), Z: 5}
+	steps := FixedOrdering(cur, next)
+	if steps[0] != StepToolChange || steps[len(steps)-1] != StepMove {
+		t.Errorf("Steps %v, expected the toolchange first and the move last", steps)
+	}
+	if steps := SafeOrdering(cur, next); steps[len(steps)-1] == StepMove {
+		t.Errorf("Steps %v, expected the retract before the toolchange", steps)
+	}
+}
+
+func TestEpilogueCodes(t *testing.T) {
+	post, err := ReadPostConfig(strings.NewReader("name = \"Test\"\ncodes = [\"G0\", \"G1\", \"M5\", \"M9\", \"M30\"]\n"))
+	if err != nil {
+		t.Fatalf("Could not read post: %s", err)
+	}
+
+	e := Epilogue{StopSpindle: true, StopCoolant: true, End: 30}
+	if err := post.Require(e.Codes()...); err != nil {
+		t.Errorf("Epilogue refused: %s", err)
+	}
+	for _, e := range []Epilogue{{Park: &vector.Vector{}}, {End: 2}, {Pallet: 60}} {
+		if err := post.Require(e.Codes()...); err == nil {
+			t.Errorf("Epilogue with %v accepted by a post without them", e.Codes())
+		}
+	}
+}
+
+func TestTolerance(t *testing.T) {
+	defer func(tolerance float64) { Tolerance = tolerance }(Tolerance)
+	Tolerance = 0.001
+
+	// Steps within tolerance are left out until they add up to more
+	var positions []vm.Position
+	for k := 1; k <= 4; k++ {
+		positions = append(positions, vm.Position{State: cuttingState(-1, vm.MoveModeLinear), X: 0.0006 * float64(k)})
+	}
+	lines := exportLines(t, positions...)
+	lineWith(t, lines, lineWith(t, lines, 0, "X0.0012"), "X0.0024")
+	for _, l := range lines {
+		if strings.Contains(l, "X0.0006") || strings.Contains(l, "X0.0018") {
+			t.Errorf("Step within tolerance written: %q", lines)
+		}
+	}
+
+	// Axes within tolerance of where they are are not written
+	lines = exportLines(t,
+		vm.Position{State: cuttingState(-1, vm.MoveModeLinear), X: 1, Y: 1},
+		vm.Position{State: cuttingState(-1, vm.MoveModeLinear), X: 1.0004, Y: 2},
+	)
+	if l := lines[len(lines)-1]; l != "Y2" {
+		t.Errorf("Last line %q, expected Y2", l)
+	}
+}
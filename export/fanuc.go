@@ -0,0 +1,112 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "strings"
+import "fmt"
+
+//
+// Fanuc code generator
+//
+// Used for exporting VM state as ISO gcode for Fanuc and Haas controls:
+//
+//   %
+//   O0001 (EXPORTED BY GOCNC)
+//   N10 G17 G21 G40 G49 G80 G90
+//   N20 G91 G28 Z0.
+//   N30 G90
+//   N40 T1 M06
+//   ...
+//   N200 G91 G28 Z0.
+//   N210 G28 X0. Y0.
+//   N220 G90
+//   N230 M30
+//   %
+//
+// Blocks are numbered, codes have two digits, and axis words always have a
+// decimal point, as words without one are taken as the smallest increment of
+// the control. The machine returns to its reference point in Z (G28) before
+// each tool change, and in all axes at the end. Like the other generators,
+// G and F words are only put in when they change.
+//
+// Notes:
+//   Dwells are given in milliseconds with P
+//   Arcs are only kept if the VM was run with KeepArcs
+//
+
+// G codes the FanucGenerator puts in at the start and end of every program,
+// besides that of the units, and M30 ending it. A post used with it must
+// support them, as they are put in outside HandlePosition.
+var FanucCodes = []string{"G17", "G28", "G40", "G49", "G80", "G90", "G91", "M30"}
+
+type FanucGenerator struct {
+	ConfigurableGenerator
+	Program int // Program number (O word)
+}
+
+// Returns the post configuration used by the FanucGenerator, numbering blocks
+// in steps of increment.
+func FanucConfig(increment int) *PostConfig {
+	c := NewPostConfig()
+	c.Name = "Fanuc"
+	c.Precision = 3
+	c.Precisions['F'] = 1
+	c.Precisions['S'] = 0
+	c.Separator = " "
+	c.LineNumbers = increment
+	c.MaxLineNumber = 99999
+	c.CodeDigits = 2
+	c.DecimalPoint = true
+	c.DwellUnit = vm.DwellMilliseconds
+	return c
+}
+
+// Initializes state, with the Fanuc configuration in steps of 10 unless
+// another is set, and puts in the program start and a safety block.
+func (s *FanucGenerator) Init() {
+	if s.Config == nil {
+		s.Config = FanucConfig(10)
+	}
+	s.init()
+	s.Lines = append([]string{"%", fmt.Sprintf("O%04d (EXPORTED BY GOCNC)", s.Program)}, s.Lines...)
+	s.put(s.code('G', 17), s.units(), s.code('G', 40), s.code('G', 49), s.code('G', 80), s.code('G', 90))
+}
+
+// Returns to the reference point in Z, or in all axes.
+func (s *FanucGenerator) home(all bool) {
+	s.put(s.code('G', 91), s.code('G', 28), s.word('Z', 0))
+	if all {
+		s.put(s.code('G', 28), s.word('X', 0), s.word('Y', 0))
+	}
+	s.put(s.code('G', 90))
+}
+
+// Fetch the generated gcodes, followed by the return to the reference point,
+// the footer and the program end.
+func (s *FanucGenerator) Retrieve() string {
+	lines, lineNumber := s.Lines, s.lineNumber
+	s.Lines = append([]string(nil), lines...)
+	defer func() {
+		s.Lines, s.lineNumber = lines, lineNumber
+	}()
+
+	s.home(true)
+	for _, l := range s.Config.Footer {
+		s.put(l)
+	}
+	s.put(s.code('M', 30))
+	s.Lines = append(s.Lines, "%")
+	return strings.Join(s.Lines, "\n")
+}
+
+// Adds a toolchange operation (Tn M06), after returning to the reference
+// point in Z. The toolchange of the configuration is used instead, if set.
+func (s *FanucGenerator) ToolChange(t int) {
+	s.home(false)
+	if len(s.Config.ToolChange) > 0 {
+		s.ConfigurableGenerator.ToolChange(t)
+		return
+	}
+	s.put(fmt.Sprintf("T%d", t), s.code('M', 6))
+	s.Tool = t
+	s.ForceModeWrite = true
+}
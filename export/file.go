@@ -0,0 +1,89 @@
+package export
+
+import "archive/zip"
+import "compress/gzip"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+
+// A file being written. It is written to a temporary file next to it, which
+// only replaces the file once it is closed without errors, so a failed export
+// never leaves a partial program behind.
+type File struct {
+	io.Writer
+	archive io.Closer // Zip archive to close, if any
+	gz      io.Closer // Compressor to close, if any
+	file    *os.File
+	name    string
+}
+
+// Finishes the file, and puts it in place. The temporary file is removed if
+// that fails.
+func (f *File) Close() error {
+	var err error
+	if f.gz != nil {
+		err = f.gz.Close()
+	}
+	if f.archive != nil {
+		if aerr := f.archive.Close(); err == nil {
+			err = aerr
+		}
+	}
+	if ferr := f.file.Close(); err == nil {
+		err = ferr
+	}
+	if err == nil {
+		err = os.Rename(f.file.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(f.file.Name())
+	}
+	return err
+}
+
+// Removes the file being written, leaving any previous file of its name as
+// it was.
+func (f *File) Discard() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+// Creates a file for writing, compressing it if it is named .gz, or putting
+// it in a zip archive if it is named .zip. The file in the archive is named
+// like the archive without .zip, with .nc added if it has no extension. The
+// file is only put in place by Close.
+func CreateFile(name string) (*File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext != ".gz" && ext != ".zip" {
+		return &File{Writer: f, file: f, name: name}, nil
+	}
+	if ext == ".gz" {
+		gz := gzip.NewWriter(f)
+		return &File{Writer: gz, gz: gz, file: f, name: name}, nil
+	}
+
+	entry := filepath.Base(name[:len(name)-len(ext)])
+	if filepath.Ext(entry) == "" {
+		entry += ".nc"
+	}
+	archive := zip.NewWriter(f)
+	w, err := archive.Create(entry)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &File{Writer: w, archive: archive, file: f, name: name}, nil
+}
@@ -0,0 +1,90 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "strconv"
+import "strings"
+import "fmt"
+
+// Formatting of the numbers of words, shared by the gcode generators.
+type Format struct {
+	Precision     int          // Default number of decimals
+	Precisions    map[rune]int // Number of decimals by address, overriding Precision
+	TrailingZeros bool         // Keep trailing zeros of decimals, such as X1.500
+	DecimalPoint  bool         // Always put a decimal point in axis and offset words, such as X1.
+	Width         int          // Minimum digits before the decimal point of axis and offset words, padded with leading zeros
+}
+
+// Returns a format of the given precision, without trailing zeros.
+func NewFormat(precision int) *Format {
+	return &Format{Precision: precision, Precisions: make(map[rune]int)}
+}
+
+// Returns whether the address is an axis or arc offset, which the decimal
+// point and width apply to.
+func isAxisAddress(address rune) bool {
+	return strings.IndexRune("XYZIJKR", address) != -1
+}
+
+// Millimetres per inch
+const mmPerInch = 25.4
+
+// Converts the value of a word from the millimetres of the VM to inches, for
+// generators exporting imperial gcode (G20). Axis and arc offset words are
+// lengths, and feedrates are lengths per minute or revolution, unless fed in
+// inverse time.
+func toInches(address rune, v float64, feedMode int) float64 {
+	if isAxisAddress(address) || (address == 'F' && feedMode != vm.FeedModeInvTime) {
+		return v / mmPerInch
+	}
+	return v
+}
+
+// Formats the number of a word with the precision of its address.
+func (f *Format) Number(address rune, v float64) string {
+	p, ok := f.Precisions[address]
+	if !ok {
+		p = f.Precision
+	}
+	var x string
+	if f.TrailingZeros {
+		x = strconv.FormatFloat(v, 'f', p, 64)
+	} else {
+		x = floatToString(v, p)
+	}
+	if !isAxisAddress(address) {
+		return x
+	}
+
+	if f.DecimalPoint && strings.IndexRune(x, '.') == -1 {
+		x += "."
+	}
+	if f.Width > 0 {
+		sign := ""
+		if x[0] == '-' {
+			sign, x = "-", x[1:]
+		}
+		digits := strings.IndexRune(x, '.')
+		if digits == -1 {
+			digits = len(x)
+		}
+		if digits < f.Width {
+			x = strings.Repeat("0", f.Width-digits) + x
+		}
+		x = sign + x
+	}
+	return x
+}
+
+// Formats a word, such as "X1.5".
+func (f *Format) Word(address rune, v float64) string {
+	return fmt.Sprintf("%c%s", address, f.Number(address, v))
+}
+
+// Formats a word with the format if set, or with the precision otherwise, as
+// the generators without a format do.
+func formatWord(f *Format, precision int, address rune, v float64) string {
+	if f == nil {
+		return fmt.Sprintf("%c%s", address, floatToString(v, precision))
+	}
+	return f.Word(address, v)
+}
@@ -2,6 +2,7 @@ package export
 
 import "github.com/kennylevinsen/gocnc/vm"
 import "strconv"
+import "math"
 import "strings"
 import "errors"
 import "fmt"
@@ -22,39 +23,97 @@ func floatToString(f float64, p int) string {
 	return x
 }
 
+// Returns the P word of a dwell, in seconds, or in whole milliseconds for
+// vm.DwellMilliseconds.
+func dwellWord(f *Format, precision, unit int, seconds float64) string {
+	if unit == vm.DwellMilliseconds {
+		return fmt.Sprintf("P%d", int(seconds*1000+0.5))
+	}
+	return formatWord(f, precision, 'P', seconds)
+}
+
+// Returns the M code turning a coolant channel on or off, panicking if the
+// channel has none.
+func coolantCode(codes map[int]vm.CoolantCodes, channel int, on bool) float64 {
+	c, ok := codes[channel]
+	if !ok {
+		panic(fmt.Sprintf("No M code for %s coolant", vm.CoolantName(channel)))
+	}
+	if on {
+		return c.On
+	}
+	return c.Off
+}
+
+// The tolerance within which positions and values are taken as unchanged when
+// exporting, such that float noise does not put in redundant words.
+var Tolerance = vm.DefaultTolerance
+
+// Marks the position of the machine as unknown, as after a macro that may
+// have moved it, so the next move gives all axes.
+func forgetPosition(pos *vm.Position) {
+	pos.X, pos.Y, pos.Z = math.NaN(), math.NaN(), math.NaN()
+}
+
+// Returns whether the position of the machine is unknown.
+func positionUnknown(pos vm.Position) bool {
+	return math.IsNaN(pos.X) || math.IsNaN(pos.Y) || math.IsNaN(pos.Z)
+}
+
+// Returns whether a and b are equal within Tolerance.
+func same(a, b float64) bool {
+	return vm.Near(a, b, Tolerance)
+}
+
 // Interface for exporting a vm position stack.
 type CodeGenerator interface {
 	GetPosition() vm.Position
 	SetPosition(vm.Position)
 	ToolChange(int)
+	ToolSet(int)
 	ToolChangeSuggestion(int)
 	ToolLengthChange(int)
+	DynamicToolLength(float64)
 	Spindle(bool, bool, float64)
 	Coolant(bool, bool)
+	CoolantChannel(int, bool)
 	FeedMode(int)
 	Feedrate(float64)
 	CutterCompensation(int)
 	Dwell(float64)
 	Move(float64, float64, float64, int)
+	Arc(float64, float64, float64, float64, float64, int)
 	Init()
 }
 
+// Implemented by generators logging the positions themselves, rather than
+// the steps towards them, which SetPosition is called for. RecordPosition is
+// called once for each position, after the steps towards it.
+type PositionRecorder interface {
+	RecordPosition(vm.Position)
+}
+
 // A simple generator with a few essentials.
 type BaseGenerator struct {
 	Position vm.Position
 }
 
 func (s *BaseGenerator) ToolChange(int)                      {}
+func (s *BaseGenerator) ToolSet(int)                         {}
 func (s *BaseGenerator) ToolChangeSuggestion(int)            {}
 func (s *BaseGenerator) ToolLengthChange(int)                {}
+func (s *BaseGenerator) DynamicToolLength(float64)           {}
 func (s *BaseGenerator) Spindle(bool, bool, float64)         {}
 func (s *BaseGenerator) Coolant(bool, bool)                  {}
+func (s *BaseGenerator) CoolantChannel(int, bool)            {}
 func (s *BaseGenerator) FeedMode(int)                        {}
 func (s *BaseGenerator) Feedrate(float64)                    {}
 func (s *BaseGenerator) CutterCompensation(int)              {}
 func (s *BaseGenerator) Dwell(float64)                       {}
 func (s *BaseGenerator) Move(float64, float64, float64, int) {}
 
+func (s *BaseGenerator) Arc(float64, float64, float64, float64, float64, int) {}
+
 // Gets the current position for comparisons.
 func (s *BaseGenerator) GetPosition() vm.Position {
 	return s.Position
@@ -70,58 +129,34 @@ func (s *BaseGenerator) Init() {
 	s.Position = vm.Position{State: vm.NewState()}
 }
 
-// Calls the CodeGenerator for all changed states.
+// Calls the CodeGenerator for all changed states, ordered by DefaultOrdering.
 func HandlePosition(pos vm.Position, gens ...CodeGenerator) (err error) {
+	return HandlePositionOrdered(pos, DefaultOrdering, gens...)
+}
+
+// Calls the CodeGenerator for all changed states, in the order decided by policy.
+func HandlePositionOrdered(pos vm.Position, policy OrderingPolicy, gens ...CodeGenerator) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
+			if e, ok := r.(error); ok {
+				// Preserve typed errors, such as alarms from a streamer
+				err = e
+			} else {
+				err = errors.New(fmt.Sprintf("%s", r))
+			}
 		}
 	}()
 	for _, s := range gens {
-		cp := s.GetPosition()
-		cs := cp.State
-		ns := pos.State
-
-		if ns.ToolIndex != cs.ToolIndex {
-			s.ToolChange(ns.ToolIndex)
+		for _, step := range policy(s.GetPosition(), pos) {
+			handleStep(s, step, pos)
 		}
-
-		if ns.NextToolIndex != cs.NextToolIndex {
-			s.ToolChangeSuggestion(ns.NextToolIndex)
-		}
-
-		if ns.ToolLengthIndex != cs.ToolLengthIndex {
-			s.ToolLengthChange(ns.ToolLengthIndex)
-		}
-
-		if ns.SpindleEnabled != cs.SpindleEnabled ||
-			ns.SpindleClockwise != cs.SpindleClockwise ||
-			ns.SpindleSpeed != cs.SpindleSpeed {
-			s.Spindle(ns.SpindleEnabled, ns.SpindleClockwise, ns.SpindleSpeed)
-		}
-
-		if ns.FloodCoolant != cs.FloodCoolant || ns.MistCoolant != cs.MistCoolant {
-			s.Coolant(ns.FloodCoolant, ns.MistCoolant)
-		}
-
-		if ns.FeedMode != cs.FeedMode {
-			s.FeedMode(ns.FeedMode)
-		}
-
-		if ns.Feedrate != cs.Feedrate {
-			s.Feedrate(ns.Feedrate)
-		}
-
-		if ns.CutterCompensation != cs.CutterCompensation {
-			s.CutterCompensation(ns.CutterCompensation)
-		}
-
-		if ns.MoveMode == vm.MoveModeDwell {
-			s.Dwell(ns.DwellTime)
-		} else if cp.X != pos.X || cp.Y != pos.Y || cp.Z != pos.Z || cs.MoveMode != ns.MoveMode {
-			s.Move(pos.X, pos.Y, pos.Z, ns.MoveMode)
+		// The coordinates are those last written, as left by handleStep
+		p, cp := pos, s.GetPosition()
+		p.X, p.Y, p.Z = cp.X, cp.Y, cp.Z
+		s.SetPosition(p)
+		if r, ok := s.(PositionRecorder); ok {
+			r.RecordPosition(pos)
 		}
-		s.SetPosition(pos)
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package export
 
 import "github.com/kennylevinsen/gocnc/vm"
+import "errors"
 import "fmt"
 
 type GrblGenerator struct {
@@ -8,6 +9,84 @@ type GrblGenerator struct {
 	Precision      int
 	Write          func(string)
 	ForceModeWrite bool
+	Macros         Macros  // Lines put in at the start and end, and around tool changes
+	Format         *Format // Formatting of numbers, overriding Precision, if set
+	SafeStart      bool    // Set all modes and stop the spindle and coolant before the header macro
+
+	// M codes of coolant channels. Grbl has none of its own, so channels
+	// cannot be used unless given here, such as for a build adding them.
+	CoolantCodes map[int]vm.CoolantCodes
+}
+
+// Formats a word, with Format if set, or Precision otherwise.
+func (s *GrblGenerator) word(address rune, v float64) string {
+	return formatWord(s.Format, s.Precision, address, v)
+}
+
+// Writes the lines of a macro, returning errors raised by Write.
+func (s *GrblGenerator) writeMacro(lines []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = errors.New(fmt.Sprintf("%s", r))
+			}
+		}
+	}()
+	tool := s.Position.State.ToolIndex
+	for _, l := range s.Macros.Expand(lines, tool, tool, s.Precision) {
+		s.Write(l)
+	}
+	if len(lines) > 0 {
+		forgetPosition(&s.Position)
+	}
+	return nil
+}
+
+// Writes the header macro, after the safe start blocks if set. Grbl has no
+// notion of a program, so this is left to the caller at the start of one.
+func (s *GrblGenerator) Header() error {
+	if s.SafeStart {
+		if err := s.writeMacro([]string{"G17G21G90G94G40G49G54", "M5M9"}); err != nil {
+			return err
+		}
+	}
+	return s.writeMacro(s.Macros.Header)
+}
+
+// Writes the footer macro, to be called at the end of a program.
+func (s *GrblGenerator) Footer() error {
+	return s.writeMacro(s.Macros.Footer)
+}
+
+// Writes the tool change macros. Grbl does not support M6, so the tool
+// change itself is left to the operator, such as with --manualtool.
+func (s *GrblGenerator) ToolChange(t int) {
+	old := s.Position.State.ToolIndex
+	for _, l := range s.Macros.Expand(s.Macros.BeforeToolChange, old, t, s.Precision) {
+		s.Write(l)
+	}
+	for _, l := range s.Macros.Expand(s.Macros.AfterToolChange, old, t, s.Precision) {
+		s.Write(l)
+	}
+	if len(s.Macros.BeforeToolChange) > 0 || len(s.Macros.AfterToolChange) > 0 {
+		forgetPosition(&s.Position)
+	}
+	s.ForceModeWrite = true
+}
+
+// Cancels a dynamic tool length offset (G49). Tool length offsets from a
+// tool table (G43 Hn) are not supported by Grbl, and are left out.
+func (s *GrblGenerator) ToolLengthChange(h int) {
+	if h == 0 && s.Position.State.ToolLengthIndex == vm.ToolLengthDynamic {
+		s.Write("G49")
+	}
+}
+
+// Sets a dynamic tool length offset (G43.1 Zn).
+func (s *GrblGenerator) DynamicToolLength(z float64) {
+	s.Write("G43.1" + s.word('Z', z))
 }
 
 func (s *GrblGenerator) Spindle(enabled, clockwise bool, speed float64) {
@@ -24,8 +103,8 @@ func (s *GrblGenerator) Spindle(enabled, clockwise bool, speed float64) {
 		}
 	}
 
-	if enabled && state.SpindleSpeed != speed {
-		x += fmt.Sprintf("S%s", floatToString(speed, s.Precision))
+	if enabled && !same(state.SpindleSpeed, speed) {
+		x += s.word('S', speed)
 	}
 	s.Write(x)
 }
@@ -44,6 +123,11 @@ func (s *GrblGenerator) Coolant(floodCoolant, mistCoolant bool) {
 	s.ForceModeWrite = true
 }
 
+func (s *GrblGenerator) CoolantChannel(channel int, on bool) {
+	s.Write("M" + floatToString(coolantCode(s.CoolantCodes, channel, on), -1))
+	s.ForceModeWrite = true
+}
+
 func (s *GrblGenerator) FeedMode(feedMode int) {
 	switch feedMode {
 	case vm.FeedModeInvTime:
@@ -51,14 +135,14 @@ func (s *GrblGenerator) FeedMode(feedMode int) {
 	case vm.FeedModeUnitsMin:
 		s.Write("G94")
 	case vm.FeedModeUnitsRev:
-		s.Write("G95")
+		panic("Units per revolution feed mode (G95) not supported by Grbl")
 	default:
 		panic("Unknown feed mode")
 	}
 }
 
 func (s *GrblGenerator) Feedrate(feedrate float64) {
-	s.Write(fmt.Sprintf("F%s", floatToString(feedrate, s.Precision)))
+	s.Write(s.word('F', feedrate))
 }
 
 // A no-op cutter-compensation, as Grbl doesn't support it
@@ -69,7 +153,7 @@ func (s *GrblGenerator) CutterCompensation(cutComp int) {
 }
 
 func (s *GrblGenerator) Dwell(seconds float64) {
-	s.Write(fmt.Sprintf("G4P%s", floatToString(seconds, s.Precision)))
+	s.Write("G4" + s.word('P', seconds))
 }
 
 func (s *GrblGenerator) Move(x, y, z float64, moveMode int) {
@@ -93,15 +177,45 @@ func (s *GrblGenerator) Move(x, y, z float64, moveMode int) {
 	}
 	s.ForceModeWrite = false
 
-	if pos.X != x {
-		w += fmt.Sprintf("X%s", floatToString(x, s.Precision))
+	if !same(pos.X, x) {
+		w += s.word('X', x)
+	}
+	if !same(pos.Y, y) {
+		w += s.word('Y', y)
+	}
+	if !same(pos.Z, z) {
+		w += s.word('Z', z)
+	}
+
+	s.Write(w)
+}
+
+// Issues an arc (G2/G3 [Xn] [Yn] [Zn] In Jn)
+func (s *GrblGenerator) Arc(x, y, z, i, j float64, moveMode int) {
+	w := ""
+	pos := s.GetPosition()
+	if pos.State.MoveMode != moveMode || s.ForceModeWrite {
+		switch moveMode {
+		case vm.MoveModeCWArc:
+			w = "G2"
+		case vm.MoveModeCCWArc:
+			w = "G3"
+		default:
+			panic("Unknown arc mode")
+		}
+	}
+	s.ForceModeWrite = false
+
+	if !same(pos.X, x) {
+		w += s.word('X', x)
 	}
-	if pos.Y != y {
-		w += fmt.Sprintf("Y%s", floatToString(y, s.Precision))
+	if !same(pos.Y, y) {
+		w += s.word('Y', y)
 	}
-	if pos.Z != z {
-		w += fmt.Sprintf("Z%s", floatToString(z, s.Precision))
+	if !same(pos.Z, z) {
+		w += s.word('Z', z)
 	}
+	w += s.word('I', i) + s.word('J', j)
 
 	s.Write(w)
 }
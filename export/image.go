@@ -0,0 +1,179 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+import "image"
+import "image/color"
+import "image/png"
+import "math"
+import "io"
+import "errors"
+import "fmt"
+
+//
+// Image generator
+//
+// Used for rendering a top-down preview of the toolpath
+//
+// Notes:
+//   Moves are drawn in the order they are made, so later moves cover earlier
+//   ones. Cutting moves are shaded by depth, from light at the top of the
+//   work to dark at the deepest cut. Rapid moves are drawn in light red.
+//
+
+const (
+	// Margin around the rendered area (pixels)
+	imageMargin = 10
+
+	// Maximum width or height of a rendered image (pixels)
+	maxImageSize = 16384
+)
+
+type imageSegment struct {
+	x1, y1, x2, y2, z float64
+	rapid             bool
+}
+
+type ImageGenerator struct {
+	BaseGenerator
+
+	// Resolution (pixels per inch)
+	DPI float64
+
+	// Area to render (mm). All moves are rendered if the area is empty.
+	MinX, MinY, MaxX, MaxY float64
+
+	segments []imageSegment
+}
+
+// Initializes state, and sets the default resolution if unset.
+func (s *ImageGenerator) Init() {
+	s.Position = vm.Position{State: vm.NewState()}
+	s.segments = nil
+	if s.DPI <= 0 {
+		s.DPI = 100
+	}
+}
+
+// Records a move. Moves that only change Z are drawn as a single pixel,
+// marking plunges and drills.
+func (s *ImageGenerator) Move(x, y, z float64, moveMode int) {
+	pos := s.GetPosition()
+	switch moveMode {
+	case vm.MoveModeRapid, vm.MoveModeLinear:
+	case vm.MoveModeCWArc, vm.MoveModeCCWArc:
+		panic("Cannot export arcs")
+	default:
+		return
+	}
+
+	// Shade by the deepest end of the move
+	s.segments = append(s.segments, imageSegment{
+		x1: pos.X, y1: pos.Y, x2: x, y2: y,
+		z:     math.Min(pos.Z, z),
+		rapid: moveMode == vm.MoveModeRapid,
+	})
+}
+
+// Records an arc as lines deviating at most half a pixel from it.
+func (s *ImageGenerator) Arc(x, y, z, i, j float64, moveMode int) {
+	start := s.GetPosition()
+	end := vm.Position{X: x, Y: y, Z: z, Center: vector.Vector{start.X + i, start.Y + j, 0}}
+	end.State.MoveMode = moveMode
+
+	last := start.Vector()
+	for _, p := range vm.InterpolateArc(start, end, 25.4/s.DPI/2) {
+		s.segments = append(s.segments, imageSegment{
+			x1: last.X, y1: last.Y, x2: p.X, y2: p.Y,
+			z: math.Min(last.Z, p.Z),
+		})
+		last = p
+	}
+}
+
+// Returns the area to render, either as configured or covering all moves.
+func (s *ImageGenerator) bounds() (minx, miny, maxx, maxy float64) {
+	if s.MaxX > s.MinX && s.MaxY > s.MinY {
+		return s.MinX, s.MinY, s.MaxX, s.MaxY
+	}
+	if len(s.segments) == 0 {
+		return 0, 0, 0, 0
+	}
+	minx, miny = math.Inf(1), math.Inf(1)
+	maxx, maxy = math.Inf(-1), math.Inf(-1)
+	for _, seg := range s.segments {
+		minx = math.Min(minx, math.Min(seg.x1, seg.x2))
+		miny = math.Min(miny, math.Min(seg.y1, seg.y2))
+		maxx = math.Max(maxx, math.Max(seg.x1, seg.x2))
+		maxy = math.Max(maxy, math.Max(seg.y1, seg.y2))
+	}
+	return
+}
+
+// Renders the recorded moves.
+func (s *ImageGenerator) Image() (*image.RGBA, error) {
+	minx, miny, maxx, maxy := s.bounds()
+	scale := s.DPI / 25.4
+
+	width := int(math.Ceil((maxx-minx)*scale)) + 2*imageMargin + 1
+	height := int(math.Ceil((maxy-miny)*scale)) + 2*imageMargin + 1
+	if width > maxImageSize || height > maxImageSize {
+		return nil, errors.New(fmt.Sprintf("Preview too large (%dx%d pixels), lower the DPI", width, height))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for idx := range img.Pix {
+		img.Pix[idx] = 0xFF
+	}
+
+	minz := 0.0
+	for _, seg := range s.segments {
+		if !seg.rapid && seg.z < minz {
+			minz = seg.z
+		}
+	}
+
+	// Image coordinates grow downwards
+	px := func(x float64) float64 { return (x-minx)*scale + imageMargin }
+	py := func(y float64) float64 { return float64(height-1) - ((y-miny)*scale + imageMargin) }
+
+	for _, seg := range s.segments {
+		var c color.RGBA
+		switch {
+		case seg.rapid:
+			c = color.RGBA{0xFF, 0xB0, 0xB0, 0xFF}
+		case seg.z >= 0 || minz == 0:
+			c = color.RGBA{0xA0, 0xC0, 0xFF, 0xFF}
+		default:
+			// From light to dark blue by depth
+			d := seg.z / minz
+			c = color.RGBA{uint8(0xA0 * (1 - d)), uint8(0xC0 * (1 - d)), uint8(0xFF - 0x7F*d), 0xFF}
+		}
+		drawLine(img, px(seg.x1), py(seg.y1), px(seg.x2), py(seg.y2), c)
+	}
+	return img, nil
+}
+
+// Renders the recorded moves, and writes them as PNG.
+func (s *ImageGenerator) WritePNG(w io.Writer) error {
+	img, err := s.Image()
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// Draws a line by sampling it at every pixel along its longest axis.
+func drawLine(img *image.RGBA, x1, y1, x2, y2 float64, c color.RGBA) {
+	steps := int(math.Ceil(math.Max(math.Abs(x2-x1), math.Abs(y2-y1))))
+	if steps == 0 {
+		img.SetRGBA(int(math.Floor(x1+0.5)), int(math.Floor(y1+0.5)), c)
+		return
+	}
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x := x1 + (x2-x1)*t
+		y := y1 + (y2-y1)*t
+		img.SetRGBA(int(math.Floor(x+0.5)), int(math.Floor(y+0.5)), c)
+	}
+}
@@ -0,0 +1,113 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+import "encoding/json"
+import "io"
+
+//
+// JSON generator
+//
+// Used for exporting the position stack along with its analysis, for web
+// visualizers and other tools
+//
+// Notes:
+//   Times are in seconds, and based on vm.Machine.PositionETAs, so they are
+//   as rough as the ETA printed by the command-line
+//
+
+// A toolchange, made before the position at Index.
+type JSONToolChange struct {
+	Index int
+	Tool  int
+}
+
+// The estimated time spent with a tool.
+type JSONToolTime struct {
+	Tool int
+	Time float64
+}
+
+// The bounds of the cutting moves made with a tool.
+type JSONToolBounds struct {
+	Tool     int
+	Min, Max vector.Vector
+}
+
+// The exported document.
+type JSONDocument struct {
+	Positions   []vm.Position
+	ToolChanges []JSONToolChange
+
+	// Bounds of all positions
+	Min, Max vector.Vector
+
+	Feedrates []float64
+	ETA       float64
+	ToolTimes []JSONToolTime
+
+	// Bounds of the cutting moves of each tool, as by vm.Machine.ToolBounds
+	ToolBounds []JSONToolBounds
+}
+
+type JSONGenerator struct {
+	BaseGenerator
+	positions   []vm.Position
+	toolChanges []JSONToolChange
+}
+
+// Initializes state.
+func (s *JSONGenerator) Init() {
+	s.Position = vm.Position{State: vm.NewState()}
+	s.positions = nil
+	s.toolChanges = nil
+}
+
+// Records a position, once the steps towards it are made.
+func (s *JSONGenerator) RecordPosition(pos vm.Position) {
+	s.positions = append(s.positions, pos)
+}
+
+// Records a toolchange before the next position.
+func (s *JSONGenerator) ToolChange(t int) {
+	s.toolChanges = append(s.toolChanges, JSONToolChange{Index: len(s.positions), Tool: t})
+}
+
+// Returns the recorded positions along with their analysis.
+func (s *JSONGenerator) Document() JSONDocument {
+	m := vm.Machine{Positions: s.positions}
+	doc := JSONDocument{Positions: s.positions, ToolChanges: s.toolChanges}
+	doc.Min.X, doc.Min.Y, doc.Min.Z, doc.Max.X, doc.Max.Y, doc.Max.Z, doc.Feedrates = m.Info()
+
+	// Sum up per tool, in the order the tools are first used
+	times := make(map[int]int)
+	for idx, eta := range m.PositionETAs() {
+		tool := s.positions[idx].State.ToolIndex
+		t, ok := times[tool]
+		if !ok {
+			t = len(doc.ToolTimes)
+			times[tool] = t
+			doc.ToolTimes = append(doc.ToolTimes, JSONToolTime{Tool: tool})
+		}
+		doc.ToolTimes[t].Time += eta.Seconds()
+		doc.ETA += eta.Seconds()
+	}
+
+	bounds := m.ToolBounds()
+	for _, t := range doc.ToolTimes {
+		if b, ok := bounds[t.Tool]; ok {
+			doc.ToolBounds = append(doc.ToolBounds, JSONToolBounds{Tool: t.Tool, Min: b.Min, Max: b.Max})
+		}
+	}
+	return doc
+}
+
+// Writes the document as indented JSON.
+func (s *JSONGenerator) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(s.Document(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,71 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "fmt"
+
+//
+// Mach code generator
+//
+// Used for exporting VM state as gcode for Mach3 and Mach4, keeping the arcs
+// and tool length offsets they support. Tool changes are put in as "T1 M6"
+// with a comment describing the tool from Tools, which Mach shows in its tool
+// change prompt.
+//
+// Notes:
+//   Arcs are only kept if the VM was run with KeepArcs
+//   Dwells are given in seconds, the default of Mach
+//
+
+// G codes the MachGenerator puts in at the start of every program, besides
+// that of the units. A post used with it must support them, as they are put
+// in outside HandlePosition.
+var MachCodes = []string{"G17", "G40", "G49", "G80", "G90"}
+
+type MachGenerator struct {
+	ConfigurableGenerator
+	Tools map[int]vm.Tool // Tool table for the tool change comments
+}
+
+// Returns the post configuration used by the MachGenerator.
+func MachConfig() *PostConfig {
+	c := NewPostConfig()
+	c.Name = "Mach"
+	c.Separator = " "
+	c.Header = []string{"(Exported by gocnc)"}
+	c.Footer = []string{"M30"}
+	return c
+}
+
+// Initializes state, with the Mach configuration unless another is set, and
+// puts in the header and a safety block.
+func (s *MachGenerator) Init() {
+	if s.Config == nil {
+		s.Config = MachConfig()
+	}
+	s.init()
+	s.put(s.units(), s.code('G', 90), s.code('G', 17), s.code('G', 40), s.code('G', 49), s.code('G', 80))
+}
+
+// Returns a comment describing a tool, such as "(3 mm, 2 flute, ball nose)",
+// or an empty string if it is not in the tool table.
+func (s *MachGenerator) toolComment(t int) string {
+	tool, ok := s.Tools[t]
+	if !ok {
+		return ""
+	}
+	desc := fmt.Sprintf("%s mm", floatToString(tool.Diameter, s.Config.Precision))
+	if tool.Flutes > 0 {
+		desc += fmt.Sprintf(", %d flute", tool.Flutes)
+	}
+	if tool.BallNose {
+		desc += ", ball nose"
+	}
+	return "(" + desc + ")"
+}
+
+// Adds a toolchange operation (Tn M6 (description)).
+func (s *MachGenerator) ToolChange(t int) {
+	s.put(fmt.Sprintf("T%d", t), s.code('M', 6), s.toolComment(t))
+	s.Tool = t
+	s.ForceModeWrite = true
+}
@@ -0,0 +1,55 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "strconv"
+import "strings"
+
+//
+// Macros
+//
+// User-supplied gcode put in by the string and Grbl generators, such as to
+// park the machine or lift a dust boot around tool changes. Lines are
+// templates, where the following are replaced:
+//
+//   {tool}        Number of the new tool
+//   {length}      Length of the new tool
+//   {diameter}    Diameter of the new tool
+//   {oldtool}     Number of the previous tool
+//   {oldlength}   Length of the previous tool
+//
+// Lengths and diameters are taken from Tools, and are 0 for tools not in it.
+// As macros may move the machine, such as to park it, the generators give all
+// axes on the first move after one.
+// Header and footer lines see the tool in use at the start and end of the
+// program as both tools, which is -1 before any tool change.
+//
+
+type Macros struct {
+	Header           []string        // Lines put before the program
+	Footer           []string        // Lines put after the program
+	BeforeToolChange []string        // Lines put before each tool change
+	AfterToolChange  []string        // Lines put after each tool change
+	Tools            map[int]vm.Tool // Tool table for lengths and diameters
+}
+
+// Returns the lines with the templates filled in for a change from the tool
+// oldTool to tool.
+func (m *Macros) Expand(lines []string, oldTool, tool, precision int) []string {
+	if len(lines) == 0 {
+		return nil
+	}
+	t, old := m.Tools[tool], m.Tools[oldTool]
+	r := strings.NewReplacer(
+		"{tool}", strconv.Itoa(tool),
+		"{length}", floatToString(t.Length, precision),
+		"{diameter}", floatToString(t.Diameter, precision),
+		"{oldtool}", strconv.Itoa(oldTool),
+		"{oldlength}", floatToString(old.Length, precision),
+	)
+
+	var expanded []string
+	for _, l := range lines {
+		expanded = append(expanded, r.Replace(l))
+	}
+	return expanded
+}
@@ -0,0 +1,249 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+
+//
+// State change ordering
+//
+// HandlePosition splits the transition from the current position of a
+// generator to the next position into steps, each calling a single
+// CodeGenerator method. An OrderingPolicy decides in which order these steps
+// are executed, which matters for safety: the spindle must be stopped before
+// a toolchange, and must be running before the tool descends into the stock.
+//
+
+// Constants for transition steps
+const (
+	StepToolChange           = iota
+	StepToolChangeSuggestion = iota
+	StepToolLength           = iota
+	StepSpindle              = iota
+	StepSpindleStop          = iota
+	StepCoolant              = iota
+	StepCoolantStop          = iota
+	StepFeedMode             = iota
+	StepFeedrate             = iota
+	StepCutterCompensation   = iota
+	StepMove                 = iota
+)
+
+// An OrderingPolicy returns the steps required to go from cur to next, in the
+// order they should be executed. Steps that turn out to be no-ops are skipped.
+type OrderingPolicy func(cur, next vm.Position) []int
+
+// The policy used by HandlePosition.
+var DefaultOrdering OrderingPolicy = SafeOrdering
+
+// Executes all state changes before the move, in a fixed order. This is the
+// historical behaviour, which can start the spindle before a retract, or
+// change tools with the spindle running.
+func FixedOrdering(cur, next vm.Position) []int {
+	return []int{
+		StepToolChange,
+		StepToolChangeSuggestion,
+		StepToolLength,
+		StepSpindle,
+		StepCoolant,
+		StepFeedMode,
+		StepFeedrate,
+		StepCutterCompensation,
+		StepMove,
+	}
+}
+
+// Orders state changes safely. Retracts (Z-only upwards moves) happen before
+// any tool, spindle or coolant change. Coolant and spindle are stopped before
+// a toolchange and restarted after it, and a running spindle is stopped before
+// reversing direction. Coolant is stopped before the spindle, and started after
+// it. Everything else happens before the move, as the move depends on it.
+func SafeOrdering(cur, next vm.Position) []int {
+	var steps []int
+
+	retract := isRetract(cur, next)
+	if retract {
+		steps = append(steps, StepFeedMode, StepFeedrate, StepCutterCompensation, StepMove)
+	}
+
+	cs, ns := cur.State, next.State
+	if ns.ToolIndex != cs.ToolIndex && !ns.ToolSet {
+		steps = append(steps, StepCoolantStop, StepSpindleStop, StepToolChange)
+	} else {
+		if ns.ToolIndex != cs.ToolIndex {
+			// Setting the tool (M61) involves no toolchange
+			steps = append(steps, StepToolChange)
+		}
+		if (cs.FloodCoolant && !ns.FloodCoolant) || (cs.MistCoolant && !ns.MistCoolant) {
+			// Coolant cannot be partially disabled, so stop it and start over
+			steps = append(steps, StepCoolantStop)
+		}
+		if cs.SpindleEnabled && ns.SpindleEnabled && cs.SpindleClockwise != ns.SpindleClockwise {
+			// Never reverse a running spindle
+			steps = append(steps, StepSpindleStop)
+		}
+	}
+
+	steps = append(steps, StepToolChangeSuggestion, StepToolLength, StepSpindle, StepCoolant)
+
+	if !retract {
+		steps = append(steps, StepFeedMode, StepFeedrate, StepCutterCompensation, StepMove)
+	}
+	return steps
+}
+
+// Tests if the move from cur to next only lifts the Z axis.
+func isRetract(cur, next vm.Position) bool {
+	switch next.State.MoveMode {
+	case vm.MoveModeRapid, vm.MoveModeLinear:
+	default:
+		return false
+	}
+	return same(cur.X, next.X) && same(cur.Y, next.Y) && next.Z > cur.Z
+}
+
+// Executes a single step towards pos on the generator, and updates the
+// generator position to reflect the intermediate state.
+func handleStep(s CodeGenerator, step int, pos vm.Position) {
+	cp := s.GetPosition()
+	cs := cp.State
+	ns := pos.State
+
+	// The steps towards pos are made for the block that made it
+	cp.Line = pos.Line
+
+	switch step {
+	case StepToolChange:
+		if ns.ToolIndex == cs.ToolIndex {
+			return
+		}
+		if ns.ToolSet {
+			s.ToolSet(ns.ToolIndex)
+		} else {
+			s.ToolChange(ns.ToolIndex)
+		}
+		// Macros around the toolchange may have moved the machine
+		moved := s.GetPosition()
+		cp.X, cp.Y, cp.Z = moved.X, moved.Y, moved.Z
+		cp.State.ToolIndex = ns.ToolIndex
+		cp.State.ToolSet = ns.ToolSet
+
+	case StepToolChangeSuggestion:
+		if ns.NextToolIndex == cs.NextToolIndex {
+			return
+		}
+		s.ToolChangeSuggestion(ns.NextToolIndex)
+		cp.State.NextToolIndex = ns.NextToolIndex
+
+	case StepToolLength:
+		if ns.ToolLengthIndex == cs.ToolLengthIndex && same(ns.ToolLengthOffset, cs.ToolLengthOffset) {
+			return
+		}
+		if ns.ToolLengthIndex == vm.ToolLengthDynamic {
+			s.DynamicToolLength(ns.ToolLengthOffset)
+		} else {
+			s.ToolLengthChange(ns.ToolLengthIndex)
+		}
+		cp.State.ToolLengthIndex = ns.ToolLengthIndex
+		cp.State.ToolLengthOffset = ns.ToolLengthOffset
+
+	case StepSpindleStop:
+		if !cs.SpindleEnabled {
+			return
+		}
+		s.Spindle(false, cs.SpindleClockwise, cs.SpindleSpeed)
+		cp.State.SpindleEnabled = false
+
+	case StepSpindle:
+		if ns.SpindleEnabled == cs.SpindleEnabled &&
+			ns.SpindleClockwise == cs.SpindleClockwise &&
+			same(ns.SpindleSpeed, cs.SpindleSpeed) {
+			return
+		}
+		s.Spindle(ns.SpindleEnabled, ns.SpindleClockwise, ns.SpindleSpeed)
+		cp.State.SpindleEnabled = ns.SpindleEnabled
+		cp.State.SpindleClockwise = ns.SpindleClockwise
+		cp.State.SpindleSpeed = ns.SpindleSpeed
+
+	case StepCoolantStop:
+		if cs.FloodCoolant || cs.MistCoolant {
+			s.Coolant(false, false)
+			cp.State.FloodCoolant = false
+			cp.State.MistCoolant = false
+		}
+		for _, c := range vm.CoolantChannels {
+			if cs.Coolant&c != 0 {
+				s.CoolantChannel(c, false)
+			}
+		}
+		cp.State.Coolant = 0
+
+	case StepCoolant:
+		if ns.FloodCoolant != cs.FloodCoolant || ns.MistCoolant != cs.MistCoolant {
+			s.Coolant(ns.FloodCoolant, ns.MistCoolant)
+			cp.State.FloodCoolant = ns.FloodCoolant
+			cp.State.MistCoolant = ns.MistCoolant
+		}
+		for _, c := range vm.CoolantChannels {
+			if (cs.Coolant^ns.Coolant)&c != 0 {
+				s.CoolantChannel(c, ns.Coolant&c != 0)
+			}
+		}
+		cp.State.Coolant = ns.Coolant
+
+	case StepFeedMode:
+		if ns.FeedMode == cs.FeedMode {
+			return
+		}
+		s.FeedMode(ns.FeedMode)
+		cp.State.FeedMode = ns.FeedMode
+
+	case StepFeedrate:
+		if same(ns.Feedrate, cs.Feedrate) {
+			return
+		}
+		s.Feedrate(ns.Feedrate)
+		cp.State.Feedrate = ns.Feedrate
+
+	case StepCutterCompensation:
+		if ns.CutterCompensation == cs.CutterCompensation {
+			return
+		}
+		s.CutterCompensation(ns.CutterCompensation)
+		cp.State.CutterCompensation = ns.CutterCompensation
+
+	case StepMove:
+		// Positions without a move, and dwells, do not tell where the machine
+		// is when it is unknown, such as after a macro
+		known := !positionUnknown(cp) || (ns.MoveMode != vm.MoveModeNone && ns.MoveMode != vm.MoveModeDwell)
+		if ns.MoveMode == vm.MoveModeDwell {
+			s.Dwell(ns.DwellTime)
+		} else if ns.MoveMode == vm.MoveModeCWArc || ns.MoveMode == vm.MoveModeCCWArc {
+			// The center is given relative to the start, as I and J
+			s.Arc(pos.X, pos.Y, pos.Z, pos.Center.X-cp.X, pos.Center.Y-cp.Y, ns.MoveMode)
+		} else if known && (!same(cp.X, pos.X) || !same(cp.Y, pos.Y) || !same(cp.Z, pos.Z) || cs.MoveMode != ns.MoveMode) {
+			s.Move(pos.X, pos.Y, pos.Z, ns.MoveMode)
+		}
+		if known {
+			// Axes left out of the move keep the coordinate last written, so
+			// steps within Tolerance cannot add up without being written
+			advance(&cp.X, pos.X)
+			advance(&cp.Y, pos.Y)
+			advance(&cp.Z, pos.Z)
+		}
+		cp.Center = pos.Center
+		cp.State.MoveMode = ns.MoveMode
+		cp.State.DwellTime = ns.DwellTime
+
+	default:
+		panic("Unknown transition step")
+	}
+
+	s.SetPosition(cp)
+}
+
+// Moves an axis of the current position to next, unless within Tolerance of
+// it, where the generators leave the axis word out.
+func advance(cur *float64, next float64) {
+	if !same(*cur, next) {
+		*cur = next
+	}
+}
@@ -0,0 +1,722 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/gcode"
+import "io"
+import "bufio"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+//
+// Post-processor configuration
+//
+// Describes the gcode dialect of a controller for the ConfigurableGenerator,
+// read from a TOML file such as:
+//
+//   name = "Fanuc 0i"
+//   precision = 3
+//   separator = " "
+//   trailing_zeros = true
+//   line_numbers = 10
+//   max_line_number = 99999
+//   code_digits = 2
+//   decimal_point = true
+//   width = 0
+//   arcs = true
+//   dwell_unit = "ms"
+//   imperial = false
+//   safe_start = true
+//   codes = ["G0", "G1", "G2", "G3", "G4", "G40", "G43", "G49", "G94",
+//            "M3", "M4", "M5", "M6", "M8", "M9"]
+//   header = ["%", "O1000", "G21 G90 G17"]
+//   footer = ["M5", "M30", "%"]
+//   toolchange = ["M5", "G91 G28 Z0", "G90", "T{tool} M6"]
+//
+//   [precision]
+//   F = 0
+//   S = 0
+//
+//   [coolant]
+//   air = ["M73", "M74"]
+//   vacuum = ["M10", "M11"]
+//
+// The coolant table gives the on and off M codes of coolant channels, added
+// to those of vm.DefaultCoolantCodes.
+//
+// Only the subset of TOML needed for this is read: tables, and keys with
+// strings, numbers, booleans and arrays of those as values.
+//
+
+type PostConfig struct {
+	Format
+	Name          string
+	Separator     string                  // Put between the words of a block
+	LineNumbers   int                     // Step of N words put on blocks, 0 for none
+	MaxLineNumber int                     // Largest N word, after which they start over, 0 for no limit
+	CodeDigits    int                     // Minimum digits of G and M codes, such as 2 for G01
+	Arcs          bool                    // Whether G2 and G3 can be used
+	Codes         []string                // G and M codes that can be used, all if empty
+	Header        []string                // Lines put before the program
+	Footer        []string                // Lines put after the program
+	ToolChange    []string                // Lines replacing M6 Tn, with {tool} replaced by the tool number
+	Coolant       map[int]vm.CoolantCodes // M codes of coolant channels
+	DwellUnit     int                     // Unit of G4 P, seconds unless set to vm.DwellMilliseconds
+	Imperial      bool                    // Export in inches (G20) rather than millimetres
+	SafeStart     bool                    // Set all modes and stop the spindle and coolant after the header
+
+	codes map[gcode.Word]bool
+}
+
+// Returns the default configuration, which gives the output of the
+// StringCodeGenerator without its header.
+func NewPostConfig() *PostConfig {
+	return &PostConfig{
+		Format:  *NewFormat(4),
+		Name:    "gocnc",
+		Arcs:    true,
+		Coolant: vm.DefaultCoolantCodes(),
+	}
+}
+
+// Splits a value at top-level commas, leaving those in strings and nested
+// arrays.
+func splitValues(s string) []string {
+	var (
+		parts           []string
+		depth, start    int
+		quoted, escaped bool
+	)
+	for idx, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, s[start:idx])
+			start = idx + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		parts = append(parts, rest)
+	}
+	return parts
+}
+
+// Parses a TOML value: a string, number, boolean or array.
+func parseValue(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return nil, errors.New("Missing value")
+	case s == "true", s == "false":
+		return s == "true", nil
+	case s[0] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid string: %s", s))
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, errors.New(fmt.Sprintf("Invalid string: %s", s))
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		if s[len(s)-1] != ']' {
+			return nil, errors.New(fmt.Sprintf("Unterminated array: %s", s))
+		}
+		var values []interface{}
+		for _, part := range splitValues(s[1 : len(s)-1]) {
+			v, err := parseValue(part)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	f, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid value: %s", s))
+	}
+	return f, nil
+}
+
+// Removes a comment from a line, unless in a string.
+func stripComment(s string) string {
+	quoted, escaped := false, false
+	for idx, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == '#' && !quoted:
+			return s[:idx]
+		}
+	}
+	return s
+}
+
+// Returns whether an array value has more brackets opened than closed.
+func openArray(s string) bool {
+	depth, quoted, escaped := 0, false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+func toInt(v interface{}) (int, error) {
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, errors.New(fmt.Sprintf("Expected integer, got %v", v))
+	}
+	return int(f), nil
+}
+
+func toStrings(v interface{}) ([]string, error) {
+	if s, ok := v.(string); ok {
+		return []string{s}, nil
+	}
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Expected array of strings, got %v", v))
+	}
+	var strs []string
+	for _, x := range values {
+		s, ok := x.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Expected string, got %v", x))
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// Sets a key of the configuration.
+func (c *PostConfig) set(table, key string, v interface{}) error {
+	var (
+		ok  bool
+		err error
+	)
+
+	if table == "precision" {
+		if len(key) != 1 {
+			return errors.New(fmt.Sprintf("Invalid address: %s", key))
+		}
+		p, err := toInt(v)
+		if err != nil {
+			return err
+		}
+		c.Precisions[rune(strings.ToUpper(key)[0])] = p
+		return nil
+	} else if table == "coolant" {
+		codes, err := toStrings(v)
+		if err != nil {
+			return err
+		}
+		channel, cc, err := vm.ParseCoolantCodes(key, strings.Join(codes, ","))
+		if err != nil {
+			return err
+		}
+		c.Coolant[channel] = cc
+		return nil
+	} else if table != "" {
+		return errors.New(fmt.Sprintf("Unknown table: %s", table))
+	}
+
+	switch key {
+	case "name":
+		c.Name, ok = v.(string)
+	case "separator":
+		c.Separator, ok = v.(string)
+	case "trailing_zeros":
+		c.TrailingZeros, ok = v.(bool)
+	case "arcs":
+		c.Arcs, ok = v.(bool)
+	case "imperial":
+		c.Imperial, ok = v.(bool)
+	case "safe_start":
+		c.SafeStart, ok = v.(bool)
+	case "dwell_unit":
+		var unit string
+		if unit, ok = v.(string); ok {
+			c.DwellUnit, err = vm.ParseDwellUnit(unit)
+			ok, err = err == nil, nil
+		}
+	case "precision":
+		c.Precision, err = toInt(v)
+		ok = err == nil && c.Precision >= 0
+	case "line_numbers":
+		c.LineNumbers, err = toInt(v)
+		ok = err == nil && c.LineNumbers >= 0
+	case "max_line_number":
+		c.MaxLineNumber, err = toInt(v)
+		ok = err == nil && c.MaxLineNumber >= 0
+	case "code_digits":
+		c.CodeDigits, err = toInt(v)
+		ok = err == nil && c.CodeDigits >= 0
+	case "decimal_point":
+		c.DecimalPoint, ok = v.(bool)
+	case "width":
+		c.Width, err = toInt(v)
+		ok = err == nil && c.Width >= 0
+	case "codes":
+		c.Codes, err = toStrings(v)
+		ok = err == nil
+	case "header":
+		c.Header, err = toStrings(v)
+		ok = err == nil
+	case "footer":
+		c.Footer, err = toStrings(v)
+		ok = err == nil
+	case "toolchange":
+		c.ToolChange, err = toStrings(v)
+		ok = err == nil
+	default:
+		return errors.New(fmt.Sprintf("Unknown key: %s", key))
+	}
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid value for %s: %s", key, err))
+	}
+	if !ok {
+		return errors.New(fmt.Sprintf("Invalid value for %s: %v", key, v))
+	}
+	return nil
+}
+
+// Reads a post-processor configuration, with unset keys keeping the defaults
+// of NewPostConfig.
+func ReadPostConfig(r io.Reader) (*PostConfig, error) {
+	c := NewPostConfig()
+	scanner := bufio.NewScanner(r)
+	var (
+		line, start int
+		table, key  string
+		value       string
+	)
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+
+		// Continuation of an array spanning several lines
+		if key != "" {
+			value += " " + text
+			if openArray(value) {
+				continue
+			}
+		} else if text == "" {
+			continue
+		} else if text[0] == '[' {
+			if text[len(text)-1] != ']' {
+				return nil, errors.New(fmt.Sprintf("Line %d: invalid table: %s", line, text))
+			}
+			table = strings.ToLower(strings.TrimSpace(text[1 : len(text)-1]))
+			continue
+		} else {
+			eq := strings.IndexRune(text, '=')
+			if eq == -1 {
+				return nil, errors.New(fmt.Sprintf("Line %d: expected key = value", line))
+			}
+			start = line
+			key = strings.Trim(strings.TrimSpace(text[:eq]), "\"")
+			value = strings.TrimSpace(text[eq+1:])
+			if openArray(value) {
+				continue
+			}
+		}
+
+		v, err := parseValue(value)
+		if err == nil {
+			err = c.set(table, key, v)
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Line %d: %s", start, err))
+		}
+		key = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if key != "" {
+		return nil, errors.New(fmt.Sprintf("Line %d: unterminated array", start))
+	}
+
+	if err := c.parseCodes(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Parses the supported codes.
+func (c *PostConfig) parseCodes() error {
+	c.codes = nil
+	if len(c.Codes) == 0 {
+		return nil
+	}
+	c.codes = make(map[gcode.Word]bool)
+	for _, code := range c.Codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) < 2 || (code[0] != 'G' && code[0] != 'M') {
+			return errors.New(fmt.Sprintf("Invalid code: %s", code))
+		}
+		n, err := strconv.ParseFloat(code[1:], 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid code: %s", code))
+		}
+		c.codes[gcode.Word{Address: rune(code[0]), Command: n}] = true
+	}
+	return nil
+}
+
+// Returns whether a G or M code can be used.
+func (c *PostConfig) Supports(address rune, code float64) bool {
+	if c.codes == nil && len(c.Codes) > 0 {
+		if err := c.parseCodes(); err != nil {
+			return false
+		}
+	}
+	return c.codes == nil || c.codes[gcode.Word{Address: address, Command: code}]
+}
+
+// Returns an error for the first of the G and M codes, such as "G17", that
+// cannot be used.
+func (c *PostConfig) Require(codes ...string) error {
+	for _, code := range codes {
+		n, err := strconv.ParseFloat(code[1:], 64)
+		if err != nil || !c.Supports(rune(code[0]), n) {
+			return errors.New(fmt.Sprintf("%s not supported by post %s", code, c.Name))
+		}
+	}
+	return nil
+}
+
+// Formats a G or M code, padded to CodeDigits.
+func (c *PostConfig) Code(address rune, code float64) string {
+	x := strconv.FormatFloat(code, 'f', -1, 64)
+	digits := len(x)
+	if idx := strings.IndexRune(x, '.'); idx != -1 {
+		digits = idx
+	}
+	for ; digits < c.CodeDigits; digits++ {
+		x = "0" + x
+	}
+	return fmt.Sprintf("%c%s", address, x)
+}
+
+//
+// Configurable code generator
+//
+// Used for exporting VM state as gcode for controllers described by a
+// PostConfig. Codes the configuration does not support cause a panic, like
+// the arcs of the other generators.
+//
+
+type ConfigurableGenerator struct {
+	BaseGenerator
+	Config         *PostConfig
+	Lines          []string
+	Tool           int
+	ForceModeWrite bool
+
+	lineNumber int
+}
+
+// G and M codes of the safe start blocks, besides that of the units. A post
+// with SafeStart must support them, as they are put in outside
+// HandlePosition.
+var SafeStartCodes = []string{"G17", "G40", "G49", "G54", "G90", "G94", "M5", "M9"}
+
+// Initializes state, and puts in the header, followed by G20 if exporting
+// in inches.
+func (s *ConfigurableGenerator) Init() {
+	s.init()
+	if s.Config.Imperial && !s.Config.SafeStart {
+		s.put(s.code('G', 20))
+	}
+}
+
+// Initializes state, and puts in the header, followed by the safe start
+// blocks if configured.
+func (s *ConfigurableGenerator) init() {
+	if s.Config == nil {
+		s.Config = NewPostConfig()
+	}
+	s.Position = vm.Position{State: vm.NewState()}
+	s.Lines = append([]string(nil), s.Config.Header...)
+	s.lineNumber = 0
+	if s.Config.SafeStart {
+		s.put(s.code('G', 17), s.units(), s.code('G', 90), s.code('G', 94), s.code('G', 40), s.code('G', 49), s.code('G', 54))
+		s.put(s.code('M', 5), s.code('M', 9))
+	}
+}
+
+// Returns the G code of the units of the output, G20 for inches or G21 for
+// millimetres.
+func (s *ConfigurableGenerator) units() string {
+	if s.Config.Imperial {
+		return s.code('G', 20)
+	}
+	return s.code('G', 21)
+}
+
+// Formats a word, converted to inches if exporting in them.
+func (s *ConfigurableGenerator) word(address rune, v float64) string {
+	if s.Config.Imperial {
+		v = toInches(address, v, s.Position.State.FeedMode)
+	}
+	return s.Config.Word(address, v)
+}
+
+// Returns a G or M code, panicking if it is not supported.
+func (s *ConfigurableGenerator) code(address rune, code float64) string {
+	if !s.Config.Supports(address, code) {
+		panic(fmt.Sprintf("%c%g not supported by post %s", address, code, s.Config.Name))
+	}
+	return s.Config.Code(address, code)
+}
+
+// Puts in a block of the given words, numbered if configured.
+func (s *ConfigurableGenerator) put(words ...string) {
+	var w []string
+	for _, x := range words {
+		if x != "" {
+			w = append(w, x)
+		}
+	}
+	if len(w) == 0 {
+		return
+	}
+	if s.Config.LineNumbers > 0 {
+		s.lineNumber += s.Config.LineNumbers
+		if s.Config.MaxLineNumber > 0 && s.lineNumber > s.Config.MaxLineNumber {
+			s.lineNumber = s.Config.LineNumbers
+		}
+		w = append([]string{fmt.Sprintf("N%d", s.lineNumber)}, w...)
+	}
+	s.Lines = append(s.Lines, strings.Join(w, s.Config.Separator))
+}
+
+// Fetch the generated gcodes, followed by the footer.
+func (s *ConfigurableGenerator) Retrieve() string {
+	lines := append(append([]string(nil), s.Lines...), s.Config.Footer...)
+	return strings.Join(lines, "\n")
+}
+
+// Adds a toolchange operation, using the toolchange macro if configured.
+func (s *ConfigurableGenerator) ToolChange(t int) {
+	if len(s.Config.ToolChange) > 0 {
+		tool := strconv.Itoa(t)
+		for _, l := range s.Config.ToolChange {
+			s.put(strings.Replace(l, "{tool}", tool, -1))
+		}
+		forgetPosition(&s.Position)
+	} else {
+		s.put(s.code('M', 6), fmt.Sprintf("T%d", t))
+	}
+	s.Tool = t
+	s.ForceModeWrite = true
+}
+
+// Sets the tool in the spindle without a toolchange (M61 Qn).
+func (s *ConfigurableGenerator) ToolSet(t int) {
+	s.put(s.code('M', 61), fmt.Sprintf("Q%d", t))
+	s.Tool = t
+}
+
+// Adds a toolchange suggest operation (Tn).
+func (s *ConfigurableGenerator) ToolChangeSuggestion(t int) {
+	if s.Tool != t {
+		s.put(fmt.Sprintf("T%d", t))
+		s.Tool = t
+		s.ForceModeWrite = true
+	}
+}
+
+// Adds a tool length index operation (G43 Hn or G49)
+func (s *ConfigurableGenerator) ToolLengthChange(h int) {
+	switch h {
+	case 0:
+		s.put(s.code('G', 49))
+	default:
+		s.put(s.code('G', 43), fmt.Sprintf("H%d", h))
+	}
+}
+
+// Adds a dynamic tool length offset (G43.1 Zn).
+func (s *ConfigurableGenerator) DynamicToolLength(z float64) {
+	s.put(s.code('G', 43.1), s.word('Z', z))
+}
+
+// Adds a spindle operation (M3/M4/M5 [Sn]).
+func (s *ConfigurableGenerator) Spindle(enabled, clockwise bool, speed float64) {
+	var m, sp string
+	if s.Position.State.SpindleEnabled != enabled || s.Position.State.SpindleClockwise != clockwise {
+		s.ForceModeWrite = true
+		if enabled && clockwise {
+			m = s.code('M', 3)
+		} else if enabled && !clockwise {
+			m = s.code('M', 4)
+		} else {
+			m = s.code('M', 5)
+		}
+	}
+
+	if enabled && !same(s.Position.State.SpindleSpeed, speed) {
+		sp = s.Config.Word('S', speed)
+	}
+
+	s.put(m, sp)
+}
+
+// Adds a coolant operation (M7/M8/M9).
+func (s *ConfigurableGenerator) Coolant(floodCoolant, mistCoolant bool) {
+	if !floodCoolant && !mistCoolant {
+		s.put(s.code('M', 9))
+	} else {
+		if floodCoolant {
+			s.put(s.code('M', 8))
+		}
+		if mistCoolant {
+			s.put(s.code('M', 7))
+		}
+	}
+	s.ForceModeWrite = true
+}
+
+// Turns a coolant channel on or off, with the M code from the configuration.
+func (s *ConfigurableGenerator) CoolantChannel(channel int, on bool) {
+	s.put(s.code('M', coolantCode(s.Config.Coolant, channel, on)))
+	s.ForceModeWrite = true
+}
+
+// Sets feedmode (G93/G94/G95)
+func (s *ConfigurableGenerator) FeedMode(feedMode int) {
+	switch feedMode {
+	case vm.FeedModeInvTime:
+		s.put(s.code('G', 93))
+	case vm.FeedModeUnitsMin:
+		s.put(s.code('G', 94))
+	case vm.FeedModeUnitsRev:
+		s.put(s.code('G', 95))
+	default:
+		panic("Unknown feed mode")
+	}
+}
+
+// Sets feedrate (Fn)
+func (s *ConfigurableGenerator) Feedrate(feedrate float64) {
+	s.put(s.word('F', feedrate))
+}
+
+// Sets cutter compensation mode (G40/G41/G42)
+func (s *ConfigurableGenerator) CutterCompensation(cutComp int) {
+	switch cutComp {
+	case vm.CutCompModeNone:
+		s.put(s.code('G', 40))
+	case vm.CutCompModeOuter:
+		s.put(s.code('G', 41))
+	case vm.CutCompModeInner:
+		s.put(s.code('G', 42))
+	default:
+		panic("Unknown cutter compensation mode")
+	}
+}
+
+func (s *ConfigurableGenerator) Dwell(seconds float64) {
+	s.put(s.code('G', 4), dwellWord(&s.Config.Format, s.Config.Precision, s.Config.DwellUnit, seconds))
+}
+
+// Returns the axis words of a move to x, y, z that differ from the current
+// position.
+func (s *ConfigurableGenerator) axes(x, y, z float64) []string {
+	var w []string
+	pos := s.GetPosition()
+	if !same(pos.X, x) {
+		w = append(w, s.word('X', x))
+	}
+	if !same(pos.Y, y) {
+		w = append(w, s.word('Y', y))
+	}
+	if !same(pos.Z, z) {
+		w = append(w, s.word('Z', z))
+	}
+	return w
+}
+
+// Issues a move ([G0/G1] [Xn] [Yn] [Zn])
+func (s *ConfigurableGenerator) Move(x, y, z float64, moveMode int) {
+	var w []string
+	pos := s.GetPosition()
+	if pos.State.MoveMode != moveMode || s.ForceModeWrite {
+		switch moveMode {
+		case vm.MoveModeNone:
+			return
+		case vm.MoveModeRapid:
+			w = append(w, s.code('G', 0))
+		case vm.MoveModeLinear:
+			w = append(w, s.code('G', 1))
+		case vm.MoveModeCWArc:
+			panic("Cannot export arcs")
+		case vm.MoveModeCCWArc:
+			panic("Cannot export arcs")
+		default:
+			panic("Unknown move mode")
+		}
+	}
+
+	s.ForceModeWrite = false
+	s.put(append(w, s.axes(x, y, z)...)...)
+}
+
+// Issues an arc (G2/G3 [Xn] [Yn] [Zn] In Jn)
+func (s *ConfigurableGenerator) Arc(x, y, z, i, j float64, moveMode int) {
+	if !s.Config.Arcs {
+		panic(fmt.Sprintf("Arcs not supported by post %s", s.Config.Name))
+	}
+
+	var w []string
+	pos := s.GetPosition()
+	if pos.State.MoveMode != moveMode || s.ForceModeWrite {
+		switch moveMode {
+		case vm.MoveModeCWArc:
+			w = append(w, s.code('G', 2))
+		case vm.MoveModeCCWArc:
+			w = append(w, s.code('G', 3))
+		default:
+			panic("Unknown arc mode")
+		}
+	}
+	s.ForceModeWrite = false
+
+	w = append(w, s.axes(x, y, z)...)
+	w = append(w, s.word('I', i), s.word('J', j))
+	s.put(w...)
+}
@@ -0,0 +1,27 @@
+package export
+
+import "fmt"
+
+//
+// RepRap line numbers and checksums
+//
+// RepRap firmware, such as Marlin and RepRapFirmware, detects corrupted and
+// lost lines on the serial connection by line numbers and checksums, as in
+// "N12 G1X10*87", and asks for lines to be sent again with "Resend: 12".
+//
+
+// Returns the checksum of a line, which is the XOR of its bytes, including
+// the line number.
+func Checksum(line string) byte {
+	var cs byte
+	for idx := 0; idx < len(line); idx++ {
+		cs ^= line[idx]
+	}
+	return cs
+}
+
+// Returns a line with line number n and its checksum added.
+func NumberLine(n int, line string) string {
+	l := fmt.Sprintf("N%d %s", n, line)
+	return fmt.Sprintf("%s*%d", l, Checksum(l))
+}
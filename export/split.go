@@ -0,0 +1,223 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "strings"
+import "math"
+import "errors"
+import "fmt"
+
+//
+// Program size
+//
+// Some controllers only hold programs up to a number of lines or bytes. The
+// size of the exported gcode can be reported per tool, and a program split
+// into parts that each fit, at safe boundaries: where a move starts from at or
+// above the safe height, such as at tool changes and rapids between
+// operations. Each part is a program of its own, with the header and footer
+// of the generator, and the tool, spindle, coolant and feed set up again
+// before its first move.
+//
+
+// A generator keeping its gcode as lines, such as the StringCodeGenerator and
+// the ConfigurableGenerator.
+type LineGenerator interface {
+	CodeGenerator
+	Retrieve() string
+	lines() []string
+}
+
+func (s *StringCodeGenerator) lines() []string {
+	return s.Lines
+}
+
+func (s *ConfigurableGenerator) lines() []string {
+	return s.Lines
+}
+
+// The size of the gcode of a tool.
+type ToolSize struct {
+	Tool  int // Tool index, -1 for moves before the first tool
+	Lines int
+	Bytes int // Including newlines
+}
+
+// Sizes of the gcode made for each position, as running totals of the lines
+// after the header, along with the size of a program without positions.
+type programSize struct {
+	lines, bytes           []int
+	emptyLines, emptyBytes int
+}
+
+// Returns the lines and bytes of gcode, with a newline after each line.
+func textSize(lines []string) (int, int) {
+	bytes := 0
+	for _, l := range lines {
+		bytes += len(l) + 1
+	}
+	return len(lines), bytes
+}
+
+// Exports the program once, recording the size of the gcode of each
+// position. The gcode of a position is the lines put in while handling it.
+func measure(m *vm.Machine, gen LineGenerator) (*programSize, error) {
+	gen.Init()
+	out := strings.Split(gen.Retrieve(), "\n")
+	size := &programSize{}
+	size.emptyLines, size.emptyBytes = textSize(out)
+
+	seen := len(gen.lines())
+	lines, bytes := 0, 0
+	for _, pos := range m.Positions {
+		if err := HandlePosition(pos, gen); err != nil {
+			return nil, err
+		}
+		l, b := textSize(gen.lines()[seen:])
+		seen = len(gen.lines())
+		lines, bytes = lines+l, bytes+b
+		size.lines = append(size.lines, lines)
+		size.bytes = append(size.bytes, bytes)
+	}
+	return size, nil
+}
+
+// Returns the lines and bytes of gcode made for each tool, in the order the
+// tools are first used.
+func SizeByTool(m *vm.Machine, gen LineGenerator) ([]ToolSize, error) {
+	size, err := measure(m, gen)
+	if err != nil {
+		return nil, err
+	}
+
+	var sizes []ToolSize
+	index := make(map[int]int)
+	prevLines, prevBytes := 0, 0
+	for idx, pos := range m.Positions {
+		t := pos.State.ToolIndex
+		n, ok := index[t]
+		if !ok {
+			n = len(sizes)
+			index[t] = n
+			sizes = append(sizes, ToolSize{Tool: t})
+		}
+		sizes[n].Lines += size.lines[idx] - prevLines
+		sizes[n].Bytes += size.bytes[idx] - prevBytes
+		prevLines, prevBytes = size.lines[idx], size.bytes[idx]
+	}
+	return sizes, nil
+}
+
+// Returns whether a part can start at the position of the index: the move
+// to it is a rapid, or a linear move changing tool, starting at or above the
+// safe height.
+func safeBoundary(m *vm.Machine, idx int, safeZ float64) bool {
+	if idx <= 0 || idx >= len(m.Positions) {
+		return false
+	}
+	prev, pos := m.Positions[idx-1], m.Positions[idx]
+	switch {
+	case prev.Z < safeZ:
+		return false
+	case pos.State.MoveMode == vm.MoveModeRapid:
+		return true
+	}
+	return pos.State.MoveMode == vm.MoveModeLinear && pos.State.ToolIndex != prev.State.ToolIndex
+}
+
+// Exports the positions from start up to end as a program of its own. As the
+// machine may be elsewhere when a part is started, such as after returning
+// to its reference point at the end of the last part, parts other than the
+// first rapid up to the height the part starts at, which is at or above the
+// safe height, then over to where it starts, before its first move.
+func exportPart(m *vm.Machine, gen LineGenerator, start, end int) (string, error) {
+	gen.Init()
+	if start > 0 {
+		from := m.Positions[start-1]
+		from.State.MoveMode = vm.MoveModeRapid
+
+		// Only Z is unknown for the move up, so only Z is put in, and the
+		// state of the part is only set up once it is up
+		pos := gen.GetPosition()
+		pos.X, pos.Y, pos.Z = from.X, from.Y, math.NaN()
+		gen.SetPosition(pos)
+		up := pos
+		up.Z = from.Z
+		up.State.MoveMode = vm.MoveModeRapid
+		if err := HandlePosition(up, gen); err != nil {
+			return "", err
+		}
+
+		pos = gen.GetPosition()
+		pos.X, pos.Y = math.NaN(), math.NaN()
+		gen.SetPosition(pos)
+		if err := HandlePosition(from, gen); err != nil {
+			return "", err
+		}
+	}
+	for _, pos := range m.Positions[start:end] {
+		if err := HandlePosition(pos, gen); err != nil {
+			return "", err
+		}
+	}
+	return gen.Retrieve(), nil
+}
+
+// Splits the program into parts of at most maxLines lines and maxBytes
+// bytes (0 for no limit), at moves starting at or above safeZ. newGen is
+// called for a generator for each part, numbered from 0, as well as for
+// measuring the program.
+func Split(m *vm.Machine, newGen func(part int) LineGenerator, maxLines, maxBytes int, safeZ float64) ([]string, error) {
+	size, err := measure(m, newGen(0))
+	if err != nil {
+		return nil, err
+	}
+
+	fits := func(lines, bytes int) bool {
+		return (maxLines <= 0 || lines <= maxLines) && (maxBytes <= 0 || bytes <= maxBytes)
+	}
+	// Estimated size of the part from start up to end, without the setup
+	// before its first move
+	estimate := func(start, end int) (int, int) {
+		lines, bytes := size.lines[end-1]+size.emptyLines, size.bytes[end-1]+size.emptyBytes
+		if start > 0 {
+			lines -= size.lines[start-1]
+			bytes -= size.bytes[start-1]
+		}
+		return lines, bytes
+	}
+
+	var boundaries []int
+	for idx := range m.Positions {
+		if safeBoundary(m, idx, safeZ) {
+			boundaries = append(boundaries, idx)
+		}
+	}
+	boundaries = append(boundaries, len(m.Positions))
+
+	var parts []string
+	for start := 0; start < len(m.Positions); {
+		// Try the furthest boundary estimated to fit first, and earlier ones
+		// if the setup of the part makes it too large
+		var (
+			code string
+			end  int
+		)
+		for b := len(boundaries) - 1; b >= 0 && end == 0; b-- {
+			if boundaries[b] <= start || !fits(estimate(start, boundaries[b])) {
+				continue
+			}
+			c, err := exportPart(m, newGen(len(parts)), start, boundaries[b])
+			if err != nil {
+				return nil, err
+			}
+			if fits(textSize(strings.Split(c, "\n"))) {
+				code, end = c, boundaries[b]
+			}
+		}
+		if end == 0 {
+			return nil, errors.New(fmt.Sprintf("Part %d, starting at position %d, cannot be made small enough between safe boundaries", len(parts)+1, start))
+		}
+		parts = append(parts, code)
+		start = end
+	}
+	return parts, nil
+}
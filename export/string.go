@@ -1,6 +1,7 @@
 package export
 
 import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/gcode"
 import "fmt"
 import "strings"
 
@@ -12,6 +13,11 @@ import "strings"
 // Notes:
 //   Inverse time feed requires F to be set for every G-word, which is not done
 //
+//   With Source set, the comments, empty lines and N words of the source
+//   document are put back in along the positions made by its blocks. Those of
+//   blocks making no positions, or only positions removed or moved earlier by
+//   optimization, are put in before the next position made by a later block
+//
 
 type StringCodeGenerator struct {
 	BaseGenerator
@@ -19,25 +25,155 @@ type StringCodeGenerator struct {
 	Lines          []string
 	Tool           int
 	ForceModeWrite bool
+	Source         *gcode.Document         // Document the positions were made from, whose annotations are kept, if set
+	Macros         Macros                  // Lines put in at the start and end, and around tool changes
+	Format         *Format                 // Formatting of numbers, overriding Precision, if set
+	CoolantCodes   map[int]vm.CoolantCodes // M codes of coolant channels, vm.DefaultCoolantCodes if nil
+	DwellUnit      int                     // Unit of G4 P, seconds unless set to vm.DwellMilliseconds
+	Imperial       bool                    // Export in inches (G20) rather than millimetres (G21)
+	SafeStart      bool                    // Set all modes and stop the spindle and coolant in the header block
+
+	sourceLine int // Last line of Source put back in
+	mark       int // Number of lines before the current position
 }
 
-// Initializes state, and puts in a header block.
+// Initializes state, and puts in a header block followed by the header macro.
 func (s *StringCodeGenerator) Init() {
 	s.Position = vm.Position{State: vm.NewState()}
-	s.Lines = []string{"(Exported by gocnc)", "G21G90\n"}
+	units := "G21"
+	if s.Imperial {
+		units = "G20"
+	}
+	s.Lines = []string{"(Exported by gocnc)", units + "G90\n"}
+	if s.SafeStart {
+		// Modes a previous program may have left changed, in the order of a
+		// safety block
+		s.Lines = []string{"(Exported by gocnc)", "G17" + units + "G90G94G40G49G54", "M5M9\n"}
+	}
+	tool := s.Position.State.ToolIndex
+	s.Lines = append(s.Lines, s.Macros.Expand(s.Macros.Header, tool, tool, s.Precision)...)
+	if len(s.Macros.Header) > 0 {
+		forgetPosition(&s.Position)
+	}
+	s.sourceLine = 0
+	s.mark = len(s.Lines)
+}
+
+// Returns the annotations of a block of the source put back in on lines of
+// their own: the source text of blocks with only comments or nothing at all,
+// and the comments of others.
+func sourceAnnotations(b gcode.Block) []string {
+	var (
+		comments []string
+		words    bool
+	)
+	for _, n := range b.Nodes {
+		switch n.(type) {
+		case *gcode.Comment:
+			comments = append(comments, n.Export(-1))
+		case *gcode.Filemarker:
+			// The exported code is a program of its own
+			return nil
+		default:
+			words = true
+		}
+	}
+	if !words {
+		return []string{b.Source}
+	}
+	return comments
+}
+
+// Puts the annotations of the source up to and including line in before the
+// lines of the current position, with the N word and comments of the block
+// at line on the first of them.
+func (s *StringCodeGenerator) annotate(line int) {
+	var before []string
+	blocks := s.Source.Blocks
+	for l := s.sourceLine + 1; l < line && l <= len(blocks); l++ {
+		before = append(before, sourceAnnotations(blocks[l-1])...)
+	}
+
+	added := s.Lines[s.mark:]
+	if b := blocks[line-1]; len(added) == 0 {
+		before = append(before, sourceAnnotations(b)...)
+	} else {
+		first := added[0]
+		if n, err := b.GetWord('N'); err == nil {
+			first = (&gcode.Word{Address: 'N', Command: n}).Export(-1) + first
+		}
+		for _, node := range b.Nodes {
+			if c, ok := node.(*gcode.Comment); ok {
+				first += c.Export(-1)
+			}
+		}
+		added[0] = first
+	}
+
+	s.Lines = append(s.Lines[:s.mark], append(before, added...)...)
+	s.sourceLine = line
+}
+
+// Sets the current position, putting the annotations of the source in before
+// the lines issued since the last position. As the intermediate positions of
+// the steps towards a position carry its line, this is the first step made
+// for a block.
+func (s *StringCodeGenerator) SetPosition(pos vm.Position) {
+	if s.Source != nil && pos.Line > s.sourceLine && pos.Line <= len(s.Source.Blocks) {
+		s.annotate(pos.Line)
+	}
+	s.Position = pos
+	s.mark = len(s.Lines)
+}
+
+// Formats a word, with Format if set, or Precision otherwise, converted to
+// inches if Imperial.
+func (s *StringCodeGenerator) word(address rune, v float64) string {
+	if s.Imperial {
+		v = toInches(address, v, s.Position.State.FeedMode)
+	}
+	return formatWord(s.Format, s.Precision, address, v)
 }
 
 func (s *StringCodeGenerator) put(x string) {
 	s.Lines = append(s.Lines, x)
 }
 
-// Fetch the generated gcodes.
+// Fetch the generated gcodes, along with the remaining annotations of the
+// source, if set, and the footer macro.
 func (s *StringCodeGenerator) Retrieve() string {
-	return strings.Join(s.Lines, "\n")
+	lines := append(append([]string(nil), s.Lines...), s.trailer()...)
+	return strings.Join(lines, "\n")
+}
+
+// Returns the lines following the generated gcodes: the remaining
+// annotations of the source, if set, and the footer macro.
+func (s *StringCodeGenerator) trailer() []string {
+	var lines []string
+	if s.Source != nil {
+		for l := s.sourceLine + 1; l <= len(s.Source.Blocks); l++ {
+			lines = append(lines, sourceAnnotations(s.Source.Blocks[l-1])...)
+		}
+	}
+	tool := s.Position.State.ToolIndex
+	return append(lines, s.Macros.Expand(s.Macros.Footer, tool, tool, s.Precision)...)
 }
 
-// Adds a toolchange operation (M6 Tn).
+// Adds a toolchange operation (M6 Tn), between the tool change macros.
 func (s *StringCodeGenerator) ToolChange(t int) {
+	old := s.Position.State.ToolIndex
+	for _, l := range s.Macros.Expand(s.Macros.BeforeToolChange, old, t, s.Precision) {
+		s.put(l)
+	}
+	defer func() {
+		for _, l := range s.Macros.Expand(s.Macros.AfterToolChange, old, t, s.Precision) {
+			s.put(l)
+		}
+		if len(s.Macros.BeforeToolChange) > 0 || len(s.Macros.AfterToolChange) > 0 {
+			forgetPosition(&s.Position)
+		}
+	}()
+
 	if s.Tool == t {
 		if s.Lines[len(s.Lines)-1] == fmt.Sprintf("T%d", t) {
 			s.Lines[len(s.Lines)-1] = fmt.Sprintf("M6 T%d", t)
@@ -51,6 +187,12 @@ func (s *StringCodeGenerator) ToolChange(t int) {
 	s.ForceModeWrite = true
 }
 
+// Sets the tool in the spindle without a toolchange (M61 Qn).
+func (s *StringCodeGenerator) ToolSet(t int) {
+	s.put(fmt.Sprintf("M61 Q%d", t))
+	s.Tool = t
+}
+
 // Adds a toolchange suggest operation (Tn).
 func (s *StringCodeGenerator) ToolChangeSuggestion(t int) {
 	if s.Tool != t {
@@ -70,6 +212,11 @@ func (s *StringCodeGenerator) ToolLengthChange(h int) {
 	}
 }
 
+// Adds a dynamic tool length offset (G43.1 Zn).
+func (s *StringCodeGenerator) DynamicToolLength(z float64) {
+	s.put("G43.1" + s.word('Z', z))
+}
+
 // Adds a spindle operation (M3/M4/M5 [Sn]).
 func (s *StringCodeGenerator) Spindle(enabled, clockwise bool, speed float64) {
 	x := ""
@@ -84,8 +231,8 @@ func (s *StringCodeGenerator) Spindle(enabled, clockwise bool, speed float64) {
 		}
 	}
 
-	if enabled && s.Position.State.SpindleSpeed != speed {
-		x += fmt.Sprintf("S%s", floatToString(speed, s.Precision))
+	if enabled && !same(s.Position.State.SpindleSpeed, speed) {
+		x += s.word('S', speed)
 	}
 
 	s.put(x)
@@ -106,6 +253,16 @@ func (s *StringCodeGenerator) Coolant(floodCoolant, mistCoolant bool) {
 	s.ForceModeWrite = true
 }
 
+// Turns a coolant channel on or off, with the M code from CoolantCodes.
+func (s *StringCodeGenerator) CoolantChannel(channel int, on bool) {
+	codes := s.CoolantCodes
+	if codes == nil {
+		codes = vm.DefaultCoolantCodes()
+	}
+	s.put("M" + floatToString(coolantCode(codes, channel, on), -1))
+	s.ForceModeWrite = true
+}
+
 // Sets feedmode (G93/G94/G95)
 func (s *StringCodeGenerator) FeedMode(feedMode int) {
 	switch feedMode {
@@ -122,7 +279,7 @@ func (s *StringCodeGenerator) FeedMode(feedMode int) {
 
 // Sets feedrate (Fn)
 func (s *StringCodeGenerator) Feedrate(feedrate float64) {
-	s.put(fmt.Sprintf("F%s", floatToString(feedrate, s.Precision)))
+	s.put(s.word('F', feedrate))
 }
 
 // Sets cutter compensation mode (G40/G41/G42)
@@ -140,7 +297,7 @@ func (s *StringCodeGenerator) CutterCompensation(cutComp int) {
 }
 
 func (s *StringCodeGenerator) Dwell(seconds float64) {
-	s.put(fmt.Sprintf("G4P%s", floatToString(seconds, s.Precision)))
+	s.put("G4" + dwellWord(s.Format, s.Precision, s.DwellUnit, seconds))
 }
 
 // Issues a move ([G0/G1] [Xn] [Yn] [Zn])
@@ -166,15 +323,45 @@ func (s *StringCodeGenerator) Move(x, y, z float64, moveMode int) {
 
 	s.ForceModeWrite = false
 
-	if pos.X != x {
-		w += fmt.Sprintf("X%s", floatToString(x, s.Precision))
+	if !same(pos.X, x) {
+		w += s.word('X', x)
+	}
+	if !same(pos.Y, y) {
+		w += s.word('Y', y)
+	}
+	if !same(pos.Z, z) {
+		w += s.word('Z', z)
+	}
+
+	s.put(w)
+}
+
+// Issues an arc (G2/G3 [Xn] [Yn] [Zn] In Jn)
+func (s *StringCodeGenerator) Arc(x, y, z, i, j float64, moveMode int) {
+	w := ""
+	pos := s.GetPosition()
+	if pos.State.MoveMode != moveMode || s.ForceModeWrite {
+		switch moveMode {
+		case vm.MoveModeCWArc:
+			w = "G2"
+		case vm.MoveModeCCWArc:
+			w = "G3"
+		default:
+			panic("Unknown arc mode")
+		}
+	}
+	s.ForceModeWrite = false
+
+	if !same(pos.X, x) {
+		w += s.word('X', x)
 	}
-	if pos.Y != y {
-		w += fmt.Sprintf("Y%s", floatToString(y, s.Precision))
+	if !same(pos.Y, y) {
+		w += s.word('Y', y)
 	}
-	if pos.Z != z {
-		w += fmt.Sprintf("Z%s", floatToString(z, s.Precision))
+	if !same(pos.Z, z) {
+		w += s.word('Z', z)
 	}
+	w += s.word('I', i) + s.word('J', j)
 
 	s.put(w)
 }
@@ -0,0 +1,155 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+import "strings"
+import "errors"
+import "fmt"
+
+// The maximum number of differences reported by Verify
+const maxVerifyDifferences = 10
+
+// Verifies that the exported gcode reproduces the machine state, by
+// exporting it with a StringCodeGenerator of the given precision, running the
+// result through a fresh VM, and comparing the position stacks within
+// epsilon. Output of other generators, posts and macros is not verified.
+//
+// The comparison covers the path (move endpoints, move modes, feedrates and
+// dwells), the spindle, coolant and tool state of every cutting move, and the
+// order of toolchanges. State changes on non-cutting moves are not compared,
+// as the ordering policy is free to move them to neighbouring moves.
+func Verify(m *vm.Machine, precision int, epsilon float64) error {
+	g := StringCodeGenerator{Precision: precision, CoolantCodes: m.CoolantCodes}
+	g.Init()
+	if err := HandleAllPositions(m, &g); err != nil {
+		return errors.New(fmt.Sprintf("Export failed: %s", err))
+	}
+
+	doc, err := gcode.Parse(g.Retrieve())
+	if err != nil {
+		return errors.New(fmt.Sprintf("Exported code does not parse: %s", err))
+	}
+
+	var rm vm.Machine
+	rm.Init()
+	rm.KeepArcs = true
+	if m.CoolantCodes != nil {
+		rm.CoolantCodes = m.CoolantCodes
+	}
+	if err := rm.Process(doc); err != nil {
+		return errors.New(fmt.Sprintf("Exported code does not run: %s", err))
+	}
+
+	return comparePositions(m.Positions, rm.Positions, epsilon)
+}
+
+// Reduces a position stack to the moves that take effect.
+func effectiveMoves(positions []vm.Position, epsilon float64) []vm.Position {
+	var (
+		res  []vm.Position
+		last = vm.Position{State: vm.NewState()}
+	)
+	for _, p := range positions {
+		switch p.State.MoveMode {
+		case vm.MoveModeNone:
+			continue
+		case vm.MoveModeDwell:
+			res = append(res, p)
+			continue
+		}
+		if math.Abs(p.X-last.X) <= epsilon && math.Abs(p.Y-last.Y) <= epsilon && math.Abs(p.Z-last.Z) <= epsilon {
+			continue
+		}
+		res = append(res, p)
+		last = p
+	}
+	return res
+}
+
+// Extracts the order of toolchanges.
+func toolSequence(positions []vm.Position) []int {
+	var res []int
+	last := vm.NewState().ToolIndex
+	for _, p := range positions {
+		if p.State.ToolIndex != last {
+			res = append(res, p.State.ToolIndex)
+			last = p.State.ToolIndex
+		}
+	}
+	return res
+}
+
+func comparePositions(original, result []vm.Position, epsilon float64) error {
+	var diffs []string
+	report := func(format string, args ...interface{}) {
+		diffs = append(diffs, fmt.Sprintf(format, args...))
+	}
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) <= epsilon
+	}
+
+	ot, rt := toolSequence(original), toolSequence(result)
+	if fmt.Sprint(ot) != fmt.Sprint(rt) {
+		report("toolchange order %v, exported %v", ot, rt)
+	}
+
+	om, rm := effectiveMoves(original, epsilon), effectiveMoves(result, epsilon)
+	if len(om) != len(rm) {
+		report("%d moves, exported %d", len(om), len(rm))
+	}
+
+	var prev vm.Position
+	for idx := 0; idx < len(om) && idx < len(rm) && len(diffs) < maxVerifyDifferences; idx++ {
+		o, r := om[idx], rm[idx]
+		ostate, rstate := o.State, r.State
+
+		if ostate.MoveMode != rstate.MoveMode {
+			report("move %d: move mode %d, exported %d", idx, ostate.MoveMode, rstate.MoveMode)
+			continue
+		}
+
+		if ostate.MoveMode == vm.MoveModeDwell {
+			if !near(ostate.DwellTime, rstate.DwellTime) {
+				report("move %d: dwell %g, exported %g", idx, ostate.DwellTime, rstate.DwellTime)
+			}
+			continue
+		}
+
+		if !near(o.X, r.X) || !near(o.Y, r.Y) || !near(o.Z, r.Z) {
+			report("move %d: position %g, %g, %g, exported %g, %g, %g", idx, o.X, o.Y, o.Z, r.X, r.Y, r.Z)
+		}
+
+		// Centers are exported relative to the start, so may be off by twice the precision
+		if ostate.MoveMode == vm.MoveModeCWArc || ostate.MoveMode == vm.MoveModeCCWArc {
+			if math.Abs(o.Center.X-r.Center.X) > 2*epsilon || math.Abs(o.Center.Y-r.Center.Y) > 2*epsilon {
+				report("move %d: arc center %g, %g, exported %g, %g", idx, o.Center.X, o.Center.Y, r.Center.X, r.Center.Y)
+			}
+		}
+
+		cutting := ostate.MoveMode != vm.MoveModeRapid && !isRetract(prev, o)
+		prev = o
+		if !cutting {
+			continue
+		}
+
+		if !near(ostate.Feedrate, rstate.Feedrate) {
+			report("move %d: feedrate %g, exported %g", idx, ostate.Feedrate, rstate.Feedrate)
+		}
+		if ostate.SpindleEnabled != rstate.SpindleEnabled || (ostate.SpindleEnabled &&
+			(ostate.SpindleClockwise != rstate.SpindleClockwise || !near(ostate.SpindleSpeed, rstate.SpindleSpeed))) {
+			report("move %d: spindle state differs", idx)
+		}
+		if ostate.FloodCoolant != rstate.FloodCoolant || ostate.MistCoolant != rstate.MistCoolant || ostate.Coolant != rstate.Coolant {
+			report("move %d: coolant state differs", idx)
+		}
+		if ostate.ToolIndex != rstate.ToolIndex {
+			report("move %d: tool %d, exported %d", idx, ostate.ToolIndex, rstate.ToolIndex)
+		}
+	}
+
+	if len(diffs) > 0 {
+		return errors.New(fmt.Sprintf("Round-trip verification failed:\n   %s", strings.Join(diffs, "\n   ")))
+	}
+	return nil
+}
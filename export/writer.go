@@ -0,0 +1,86 @@
+package export
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "bufio"
+import "io"
+
+//
+// Writer code generator
+//
+// Used for exporting VM state as a gcode string to an io.Writer, writing
+// lines as they are done with rather than holding the whole program like the
+// StringCodeGenerator. The output is the same as that of the
+// StringCodeGenerator, and is complete once Close is called.
+//
+// Notes:
+//   Lines are held back until the next position, as the annotations of the
+//   source are put in before them, and the last line is held back until
+//   Close, as a toolchange can rewrite it
+//
+
+type WriterGenerator struct {
+	StringCodeGenerator
+	Writer io.Writer
+
+	w       *bufio.Writer
+	written bool  // Whether a line has been written, to separate the next by a newline
+	err     error // First error from Writer
+}
+
+// Initializes state, and puts in a header block.
+func (s *WriterGenerator) Init() {
+	s.StringCodeGenerator.Init()
+	s.w = bufio.NewWriter(s.Writer)
+	s.written = false
+	s.err = nil
+}
+
+// Writes lines, separated by newlines. Errors are kept for Close.
+func (s *WriterGenerator) write(lines []string) {
+	for _, l := range lines {
+		if s.err != nil {
+			return
+		}
+		if s.written {
+			_, s.err = s.w.WriteString("\n")
+		}
+		if s.err == nil {
+			_, s.err = s.w.WriteString(l)
+		}
+		s.written = true
+	}
+}
+
+// Sets the current position, and writes the lines before it.
+func (s *WriterGenerator) SetPosition(pos vm.Position) {
+	s.StringCodeGenerator.SetPosition(pos)
+
+	n := s.mark
+	if n > len(s.Lines)-1 {
+		n = len(s.Lines) - 1
+	}
+	if n <= 0 {
+		return
+	}
+	s.write(s.Lines[:n])
+	s.Lines = append(s.Lines[:0], s.Lines[n:]...)
+	s.mark -= n
+
+	if s.err != nil {
+		// Stop the export, rather than generating code that goes nowhere
+		panic(s.err)
+	}
+}
+
+// Writes the remaining lines and the trailer, and flushes the output. The
+// Writer itself is not closed.
+func (s *WriterGenerator) Close() error {
+	s.write(s.Lines)
+	s.write(s.trailer())
+	s.Lines = nil
+	s.mark = 0
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	return s.err
+}
@@ -85,6 +85,7 @@ func (f *Filemarker) Export(precision int) string {
 type Block struct {
 	Nodes       []Node
 	BlockDelete bool
+	Source      string // Text of the line the block was parsed from, without line ending. Not updated when Nodes change
 }
 
 // Append a node to the block.
@@ -232,6 +233,21 @@ func (doc *Document) Export(precision int) string {
 	return strings.Join(l, "\n")
 }
 
+// Exports the document as it was read, using the source text of blocks that
+// have it, including spacing and deleted blocks, and exporting the others
+// using the provided floating point precision.
+func (doc *Document) ExportSource(precision int) string {
+	l := make([]string, len(doc.Blocks))
+	for idx, b := range doc.Blocks {
+		if b.Source != "" {
+			l[idx] = b.Source
+		} else {
+			l[idx] = b.Export(precision)
+		}
+	}
+	return strings.Join(l, "\n")
+}
+
 // Like Export, but uses as many digits as necessary for floating point.
 func (doc *Document) ToString() string {
 	return doc.Export(-1)
@@ -0,0 +1,173 @@
+package gcode
+
+import "strconv"
+import "fmt"
+
+//
+// Expression evaluator
+//
+// Word values may be given as expressions, which are evaluated while parsing:
+//
+//   #5           - numbered parameter
+//   #<depth>     - named parameter
+//   {depth}      - template placeholder, same as #<depth>, but must be defined
+//   [1 + #5 * 2] - arithmetic (+, -, *, /) with the usual precedence
+//
+// Assignments (#5=1, #<depth>=[#5 * 2]) take effect at the end of the block.
+//
+
+// The maximum nesting of brackets and signs in an expression
+const maxExprDepth = 64
+
+type exprParser struct {
+	input  []rune
+	pos    int
+	depth  int
+	params *Parameters
+	fail   func(idx int, err string) string
+}
+
+type paramRef struct {
+	number int
+	name   string
+}
+
+func (e *exprParser) peek() rune {
+	for e.pos < len(e.input) && (e.input[e.pos] == ' ' || e.input[e.pos] == '\t') {
+		e.pos++
+	}
+	if e.pos >= len(e.input) {
+		return 0
+	}
+	return e.input[e.pos]
+}
+
+func (e *exprParser) expect(c rune) {
+	if e.peek() != c {
+		e.fail(e.pos, fmt.Sprintf("Expected [%c] in expression", c))
+	}
+	e.pos++
+}
+
+// Reads until the terminator, which is consumed.
+func (e *exprParser) readUntil(term rune) string {
+	start := e.pos
+	for e.pos < len(e.input) && e.input[e.pos] != term {
+		if e.input[e.pos] == '\n' {
+			e.fail(e.pos, fmt.Sprintf("Expected [%c] before end of line", term))
+		}
+		e.pos++
+	}
+	if e.pos >= len(e.input) {
+		e.fail(start, fmt.Sprintf("Expected [%c]", term))
+	}
+	s := string(e.input[start:e.pos])
+	e.pos++
+	return s
+}
+
+func (e *exprParser) number() float64 {
+	start := e.pos
+	for e.pos < len(e.input) {
+		c := e.input[e.pos]
+		if (c < '0' || c > '9') && c != '.' {
+			break
+		}
+		e.pos++
+	}
+	if start == e.pos {
+		e.fail(start, "Expected number in expression")
+	}
+	f, err := strconv.ParseFloat(string(e.input[start:e.pos]), 64)
+	if err != nil {
+		e.fail(start, fmt.Sprintf("Invalid number in expression: %s", err))
+	}
+	return f
+}
+
+// Parses a parameter reference, starting at '#'.
+func (e *exprParser) reference() paramRef {
+	e.expect('#')
+	if e.peek() == '<' {
+		e.pos++
+		return paramRef{name: e.readUntil('>')}
+	}
+	return paramRef{number: int(e.number())}
+}
+
+func (e *exprParser) lookup(ref paramRef) float64 {
+	if ref.name == "" {
+		return e.params.GetNumbered(ref.number)
+	}
+	v, ok := e.params.GetNamed(ref.name)
+	if !ok {
+		e.fail(e.pos, fmt.Sprintf("Undefined parameter <%s>", ref.name))
+	}
+	return v
+}
+
+// Parses a single value: a number, parameter, placeholder or bracketed expression.
+func (e *exprParser) value() float64 {
+	e.depth++
+	defer func() { e.depth-- }()
+	if e.depth > maxExprDepth {
+		e.fail(e.pos, "Expression nested too deeply")
+	}
+
+	switch c := e.peek(); {
+	case c == '-':
+		e.pos++
+		return -e.value()
+	case c == '+':
+		e.pos++
+		return e.value()
+	case c == '#':
+		return e.lookup(e.reference())
+	case c == '{':
+		e.pos++
+		return e.lookup(paramRef{name: e.readUntil('}')})
+	case c == '[':
+		e.pos++
+		v := e.expression()
+		e.expect(']')
+		return v
+	default:
+		return e.number()
+	}
+}
+
+func (e *exprParser) term() float64 {
+	v := e.value()
+	for {
+		switch e.peek() {
+		case '*':
+			e.pos++
+			v *= e.value()
+		case '/':
+			e.pos++
+			d := e.value()
+			if d == 0 {
+				e.fail(e.pos, "Division by zero in expression")
+			}
+			v /= d
+		default:
+			return v
+		}
+	}
+}
+
+func (e *exprParser) expression() float64 {
+	v := e.term()
+	for {
+		switch e.peek() {
+		case '+':
+			e.pos++
+			v += e.term()
+		case '-':
+			e.pos++
+			v -= e.term()
+		default:
+			return v
+		}
+	}
+}
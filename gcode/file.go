@@ -0,0 +1,103 @@
+package gcode
+
+import "archive/zip"
+import "compress/gzip"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "errors"
+import "fmt"
+
+// Reads the archive entry, and closes the archive along with it.
+type zipEntry struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (z *zipEntry) Close() error {
+	err := z.ReadCloser.Close()
+	if aerr := z.archive.Close(); err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// Reads the gzip stream, and closes the file along with it.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if ferr := g.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// Opens a file for reading, decompressing it if it is gzipped (.gz) or a zip
+// archive (.zip), which must hold a single file. Returns the name of the
+// content, which is the name without .gz, or the name of the file in the
+// archive.
+func OpenFile(name string) (io.ReadCloser, string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz":
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, "", err
+		}
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, "", errors.New(fmt.Sprintf("%s: %s", name, err))
+		}
+		return &gzipFile{r, f}, name[:len(name)-len(".gz")], nil
+
+	case ".zip":
+		archive, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, "", err
+		}
+		var files []*zip.File
+		for _, f := range archive.File {
+			if !f.FileInfo().IsDir() {
+				files = append(files, f)
+			}
+		}
+		if len(files) != 1 {
+			archive.Close()
+			return nil, "", errors.New(fmt.Sprintf("%s: Archive holds %d files, expected 1", name, len(files)))
+		}
+		r, err := files[0].Open()
+		if err != nil {
+			archive.Close()
+			return nil, "", errors.New(fmt.Sprintf("%s: %s", name, err))
+		}
+		return &zipEntry{r, archive}, files[0].Name, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, name, nil
+}
+
+// Reads a file, decompressing it as OpenFile. Returns the content and its
+// name.
+func ReadFile(name string) (string, string, error) {
+	r, content, err := OpenFile(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("%s: %s", name, err))
+	}
+	return string(b), content, nil
+}
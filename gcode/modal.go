@@ -21,6 +21,8 @@ var (
 			&Word{'G', 1},
 			&Word{'G', 2},
 			&Word{'G', 3},
+			&Word{'G', 5},
+			&Word{'G', 5.1},
 			&Word{'G', 33},
 			&Word{'G', 38.2},
 			&Word{'G', 38.3},
@@ -0,0 +1,88 @@
+package gcode
+
+import "io"
+import "bufio"
+import "sort"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// A store of numbered (#5) and named (#<depth>) parameters.
+type Parameters struct {
+	Numbered map[int]float64
+	Named    map[string]float64
+}
+
+// NewParameters returns an empty parameter store.
+func NewParameters() *Parameters {
+	return &Parameters{
+		Numbered: make(map[int]float64),
+		Named:    make(map[string]float64),
+	}
+}
+
+// Names are case-insensitive, and ignore whitespace.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "", -1))
+}
+
+// Sets a parameter by key. Numeric keys set numbered parameters, anything
+// else sets named parameters.
+func (p *Parameters) Set(key string, value float64) {
+	if n, err := strconv.Atoi(key); err == nil {
+		p.Numbered[n] = value
+	} else {
+		p.Named[normalizeName(key)] = value
+	}
+}
+
+// Retrieves a numbered parameter. Unset parameters are 0.
+func (p *Parameters) GetNumbered(n int) float64 {
+	return p.Numbered[n]
+}
+
+// Retrieves a named parameter.
+func (p *Parameters) GetNamed(name string) (float64, bool) {
+	v, ok := p.Named[normalizeName(name)]
+	return v, ok
+}
+
+// Reads parameters from a LinuxCNC variable file (lines of "number value").
+func (p *Parameters) ReadVar(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return errors.New(fmt.Sprintf("Line %d: expected parameter and value", line))
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Line %d: invalid value: %s", line, err))
+		}
+		p.Set(strings.Trim(fields[0], "#<>"), v)
+	}
+	return scanner.Err()
+}
+
+// Writes all numbered parameters in LinuxCNC variable file format.
+func (p *Parameters) WriteVar(w io.Writer) error {
+	keys := make([]int, 0, len(p.Numbered))
+	for k := range p.Numbered {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	bw := bufio.NewWriter(w)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(bw, "%d\t%f\n", k, p.Numbered[k]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
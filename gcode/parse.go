@@ -3,9 +3,54 @@ package gcode
 import "fmt"
 import "errors"
 import "strconv"
+import "strings"
+import "unicode"
 
-// Parses a string, and returns an AST.
+// Parses a string, and returns an AST. Malformed input is an error, as with
+// ParseStrict.
 func Parse(input string) (doc *Document, err error) {
+	return ParseWithParameters(input, NewParameters())
+}
+
+// Parses a string, and returns an AST. Any malformed input is an error,
+// including control characters outside comments. A "(" in a comment is part
+// of it, and the comment ends at the first ")".
+func ParseStrict(input string) (doc *Document, err error) {
+	return ParseWithParameters(input, NewParameters())
+}
+
+// Parses a string, and returns an AST. Control characters outside comments
+// are skipped, comments may be nested, comments not terminated at the end of
+// the line are terminated there, and stray ")" and "/" are ignored. Words
+// without a valid number are still an error, as guessing them would move the
+// machine somewhere else.
+func ParseLenient(input string) (doc *Document, err error) {
+	return ParseLenientWithParameters(input, NewParameters())
+}
+
+// Parses a string, evaluating parameters and expressions against params, and
+// returns an AST. Assignments in the input update params.
+func ParseWithParameters(input string, params *Parameters) (doc *Document, err error) {
+	return parse(input, params, false)
+}
+
+// Like ParseWithParameters, but recovers from malformed input like ParseLenient.
+func ParseLenientWithParameters(input string, params *Parameters) (doc *Document, err error) {
+	return parse(input, params, true)
+}
+
+// The maximum number of characters of an invalid number reported
+const maxNumberReport = 20
+
+// Returns the character for error messages, or its code if it is not printable.
+func printable(c rune) string {
+	if unicode.IsPrint(c) {
+		return string(c)
+	}
+	return fmt.Sprintf("%U", c)
+}
+
+func parse(input string, params *Parameters, lenient bool) (doc *Document, err error) {
 
 	const (
 		normal     = iota
@@ -19,11 +64,16 @@ func Parse(input string) (doc *Document, err error) {
 		curBlock    Block = Block{}
 		state       int   = normal
 		lastNewline int   = 0
-		buffer      string
+		buffer      []rune
 		address     rune
+		depth       int // Depth of nested comments
+		lineStart   int // Index of the first character of the line
+		skip        int
+		assignments []func()
 	)
 
 	input += "\n"
+	runes := []rune(input)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -33,7 +83,7 @@ func Parse(input string) (doc *Document, err error) {
 
 	parserPanic := func(idx int, err string) string {
 		nl := 0
-		for idy, s := range input {
+		for idy, s := range runes {
 			if idy == idx {
 				break
 			} else if s == '\n' {
@@ -43,13 +93,17 @@ func Parse(input string) (doc *Document, err error) {
 		panic(fmt.Sprintf("Line %d, pos %d: %s", nl, idx-lastNewline+1, err))
 	}
 
+	newExprParser := func(idx int) *exprParser {
+		return &exprParser{input: runes, pos: idx, params: params, fail: parserPanic}
+	}
+
 	parseNormal := func(c rune, idx int) {
 		switch c {
 		case '/':
 			if idx-lastNewline == 0 {
 				curBlock.BlockDelete = true
 				lastNewline--
-			} else {
+			} else if !lenient {
 				parserPanic(idx, "Unexpected /")
 			}
 		case '%':
@@ -57,16 +111,40 @@ func Parse(input string) (doc *Document, err error) {
 			curBlock.AppendNode(&fm)
 		case '(':
 			state = comment
+			depth = 1
+		case ')':
+			if !lenient {
+				parserPanic(idx, "Unexpected )")
+			}
 		case ';':
 			state = eolcomment
+		case '#':
+			// Parameter assignment
+			e := newExprParser(idx)
+			ref := e.reference()
+			e.expect('=')
+			v := e.value()
+			skip = e.pos - idx - 1
+			assignments = append(assignments, func() {
+				if ref.name == "" {
+					params.Numbered[ref.number] = v
+				} else {
+					params.Named[normalizeName(ref.name)] = v
+				}
+			})
 		case '\n':
+			// Assignments on a line take effect after the line is read
+			for _, a := range assignments {
+				a()
+			}
+			assignments = nil
+
+			curBlock.Source = strings.TrimSuffix(string(runes[lineStart:idx]), "\r")
 			document.AppendBlock(curBlock)
 			curBlock = Block{}
 			lastNewline = idx + 1
-		case '\r':
-			// Ignore
-			return
-		case ' ':
+			lineStart = idx + 1
+		case ' ', '\t', '\r':
 			// Ignore
 			return
 		default:
@@ -78,24 +156,46 @@ func Parse(input string) (doc *Document, err error) {
 				// Upper-case character, @ or ^
 				state = word
 				address = c
-			} else {
+			} else if !lenient || !unicode.IsControl(c) {
 				// No clue
-				parserPanic(idx, fmt.Sprintf("Expected word address, found [%c]", c))
+				parserPanic(idx, fmt.Sprintf("Expected word address, found [%s]", printable(c)))
 			}
 		}
 	}
 
 	parseComment := func(c rune, idx int) {
 		switch c {
+		case '(':
+			if lenient {
+				depth++
+			}
+			buffer = append(buffer, c)
 		case ')':
+			depth--
+			if depth > 0 {
+				buffer = append(buffer, c)
+				return
+			}
 			state = normal
-			cm := Comment{buffer, false}
+			cm := Comment{string(buffer), false}
 			curBlock.AppendNode(&cm)
-			buffer = ""
+			buffer = buffer[:0]
 		case '\n':
-			parserPanic(idx, "Non-terminated comment")
+			if !lenient {
+				parserPanic(idx, "Non-terminated comment")
+			}
+			state = normal
+			cm := Comment{string(buffer), false}
+			curBlock.AppendNode(&cm)
+			buffer = buffer[:0]
+			parseNormal(c, idx)
+		case '\r':
+			// Ignore
 		default:
-			buffer += string(c)
+			if lenient && unicode.IsControl(c) {
+				return
+			}
+			buffer = append(buffer, c)
 		}
 	}
 
@@ -103,34 +203,66 @@ func Parse(input string) (doc *Document, err error) {
 		switch c {
 		case '\n':
 			state = normal
-			cm := Comment{buffer, true}
+			cm := Comment{string(buffer), true}
 			curBlock.AppendNode(&cm)
-			buffer = ""
+			buffer = buffer[:0]
 			parseNormal(c, idx)
+		case '\r':
+			// Ignore
 		default:
-			buffer += string(c)
+			if lenient && unicode.IsControl(c) {
+				return
+			}
+			buffer = append(buffer, c)
 		}
 	}
 
 	parseWord := func(c rune, idx int) {
-		if (c >= 48 && c <= 57) || c == 46 || c == 45 || c == 43 {
+		signOnly := len(buffer) == 0 || (len(buffer) == 1 && (buffer[0] == '-' || buffer[0] == '+'))
+		if (c == '#' || c == '[' || c == '{') && signOnly {
+			// Expression
+			e := newExprParser(idx)
+			v := e.value()
+			if len(buffer) == 1 && buffer[0] == '-' {
+				v = -v
+			}
+			skip = e.pos - idx - 1
+			state = normal
+			w := Word{address, v}
+			curBlock.AppendNode(&w)
+			buffer = buffer[:0]
+		} else if (c >= 48 && c <= 57) || c == 46 || c == 45 || c == 43 {
 			// [0-9\.\-\+]
-			buffer += string(c)
+			buffer = append(buffer, c)
+		} else if c == ' ' || c == '\t' {
+			// Spaces are allowed anywhere in a word
+			return
 		} else {
 			if len(buffer) == 0 {
-				parserPanic(idx, fmt.Sprintf("Expected word command, found [%c]", c))
+				parserPanic(idx, fmt.Sprintf("Expected word command, found [%s]", printable(c)))
 			}
 			// End of command
 			state = normal
-			f, _ := strconv.ParseFloat(string(buffer), 64)
+			f, err := strconv.ParseFloat(string(buffer), 64)
+			if err != nil {
+				number := string(buffer)
+				if len(buffer) > maxNumberReport {
+					number = string(buffer[:maxNumberReport]) + "..."
+				}
+				parserPanic(idx-1, fmt.Sprintf("Invalid number [%c%s]: %s", address, number, err.(*strconv.NumError).Err))
+			}
 			w := Word{address, f}
 			curBlock.AppendNode(&w)
-			buffer = ""
+			buffer = buffer[:0]
 			parseNormal(c, idx)
 		}
 	}
 
-	for idx, c := range input {
+	for idx, c := range runes {
+		if skip > 0 {
+			skip--
+			continue
+		}
 		switch state {
 		case normal:
 			parseNormal(c, idx)
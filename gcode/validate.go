@@ -0,0 +1,261 @@
+package gcode
+
+import "sort"
+import "fmt"
+
+// A problem found in a block by Validate.
+type Diagnostic struct {
+	Line    int   // Line of the block, counting from 1
+	Word    *Word // The word the problem was found at, if any
+	Message string
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("Line %d: %s", d.Line, d.Message)
+}
+
+// Axis words, which are used by motion and some non-modal commands
+var axisWords = []rune{'X', 'Y', 'Z', 'A', 'B', 'C', 'U', 'V', 'W'}
+
+// Non-modal commands using the axis words of their block
+var axisCommands = sliceOfWords{&Word{'G', 10}, &Word{'G', 28}, &Word{'G', 30}, &Word{'G', 92}}
+
+// Arc offset words by plane (G17, G18, G19)
+var planeOffsets = map[float64][]rune{17: {'I', 'J'}, 18: {'I', 'K'}, 19: {'J', 'K'}}
+
+// Checks each block for words from the same modal group, repeated words,
+// commands missing the words they require, and axis words without a motion
+// mode to use them, following the motion mode and plane through the
+// document. Diagnostics are returned in the order of the blocks, and the
+// document is not changed.
+//
+// Only the structure of blocks is checked, so a valid document can still be
+// rejected by the VM, such as for arcs with inconsistent radii.
+func Validate(doc *Document) []Diagnostic {
+	var (
+		diags  []Diagnostic
+		motion float64 = 80 // Motion mode, starting without one like the VM
+		plane  float64 = 17
+		names  []string
+	)
+
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for idx := range doc.Blocks {
+		b := &doc.Blocks[idx]
+		report := func(w *Word, format string, args ...interface{}) {
+			diags = append(diags, Diagnostic{Line: idx + 1, Word: w, Message: fmt.Sprintf(format, args...)})
+		}
+
+		// Modal group conflicts
+		for _, name := range names {
+			var found []*Word
+			for _, n := range b.Nodes {
+				if w, ok := n.(*Word); ok && groups[name].isInGroup(w) {
+					found = append(found, w)
+				}
+			}
+			if len(found) > 1 {
+				report(found[1], "Multiple words from the same modal group (%s): %s and %s", name, found[0].Export(-1), found[1].Export(-1))
+			}
+		}
+
+		// Repeated words, other than G and M words from different groups
+		seen := make(map[rune]bool)
+		for _, n := range b.Nodes {
+			if w, ok := n.(*Word); ok && w.Address != 'G' && w.Address != 'M' {
+				if seen[w.Address] {
+					report(w, "Multiple %c words", w.Address)
+				}
+				seen[w.Address] = true
+			}
+		}
+
+		has := func(addresses ...rune) bool {
+			for _, a := range addresses {
+				if seen[a] {
+					return true
+				}
+			}
+			return false
+		}
+
+		// The block is not checked further if it is ambiguous
+		motionWord, err := b.GetModalGroup("motionGroup")
+		if err != nil {
+			continue
+		}
+		nonModal, err := b.GetModalGroup("nonModalGroup")
+		if err != nil {
+			continue
+		}
+		if w, err := b.GetModalGroup("planeSelectionGroup"); err == nil && w != nil {
+			plane = float64(int(w.Command))
+		}
+
+		usesAxes := nonModal != nil && axisCommands.isInGroup(nonModal)
+		if motionWord != nil {
+			if motionWord.Command != 80 && usesAxes && has(axisWords...) {
+				report(motionWord, "Axis words used by both %s and %s", nonModal.Export(-1), motionWord.Export(-1))
+			}
+			motion = motionWord.Command
+		}
+
+		// Required words
+		if nonModal != nil {
+			switch nonModal.Command {
+			case 4:
+				if !has('P') {
+					report(nonModal, "G4 without P word")
+				}
+			case 10:
+				if !has('L') || !has('P') {
+					report(nonModal, "G10 without L and P words")
+				}
+			case 92:
+				if !has(axisWords...) {
+					report(nonModal, "G92 without axis words")
+				}
+			}
+		}
+
+		if usesAxes {
+			continue
+		}
+		if (motion == 2 || motion == 3) && (motionWord != nil || has(axisWords...)) {
+			offsets := planeOffsets[plane]
+			switch {
+			case has('R') && has('I', 'J', 'K'):
+				report(motionWord, "G%g with both R and I, J or K words", motion)
+			case !has('R') && !has(offsets...):
+				report(motionWord, "G%g without %c, %c or R words", motion, offsets[0], offsets[1])
+			}
+		}
+		if (motion == 5 || motion == 5.1) && (motionWord != nil || has(axisWords...)) {
+			switch {
+			case plane != 17:
+				report(motionWord, "G%g outside the XY plane", motion)
+			case motion == 5 && (!has('P') || !has('Q')):
+				report(motionWord, "G5 without P and Q words")
+			case motion == 5.1 && (!has('I') || !has('J')):
+				report(motionWord, "G5.1 without I and J words")
+			}
+		}
+		if motion >= 38 && motion < 39 && motionWord != nil && !has(axisWords...) {
+			report(motionWord, "G%g without axis words", motion)
+		}
+		if motion == 80 && has(axisWords...) {
+			if motionWord != nil {
+				report(motionWord, "Axis words with G80")
+			} else {
+				report(nil, "Axis words without a motion mode")
+			}
+		}
+	}
+	return diags
+}
+
+// A modal group a move relies on, with the mode the VM assumes until a
+// program sets one.
+type initialMode struct {
+	group string
+	name  string
+	mode  string
+	used  func(motion float64) bool // Whether moves of a motion mode rely on it
+}
+
+func anyMotion(motion float64) bool {
+	return true
+}
+
+func feedMotion(motion float64) bool {
+	return motion != 0
+}
+
+func planeMotion(motion float64) bool {
+	return motion == 2 || motion == 3 || motion == 5 || motion == 5.1 || motion == 73 || motion > 80
+}
+
+// The modes put in by a safe preamble, in order
+var initialModes = []initialMode{
+	{"planeSelectionGroup", "plane", "G17", planeMotion},
+	{"unitsGroup", "units", "G21", anyMotion},
+	{"distanceModeGroup", "distance mode", "G90", anyMotion},
+	{"feedRateModeGroup", "feed rate mode", "G94", feedMotion},
+	{"cutterCompensationModeGroup", "cutter compensation", "G40", anyMotion},
+	{"toolLengthGroup", "tool length offset", "G49", anyMotion},
+	{"coordinateSystemGroup", "coordinate system", "G54", anyMotion},
+}
+
+// Checks that the document sets the modes its moves rely on before the first
+// of them, rather than relying on the state a previous program left the
+// controller in. Each mode relied on is reported once, at the first move
+// relying on it. Spindle and coolant are not checked, as moves run with
+// either off.
+//
+// Blocks are expected to pass Validate; those with words from the same modal
+// group are skipped.
+func ValidateInitialState(doc *Document) []Diagnostic {
+	var (
+		diags  []Diagnostic
+		motion float64 = 80
+		set            = make(map[string]bool)
+	)
+
+	for idx := range doc.Blocks {
+		b := &doc.Blocks[idx]
+		motionWord, err := b.GetModalGroup("motionGroup")
+		if err != nil {
+			continue
+		}
+		nonModal, err := b.GetModalGroup("nonModalGroup")
+		if err != nil {
+			continue
+		}
+		if motionWord != nil {
+			motion = motionWord.Command
+		}
+
+		// Modes set in a block apply to its move
+		for _, m := range initialModes {
+			if w, err := b.GetModalGroup(m.group); err == nil && w != nil {
+				set[m.group] = true
+			}
+		}
+
+		moves := false
+		for _, n := range b.Nodes {
+			if w, ok := n.(*Word); ok {
+				for _, a := range axisWords {
+					moves = moves || w.Address == a
+				}
+			}
+		}
+		if !moves {
+			continue
+		}
+
+		// G28 and G30 move at rapid speed through the given point, while the
+		// other non-modal commands use the axis words for settings
+		used := motion
+		if nonModal != nil && axisCommands.isInGroup(nonModal) {
+			if nonModal.Command != 28 && nonModal.Command != 30 {
+				continue
+			}
+			used = 0
+		} else if motion == 80 {
+			continue
+		}
+
+		for _, m := range initialModes {
+			if !set[m.group] && m.used(used) {
+				diags = append(diags, Diagnostic{Line: idx + 1, Message: fmt.Sprintf("Move before the %s is set, relying on %s", m.name, m.mode)})
+				set[m.group] = true
+			}
+		}
+	}
+	return diags
+}
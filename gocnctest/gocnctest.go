@@ -0,0 +1,195 @@
+package gocnctest
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/export"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "flag"
+import "math"
+import "strings"
+import "testing"
+import "errors"
+import "fmt"
+
+//
+// Golden file regression harness
+//
+// Runs programs through parsing, the VM, optimization and export, and
+// compares the output against golden files, with a tolerance for the
+// numbers, so that changes to the numeric passes show up as differences.
+//
+// Notes:
+//   Golden files are rewritten rather than compared against when tests are
+//   run with -gocnc.update
+//
+
+var update = flag.Bool("gocnc.update", false, "Rewrite golden files instead of comparing against them")
+
+// The maximum number of differences reported by Compare
+const maxDifferences = 10
+
+// The steps a program is run through.
+type Pipeline struct {
+	Setup     func(*vm.Machine) // Called on the machine before running the program, such as to set KeepArcs or the tool table
+	Optimize  func(*vm.Machine) // Optimization passes, if any
+	Precision int               // Precision of the exported code
+}
+
+// Runs the program through the pipeline, returning the exported code.
+func (p Pipeline) Run(code string) (string, error) {
+	document, err := gcode.Parse(code)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Parse error: %s", err))
+	}
+
+	var m vm.Machine
+	m.Init()
+	if p.Setup != nil {
+		p.Setup(&m)
+	}
+	if err := m.Process(document); err != nil {
+		return "", errors.New(fmt.Sprintf("VM failed: %s", err))
+	}
+	if p.Optimize != nil {
+		p.Optimize(&m)
+	}
+
+	g := export.StringCodeGenerator{Precision: p.Precision}
+	g.Init()
+	if err := export.HandleAllPositions(&m, &g); err != nil {
+		return "", errors.New(fmt.Sprintf("Export failed: %s", err))
+	}
+	return g.Retrieve(), nil
+}
+
+// Returns whether two blocks differ, comparing numbers within tolerance.
+func blockDiffers(got, want gcode.Block, tolerance float64) bool {
+	if len(got.Nodes) != len(want.Nodes) || got.BlockDelete != want.BlockDelete {
+		return true
+	}
+	for idx, node := range got.Nodes {
+		switch n := node.(type) {
+		case *gcode.Word:
+			w, ok := want.Nodes[idx].(*gcode.Word)
+			if !ok || n.Address != w.Address || math.Abs(n.Command-w.Command) > tolerance {
+				return true
+			}
+		case *gcode.Comment:
+			c, ok := want.Nodes[idx].(*gcode.Comment)
+			if !ok || n.Content != c.Content {
+				return true
+			}
+		default:
+			if node.GetType() != want.Nodes[idx].GetType() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A block along with the line it is on.
+type line struct {
+	gcode.Block
+	number int
+}
+
+// Returns the non-empty blocks of a document.
+func lines(doc *gcode.Document) []line {
+	var res []line
+	for idx, b := range doc.Blocks {
+		if len(b.Nodes) > 0 {
+			res = append(res, line{b, idx + 1})
+		}
+	}
+	return res
+}
+
+// Compares code word by word, allowing numbers to differ by tolerance.
+// Formatting, such as spacing, the number of digits and empty lines, is not
+// compared. Differences are reported by the line in got, or in want where got
+// ended early.
+func Compare(got, want string, tolerance float64) error {
+	gotDoc, err := gcode.Parse(got)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Output does not parse: %s", err))
+	}
+	wantDoc, err := gcode.Parse(want)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Golden code does not parse: %s", err))
+	}
+
+	var (
+		diffs     []string
+		gotLines  = lines(gotDoc)
+		wantLines = lines(wantDoc)
+	)
+	for idx := 0; idx < len(gotLines) || idx < len(wantLines); idx++ {
+		var (
+			g, w   string
+			number int
+		)
+		switch {
+		case idx >= len(gotLines):
+			w, number = wantLines[idx].Export(-1), wantLines[idx].number
+		case idx >= len(wantLines):
+			g, number = gotLines[idx].Export(-1), gotLines[idx].number
+		case blockDiffers(gotLines[idx].Block, wantLines[idx].Block, tolerance):
+			g, w, number = gotLines[idx].Export(-1), wantLines[idx].Export(-1), gotLines[idx].number
+		default:
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("line %d: got \"%s\", want \"%s\"", number, g, w))
+		if len(diffs) == maxDifferences {
+			break
+		}
+	}
+
+	if len(diffs) > 0 {
+		return errors.New(strings.Join(diffs, "\n"))
+	}
+	return nil
+}
+
+// Runs the program through the pipeline, and compares the output against the
+// golden file at path, allowing numbers to differ by tolerance. The test
+// fails on any difference. When run with -gocnc.update, the golden file is
+// written instead.
+func (p Pipeline) Golden(t testing.TB, path, code string, tolerance float64) {
+	t.Helper()
+	got, err := p.Run(code)
+	if err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: %s (run with -gocnc.update to create it)", path, err)
+	}
+	if err := Compare(got, string(want), tolerance); err != nil {
+		t.Errorf("%s differs from golden file:\n%s", path, err)
+	}
+}
+
+// Like Golden, but reads the program from a file, and keeps the golden file
+// next to it, with ".golden" appended to its name.
+func (p Pipeline) GoldenFile(t testing.TB, path string, tolerance float64) {
+	t.Helper()
+	code, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	p.Golden(t, path+".golden", string(code), tolerance)
+}
@@ -3,33 +3,142 @@ package main
 import "github.com/kennylevinsen/gocnc/gcode"
 import "github.com/kennylevinsen/gocnc/vm"
 import "github.com/kennylevinsen/gocnc/optimize"
+import "github.com/kennylevinsen/gocnc/cam"
+import "github.com/kennylevinsen/gocnc/sim"
+import "github.com/kennylevinsen/gocnc/vector"
 import "github.com/kennylevinsen/gocnc/export"
 import "github.com/kennylevinsen/gocnc/streaming"
 import "github.com/cheggaaa/pb"
 import "github.com/alecthomas/kingpin"
 
+import "io"
 import "io/ioutil"
 import "bufio"
+import "bytes"
 
 import "fmt"
 import "os"
 
 import "time"
+import "math"
 import "strconv"
+import "errors"
+import "strings"
+import "sort"
+import "path/filepath"
 
 var (
-	inputFile  = kingpin.Arg("input", "Input file").Required().ExistingFile()
-	device     = kingpin.Flag("device", "Serial device for gcode").Short('d').ExistingFile()
-	baudrate   = kingpin.Flag("baudrate", "Baudrate for serial device").Short('b').Default("115200").Int()
-	outputFile = kingpin.Flag("output", "Output file for gcode").Short('o').String()
+	inputFiles    = kingpin.Arg("input", "Input files, run one after another").ExistingFiles()
+	device        = kingpin.Flag("device", "Serial device, or tcp://host:port of a serial-to-TCP bridge, for gcode").Short('d').String()
+	baudrate      = kingpin.Flag("baudrate", "Baudrate for serial device").Short('b').Default("115200").Int()
+	simulate      = kingpin.Flag("simulate", "Stream to a simulated Grbl instead of a serial device").Bool()
+	simLatency    = kingpin.Flag("simlatency", "Response latency of the simulated Grbl (ms)").Default("0").Int()
+	simBuffer     = kingpin.Flag("simbuffer", "Planner buffer size of the simulated Grbl (blocks)").Default("15").Int()
+	simSpeed      = kingpin.Flag("simspeed", "Execution speed of the simulated Grbl relative to real time (0 for instant)").Default("0").Float()
+	duet          = kingpin.Flag("duet", "Upload and run the job on a Duet board running RepRapFirmware, at the given address").String()
+	duetPassword  = kingpin.Flag("duetpassword", "Password of the Duet board").String()
+	reprap        = kingpin.Flag("reprap", "Stream to RepRap firmware, such as Marlin or RepRapFirmware, with line numbers and checksums").Bool()
+	grblFix       = kingpin.Flag("grblfix", "Rewrite what Grbl does not support where possible rather than refusing it, such as feeds per revolution, cutter compensation and lines too long for Grbl").Bool()
+	home          = kingpin.Flag("home", "Run the homing cycle before starting ($H, or G28 with --reprap)").Bool()
+	unlock        = kingpin.Flag("unlock", "Clear a Grbl alarm lock before starting, without homing").Bool()
+	outputFile    = kingpin.Flag("output", "Output file for gcode").Short('o').String()
+	postFile      = kingpin.Flag("post", "Post-processor configuration describing the gcode dialect for --output and --stdout").ExistingFile()
+	machOutput    = kingpin.Flag("mach", "Export gcode for Mach3 and Mach4 for --output and --stdout, keeping arcs").Bool()
+	fanucOutput   = kingpin.Flag("fanuc", "Export ISO gcode for Fanuc and Haas for --output and --stdout, with block numbers and % wrappers").Bool()
+	programNumber = kingpin.Flag("program", "Program number (O word) for --fanuc").Default("1").Int()
+	blockStep     = kingpin.Flag("blockstep", "Step of block numbers (N words) for --fanuc").Default("10").Int()
+	maxLines      = kingpin.Flag("maxlines", "Split --output into numbered files of at most this many lines, at moves from the safety height").Int()
+	maxBytes      = kingpin.Flag("maxbytes", "Split --output into numbered files of at most this many bytes, at moves from the safety height").Int()
+	splitTools    = kingpin.Flag("splittools", "Run the job as a job per tool, each with its own setup and return to X0 Y0 Z0, writing --output to a file per tool").Bool()
+	sizeReport    = kingpin.Flag("sizes", "Print the lines and bytes of the exported gcode for each tool").Bool()
+
+	jsonFile      = kingpin.Flag("json", "Output file for the toolpath and its analysis as JSON (- for stdout)").String()
+	csvFile       = kingpin.Flag("csv", "Output file for a move log with one row per position as CSV (- for stdout)").String()
+	previewFile   = kingpin.Flag("preview", "Output file for a top-down PNG preview of the toolpath").String()
+	previewDPI    = kingpin.Flag("previewdpi", "Resolution of the preview (pixels per inch)").Default("100").Float()
+	previewBounds = kingpin.Flag("previewbounds", "Area to preview (minx,miny,maxx,maxy in mm, all moves if unset)").String()
+
+	dumpSettings    = kingpin.Flag("dumpsettings", "Dump Grbl settings to file (- for stdout) and exit").String()
+	restoreSettings = kingpin.Flag("restoresettings", "Restore Grbl settings from file and exit").ExistingFile()
+	jogMode         = kingpin.Flag("jog", "Interactively jog the machine and set work zero, then exit").Bool()
+	jogFeed         = kingpin.Flag("jogfeed", "Feedrate for jogging (mm/min)").Default("500").Float()
+	mdiMode         = kingpin.Flag("mdi", "Interactively run gcode typed in block by block, then exit").Bool()
+	serve           = kingpin.Flag("serve", "Serve an HTTP API for queueing and streaming jobs on the given address, such as :8080 for localhost or 0.0.0.0:8080 for all interfaces").String()
+	serveToken      = kingpin.Flag("servetoken", "Token required by the HTTP API (generated and printed if not given)").String()
 
 	dumpStdout          = kingpin.Flag("stdout", "Dump gcode to stdout").Bool()
 	debugDump           = kingpin.Flag("debugdump", "Dump VM state to stdout").Hidden().Bool()
 	allowRemainingWords = kingpin.Flag("allowremainingwords", "Allow remaining words on block when done parsing").Default("false").Bool()
+	preserve            = kingpin.Flag("preserve", "Keep the comments, empty lines and N words of the input in the gcode output").Bool()
+	validate            = kingpin.Flag("validate", "Check blocks for modal group conflicts and missing words before running them").Bool()
+	safeStart           = kingpin.Flag("safestart", "Start exported gcode, and jobs streamed to Grbl, by setting all modes to their defaults (G17 G21 G90 G94 G40 G49 G54) and stopping the spindle and coolant, warning of moves in the input relying on modes it does not set (not for --reprap and --duet)").Bool()
+	lenientParse        = kingpin.Flag("lenient", "Skip control characters, nest comments, allow unterminated comments, and ignore stray \")\" and \"/\" when parsing").Bool()
 
 	stats       = kingpin.Flag("stats", "Print gcode metrics").Default("true").Bool()
+	report      = kingpin.Flag("report", "Print estimated cutting, rapid and dwell time per tool and per operation").Bool()
+	optReport   = kingpin.Flag("optreport", "Print the moves, distance and time saved by each optimization pass, and any Z excursions it introduced").Bool()
+	verify      = kingpin.Flag("verify", "Verify that plain exported gcode reproduces the toolpath before output, without posts, macros or dialects").Default("false").Bool()
+	finish      = kingpin.Flag("finish", "Print surface finish estimates per operation (requires --tool)").Bool()
+	finishDev   = kingpin.Flag("finishdeviation", "Surface deviation considered a poor finish (mm)").Default("0.01").Float()
+	material    = kingpin.Flag("material", "Check feeds and speeds against the material (wood, mdf, plastic, aluminium, brass or steel, requires --tool)").String()
+	feedFactor  = kingpin.Flag("feedfactor", "How far off the recommended feeds and speeds may be before warning").Default("5").Float()
+	tools       = kingpin.Flag("tool", "Tool table entry (index:diameter[:flutes[:ball]])").Strings()
+	stock       = kingpin.Flag("stock", "Simulate cutting the stock, reporting collisions and gouges (minx,miny,minz,maxx,maxy,maxz in mm)").String()
+	stockRes    = kingpin.Flag("stockres", "Voxel size of the simulated stock (mm)").Default("0.5").Float()
+	envelope    = kingpin.Flag("envelope", "Travel of the machine to keep all moves within, checked again after transforms such as --flipxy (minx,miny,minz,maxx,maxy,maxz in mm)").String()
+	fixtures    = kingpin.Flag("fixture", "Fixture or clamp to keep the tool out of (minx,miny,minz,maxx,maxy,maxz in mm)").Strings()
+	spindleMin  = kingpin.Flag("spindlemin", "Lowest speed of the spindle, rejecting programs running it slower (RPM, 0 to disable)").Float()
+	spindleMax  = kingpin.Flag("spindlemax", "Highest speed of the spindle, rejecting programs running it faster (RPM, 0 to disable)").Float()
+	spindleRngs = kingpin.Flag("spindlerange", "Range of speeds of the spindle, such as of a gear or VFD setting, instead of --spindlemin and --spindlemax (min-max in RPM)").Strings()
+	clampSpeed  = kingpin.Flag("clampspindle", "Clamp spindle speeds outside the spindle range to the nearest within it, rather than rejecting the program").Bool()
+	floor       = kingpin.Flag("floor", "Lowest height to cut to during simulation (mm, bottom of the stock if unset)").String()
 	autoStart   = kingpin.Flag("autostart", "Start sending code without asking questions").Bool()
 	ignBlockDel = kingpin.Flag("ignblockdel", "Ignore lines starting with block delete").Bool()
+	dwellUnit   = kingpin.Flag("dwellunit", "Unit of G4 P in the input (s for seconds, ms for milliseconds)").Default("s").String()
+	outDwell    = kingpin.Flag("outdwellunit", "Unit of G4 P in exported gcode (s or ms, the default of the output if unset)").String()
+	outUnits    = kingpin.Flag("units", "Units of exported gcode (mm, inch, or native for those the program ends in, mm or that of the post if unset)").String()
+	setParams   = kingpin.Flag("set", "Set a parameter used by the input file, such as {depth} or #<depth> (name=value)").StringMap()
+	varFile     = kingpin.Flag("varfile", "Load parameters, coordinate systems and offsets from a LinuxCNC .var file").ExistingFile()
+	saveVarFile = kingpin.Flag("savevarfile", "Save parameters, coordinate systems and offsets to a LinuxCNC .var file").String()
+	contours    = kingpin.Flag("contours", "Print the closed contours of each operation, and the direction they are milled in").Bool()
+	dumpOffsets = kingpin.Flag("dumpoffsets", "Print the work coordinate systems, G92 offset and active coordinate system left by the program").Bool()
+
+	drillDepth   = kingpin.Flag("drilldepth", "Depth to drill holes from drill files to (mm)").Default("-2").Float()
+	drillSafety  = kingpin.Flag("drillsafety", "Height to move between holes from drill files at (mm)").Default("2").Float()
+	drillPlunge  = kingpin.Flag("drillplunge", "Plunge feedrate for holes from drill files (mm/min)").Default("100").Float()
+	drillSpindle = kingpin.Flag("drillspindle", "Spindle speed for holes from drill files (RPM, 0 to leave off)").Default("0").Float()
+
+	penUp   = kingpin.Flag("penup", "Height to move at with the pen up in HPGL files (mm)").Default("2").Float()
+	penDown = kingpin.Flag("pendown", "Height to cut or draw at with the pen down in HPGL files (mm)").Default("0").Float()
+	penFeed = kingpin.Flag("penfeed", "Feedrate with the pen down in HPGL files (mm/min)").Default("1000").Float()
+
+	svgDepth     = kingpin.Flag("svgdepth", "Depth to cut paths from SVG files to (mm)").Default("-0.2").Float()
+	svgStepdown  = kingpin.Flag("svgstepdown", "Maximum depth of each pass along paths from SVG files (mm, 0 for a single pass)").Default("0").Float()
+	svgSafety    = kingpin.Flag("svgsafety", "Height to move between paths from SVG files at (mm)").Default("2").Float()
+	svgFeed      = kingpin.Flag("svgfeed", "Feedrate along paths from SVG files (mm/min)").Default("600").Float()
+	svgPlunge    = kingpin.Flag("svgplunge", "Plunge feedrate for paths from SVG files (mm/min)").Default("100").Float()
+	svgSpindle   = kingpin.Flag("svgspindle", "Spindle speed for paths from SVG files (RPM, 0 to leave off)").Default("0").Float()
+	svgTolerance = kingpin.Flag("svgtolerance", "Maximum deviation from curves of paths from SVG files (mm)").Default("0.01").Float()
+	svgScale     = kingpin.Flag("svgscale", "Size of a user unit of SVG files (mm, 0 to take it from the document)").Default("0").Float()
+
+	roughTool      = kingpin.Flag("roughtool", "Tool diameter for roughing STL files (mm)").Default("3.175").Float()
+	roughStepover  = kingpin.Flag("roughstepover", "Distance between passes when roughing STL files (mm)").Default("1.5").Float()
+	roughStepdown  = kingpin.Flag("roughstepdown", "Maximum depth of each level when roughing STL files (mm)").Default("1").Float()
+	roughAllowance = kingpin.Flag("roughallowance", "Material to leave when roughing STL files (mm)").Default("0.2").Float()
+	roughSafety    = kingpin.Flag("roughsafety", "Height above the model to move at when roughing STL files (mm)").Default("2").Float()
+	roughFeed      = kingpin.Flag("roughfeed", "Feedrate for roughing STL files (mm/min)").Default("800").Float()
+	roughPlunge    = kingpin.Flag("roughplunge", "Plunge feedrate for roughing STL files (mm/min)").Default("200").Float()
+	roughSpindle   = kingpin.Flag("roughspindle", "Spindle speed for roughing STL files (RPM, 0 to leave off)").Default("0").Float()
+
+	pocketOps       = kingpin.Flag("pocket", "Clear the inside of the closed contour of the given operation right after it, by number as in --report or by label").Strings()
+	pocketTool      = kingpin.Flag("pockettool", "Tool to change to for pockets, with its diameter given by --tool (0 for the tool of the operation)").Default("0").Int()
+	pocketStepover  = kingpin.Flag("pocketstepover", "Distance between passes of pockets (mm)").Default("1.5").Float()
+	pocketStepdown  = kingpin.Flag("pocketstepdown", "Maximum depth of each level of pockets (mm)").Default("1").Float()
+	pocketDepth     = kingpin.Flag("pocketdepth", "Depth of pockets below --stocktop (mm, 0 for the depth of the contour)").Default("0").Float()
+	pocketAllowance = kingpin.Flag("pocketallowance", "Material to leave on the walls of pockets (mm)").Default("0").Float()
+	pocketSafety    = kingpin.Flag("pocketsafety", "Height above --stocktop to move at between passes of pockets (mm)").Default("2").Float()
+	pocketFeed      = kingpin.Flag("pocketfeed", "Feedrate for pockets (mm/min, 0 for the feedrate of the contour)").Default("0").Float()
+	pocketPlunge    = kingpin.Flag("pocketplunge", "Plunge feedrate for pockets (mm/min)").Default("200").Float()
 
 	opt             = kingpin.Flag("opt", "Allow optimizations").Default("false").Bool()
 	optBogusMove    = kingpin.Flag("optbogus", "Remove all moves that would be an implicit part of another move (Deprecated for optvector)").Default("false").Bool()
@@ -37,34 +146,118 @@ var (
 	optLiftSpeed    = kingpin.Flag("optlifts", "Use rapid positioning for Z-only upwards moves").Default("true").Bool()
 	optDrillSpeed   = kingpin.Flag("optdrill", "Use fast positioning for drills to last drilled depth").Default("false").Bool()
 	optFloatingZ    = kingpin.Flag("optfloat", "Remove bogus moves above Z0 (floating Z)").Default("true").Bool()
+	optDuplicates   = kingpin.Flag("optduplicates", "Remove passes that repeat earlier passes exactly").Default("false").Bool()
 	optPathGrouping = kingpin.Flag("optpath", "Optimize path to minimize moves between individual operations").Default("false").Bool()
-	optPrepareTool  = kingpin.Flag("optpreparetool", "Ensures that the next tool is prepared as long in advance as possible").Default("false").Bool()
+	optPathOrdering = kingpin.Flag("optorder", "Order paths by an improved tour to minimize moves between individual operations").Default("false").Bool()
+	optRegionOrder  = kingpin.Flag("optregion", "Complete all depths of a region before moving on to the next").Default("false").Bool()
+	optLoopStart    = kingpin.Flag("optloopstart", "Start closed loops at the corner nearest to the previous operation").Default("false").Bool()
+	optPrepareTool  = kingpin.Flag("optpreparetool", "Prepares the next tool as long in advance as possible, with a T word right after the previous toolchange").Default("false").Bool()
+	optSimplify     = kingpin.Flag("optsimplify", "Remove all moves that keep runs of moves within tolerance of their simplified path").Default("false").Bool()
+	optArcFit       = kingpin.Flag("optarcfit", "Replace chains of short moves along arcs with arc moves").Default("false").Bool()
+	optCornerBlend  = kingpin.Flag("optcornerblend", "Round corners between moves with arcs within tolerance").Default("false").Bool()
+	optLeadInOut    = kingpin.Flag("optleadin", "Insert tangential arc lead-ins and lead-outs on closed contours, on the side given by cutter compensation or --contourside").Default("false").Bool()
+	optRampEntry    = kingpin.Flag("optramp", "Replace plunges into the stock with ramps or helical entries").Default("false").Bool()
+	optPeckDrill    = kingpin.Flag("optpeck", "Convert drills deeper than the peck depth into peck drilling").Default("false").Bool()
+	optAdaptiveFeed = kingpin.Flag("optadaptivefeed", "Slow down on tight arcs and into sharp corners within the acceleration of the machine").Default("false").Bool()
+	optSpindleStops = kingpin.Flag("optspindle", "Keep the spindle running between operations when stopped only briefly").Default("false").Bool()
 
 	precision        = kingpin.Flag("precision", "Precision to use for exported gcode (max mantissa digits)").Default("4").Int()
+	wordPrecision    = kingpin.Flag("wordprecision", "Precision of words of an address, overriding --precision, such as F=1 or S=0 (address=decimals)").StringMap()
+	trailingZeros    = kingpin.Flag("trailingzeros", "Keep trailing zeros in exported gcode, such as X1.5000").Bool()
+	decimalPoint     = kingpin.Flag("decimalpoint", "Always put a decimal point in axis and arc offset words, such as X1.").Bool()
+	leadingZeros     = kingpin.Flag("leadingzeros", "Pad axis and arc offset words to this many digits before the decimal point with leading zeros").Int()
 	maxArcDeviation  = kingpin.Flag("maxarcdeviation", "Maximum deviation from an ideal arc (mm)").Default("0.002").Float()
 	minArcLineLength = kingpin.Flag("minarclinelength", "Minimum arc segment line length (mm)").Default("0.01").Float()
+	tolerance        = kingpin.Flag("tolerance", "Distance within which positions and values are taken as equal when optimizing and exporting (mm, 0 for exact)").Default("1e-9").Float()
 	rtolerance       = kingpin.Flag("rtolerance", "Tolerance used by route grouping (mm)").Default("0.001").Float()
+	stockTop         = kingpin.Flag("stocktop", "Z of the top of the stock, above which path grouping and ordering move between paths, and from which entries ramp (mm)").Default("0").Float()
+	orderSteps       = kingpin.Flag("ordersteps", "Improvements to make to the path order at most (0 for no limit)").Default("10000").Int()
+	optWorkers       = kingpin.Flag("optworkers", "Number of operations to run vector, simplification and arc fitting passes on at once (0 for one per CPU), not joining moves across operations").Default("1").Int()
+	regionMargin     = kingpin.Flag("regionmargin", "Distance beyond the tool within which operations are in the same region (mm)").Default("1").Float()
 	vtolerance       = kingpin.Flag("vtolerance", "Tolerance used by vector optimization (mm)").Default("0.0003").Float()
+	stolerance       = kingpin.Flag("stolerance", "Tolerance used by path simplification (mm)").Default("0.005").Float()
+	atolerance       = kingpin.Flag("atolerance", "Tolerance used by arc fitting (mm)").Default("0.01").Float()
+	btolerance       = kingpin.Flag("btolerance", "Tolerance used by corner blending (mm)").Default("0.01").Float()
+	leadRadius       = kingpin.Flag("leadradius", "Radius of the arc lead-ins and lead-outs of --optleadin (mm)").Default("2").Float()
+	rampAngle        = kingpin.Flag("rampangle", "Maximum angle of ramps and helical entries from horizontal (degrees)").Default("3").Float()
+	entryAngle       = kingpin.Flag("entryangle", "Ramp or helically enter the stock at most this angle from horizontal where resuming or selecting operations makes new entries, rather than feeding straight down (degrees, 0 to disable)").Float()
+	helixDiameter    = kingpin.Flag("helixdiameter", "Diameter of helical entries of --optramp and --entryangle (mm, half the tool diameter if 0)").Float()
+	peckDepth        = kingpin.Flag("peckdepth", "Maximum depth of each peck when peck drilling (mm)").Default("2").Float()
+	peckRetract      = kingpin.Flag("peckretract", "Height to retract to between pecks (mm)").Default("1").Float()
+	acceleration     = kingpin.Flag("acceleration", "Acceleration of the machine used by adaptive feed (mm/s²)").Default("100").Float()
+	junctionDev      = kingpin.Flag("junctiondeviation", "Junction deviation used by adaptive feed, as configured in Grbl (mm)").Default("0.01").Float()
+	spindleIdle      = kingpin.Flag("spindleidle", "Longest spindle stop to remove").Default("10s").Duration()
 	rapiddrill       = kingpin.Flag("rapiddrill", "Use rapid moves for drills optimizations").Default("false").Bool()
 	drillfeed        = kingpin.Flag("dillfeed", "Feedrage to use for drill optimizations").Default("1000").Float()
 	floatingzheight  = kingpin.Flag("floatingzheight", "Z height required to consider a move floating").Default("1").Float()
 
 	feedLimit    = kingpin.Flag("feedlimit", "Maximum feedrate (mm/min, <= 0 to disable)").Float()
 	safetyHeight = kingpin.Flag("safetyheight", "Enforce safety height (mm, <= 0 to disable)").Float()
+	allowance    = kingpin.Flag("allowance", "Offset closed contours on the side given by cutter compensation or --contourside, leaving material if positive, or cutting further if negative (mm, 0 to disable)").Float()
+	plungeFeed   = kingpin.Flag("plungefeed", "Feedrate of plunges into the stock (mm/min, <= 0 to disable)").Float()
+	clearance    = kingpin.Flag("clearance", "Rewrite all clearance heights to a single height (mm, <= 0 to disable)").Float()
 	multiplyFeed = kingpin.Flag("multiplyfeed", "Feedrate multiplier (0 to disable)").Float()
 	multiplyMove = kingpin.Flag("multiplymove", "Move distance multiplier (0 to disable)").Float()
 
 	spindleCW  = kingpin.Flag("spindlecw", "Force clockwise spindle speed (RPM, <= 0 to disable)").Float()
 	spindleCCW = kingpin.Flag("spindleccw", "Force counter clockwise spindle speed (RPM, <= 0 to disable)").Float()
 
-	enforceReturn    = kingpin.Flag("enforcereturn", "Enforce rapid return to X0 Y0 Z0").Default("true").Bool()
+	plasma       = kingpin.Flag("plasma", "Cut with a plasma torch, lit by the spindle (M3/M5) for each cut").Bool()
+	plasmaPierce = kingpin.Flag("plasmapierce", "Height to pierce at with --plasma (mm)").Default("3.8").Float()
+	plasmaCut    = kingpin.Flag("plasmacut", "Height to cut at with --plasma (mm)").Default("1.5").Float()
+	plasmaTravel = kingpin.Flag("plasmatravel", "Lowest height of rapid moves between cuts with --plasma (mm)").Default("10").Float()
+	plasmaDelay  = kingpin.Flag("plasmadelay", "Seconds to wait for the torch to pierce with --plasma").Default("0.5").Float()
+	plasmaFeed   = kingpin.Flag("plasmafeed", "Feedrate from pierce height to cut height with --plasma (mm/min, 0 for that of the cut)").Default("0").Float()
+	plasmaKerf   = kingpin.Flag("plasmakerf", "Width cut by the torch, offsetting closed contours by half of it on the side given by cutter compensation or --contourside with --plasma (mm, 0 to disable)").Float()
+	plasmaTHC    = kingpin.Flag("plasmathc", "Turn torch height control on while cutting with --plasma, with the M codes of the thc channel of --coolantcode or --post").Bool()
+
+	enforceReturn    = kingpin.Flag("enforcereturn", "Enforce rapid return to X0 Y0 Z0, or to --returnto").Default("true").Bool()
+	returnTo         = kingpin.Flag("returnto", "Position to return to instead of X0 Y0 Z0, in work coordinates (x,y,z in mm, see --park for machine coordinates)").String()
+	endSpindle       = kingpin.Flag("endspindle", "Stop the spindle at the end of the program").Bool()
+	endCoolant       = kingpin.Flag("endcoolant", "Stop the coolant at the end of the program").Bool()
+	park             = kingpin.Flag("park", "Park at the end of the program, in machine coordinates (g28 or g30 for the stored positions, a name given with --position, or x,y,z in mm)").String()
+	positions        = kingpin.Flag("position", "Named position to park at with --park (name=x,y,z in machine coordinates, mm)").StringMap()
+	pallet           = kingpin.Flag("pallet", "M code signalling a pallet change at the end of the program, such as 60 (0 to disable)").Int()
+	endCode          = kingpin.Flag("end", "Code ending the program (m2 or m30, none if unset)").String()
 	flipXY           = kingpin.Flag("flipxy", "Flips the X and Y axes for all moves").Bool()
 	manualToolchange = kingpin.Flag("manualtool", "Wait for manual toolchange operation").Bool()
 	manualSpindle    = kingpin.Flag("manualspindle", "Wait for manual spindle operation").Bool()
 	manualCoolant    = kingpin.Flag("manualcoolant", "Wait for manual coolant operation").Bool()
-	spindleWait      = kingpin.Flag("spindlewait", "Seconds to dwell after spindle changes").Int()
+	feedPerMinute    = kingpin.Flag("feedperminute", "Convert feeds per revolution (G95) to feeds per minute (G94) at the programmed spindle speed, as always done when streaming").Bool()
+	spindleRamp      = kingpin.Flag("spindleramp", "Seconds to dwell before cutting for every 1000 RPM the spindle speeds up by (0 to disable)").Float()
 	coolantWait      = kingpin.Flag("coolantwait", "Seconds to dwell after coolant changes").Int()
+	coolantCodeFlags = kingpin.Flag("coolantcode", "M codes turning a coolant channel on and off, such as vacuum=M10,M11 (channel=on,off, for air, vacuum, spindle or thc)").StringMap()
 	toolchangeHeight = kingpin.Flag("tcheight", "Height to go to for toolchange (0 to use safety height)").Default("0").Float()
+	retractOnPause   = kingpin.Flag("pauseretract", "Retract and stop spindle on pause, instead of holding feed").Bool()
+	pauseHeight      = kingpin.Flag("pauseheight", "Height to retract to on pause (0 to use safety height)").Default("0").Float()
+	headerFile       = kingpin.Flag("header", "File of gcode to put in at the start of the program").ExistingFile()
+	footerFile       = kingpin.Flag("footer", "File of gcode to put in at the end of the program").ExistingFile()
+	beforeToolFile   = kingpin.Flag("beforetool", "File of gcode to put in before each toolchange, such as to park or lift a dust boot").ExistingFile()
+	afterToolFile    = kingpin.Flag("aftertool", "File of gcode to put in after each toolchange").ExistingFile()
+
+	probeTool      = kingpin.Flag("probetool", "Measure tools on a touch plate on toolchange, and apply the difference to the first tool as tool length offset").Bool()
+	probeX         = kingpin.Flag("probex", "Touch plate X (machine coordinates)").Default("0").Float()
+	probeY         = kingpin.Flag("probey", "Touch plate Y (machine coordinates)").Default("0").Float()
+	probeSafeZ     = kingpin.Flag("probesafez", "Height to travel to the touch plate at (machine coordinates)").Default("-1").Float()
+	probeDistance  = kingpin.Flag("probedistance", "Maximum probing distance (mm)").Default("50").Float()
+	probeFeed      = kingpin.Flag("probefeed", "Probing feedrate (mm/min)").Default("100").Float()
+	probeReference = kingpin.Flag("probereference", "Machine Z of the reference tool on the touch plate, from an earlier run (0 to measure the first tool)").Float()
+
+	timeout         = kingpin.Flag("timeout", "Seconds to wait for a response before checking the connection (0 to disable)").Default("10").Int()
+	reconnect       = kingpin.Flag("reconnect", "Attempts to reconnect if the connection is lost (0 to disable)").Default("3").Int()
+	reconnectWait   = kingpin.Flag("reconnectwait", "Seconds to wait before each reconnect attempt").Default("2").Int()
+	keepAlive       = kingpin.Flag("keepalive", "Seconds between keepalive probes for tcp:// devices").Default("30").Int()
+	checkpointFile  = kingpin.Flag("checkpoint", "File to record streaming progress to, for use with --resume").String()
+	checkpointDepth = kingpin.Flag("checkpointdepth", "Positions the checkpoint is kept behind the last acknowledged one, as controllers acknowledge lines they have buffered but not run").Default("32").Int()
+	resume          = kingpin.Flag("resume", "Resume job from the position index stored in the checkpoint file").Bool()
+	resumeIndex     = kingpin.Flag("resumeindex", "Resume job from the given position index (0 to disable)").Int()
+	startLine       = kingpin.Flag("startline", "Run job from the given line of the input, restoring the state in effect there (0 to disable)").Int()
+	onlyTools       = kingpin.Flag("onlytool", "Run only the operations of the given tool (index)").Ints()
+	skipTools       = kingpin.Flag("skiptool", "Skip the operations of the given tool (index)").Ints()
+	milling         = kingpin.Flag("milling", "Reverse closed contours milled in the other direction (climb or conventional)").String()
+	contourSide     = kingpin.Flag("contourside", "Side of the contours of an operation the tool cuts on where there is no cutter compensation, by number as in --report, by label, or for all (op=outside or inside)").StringMap()
+	onlyOps         = kingpin.Flag("onlyop", "Run only the given operation, by number as in --report or by label").Strings()
+	skipOps         = kingpin.Flag("skipop", "Skip the given operation, by number as in --report or by label").Strings()
 )
 
 var (
@@ -80,17 +273,17 @@ type WaitGenerator struct {
 	export.BaseGenerator
 }
 
-// Waits a certain time after spindle changes
-func (m *WaitGenerator) Spindle(bool, bool, float64) {
-	if *spindleWait > 0 {
-		time.Sleep(time.Duration(*spindleWait) * time.Second)
+// Waits a certain time after coolant changes
+func (m *WaitGenerator) Coolant(bool, bool) {
+	if *coolantWait > 0 {
+		time.Sleep(time.Duration(*coolantWait) * time.Second)
 	}
 }
 
-// Waits a certain time after coolant changes
-func (m *WaitGenerator) Coolant(bool, bool) {
+// Waits a certain time after coolant channel changes
+func (m *WaitGenerator) CoolantChannel(int, bool) {
 	if *coolantWait > 0 {
-		time.Sleep(time.Duration(*spindleWait) * time.Second)
+		time.Sleep(time.Duration(*coolantWait) * time.Second)
 	}
 }
 
@@ -106,6 +299,10 @@ type ManualGenerator struct {
 	hasChanged bool
 	tguard     int
 	sguard     int
+
+	// Tool length probing, if enabled
+	probe    *streaming.ToolLengthProbe
+	streamer *streaming.GrblStreamer
 }
 
 // Prompts user to make the requested changes to spindle, waits for <ENTER>
@@ -153,8 +350,23 @@ func (m *ManualGenerator) Coolant(floodCoolant, mistCoolant bool) {
 	_, _ = reader.ReadString('\n')
 }
 
-// Moves spindle to easily accessible spot, and prompts for toolchange
-func (m *ManualGenerator) Toolchange(i int) {
+// Prompts the user to turn a coolant channel on or off, waits for <ENTER>
+func (m *ManualGenerator) CoolantChannel(channel int, on bool) {
+	if !*manualCoolant {
+		return
+	}
+	if on {
+		fmt.Fprintf(os.Stderr, "Enable %s coolant. Confirm with <ENTER>", vm.CoolantName(channel))
+	} else {
+		fmt.Fprintf(os.Stderr, "Disable %s coolant. Confirm with <ENTER>", vm.CoolantName(channel))
+	}
+	reader := bufio.NewReader(os.Stdin)
+	_, _ = reader.ReadString('\n')
+}
+
+// Moves spindle to easily accessible spot, and prompts for toolchange with
+// --manualtool, or measures the new tool on the touch plate with --probetool
+func (m *ManualGenerator) ToolChange(i int) {
 	// Multiple entry guard!
 	if m.tguard > 0 {
 		return
@@ -164,7 +376,7 @@ func (m *ManualGenerator) Toolchange(i int) {
 		m.tguard--
 	}()
 
-	if !*manualToolchange {
+	if !*manualToolchange && m.probe == nil {
 		return
 	}
 
@@ -178,7 +390,8 @@ func (m *ManualGenerator) Toolchange(i int) {
 
 	curPos := m.GetPosition()
 
-	if m.hasChanged {
+	// The first tool is measured too, as it is the reference
+	if m.hasChanged || m.probe != nil {
 		newPos := curPos
 		newPos.Z = newHeight
 		export.HandlePosition(newPos, generators...)
@@ -187,9 +400,16 @@ func (m *ManualGenerator) Toolchange(i int) {
 		newPos.State.SpindleEnabled = false
 		newPos.State.MistCoolant = false
 		newPos.State.FloodCoolant = false
+		newPos.State.Coolant = 0
 		export.HandlePosition(newPos, generators...)
 	}
 
+	if m.probe != nil {
+		m.probeTool(i, newHeight)
+		m.hasChanged = true
+		return
+	}
+
 	// Await tool info
 	reader := bufio.NewReader(os.Stdin)
 	toolLength := m.toolLength
@@ -231,237 +451,2375 @@ func (m *ManualGenerator) Toolchange(i int) {
 	m.hasChanged = true
 }
 
-func printStats(m *vm.Machine) {
-	minx, miny, minz, maxx, maxy, maxz, feedrates := machine.Info()
-	fmt.Fprintf(os.Stderr, "Metrics\n")
-	fmt.Fprintf(os.Stderr, "-------------------------\n")
-	fmt.Fprintf(os.Stderr, "   Moves: %d\n", len(machine.Positions))
-	fmt.Fprintf(os.Stderr, "   Feedrates (mm/min): ")
+// Tells the user which tool comes next, as prepared by --optpreparetool, so
+// it can be made ready while the current one cuts. Only announced when
+// toolchanges are made by hand, as handled by ToolChange.
+func (m *ManualGenerator) ToolChangeSuggestion(i int) {
+	if (!*manualToolchange && m.probe == nil) || i < 0 || i == m.GetPosition().State.ToolIndex {
+		return
+	}
+	if t, ok := machine.GetTool(i); ok {
+		fmt.Fprintf(os.Stderr, "\nNext tool: %d (%g mm)\n", i, t.Diameter)
+	} else {
+		fmt.Fprintf(os.Stderr, "\nNext tool: %d\n", i)
+	}
+}
 
-	for idx, feed := range feedrates {
-		if feed == 0 {
-			continue
-		}
-		fmt.Fprintf(os.Stderr, "%g", feed)
-		if idx != len(feedrates)-1 {
-			fmt.Fprintf(os.Stderr, ", ")
-		}
+// Prompts for toolchange, and measures the tool on the touch plate. Returns
+// to X0Y0 at the given height afterwards, where the toolchange left off.
+func (m *ManualGenerator) probeTool(i int, height float64) {
+	if m.hasChanged || *manualToolchange {
+		fmt.Fprintf(os.Stderr, "Change to tool %d. Confirm with <ENTER>", i)
+		reader := bufio.NewReader(os.Stdin)
+		_, _ = reader.ReadString('\n')
 	}
-	fmt.Fprintf(os.Stderr, "\n")
-	eta := machine.ETA()
-	meta := (eta / time.Second) * time.Second
-	fmt.Fprintf(os.Stderr, "   ETA: %s\n", meta.String())
-	fmt.Fprintf(os.Stderr, "   X (mm): %g <-> %g\n", minx, maxx)
-	fmt.Fprintf(os.Stderr, "   Y (mm): %g <-> %g\n", miny, maxy)
-	fmt.Fprintf(os.Stderr, "   Z (mm): %g <-> %g\n", minz, maxz)
-	fmt.Fprintf(os.Stderr, "-------------------------\n")
 
+	fmt.Fprintf(os.Stderr, "Measuring tool %d...\n", i)
+	offset, err := m.probe.Measure(m.streamer)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "Tool %d length offset: %f (reference: %f)\n", i, offset, m.probe.Reference)
+
+	m.streamer.Write("G0X0Y0")
+	m.streamer.Write("G0Z" + strconv.FormatFloat(height, 'f', -1, 64))
+
+	// The modal move mode is no longer what the streamer expects
+	m.streamer.ForceModeWrite = true
 }
 
-//
-// Application flow
-//
+// Retracts to pause height with spindle and coolant stopped, waits for
+// <ENTER>, and returns to the exact position and state before continuing.
+func retractPause(cur vm.Position) error {
+	height := *pauseHeight
+	if height == 0 {
+		height = machine.FindSafetyHeight()
+	}
+	if height < cur.Z {
+		height = cur.Z
+	}
 
-func main() {
-	// Parse arguments
-	kingpin.Parse()
+	lift := cur
+	lift.Z = height
+	lift.State.MoveMode = vm.MoveModeRapid
+	lift.State.SpindleEnabled = false
+	lift.State.FloodCoolant = false
+	lift.State.MistCoolant = false
+	lift.State.Coolant = 0
+	if err := export.HandlePosition(lift, generators...); err != nil {
+		return err
+	}
 
-	if *spindleCW != 0 && *spindleCCW != 0 {
-		fmt.Fprintf(os.Stderr, "Error: Cannot force both clockwise and counter clockwise rotation\n")
+	fmt.Fprintf(os.Stderr, "\nPaused at safety height. Press <ENTER> to continue")
+	reader := bufio.NewReader(os.Stdin)
+	_, _ = reader.ReadString('\n')
+
+	// Restore spindle and coolant above the work, then return
+	above := cur
+	above.Z = height
+	above.State.MoveMode = vm.MoveModeRapid
+	if err := export.HandlePosition(above, generators...); err != nil {
+		return err
+	}
+	return export.HandlePosition(cur, generators...)
+}
+
+// Dumps or restores Grbl settings.
+func manageSettings() {
+	if *device == "" {
+		fmt.Fprintf(os.Stderr, "Error: Managing settings requires a device\n")
 		os.Exit(1)
 	}
 
-	fhandle, err := ioutil.ReadFile(*inputFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Could not open file: %s\n", err)
+	s := &streaming.GrblStreamer{}
+	s.Init()
+	if err := s.Connect(*device, *baudrate); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Unable to connect to device: %s\n", err)
 		os.Exit(2)
 	}
 
-	// Parse
-	code := string(fhandle)
-	document, err := gcode.Parse(code)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Parse error: %s\n", err)
-		os.Exit(3)
-	}
+	if *dumpSettings != "" {
+		settings, err := s.ReadSettings()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not read settings: %s\n", err)
+			os.Exit(2)
+		}
 
-	// Run through the VM
-	machine.Init()
-	machine.IgnoreBlockDelete = *ignBlockDel
-	machine.AllowRemainingWords = *allowRemainingWords
-	machine.MaxArcDeviation = *maxArcDeviation
-	machine.MinArcLineLength = *minArcLineLength
-
-	if err := machine.Process(document); err != nil {
-		fmt.Fprintf(os.Stderr, "VM failed: %s\n", err)
-		os.Exit(3)
-	}
+		out := ""
+		for _, setting := range settings {
+			out += setting.String()
+			if setting.Description != "" {
+				out += " (" + setting.Description + ")"
+			}
+			out += "\n"
+		}
 
-	// Optimize as requested
-	if *opt {
-		if *optDrillSpeed {
-			optimize.OptDrillSpeed(&machine, *drillfeed, *rapiddrill)
+		if *dumpSettings == "-" {
+			fmt.Print(out)
+		} else if err := ioutil.WriteFile(*dumpSettings, []byte(out), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+			os.Exit(2)
 		}
+	}
 
-		if *optFloatingZ {
-			optimize.OptFloatingZ(&machine, *floatingzheight)
+	if *restoreSettings != "" {
+		fhandle, err := ioutil.ReadFile(*restoreSettings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not open file: %s\n", err)
+			os.Exit(2)
 		}
 
-		if *optPathGrouping {
-			if err := optimize.OptPathGrouping(&machine, *rtolerance); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: Could not execute path grouping: %s\n", err)
+		for _, line := range strings.Split(string(fhandle), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line[0] != '$' {
+				continue
 			}
+			setting, err := streaming.ParseGrblSetting(line)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(3)
+			}
+			if err := s.WriteSetting(setting.ID, setting.Value); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Could not write setting %s: %s\n", setting, err)
+				os.Exit(2)
+			}
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", setting)
 		}
+	}
+}
 
-		if *optBogusMove {
-			optimize.OptBogusMoves(&machine)
-		}
+// Interactive jogging and work zero setting, for touching off.
+func jog() {
+	if *device == "" {
+		fmt.Fprintf(os.Stderr, "Error: Jogging requires a device\n")
+		os.Exit(1)
+	}
 
-		if *optVector {
-			optimize.OptVector(&machine, *vtolerance)
+	s := &streaming.GrblStreamer{}
+	s.Init()
+	if err := s.Connect(*device, *baudrate); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Unable to connect to device: %s\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "   x10, y-1.5, z-0.1   Jog the axis by the given distance (mm)\n")
+	fmt.Fprintf(os.Stderr, "   f300                Set jog feedrate (mm/min)\n")
+	fmt.Fprintf(os.Stderr, "   zero xy             Set work zero of the given axes (all if none given)\n")
+	fmt.Fprintf(os.Stderr, "   g92 xy              Set temporary work zero of the given axes with G92\n")
+	fmt.Fprintf(os.Stderr, "   home, unlock        Run the homing cycle or clear an alarm lock\n")
+	fmt.Fprintf(os.Stderr, "   ?                   Show position\n")
+	fmt.Fprintf(os.Stderr, "   q                   Quit\n")
+
+	feed := *jogFeed
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "jog> ")
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) == 0 {
+			continue
 		}
 
-		if *optLiftSpeed {
-			optimize.OptLiftSpeed(&machine)
+		switch cmd := fields[0]; {
+		case cmd == "q" || cmd == "quit":
+			return
+		case cmd == "?":
+			status, err := s.Status()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s, machine: %s, work: %s\n", status.State, status.MachinePosition, status.WorkPosition)
+		case cmd == "home":
+			err = s.Home()
+		case cmd == "unlock":
+			err = s.Unlock()
+		case cmd == "zero" || cmd == "g92":
+			axes := "xyz"
+			if len(fields) > 1 {
+				axes = fields[1]
+			}
+			if cmd == "zero" {
+				err = s.Zero(axes)
+			} else {
+				err = s.ZeroTemporary(axes)
+			}
+		case cmd[0] == 'f':
+			f, perr := strconv.ParseFloat(cmd[1:], 64)
+			if perr != nil || f <= 0 {
+				fmt.Fprintf(os.Stderr, "Error: Invalid feedrate: %s\n", cmd)
+				continue
+			}
+			feed = f
+		case cmd[0] == 'x' || cmd[0] == 'y' || cmd[0] == 'z':
+			d, perr := strconv.ParseFloat(cmd[1:], 64)
+			if perr != nil {
+				fmt.Fprintf(os.Stderr, "Error: Invalid distance: %s\n", cmd)
+				continue
+			}
+			var x, y, z float64
+			switch cmd[0] {
+			case 'x':
+				x = d
+			case 'y':
+				y = d
+			case 'z':
+				z = d
+			}
+			err = s.Jog(x, y, z, feed)
+		default:
+			fmt.Fprintf(os.Stderr, "Error: Unknown command: %s\n", cmd)
+			continue
 		}
 
-		if *optPrepareTool {
-			optimize.OptPrepareTool(&machine)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		}
 	}
+}
 
-	// Apply requested modifications
-	if *flipXY {
-		machine.FlipXY()
+// Parses a tool table entry (index:diameter[:flutes[:ball]]).
+func parseTool(s string) (int, vm.Tool, error) {
+	var t vm.Tool
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 4 {
+		return 0, t, errors.New(fmt.Sprintf("Invalid tool definition: %s", s))
 	}
 
-	if *safetyHeight > 0 {
-		if err := machine.SetSafetyHeight(*safetyHeight); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Could not set safety height%s\n", err)
+	idx, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, t, errors.New(fmt.Sprintf("Invalid tool index: %s", s))
+	}
+	if t.Diameter, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return 0, t, errors.New(fmt.Sprintf("Invalid tool diameter: %s", s))
+	}
+	if len(parts) > 2 {
+		if t.Flutes, err = strconv.Atoi(parts[2]); err != nil {
+			return 0, t, errors.New(fmt.Sprintf("Invalid tool flute count: %s", s))
 		}
 	}
+	if len(parts) > 3 {
+		switch parts[3] {
+		case "ball":
+			t.BallNose = true
+		case "flat":
+		default:
+			return 0, t, errors.New(fmt.Sprintf("Invalid tool shape: %s", s))
+		}
+	}
+	return idx, t, nil
+}
 
-	if *feedLimit > 0 {
-		machine.LimitFeedrate(*feedLimit)
+// Parses a comma-separated list of exactly n numbers.
+func parseFloats(s string, n int) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, errors.New(fmt.Sprintf("Expected %d values", n))
 	}
+	res := make([]float64, n)
+	for idx, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		res[idx] = f
+	}
+	return res, nil
+}
 
-	if *multiplyFeed != 0 {
-		machine.FeedrateMultiplier(*multiplyFeed)
+// Parses a box (minx,miny,minz,maxx,maxy,maxz).
+func parseBox(s string) (vm.Box, error) {
+	b, err := parseFloats(s, 6)
+	if err != nil {
+		return vm.Box{}, errors.New(fmt.Sprintf("Invalid box: %s", s))
 	}
+	return vm.Box{
+		Min: vector.Vector{math.Min(b[0], b[3]), math.Min(b[1], b[4]), math.Min(b[2], b[5])},
+		Max: vector.Vector{math.Max(b[0], b[3]), math.Max(b[1], b[4]), math.Max(b[2], b[5])},
+	}, nil
+}
 
-	if *multiplyMove != 0 {
-		machine.MoveMultiplier(*multiplyMove)
+// The maximum number of fixture violations or gouges printed
+const maxSimulationReports = 10
+
+// Checks that no move passes through a fixture, and prints the moves that
+// do. Returns an error if any move does.
+func checkFixtures(m *vm.Machine) error {
+	var zones []vm.Box
+	for _, f := range *fixtures {
+		b, err := parseBox(f)
+		if err != nil {
+			return err
+		}
+		zones = append(zones, b)
 	}
 
-	if *enforceReturn {
-		machine.Return(true, true)
+	violations := m.CheckKeepOut(zones)
+	for idx, v := range violations {
+		if idx == maxSimulationReports {
+			fmt.Fprintf(os.Stderr, "... and %d more\n", len(violations)-idx)
+			break
+		}
+		if v.Line > 0 {
+			fmt.Fprintf(os.Stderr, "Line %d passes through fixture %d\n", v.Line, v.Zone+1)
+		} else {
+			fmt.Fprintf(os.Stderr, "Position %d passes through fixture %d\n", v.Index, v.Zone+1)
+		}
+	}
+	if len(violations) > 0 {
+		return errors.New(fmt.Sprintf("%d moves pass through fixtures", len(violations)))
 	}
+	return nil
+}
 
-	if *spindleCW > 0 {
-		machine.EnforceSpindle(true, true, *spindleCW)
-	} else if *spindleCCW > 0 {
-		machine.EnforceSpindle(true, false, *spindleCCW)
+// Prints the moves leaving the travel of the machine.
+func printEnvelopeViolations(violations []vm.EnvelopeViolation) {
+	for idx, v := range violations {
+		if idx == maxSimulationReports {
+			fmt.Fprintf(os.Stderr, "... and %d more\n", len(violations)-idx)
+			break
+		}
+		if v.Line > 0 {
+			fmt.Fprintf(os.Stderr, "Line %d leaves the machine travel in %s\n", v.Line, v.Axes)
+		} else {
+			fmt.Fprintf(os.Stderr, "Position %d leaves the machine travel in %s\n", v.Index, v.Axes)
+		}
 	}
+}
 
-	if *stats {
-		printStats(&machine)
+// Checks that all moves are within the travel of the machine, and prints
+// the moves that are not. Returns an error if any move is not.
+func checkEnvelope(m *vm.Machine) error {
+	b, err := parseBox(*envelope)
+	if err != nil {
+		return err
+	}
+	violations := m.CheckEnvelope(b)
+	printEnvelopeViolations(violations)
+	if len(violations) > 0 {
+		return errors.New(fmt.Sprintf("%d moves leave the machine travel", len(violations)))
 	}
+	return nil
+}
 
-	// Handle VM output
-	if *debugDump {
-		machine.Dump()
+// Returns the spindle speed ranges given by the flags, which are empty if
+// none are given.
+func spindleRanges() ([]vm.SpindleRange, error) {
+	var ranges []vm.SpindleRange
+	for _, r := range *spindleRngs {
+		parts := strings.Split(r, "-")
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid spindle range: %s", r))
+		}
+		min, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		max, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 != nil || err2 != nil || min > max {
+			return nil, errors.New(fmt.Sprintf("Invalid spindle range: %s", r))
+		}
+		ranges = append(ranges, vm.SpindleRange{Min: min, Max: max})
 	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Could not export vm state: %s\n", err)
-		os.Exit(3)
+	if len(ranges) == 0 && (*spindleMin > 0 || *spindleMax > 0) {
+		max := *spindleMax
+		if max <= 0 {
+			max = math.Inf(1)
+		}
+		ranges = append(ranges, vm.SpindleRange{Min: *spindleMin, Max: max})
 	}
+	return ranges, nil
+}
 
-	if *dumpStdout {
-		g := export.StringCodeGenerator{Precision: *precision}
-		g.Init()
-		export.HandleAllPositions(&machine, &g)
-		fmt.Printf(g.Retrieve())
+// Checks spindle speeds against the spindle ranges, and prints those outside
+// them. Returns an error if any are, unless they are clamped.
+func checkSpindle(m *vm.Machine) error {
+	ranges, err := spindleRanges()
+	if err != nil {
+		return err
 	}
 
-	if *outputFile != "" {
-		g := export.StringCodeGenerator{Precision: *precision}
-		g.Init()
-		export.HandleAllPositions(&machine, &g)
+	violations := m.CheckSpindleSpeeds(ranges, *clampSpeed)
+	for idx, v := range violations {
+		if idx == maxSimulationReports {
+			fmt.Fprintf(os.Stderr, "... and %d more\n", len(violations)-idx)
+			break
+		}
+		where := fmt.Sprintf("Position %d", v.Index)
+		if v.Line > 0 {
+			where = fmt.Sprintf("Line %d", v.Line)
+		}
+		if *clampSpeed {
+			fmt.Fprintf(os.Stderr, "Warning: %s: spindle speed S%g clamped to S%g\n", where, v.Speed, v.Nearest)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: spindle speed S%g is outside the spindle range, nearest is S%g\n", where, v.Speed, v.Nearest)
+		}
+	}
+	if len(violations) > 0 && !*clampSpeed {
+		return errors.New(fmt.Sprintf("%d spindle speeds outside the spindle range", len(violations)))
+	}
+	return nil
+}
 
-		if err := ioutil.WriteFile(*outputFile, []byte(g.Retrieve()), 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
-			os.Exit(2)
+// Returns whether the operation at idx is one of the named operations, by
+// number as in --report or by label.
+func hasOp(names []string, idx int, op vm.Operation) bool {
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if n, err := strconv.Atoi(name); err == nil && n == idx+1 {
+			return true
+		}
+		if op.Label != "" && strings.EqualFold(name, op.Label) {
+			return true
 		}
 	}
+	return false
+}
 
-	if *device != "" {
-		mt := &ManualGenerator{}
-		wt := &WaitGenerator{}
-		s := &streaming.GrblStreamer{}
-		s.Precision = *precision
+// Clears the inside of the deepest closed contour of each operation given by
+// --pocket, right after the operation has lifted out of the stock.
+func pocketOperations(m *vm.Machine) error {
+	if len(*pocketOps) == 0 {
+		return nil
+	}
 
-		generators = append(generators, mt)
-		generators = append(generators, wt)
-		generators = append(generators, s)
+	side, err := contourSides()
+	if err != nil {
+		return err
+	}
+	ops := m.Operations()
+	contours := m.Contours(side)
 
-		s.Init()
-		mt.Init()
+	// Pockets are inserted from the last, so the indexes of earlier operations stay the same
+	for idx := len(ops) - 1; idx >= 0; idx-- {
+		op := ops[idx]
+		if !hasOp(*pocketOps, idx, op) {
+			continue
+		}
 
-		if err := s.Check(&machine); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Incompatibility: %s\n", err)
+		var deepest *vm.Contour
+		for k := range contours {
+			c := &contours[k]
+			if c.Operation == idx && (deepest == nil || m.Positions[c.Start].Z < m.Positions[deepest.Start].Z) {
+				deepest = c
+			}
+		}
+		if deepest == nil {
+			return errors.New(fmt.Sprintf("Operation %d has no closed contour to pocket", idx+1))
 		}
+		if deepest.Side != vm.SideInside {
+			return errors.New(fmt.Sprintf("Contour of operation %d is not cut on the inside, give it with --contourside %d=inside to pocket it", idx+1, idx+1))
+		}
+		pos := m.Positions[deepest.Start]
 
-		if !*autoStart {
-			reader := bufio.NewReader(os.Stdin)
-			fmt.Fprintf(os.Stderr, "Run code? (y/n) ")
-			text, _ := reader.ReadString('\n')
-			if text != "y\n" {
-				fmt.Fprintf(os.Stderr, "Aborting\n")
-				os.Exit(5)
+		// The contour is the path of the center of its tool, unless compensated
+		tool, _ := m.GetTool(pos.State.ToolIndex)
+		wall := tool.Diameter / 2
+		if deepest.Compensated {
+			wall = 0
+		}
+		s := cam.PocketSettings{
+			ToolDiameter:   tool.Diameter,
+			Stepover:       *pocketStepover,
+			Stepdown:       *pocketStepdown,
+			Top:            *stockTop,
+			Depth:          *pocketDepth,
+			Allowance:      *pocketAllowance - wall,
+			SafetyHeight:   *pocketSafety,
+			Feedrate:       *pocketFeed,
+			PlungeFeedrate: *pocketPlunge,
+		}
+		if *pocketTool > 0 && *pocketTool != pos.State.ToolIndex {
+			t, _ := m.GetTool(*pocketTool)
+			if t.Diameter <= 0 {
+				return errors.New(fmt.Sprintf("Unknown diameter of tool %d for pockets, give it with --tool", *pocketTool))
 			}
+			s.Tool, s.ToolDiameter = *pocketTool, t.Diameter
+		}
+		if s.ToolDiameter <= 0 {
+			return errors.New(fmt.Sprintf("Unknown tool diameter for the pocket of operation %d, give it with --tool or use another with --pockettool", idx+1))
+		}
+		if s.Depth <= 0 {
+			s.Depth = *stockTop - pos.Z
+		}
+		if s.Feedrate <= 0 {
+			s.Feedrate = pos.State.Feedrate
 		}
 
-		if err := s.Connect(*device, *baudrate); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Unable to connect to device: %s\n", err)
-			os.Exit(2)
+		// Start after the moves straight up out of the operation
+		end := op.End
+		for end < len(m.Positions) && m.Positions[end].State.MoveMode == vm.MoveModeRapid &&
+			m.SameXY(m.Positions[end].Vector(), m.Positions[end-1].Vector()) && m.Positions[end].Z >= m.Positions[end-1].Z {
+			end++
+		}
+		from := m.Positions[end-1]
+
+		var pocket vm.Machine
+		pocket.State = from.State
+		pocket.Positions = []vm.Position{from}
+		pocket.Tools = m.Tools
+		if s.Tool > 0 {
+			// The length offset follows the tool. The toolchange back to the
+			// tool of the operation is made by the moves after the pocket.
+			if pocket.State.ToolLengthIndex == pocket.State.ToolIndex {
+				pocket.State.ToolLengthIndex = s.Tool
+			}
+			pocket.State.ToolSet = false
+		}
+		boundary := []cam.Contour{cam.ContourBoundary(m, *deepest, m.MaxArcDeviation)}
+		if err := cam.Pocket(&pocket, boundary, s); err != nil {
+			return errors.New(fmt.Sprintf("Pocket of operation %d failed: %s", idx+1, err))
 		}
 
-		pBar := pb.New(len(machine.Positions))
-		pBar.ManualUpdate = true
-		pBar.Format("[=> ]")
-		pBar.Start()
+		// Return to the height the operation was left at
+		last := pocket.Positions[len(pocket.Positions)-1]
+		if !m.Equal(last.Z, from.Z) {
+			last.State.MoveMode = vm.MoveModeRapid
+			last.Z = from.Z
+			pocket.Positions = append(pocket.Positions, last)
+		}
 
-		sigchan := make(chan string, 1)
-		registerSignals(sigchan)
+		positions := append([]vm.Position(nil), m.Positions[:end]...)
+		positions = append(positions, pocket.Positions[1:]...)
+		m.Positions = append(positions, m.Positions[end:]...)
+	}
+	return nil
+}
 
-		go func() {
-			for sig := range sigchan {
-				switch sig {
-				case "interrupt":
-					fmt.Fprintf(os.Stderr, "\nStopping...\n")
-					s.Stop()
-					os.Exit(5)
-				case "stop":
-					s.Pause()
-					fmt.Fprintf(os.Stderr, "\nPaused. Press <ENTER> to continue")
-					reader := bufio.NewReader(os.Stdin)
-					_, _ = reader.ReadString('\n')
-					s.Start()
-					pBar.Update()
-				}
-			}
-		}()
+// Rewrites the job to run only the operations selected by --onlytool,
+// --skiptool, --onlyop and --skipop, if any.
+func selectOperations(m *vm.Machine) error {
+	if len(*onlyTools) == 0 && len(*skipTools) == 0 && len(*onlyOps) == 0 && len(*skipOps) == 0 {
+		return nil
+	}
 
-		for idx := range machine.Positions {
-			if err := export.HandlePositionAtIndex(&machine, idx, generators...); err != nil {
-				s.Stop()
-				panic(err)
+	hasTool := func(tools []int, op vm.Operation) bool {
+		for _, t := range tools {
+			if t == op.Tool {
+				return true
+			}
+		}
+		return false
+	}
+	return m.SelectOperations(func(idx int, op vm.Operation) bool {
+		if len(*onlyTools) > 0 && !hasTool(*onlyTools, op) {
+			return false
+		}
+		if len(*onlyOps) > 0 && !hasOp(*onlyOps, idx, op) {
+			return false
+		}
+		return !hasTool(*skipTools, op) && !hasOp(*skipOps, idx, op)
+	})
+}
+
+// Simulates cutting the stock, and prints the outcome. Returns an error if
+// the tool gouges below the floor.
+func simulateCut(m *vm.Machine) error {
+	var s sim.Simulation
+	var err error
+	if s.Stock, err = parseBox(*stock); err != nil {
+		return err
+	}
+	s.Resolution = *stockRes
+	s.Floor = s.Stock.Min.Z
+	if *floor != "" {
+		if s.Floor, err = strconv.ParseFloat(*floor, 64); err != nil {
+			return errors.New(fmt.Sprintf("Invalid floor: %s", *floor))
+		}
+	}
+
+	res, err := s.Run(m)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Simulation\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	fmt.Fprintf(os.Stderr, "   Removed (mm³): %.0f\n", res.Removed)
+	fmt.Fprintf(os.Stderr, "   Remaining (mm³): %.0f\n", res.Remaining)
+	for idx, g := range res.Gouges {
+		if idx == maxSimulationReports {
+			fmt.Fprintf(os.Stderr, "   ... and %d more gouges\n", len(res.Gouges)-idx)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "   Gouge of %g mm below the floor at position %d\n", g.Depth, g.Index)
+	}
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+
+	if len(res.Gouges) > 0 {
+		return errors.New(fmt.Sprintf("Simulation found %d gouges", len(res.Gouges)))
+	}
+	return nil
+}
+
+// Prints a row of the time report.
+func printTimes(name string, t vm.Times) {
+	d := func(d time.Duration) string {
+		return ((d / time.Second) * time.Second).String()
+	}
+	fmt.Fprintf(os.Stderr, "   %-24s %10s %10s %10s %10s %10s\n", name, d(t.Cutting), d(t.Rapid), d(t.Dwell), d(t.ToolChange), d(t.Total()))
+}
+
+func printReport(m *vm.Machine) {
+	r := m.Report()
+	tool := func(op vm.Operation) string {
+		name := "no tool"
+		if op.Tool >= 0 {
+			name = fmt.Sprintf("tool %d", op.Tool)
+		}
+		if op.Label != "" {
+			name += ", " + op.Label
+		}
+		return name
+	}
+
+	fmt.Fprintf(os.Stderr, "Time report\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	fmt.Fprintf(os.Stderr, "   %-24s %10s %10s %10s %10s %10s\n", "", "Cutting", "Rapid", "Dwell", "Toolchange", "Total")
+	for _, t := range r.Tools {
+		if t.Total() == 0 {
+			continue
+		}
+		name := fmt.Sprintf("Tool %d", t.Tool)
+		if t.Tool < 0 {
+			name = "No tool"
+		}
+		printTimes(name, t.Times)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	for idx, op := range r.Operations {
+		printTimes(fmt.Sprintf("Operation %d (%s)", idx+1, tool(op.Operation)), op.Times)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	printTimes("Total", r.Times)
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+}
+
+// Prints the moves with feeds or speeds far off the recommended for the
+// material.
+func printFeeds(m *vm.Machine, name string) error {
+	mat, ok := vm.Materials[strings.ToLower(name)]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown material: %s", name))
+	}
+
+	warnings := m.CheckFeeds(mat, *feedFactor)
+	if len(warnings) == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Feeds and speeds\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	for _, w := range warnings {
+		if w.Line > 0 {
+			fmt.Fprintf(os.Stderr, "   Line %d (tool %d, %d moves): %s\n", w.Line, w.Tool, w.Count, w.Reason)
+		} else {
+			fmt.Fprintf(os.Stderr, "   Position %d (tool %d, %d moves): %s\n", w.Index, w.Tool, w.Count, w.Reason)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	return nil
+}
+
+// The maximum number of Z excursions reported per optimization pass
+const maxExcursionReports = 5
+
+func printOptReport(audits []optimize.Audit) {
+	fmt.Fprintf(os.Stderr, "Optimization report\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	fmt.Fprintf(os.Stderr, "   %-16s %14s %20s %14s\n", "", "Moves removed", "Distance saved (mm)", "Time saved")
+	var total optimize.Audit
+	for _, a := range audits {
+		fmt.Fprintf(os.Stderr, "   %-16s %14d %20.1f %14s\n", a.Pass, a.MovesRemoved(), a.DistanceSaved(), a.TimeSaved())
+		total.Moves += a.MovesRemoved()
+		total.Distance += a.DistanceSaved()
+		total.Time += a.TimeSaved()
+	}
+	fmt.Fprintf(os.Stderr, "   %-16s %14d %20.1f %14s\n", "Total", total.Moves, total.Distance, total.Time)
+
+	for _, a := range audits {
+		for idx, e := range a.Excursions {
+			if idx == maxExcursionReports {
+				fmt.Fprintf(os.Stderr, "   %s: %d more Z excursions\n", a.Pass, len(a.Excursions)-idx)
+				break
+			}
+			at := fmt.Sprintf("position %d", e.Index)
+			if e.Line > 0 {
+				at = fmt.Sprintf("line %d", e.Line)
+			}
+			if e.Rapid {
+				fmt.Fprintf(os.Stderr, "   %s: Rapid move to Z%g at %s, below the rapid moves before the pass\n", a.Pass, e.Z, at)
+			} else {
+				fmt.Fprintf(os.Stderr, "   %s: Move to Z%g at %s, outside the heights before the pass\n", a.Pass, e.Z, at)
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+}
+
+func printFinish(m *vm.Machine) {
+	fmt.Fprintf(os.Stderr, "Surface finish\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	for idx, est := range m.EstimateFinish(*finishDev) {
+		if est.Operation.Label != "" {
+			fmt.Fprintf(os.Stderr, "   Operation %d, %s (tool %d, positions %d-%d):\n", idx+1, est.Operation.Label, est.Operation.Tool, est.Operation.Start, est.Operation.End-1)
+		} else {
+			fmt.Fprintf(os.Stderr, "   Operation %d (tool %d, positions %d-%d):\n", idx+1, est.Operation.Tool, est.Operation.Start, est.Operation.End-1)
+		}
+		fmt.Fprintf(os.Stderr, "      Feed: %g mm/min, speed: %g RPM", est.Feedrate, est.SpindleSpeed)
+		if est.FeedPerTooth > 0 {
+			fmt.Fprintf(os.Stderr, ", feed per tooth: %.4f mm", est.FeedPerTooth)
+		}
+		fmt.Fprintf(os.Stderr, "\n")
+		if est.Stepover > 0 {
+			fmt.Fprintf(os.Stderr, "      Stepover: %.4f mm, scallop height: %.4f mm\n", est.Stepover, est.ScallopHeight)
+		}
+		for _, reason := range est.Reasons {
+			fmt.Fprintf(os.Stderr, "      Poor finish: %s\n", reason)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+}
+
+func printStats(m *vm.Machine) {
+	minx, miny, minz, maxx, maxy, maxz, feedrates := machine.Info()
+	fmt.Fprintf(os.Stderr, "Metrics\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	fmt.Fprintf(os.Stderr, "   Moves: %d\n", len(machine.Positions))
+	fmt.Fprintf(os.Stderr, "   Feedrates (mm/min): ")
+
+	for idx, feed := range feedrates {
+		if feed == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%g", feed)
+		if idx != len(feedrates)-1 {
+			fmt.Fprintf(os.Stderr, ", ")
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	eta := machine.ETA()
+	meta := (eta / time.Second) * time.Second
+	fmt.Fprintf(os.Stderr, "   ETA: %s\n", meta.String())
+	fmt.Fprintf(os.Stderr, "   X (mm): %g <-> %g\n", minx, maxx)
+	fmt.Fprintf(os.Stderr, "   Y (mm): %g <-> %g\n", miny, maxy)
+	fmt.Fprintf(os.Stderr, "   Z (mm): %g <-> %g\n", minz, maxz)
+
+	r := m.Report()
+	fmt.Fprintf(os.Stderr, "   Cutting distance (mm): %.1f\n", r.Distance.Cutting)
+	fmt.Fprintf(os.Stderr, "   Rapid distance (mm): %.1f\n", r.Distance.Rapid)
+	fmt.Fprintf(os.Stderr, "   Plunges: %d\n", r.Plunges)
+	if len(r.Depths) > 0 {
+		fmt.Fprintf(os.Stderr, "   Cutting distance by depth (mm):\n")
+		for _, d := range r.Depths {
+			fmt.Fprintf(os.Stderr, "      Z %g <-> %g: %.1f\n", d.Min, d.Max, d.Distance)
+		}
+	}
+
+	bounds := machine.ToolBounds()
+	var tools []int
+	for tool := range bounds {
+		tools = append(tools, tool)
+	}
+	sort.Ints(tools)
+	for _, tool := range tools {
+		b := bounds[tool]
+		fmt.Fprintf(os.Stderr, "   Tool %d cuts (mm): X %g <-> %g, Y %g <-> %g, Z %g <-> %g\n", tool, b.Min.X, b.Max.X, b.Min.Y, b.Max.Y, b.Min.Z, b.Max.Z)
+	}
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+
+}
+
+// Prints the coordinate systems and offsets the program ended with.
+func printOffsets(m *vm.Machine) {
+	o := m.CoordinateSystems()
+	v := func(v vector.Vector) string {
+		return fmt.Sprintf("X %g, Y %g, Z %g", v.X, v.Y, v.Z)
+	}
+
+	fmt.Fprintf(os.Stderr, "Work offsets (mm)\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	for idx, s := range o.Systems {
+		active := " "
+		if idx+1 == o.Active {
+			active = "*"
+		}
+		fmt.Fprintf(os.Stderr, " %s %-6s %s", active, s.Name, v(s.Offset))
+		if s.Rotation != 0 {
+			fmt.Fprintf(os.Stderr, ", R %g", s.Rotation)
+		}
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	g92 := "disabled"
+	if o.OffsetEnabled {
+		g92 = "enabled"
+	}
+	fmt.Fprintf(os.Stderr, "   %-6s %s (%s)\n", "G92", v(o.Offset), g92)
+	if o.Active == 0 {
+		fmt.Fprintf(os.Stderr, "   No coordinate system selected\n")
+	}
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+}
+
+// Returns the side of the contours of each operation as given by
+// --contourside.
+func contourSides() (func(int, vm.Operation) int, error) {
+	sides := make(map[string]int)
+	for name, side := range *contourSide {
+		switch strings.ToLower(strings.TrimSpace(side)) {
+		case "outside":
+			sides[strings.ToLower(strings.TrimSpace(name))] = vm.SideOutside
+		case "inside":
+			sides[strings.ToLower(strings.TrimSpace(name))] = vm.SideInside
+		default:
+			return nil, errors.New(fmt.Sprintf("Invalid contour side for %s: %s", name, side))
+		}
+	}
+
+	return func(idx int, op vm.Operation) int {
+		if side, ok := sides[strconv.Itoa(idx+1)]; ok {
+			return side
+		}
+		if side, ok := sides[strings.ToLower(op.Label)]; ok && op.Label != "" {
+			return side
+		}
+		return sides["all"]
+	}, nil
+}
+
+// Reverses the closed contours to be milled in the direction given by
+// --milling.
+func setCutDirection(m *vm.Machine) error {
+	var direction int
+	switch strings.ToLower(*milling) {
+	case "":
+		return nil
+	case "climb":
+		direction = vm.CutDirectionClimb
+	case "conventional":
+		direction = vm.CutDirectionConventional
+	default:
+		return errors.New(fmt.Sprintf("Invalid milling direction: %s", *milling))
+	}
+
+	side, err := contourSides()
+	if err != nil {
+		return err
+	}
+	reversed, compensated := m.SetCutDirection(direction, side)
+	fmt.Fprintf(os.Stderr, "Milling: %d contours reversed to %s milling\n", reversed, strings.ToLower(*milling))
+	if compensated > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d contours with cutter compensation were not reversed\n", compensated)
+	}
+	return nil
+}
+
+// Prints the closed contours and their milling direction.
+func printContours(m *vm.Machine) error {
+	side, err := contourSides()
+	if err != nil {
+		return err
+	}
+	sides := []string{"unknown side", "outside", "inside"}
+	directions := []string{"unknown", "climb", "conventional"}
+
+	fmt.Fprintf(os.Stderr, "Contours\n")
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	for _, c := range m.Contours(side) {
+		turn := "counter-clockwise"
+		if c.Clockwise {
+			turn = "clockwise"
+		}
+		line := ""
+		if l := m.Positions[c.Start].Line; l > 0 {
+			line = fmt.Sprintf(", line %d", l)
+		}
+		comp := ""
+		if c.Compensated {
+			comp = ", cutter compensation"
+		}
+		fmt.Fprintf(os.Stderr, "   Operation %d%s: %s at Z %g, %s%s: %s\n", c.Operation+1, line, turn,
+			m.Positions[c.Start].Z, sides[c.Side], comp, directions[c.Direction])
+	}
+	fmt.Fprintf(os.Stderr, "-------------------------\n")
+	return nil
+}
+
+// Renders a top-down preview of the toolpath to a PNG file.
+func writePreview(m *vm.Machine, path string) error {
+	g := export.ImageGenerator{DPI: *previewDPI}
+	if *previewBounds != "" {
+		b, err := parseFloats(*previewBounds, 4)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid bounds: %s", *previewBounds))
+		}
+		g.MinX, g.MinY, g.MaxX, g.MaxY = b[0], b[1], b[2], b[3]
+	}
+	g.Init()
+	if err := export.HandleAllPositions(m, &g); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return g.WritePNG(f)
+}
+
+// Loads the parameters from the var file, and those set on the command-line.
+func loadParameters() (*gcode.Parameters, error) {
+	params := gcode.NewParameters()
+	if *varFile != "" {
+		vhandle, err := os.Open(*varFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not open file: %s", err))
+		}
+		err = params.ReadVar(vhandle)
+		vhandle.Close()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read var file: %s", err))
+		}
+	}
+
+	for key, val := range *setParams {
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for parameter %s: %s", key, err))
+		}
+		params.Set(key, f)
+	}
+	return params, nil
+}
+
+// Loads the post-processor configuration, if given. Arc optimizations are
+// rejected if it does not support arcs.
+func loadPostConfig() (*export.PostConfig, error) {
+	if *postFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(*postFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not open file: %s", err))
+	}
+	defer f.Close()
+	post, err := export.ReadPostConfig(f)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read post configuration: %s", err))
+	}
+	if !post.Arcs && (*optArcFit || *optCornerBlend) {
+		return nil, errors.New(fmt.Sprintf("Post %s does not support arcs, as used by --optarcfit and --optcornerblend", post.Name))
+	}
+	// G20 is put in at the start when exporting in inches
+	if *outUnits == "inch" || *outUnits == "native" || (*outUnits == "" && post.Imperial) {
+		if err := post.Require("G20"); err != nil {
+			return nil, errors.New(fmt.Sprintf("Post cannot export in inches: %s", err))
+		}
+	}
+	if *safeStart || post.SafeStart {
+		if err := post.Require(append(export.SafeStartCodes, postUnitCodes(post)...)...); err != nil {
+			return nil, errors.New(fmt.Sprintf("Post cannot be used with a safe start: %s", err))
+		}
+	}
+	switch {
+	case *fanucOutput:
+		if err := post.Require(append(export.FanucCodes, postUnitCodes(post)...)...); err != nil {
+			return nil, errors.New(fmt.Sprintf("Post cannot be used with --fanuc: %s", err))
+		}
+	case *machOutput:
+		if err := post.Require(append(export.MachCodes, postUnitCodes(post)...)...); err != nil {
+			return nil, errors.New(fmt.Sprintf("Post cannot be used with --mach: %s", err))
+		}
+	}
+	// The park position is checked after prepare, and plays no part in the codes
+	if e, _ := epilogue(&vm.Machine{}); e != nil {
+		if *fanucOutput {
+			// Fanuc programs always end with M30
+			e.End = 0
+		}
+		if err := post.Require(e.Codes()...); err != nil {
+			return nil, errors.New(fmt.Sprintf("Post cannot be used with the shutdown sequence: %s", err))
+		}
+	}
+	return post, nil
+}
+
+// Returns the G codes of the units the program may be exported in with the
+// post, G20 for inches and G21 for millimetres, being both for native units,
+// as those of the program are not known yet.
+func postUnitCodes(post *export.PostConfig) []string {
+	switch *outUnits {
+	case "inch":
+		return []string{"G20"}
+	case "mm":
+		return []string{"G21"}
+	case "native":
+		return []string{"G20", "G21"}
+	}
+	if post.Imperial {
+		return []string{"G20"}
+	}
+	return []string{"G21"}
+}
+
+// Reads the lines of a macro file, if given.
+func readMacro(name string) ([]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read macro: %s", err))
+	}
+	return strings.Split(strings.TrimRight(string(b), "\r\n"), "\n"), nil
+}
+
+// Loads the header, footer and toolchange macros.
+func loadMacros() (export.Macros, error) {
+	var (
+		macros export.Macros
+		err    error
+	)
+	for _, x := range []struct {
+		lines *[]string
+		name  string
+	}{
+		{&macros.Header, *headerFile},
+		{&macros.Footer, *footerFile},
+		{&macros.BeforeToolChange, *beforeToolFile},
+		{&macros.AfterToolChange, *afterToolFile},
+	} {
+		if *x.lines, err = readMacro(x.name); err != nil {
+			return macros, err
+		}
+	}
+	return macros, nil
+}
+
+// Returns the formatting of numbers given by the flags, or nil if the
+// precision alone is used.
+func outputFormat() (*export.Format, error) {
+	if len(*wordPrecision) == 0 && !*trailingZeros && !*decimalPoint && *leadingZeros == 0 {
+		return nil, nil
+	}
+	f := export.NewFormat(*precision)
+	f.TrailingZeros = *trailingZeros
+	f.DecimalPoint = *decimalPoint
+	f.Width = *leadingZeros
+	for address, val := range *wordPrecision {
+		p, err := strconv.Atoi(val)
+		if len(address) != 1 || err != nil || p < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid word precision: %s=%s", address, val))
+		}
+		f.Precisions[rune(strings.ToUpper(address)[0])] = p
+	}
+	return f, nil
+}
+
+// Returns whether to export in inches, and whether --units says either way.
+// Native units are those the program ends in.
+func imperialOutput(m *vm.Machine) (bool, bool) {
+	switch *outUnits {
+	case "inch":
+		return true, true
+	case "native":
+		return m.Imperial, true
+	case "mm":
+		return false, true
+	}
+	return false, false
+}
+
+// Returns the M codes of coolant channels given by the flags.
+func coolantCodes() (map[int]vm.CoolantCodes, error) {
+	codes := make(map[int]vm.CoolantCodes)
+	for name, val := range *coolantCodeFlags {
+		channel, c, err := vm.ParseCoolantCodes(name, val)
+		if err != nil {
+			return nil, err
+		}
+		codes[channel] = c
+	}
+	return codes, nil
+}
+
+// Returns a position to park at given by --park, in machine coordinates.
+func parkPosition(m *vm.Machine, name string) (vector.Vector, error) {
+	switch strings.ToLower(name) {
+	case "g28":
+		return m.StoredPos1, nil
+	case "g30":
+		return m.StoredPos2, nil
+	}
+	pos, ok := (*positions)[name]
+	if !ok {
+		pos = name
+	}
+	v, err := parseFloats(pos, 3)
+	if err != nil {
+		return vector.Vector{}, errors.New(fmt.Sprintf("Invalid park position: %s", name))
+	}
+	return vector.Vector{v[0], v[1], v[2]}, nil
+}
+
+// Returns the position to return to at the end of the program, X0 Y0 Z0
+// unless given by --returnto. The return is made of moves of the program, so
+// the position is in work coordinates, unlike those of --park.
+func returnPosition() (*vector.Vector, error) {
+	if *returnTo == "" {
+		return &vector.Vector{}, nil
+	}
+	v, err := parseFloats(*returnTo, 3)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid return position: %s (x,y,z in work coordinates, use --park for machine coordinates)", *returnTo))
+	}
+	return &vector.Vector{v[0], v[1], v[2]}, nil
+}
+
+// Returns the shutdown sequence given by the flags, or nil if none is.
+func epilogue(m *vm.Machine) (*export.Epilogue, error) {
+	e := &export.Epilogue{StopSpindle: *endSpindle, StopCoolant: *endCoolant, Pallet: *pallet}
+	switch strings.ToLower(*endCode) {
+	case "":
+	case "m2":
+		e.End = 2
+	case "m30":
+		e.End = 30
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid program end: %s", *endCode))
+	}
+	if *pallet < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid pallet M code: %d", *pallet))
+	}
+	if *park != "" {
+		pos, err := parkPosition(m, *park)
+		if err != nil {
+			return nil, err
+		}
+		e.Park = &pos
+	}
+	if !e.StopSpindle && !e.StopCoolant && e.Park == nil && e.Pallet == 0 && e.End == 0 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// Returns the macros with the shutdown sequence put in before the footer,
+// written as the string and Grbl generators write gcode.
+func withEpilogue(m *vm.Machine, macros export.Macros, format *export.Format, imperial bool) export.Macros {
+	// Checked by main after prepare
+	e, _ := epilogue(m)
+	if e == nil {
+		return macros
+	}
+	c := export.NewPostConfig()
+	c.Format = *export.NewFormat(*precision)
+	if format != nil {
+		c.Format = *format
+	}
+	c.Imperial = imperial
+	macros.Footer = append(e.Blocks(c), macros.Footer...)
+	return macros
+}
+
+// Returns a generator for the gcode output, for Fanuc, Mach or the post if
+// given, or with the macros otherwise. The format, if set, overrides that of
+// the post. Parts of a split program are numbered from 0, and are given
+// their own program numbers for Fanuc.
+func outputGenerator(m *vm.Machine, post *export.PostConfig, format *export.Format, macros export.Macros, source *gcode.Document, part int) export.LineGenerator {
+	if !*fanucOutput && !*machOutput && post == nil {
+		macros.Tools = m.Tools
+		g := &export.StringCodeGenerator{Precision: *precision, Format: format, Source: source, Macros: macros, CoolantCodes: m.CoolantCodes}
+		if *outDwell != "" {
+			// Checked by prepare
+			g.DwellUnit, _ = vm.ParseDwellUnit(*outDwell)
+		}
+		g.Imperial, _ = imperialOutput(m)
+		g.SafeStart = *safeStart
+		g.Macros = withEpilogue(m, g.Macros, format, g.Imperial)
+		return g
+	}
+
+	var config *export.PostConfig
+	switch {
+	case post != nil:
+		c := *post
+		config = &c
+	case *fanucOutput:
+		config = export.FanucConfig(*blockStep)
+	default:
+		config = export.MachConfig()
+	}
+	if format != nil {
+		config.Format = *format
+	}
+
+	if *outDwell != "" {
+		// Checked by prepare
+		config.DwellUnit, _ = vm.ParseDwellUnit(*outDwell)
+	}
+	if imperial, ok := imperialOutput(m); ok {
+		config.Imperial = imperial
+	}
+	if *safeStart {
+		config.SafeStart = true
+	}
+
+	// The flags were checked by prepare, and override the codes of the post
+	codes, _ := coolantCodes()
+	if len(codes) > 0 {
+		merged := make(map[int]vm.CoolantCodes)
+		for channel, c := range config.Coolant {
+			merged[channel] = c
+		}
+		for channel, c := range codes {
+			merged[channel] = c
+		}
+		config.Coolant = merged
+	}
+
+	if e, _ := epilogue(m); e != nil {
+		switch {
+		case *fanucOutput:
+			// Fanuc programs always end with M30
+			e.End = 0
+		case post == nil && e.End != 0:
+			// The end code takes the place of the M30 of the Mach footer
+			config.Footer = nil
+		}
+		config.Footer = append(e.Blocks(config), config.Footer...)
+	}
+
+	switch {
+	case *fanucOutput:
+		g := &export.FanucGenerator{Program: *programNumber + part}
+		g.Config = config
+		return g
+	case *machOutput:
+		g := &export.MachGenerator{Tools: m.Tools}
+		g.Config = config
+		return g
+	}
+	return &export.ConfigurableGenerator{Config: config}
+}
+
+// Exports the positions of the machine as gcode to w, with the generator of
+// outputGenerator. The default gcode is written as it is generated.
+func exportCode(w io.Writer, m *vm.Machine, post *export.PostConfig, format *export.Format, macros export.Macros, source *gcode.Document) error {
+	g := outputGenerator(m, post, format, macros, source, 0)
+	if sg, ok := g.(*export.StringCodeGenerator); ok {
+		wg := export.WriterGenerator{StringCodeGenerator: *sg, Writer: w}
+		wg.Init()
+		if err := export.HandleAllPositions(m, &wg); err != nil {
+			return err
+		}
+		return wg.Close()
+	}
+
+	g.Init()
+	if err := export.HandleAllPositions(m, g); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, g.Retrieve())
+	return err
+}
+
+// Returns the name of a part of a split program, such as part-2.nc for
+// part.nc, keeping the extensions of compressed files last.
+func partName(name string, part int) string {
+	return suffixedName(name, fmt.Sprintf("%d", part))
+}
+
+// Returns the name of the program of a tool, such as part-T2.nc for part.nc.
+func toolFileName(name string, tool int) string {
+	if tool < 0 {
+		return suffixedName(name, "notool")
+	}
+	return suffixedName(name, fmt.Sprintf("T%d", tool))
+}
+
+// Returns name with a suffix before the extension, such as part-2.nc for
+// part.nc, keeping the extensions of compressed files last.
+func suffixedName(name, suffix string) string {
+	compressed := ""
+	if ext := strings.ToLower(filepath.Ext(name)); ext == ".gz" || ext == ".zip" {
+		name, compressed = name[:len(name)-len(ext)], name[len(name)-len(ext):]
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%s%s%s", name[:len(name)-len(ext)], suffix, ext, compressed)
+}
+
+// Writes data to a file, compressed if it is named .gz or .zip.
+func writeFile(name string, data []byte) error {
+	f, err := export.CreateFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Discard()
+		return err
+	}
+	return f.Close()
+}
+
+// Returns whether a file is imported rather than parsed as gcode, by its extension.
+func imported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".drl", ".xln", ".exc", ".plt", ".hpgl", ".hpg", ".svg", ".stl":
+		return true
+	}
+	return false
+}
+
+// Parses code, runs it through the VM, and applies the requested
+// optimizations and modifications. Several gcode programs are run one after
+// another, keeping the state between them. Drill files are recognized by the
+// extension of their name, and imported instead of parsed as gcode, which
+// only works for a single file. Returns the parsed document, with the blocks
+// of all programs, or nil if the code was imported.
+func prepare(m *vm.Machine, names, codes []string, params *gcode.Parameters) (*gcode.Document, error) {
+	var document *gcode.Document
+
+	if len(names) > 1 {
+		for _, name := range names {
+			if imported(name) {
+				return nil, errors.New(fmt.Sprintf("Error: Only gcode can be combined with other files: %s", name))
+			}
+		}
+	}
+	name, code := names[0], codes[0]
+
+	// Run through the VM
+	m.Init()
+	m.IgnoreBlockDelete = *ignBlockDel
+	m.AllowRemainingWords = *allowRemainingWords
+	m.MaxArcDeviation = *maxArcDeviation
+	m.MinArcLineLength = *minArcLineLength
+	if *tolerance < 0 {
+		return nil, errors.New("Error: Tolerance cannot be negative")
+	}
+	m.Tolerance = *tolerance
+	export.Tolerance = *tolerance
+	m.EntryAngle = *entryAngle
+	m.EntryDiameter = *helixDiameter
+	m.StockTop = *stockTop
+	m.KeepArcs = *machOutput || *fanucOutput
+	unit, err := vm.ParseDwellUnit(*dwellUnit)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error: %s", err))
+	}
+	m.DwellUnit = unit
+	if *outDwell != "" {
+		if _, err := vm.ParseDwellUnit(*outDwell); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error: %s", err))
+		}
+	}
+	switch *outUnits {
+	case "", "mm", "inch", "native":
+	default:
+		return nil, errors.New(fmt.Sprintf("Error: Invalid units: %s", *outUnits))
+	}
+	for _, t := range *tools {
+		idx, tool, err := parseTool(t)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error: %s", err))
+		}
+		m.SetTool(idx, tool)
+	}
+	coolant, err := coolantCodes()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error: %s", err))
+	}
+	for channel, c := range coolant {
+		m.CoolantCodes[channel] = c
+	}
+	if *varFile != "" {
+		m.LoadParameters(params)
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".drl", ".xln", ".exc":
+		drill := vm.DrillSettings{
+			SafetyHeight: *drillSafety,
+			Depth:        *drillDepth,
+			Feedrate:     *drillPlunge,
+			SpindleSpeed: *drillSpindle,
+		}
+		if err := m.ImportExcellon(strings.NewReader(code), drill); err != nil {
+			return nil, errors.New(fmt.Sprintf("Drill file import failed: %s", err))
+		}
+	case ".plt", ".hpgl", ".hpg":
+		pen := vm.PenSettings{
+			UpHeight:   *penUp,
+			DownHeight: *penDown,
+			Feedrate:   *penFeed,
+		}
+		if err := m.ImportHPGL(strings.NewReader(code), pen); err != nil {
+			return nil, errors.New(fmt.Sprintf("HPGL import failed: %s", err))
+		}
+	case ".svg":
+		svg := vm.SVGSettings{
+			SafetyHeight:   *svgSafety,
+			Depth:          *svgDepth,
+			Stepdown:       *svgStepdown,
+			Feedrate:       *svgFeed,
+			PlungeFeedrate: *svgPlunge,
+			SpindleSpeed:   *svgSpindle,
+			Tolerance:      *svgTolerance,
+			Scale:          *svgScale,
+		}
+		if err := m.ImportSVG(strings.NewReader(code), svg); err != nil {
+			return nil, errors.New(fmt.Sprintf("SVG import failed: %s", err))
+		}
+	case ".stl":
+		mesh, err := cam.LoadSTL(strings.NewReader(code))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("STL import failed: %s", err))
+		}
+		rough := cam.RoughingSettings{
+			ToolDiameter:   *roughTool,
+			Stepover:       *roughStepover,
+			Stepdown:       *roughStepdown,
+			Allowance:      *roughAllowance,
+			SafetyHeight:   *roughSafety,
+			Feedrate:       *roughFeed,
+			PlungeFeedrate: *roughPlunge,
+			SpindleSpeed:   *roughSpindle,
+		}
+		if err := cam.Rough(m, mesh, rough); err != nil {
+			return nil, errors.New(fmt.Sprintf("Roughing failed: %s", err))
+		}
+	default:
+		parse := gcode.ParseWithParameters
+		if *lenientParse {
+			parse = gcode.ParseLenientWithParameters
+		}
+		document = &gcode.Document{}
+		docs := make([]*gcode.Document, len(codes))
+		for idx, code := range codes {
+			var err error
+			docs[idx], err = parse(code, params)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Parse error: %s: %s", names[idx], err))
+			}
+			if *validate {
+				if diags := gcode.Validate(docs[idx]); len(diags) > 0 {
+					l := make([]string, len(diags))
+					for k, d := range diags {
+						l[k] = d.Error()
+					}
+					return nil, errors.New(fmt.Sprintf("Validation of %s failed:\n  %s", names[idx], strings.Join(l, "\n  ")))
+				}
+			}
+			if *safeStart {
+				for _, d := range gcode.ValidateInitialState(docs[idx]) {
+					fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", names[idx], d)
+				}
+			}
+			document.Blocks = append(document.Blocks, docs[idx].Blocks...)
+		}
+		if err := m.ProcessAll(docs...); err != nil {
+			return nil, errors.New(fmt.Sprintf("VM failed: %s", err))
+		}
+	}
+
+	if err := pocketOperations(m); err != nil {
+		return nil, err
+	}
+
+	if err := setCutDirection(m); err != nil {
+		return nil, err
+	}
+
+	// Optimize as requested
+	if *opt {
+		var audits []optimize.Audit
+		run := func(name string, pass func()) {
+			if *optReport {
+				audits = append(audits, optimize.AuditPass(m, name, pass))
+			} else {
+				pass()
+			}
+		}
+
+		// Passes working within operations can be run on several at once
+		perOp := func(pass func(*vm.Machine)) {
+			if *optWorkers == 1 {
+				pass(m)
+			} else {
+				optimize.OptParallel(m, *optWorkers, pass)
+			}
+		}
+
+		if *optDrillSpeed {
+			run("Drill speed", func() { optimize.OptDrillSpeed(m, *drillfeed, *rapiddrill) })
+		}
+
+		if *optFloatingZ {
+			run("Floating Z", func() { optimize.OptFloatingZ(m, *floatingzheight) })
+		}
+
+		if *optDuplicates {
+			run("Duplicate passes", func() {
+				for _, d := range optimize.OptDuplicatePasses(m) {
+					if d.Line > 0 {
+						fmt.Fprintf(os.Stderr, "Removed duplicate pass at line %d\n", d.Line)
+					} else {
+						fmt.Fprintf(os.Stderr, "Removed duplicate pass at position %d\n", d.Start)
+					}
+				}
+			})
+		}
+
+		if *optPathGrouping {
+			run("Path grouping", func() {
+				if err := optimize.OptPathGrouping(m, *rtolerance, *stockTop); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Could not execute path grouping: %s\n", err)
+				}
+			})
+		}
+
+		if *optPathOrdering {
+			run("Path ordering", func() {
+				if err := optimize.OptPathOrdering(m, *rtolerance, *stockTop, *orderSteps); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Could not execute path ordering: %s\n", err)
+				}
+			})
+		}
+
+		if *optRegionOrder {
+			run("Region ordering", func() { optimize.OptRegionOrdering(m, *regionMargin) })
+		}
+
+		if *optLoopStart {
+			run("Loop start", func() { optimize.OptLoopStart(m) })
+		}
+
+		if *optBogusMove {
+			run("Bogus moves", func() { optimize.OptBogusMoves(m) })
+		}
+
+		if *optVector {
+			run("Vector", func() { perOp(func(m *vm.Machine) { optimize.OptVector(m, *vtolerance) }) })
+		}
+
+		if *optSimplify {
+			run("Simplify", func() { perOp(func(m *vm.Machine) { optimize.OptSimplify(m, *stolerance) }) })
+		}
+
+		if *optLiftSpeed {
+			run("Lift speed", func() { optimize.OptLiftSpeed(m) })
+		}
+
+		if *optArcFit {
+			run("Arc fitting", func() { perOp(func(m *vm.Machine) { optimize.OptArcFit(m, *atolerance) }) })
+		}
+
+		if *optCornerBlend {
+			run("Corner blending", func() { optimize.OptCornerBlend(m, *btolerance) })
+		}
+
+		if *optLeadInOut {
+			side, err := contourSides()
+			if err != nil {
+				return nil, err
+			}
+			run("Lead-in and lead-out", func() { optimize.OptLeadInOut(m, *leadRadius, side) })
+		}
+
+		if *optRampEntry {
+			run("Ramp entry", func() { optimize.OptRampEntry(m, *rampAngle, *helixDiameter, *stockTop) })
+		}
+
+		if *optPeckDrill {
+			run("Peck drilling", func() { optimize.OptPeckDrill(m, *peckDepth, *peckRetract) })
+		}
+
+		if *optAdaptiveFeed {
+			run("Adaptive feed", func() { optimize.OptAdaptiveFeed(m, *acceleration, *junctionDev) })
+		}
+
+		if *optSpindleStops {
+			run("Spindle stops", func() { optimize.OptSpindleStops(m, *spindleIdle) })
+		}
+
+		if *optPrepareTool {
+			run("Prepare tool", func() { optimize.OptPrepareTool(m) })
+		}
+
+		if *optReport {
+			printOptReport(audits)
+		}
+	}
+
+	// Apply requested modifications, which can take moves out of the travel
+	// of the machine
+	var (
+		travel      vm.Box
+		outOfTravel map[[2]int]bool
+	)
+	// Blocks are identified by line, or by index if the line is unknown
+	block := func(v vm.EnvelopeViolation) [2]int {
+		if v.Line > 0 {
+			return [2]int{v.Line, 0}
+		}
+		return [2]int{0, v.Index}
+	}
+	if *envelope != "" {
+		var err error
+		if travel, err = parseBox(*envelope); err != nil {
+			return nil, err
+		}
+		outOfTravel = make(map[[2]int]bool)
+		for _, v := range m.CheckEnvelope(travel) {
+			outOfTravel[block(v)] = true
+		}
+	}
+
+	if *flipXY {
+		m.FlipXY()
+	}
+
+	if *allowance != 0 {
+		side, err := contourSides()
+		if err != nil {
+			return nil, err
+		}
+		offset, failed := m.OffsetContours(*allowance, side)
+		fmt.Fprintf(os.Stderr, "Allowance: %d contours offset by %g mm\n", offset, *allowance)
+		if failed > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d contours could not be offset by %g mm\n", failed, *allowance)
+		}
+	}
+
+	if *plasma {
+		if *spindleCW > 0 || *spindleCCW > 0 {
+			return nil, errors.New("Error: --plasma cannot be combined with --spindlecw or --spindleccw")
+		}
+		if _, ok := m.CoolantCodes[vm.CoolantTHC]; *plasmaTHC && !ok && *postFile == "" {
+			return nil, errors.New("Error: --plasmathc needs M codes for torch height control, such as --coolantcode thc=M62,M63")
+		}
+		if *plasmaKerf != 0 {
+			side, err := contourSides()
+			if err != nil {
+				return nil, err
+			}
+			offset, failed := m.OffsetContours(*plasmaKerf/2, side)
+			fmt.Fprintf(os.Stderr, "Kerf: %d contours offset by %g mm\n", offset, *plasmaKerf/2)
+			if failed > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %d contours could not be offset by %g mm\n", failed, *plasmaKerf/2)
+			}
+		}
+		pierces, err := m.Plasma(vm.PlasmaSettings{
+			PierceHeight:   *plasmaPierce,
+			CutHeight:      *plasmaCut,
+			TravelHeight:   *plasmaTravel,
+			PierceDelay:    *plasmaDelay,
+			PierceFeedrate: *plasmaFeed,
+			THC:            *plasmaTHC,
+		})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error: %s", err))
+		}
+		fmt.Fprintf(os.Stderr, "Plasma: %d pierces\n", pierces)
+	}
+
+	if *clearance > 0 {
+		heights, err := optimize.OptNormalizeSafeHeight(m, *clearance)
+		var found []string
+		for _, h := range heights {
+			found = append(found, fmt.Sprintf("%g", h))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not normalize clearance heights (%s mm): %s\n", strings.Join(found, ", "), err)
+		} else if len(heights) > 0 {
+			fmt.Fprintf(os.Stderr, "Clearance heights %s mm set to %g mm\n", strings.Join(found, ", "), *clearance)
+		}
+	}
+
+	if *safetyHeight > 0 {
+		changes, err := m.SetSafetyHeight(*safetyHeight)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not set safety height: %s\n", err)
+		}
+		for _, c := range changes {
+			fmt.Fprintf(os.Stderr, "Safety height: %d moves at %g mm set to %g mm\n", c.Moves, c.Height, *safetyHeight)
+		}
+	}
+
+	if *plungeFeed > 0 {
+		n := m.SetPlungeFeed(*plungeFeed)
+		fmt.Fprintf(os.Stderr, "Plunge feed: %d plunges set to %g mm/min\n", n, *plungeFeed)
+	}
+
+	if *feedLimit > 0 {
+		m.LimitFeedrate(*feedLimit)
+	}
+
+	if *multiplyFeed != 0 {
+		m.FeedrateMultiplier(*multiplyFeed)
+	}
+
+	if *multiplyMove != 0 {
+		m.MoveMultiplier(*multiplyMove)
+	}
+
+	if *enforceReturn {
+		home, err := returnPosition()
+		if err != nil {
+			return nil, err
+		}
+		m.ReturnTo(*home, true, true)
+	}
+
+	// The modifications only change moves in place or add moves at the end,
+	// so moves keep their index
+	if outOfTravel != nil {
+		var added []vm.EnvelopeViolation
+		for _, v := range m.CheckEnvelope(travel) {
+			if !outOfTravel[block(v)] {
+				added = append(added, v)
+			}
+		}
+		if len(added) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d moves taken out of the machine travel by transforms and height changes:\n", len(added))
+			printEnvelopeViolations(added)
+		}
+	}
+
+	if *spindleCW > 0 {
+		m.EnforceSpindle(true, true, *spindleCW)
+	} else if *spindleCCW > 0 {
+		m.EnforceSpindle(true, false, *spindleCCW)
+	}
+
+	if *feedPerMinute || *device != "" || *simulate || *duet != "" {
+		if err := m.FeedPerMinute(); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error: Could not convert feeds per revolution: %s", err))
+		}
+	}
+
+	if *spindleRamp > 0 {
+		m.SpindleRamp(*spindleRamp)
+	}
+	return document, nil
+}
+
+// Creates a streamer for the configured device, RepRap firmware, or a
+// simulated Grbl. Returns the streamer, along with the GrblStreamer it is
+// built on.
+func newStreamer() (streaming.Streamer, *streaming.GrblStreamer) {
+	var st streaming.Streamer
+	var s *streaming.GrblStreamer
+	if *simulate {
+		sim := &streaming.SimStreamer{
+			Latency:    time.Duration(*simLatency) * time.Millisecond,
+			BufferSize: *simBuffer,
+			Speed:      *simSpeed,
+		}
+		sim.Init()
+		st, s = sim, &sim.GrblStreamer
+	} else if *reprap {
+		r := &streaming.RepRapStreamer{}
+		r.Init()
+		st, s = r, &r.GrblStreamer
+	} else {
+		s = &streaming.GrblStreamer{}
+		s.Init()
+		st = s
+	}
+	s.Precision = *precision
+	s.AutoFix = *grblFix && !*reprap
+	s.SafeStart = *safeStart && !*reprap
+	s.Timeout = time.Duration(*timeout) * time.Second
+	s.Retries = *reconnect
+	s.RetryDelay = time.Duration(*reconnectWait) * time.Second
+	s.KeepAlive = time.Duration(*keepAlive) * time.Second
+	s.OnDisconnect = func(err error) {
+		fmt.Fprintf(os.Stderr, "\n%s\n", err)
+		if *reconnect > 0 {
+			fmt.Fprintf(os.Stderr, "Reconnecting...\n")
+		}
+	}
+	return st, s
+}
+
+//
+// Application flow
+//
+
+func main() {
+	// Parse arguments
+	kingpin.Parse()
+
+	if *dumpSettings != "" || *restoreSettings != "" {
+		manageSettings()
+		return
+	}
+
+	if *jogMode {
+		jog()
+		return
+	}
+
+	if *mdiMode {
+		mdi()
+		return
+	}
+
+	if *serve != "" {
+		serveHTTP(*serve)
+		return
+	}
+
+	if len(*inputFiles) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No input file specified\n")
+		os.Exit(1)
+	}
+
+	if *unlock && *reprap {
+		fmt.Fprintf(os.Stderr, "Error: RepRap firmware has no alarm lock to clear with --unlock\n")
+		os.Exit(1)
+	}
+
+	if *spindleCW != 0 && *spindleCCW != 0 {
+		fmt.Fprintf(os.Stderr, "Error: Cannot force both clockwise and counter clockwise rotation\n")
+		os.Exit(1)
+	}
+
+	// The line is looked up in the final program, so the moves of the lines
+	// before it must still come before it
+	if *startLine > 0 && (*optPathGrouping || *optPathOrdering || *optRegionOrder || *splitTools || *milling != "") {
+		fmt.Fprintf(os.Stderr, "Error: Cannot start at a line of a reordered job (--optpath, --optorder, --optregion, --splittools, --milling)\n")
+		os.Exit(1)
+	}
+
+	// Compressed files are named by their content, to recognize drill files
+	names := make([]string, len(*inputFiles))
+	codes := make([]string, len(*inputFiles))
+	for idx, name := range *inputFiles {
+		code, content, err := gcode.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not open file: %s\n", err)
+			os.Exit(2)
+		}
+		names[idx], codes[idx] = content, code
+	}
+
+	// Parse
+	params, err := loadParameters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(2)
+	}
+
+	post, err := loadPostConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	macros, err := loadMacros()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	format, err := outputFormat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	source, err := prepare(&machine, names, codes, params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(3)
+	}
+	if !*preserve {
+		source = nil
+	}
+
+	if *dumpOffsets {
+		printOffsets(&machine)
+	}
+
+	if *contours {
+		if err := printContours(&machine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if _, err := epilogue(&machine); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *saveVarFile != "" {
+		machine.StoreParameters(params)
+		vhandle, err := os.Create(*saveVarFile)
+		if err == nil {
+			err = params.WriteVar(vhandle)
+			vhandle.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write var file: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if err := selectOperations(&machine); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not select operations: %s\n", err)
+		os.Exit(3)
+	}
+
+	// Front-load the toolchanges, running the jobs of the tools one after another
+	var toolJobs []vm.ToolJob
+	if *splitTools {
+		if *maxLines > 0 || *maxBytes > 0 {
+			fmt.Fprintf(os.Stderr, "Error: Cannot split by tool and by size at once\n")
+			os.Exit(1)
+		}
+		var home *vector.Vector
+		if *enforceReturn {
+			// Checked by prepare
+			home, _ = returnPosition()
+		}
+		toolJobs, err = machine.SplitByTool(home)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not split by tool: %s\n", err)
+			os.Exit(3)
+		}
+		machine.Positions = vm.JoinJobs(toolJobs)
+		source = nil
+	}
+
+	// Resume an interrupted job
+	resumeStart, resumeOffset := 0, 0
+	if *resume {
+		if *checkpointFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: Resume requires a checkpoint file\n")
+			os.Exit(1)
+		}
+		idx, err := streaming.ReadCheckpoint(*checkpointFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not read checkpoint: %s\n", err)
+			os.Exit(2)
+		}
+		*resumeIndex = idx
+	} else if *startLine > 0 {
+		idx, err := machine.IndexAtLine(*startLine)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not start at line %d: %s\n", *startLine, err)
+			os.Exit(3)
+		}
+		*resumeIndex = idx
+	}
+
+	if *resumeIndex > 0 {
+		idx, err := machine.Resume(*resumeIndex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not resume job: %s\n", err)
+			os.Exit(3)
+		}
+		resumeStart, resumeOffset = idx, *resumeIndex-idx
+		fmt.Fprintf(os.Stderr, "Resuming from position %d\n", *resumeIndex)
+	}
+
+	if *stats {
+		printStats(&machine)
+	}
+
+	if *report {
+		printReport(&machine)
+	}
+
+	if *finish {
+		printFinish(&machine)
+	}
+
+	if *material != "" {
+		if err := printFeeds(&machine, *material); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *spindleMin > 0 || *spindleMax > 0 || len(*spindleRngs) > 0 {
+		if err := checkSpindle(&machine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if *envelope != "" {
+		if err := checkEnvelope(&machine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if len(*fixtures) > 0 {
+		if err := checkFixtures(&machine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if *stock != "" {
+		if err := simulateCut(&machine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	// Handle VM output
+	if *debugDump {
+		machine.Dump()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not export vm state: %s\n", err)
+		os.Exit(3)
+	}
+
+	if *verify && (*dumpStdout || *outputFile != "" || *device != "" || *simulate) {
+		if err := export.Verify(&machine, *precision, math.Pow(10, -float64(*precision))); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if *dumpStdout {
+		if err := exportCode(os.Stdout, &machine, post, format, macros, source); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export gcode: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if *sizeReport {
+		sizes, err := export.SizeByTool(&machine, outputGenerator(&machine, post, format, macros, nil, 0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export gcode: %s\n", err)
+			os.Exit(3)
+		}
+		for _, sz := range sizes {
+			if sz.Lines == 0 {
+				continue
+			}
+			tool := "No tool"
+			if sz.Tool >= 0 {
+				tool = fmt.Sprintf("T%d", sz.Tool)
+			}
+			fmt.Fprintf(os.Stderr, "%-8s %8d lines %10d bytes\n", tool, sz.Lines, sz.Bytes)
+		}
+	}
+
+	if *outputFile != "" && len(toolJobs) > 0 {
+		for _, job := range toolJobs {
+			name := toolFileName(*outputFile, job.Tool)
+			f, err := export.CreateFile(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+				os.Exit(2)
+			}
+			if err := exportCode(f, job.Machine, post, format, macros, nil); err != nil {
+				f.Discard()
+				fmt.Fprintf(os.Stderr, "Error: Could not export gcode: %s\n", err)
+				os.Exit(3)
+			}
+			if err := f.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+				os.Exit(2)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d tool programs\n", len(toolJobs))
+	} else if *outputFile != "" && (*maxLines > 0 || *maxBytes > 0) {
+		newGen := func(part int) export.LineGenerator {
+			return outputGenerator(&machine, post, format, macros, nil, part)
+		}
+		parts, err := export.Split(&machine, newGen, *maxLines, *maxBytes, machine.FindSafetyHeight())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not split gcode: %s\n", err)
+			os.Exit(3)
+		}
+		for idx, code := range parts {
+			if err := writeFile(partName(*outputFile, idx+1), []byte(code)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+				os.Exit(2)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d parts\n", len(parts))
+	} else if *outputFile != "" {
+		f, err := export.CreateFile(*outputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+			os.Exit(2)
+		}
+		if err := exportCode(f, &machine, post, format, macros, source); err != nil {
+			f.Discard()
+			fmt.Fprintf(os.Stderr, "Error: Could not export gcode: %s\n", err)
+			os.Exit(3)
+		}
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *jsonFile != "" {
+		g := export.JSONGenerator{}
+		g.Init()
+		export.HandleAllPositions(&machine, &g)
+
+		var out bytes.Buffer
+		if err := g.WriteJSON(&out); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export JSON: %s\n", err)
+			os.Exit(3)
+		}
+
+		if *jsonFile == "-" {
+			fmt.Print(out.String())
+		} else if err := writeFile(*jsonFile, out.Bytes()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *csvFile != "" {
+		g := export.CSVGenerator{Precision: *precision}
+		g.Init()
+		export.HandleAllPositions(&machine, &g)
+
+		var out bytes.Buffer
+		if err := g.WriteCSV(&out); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export CSV: %s\n", err)
+			os.Exit(3)
+		}
+
+		if *csvFile == "-" {
+			fmt.Print(out.String())
+		} else if err := writeFile(*csvFile, out.Bytes()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *previewFile != "" {
+		if err := writePreview(&machine, *previewFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write preview: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *duet != "" {
+		runDuet(&machine, format, withEpilogue(&machine, macros, format, false), names[0])
+	} else if *device != "" || *simulate {
+		mt := &ManualGenerator{}
+		wt := &WaitGenerator{}
+
+		st, s := newStreamer()
+		s.Macros = withEpilogue(&machine, macros, format, false)
+		s.Format = format
+		s.Macros.Tools = machine.Tools
+		s.CoolantCodes, _ = coolantCodes()
+
+		generators = append(generators, mt)
+		generators = append(generators, wt)
+		generators = append(generators, s)
+
+		mt.Init()
+
+		if *probeTool {
+			mt.streamer = s
+			mt.probe = &streaming.ToolLengthProbe{
+				X:            *probeX,
+				Y:            *probeY,
+				SafeZ:        *probeSafeZ,
+				Distance:     *probeDistance,
+				Feedrate:     *probeFeed,
+				Reference:    *probeReference,
+				HasReference: *probeReference != 0,
+			}
+		}
+
+		job, err := s.CheckJob(&machine, s.Precision, s.Format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Incompatibility: %s\n", err)
+		}
+		for _, f := range job.Fixes {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", f)
+		}
+		if job.Format != nil {
+			s.Format = job.Format
+		}
+
+		if !*autoStart {
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Fprintf(os.Stderr, "Run code? (y/n) ")
+			text, _ := reader.ReadString('\n')
+			if text != "y\n" {
+				fmt.Fprintf(os.Stderr, "Aborting\n")
+				os.Exit(5)
+			}
+		}
+
+		if err := st.Connect(*device, *baudrate); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to connect to device: %s\n", err)
+			os.Exit(2)
+		}
+
+		// RepRap firmware homes with G28 rather than $H
+		var ctl interface {
+			Home() error
+			Unlock() error
+		} = s
+		if r, ok := st.(*streaming.RepRapStreamer); ok {
+			ctl = r
+		}
+
+		if *unlock {
+			if err := ctl.Unlock(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Unable to unlock: %s\n", err)
+				os.Exit(4)
+			}
+		}
+
+		if *home {
+			fmt.Fprintf(os.Stderr, "Homing...\n")
+			if err := ctl.Home(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Unable to home: %s\n", err)
+				os.Exit(4)
+			}
+		}
+
+		if *probeTool {
+			for _, f := range []int{streaming.FeatureProbe, streaming.FeatureDynamicToolLength} {
+				if err := s.RequireFeature(f); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: Unable to probe tools: %s\n", err)
+					os.Exit(4)
+				}
+			}
+		}
+
+		// The time left is estimated from the moves rather than the count
+		pBar := pb.New(len(machine.Positions))
+		pBar.ManualUpdate = true
+		pBar.ShowTimeLeft = false
+		pBar.Format("[=> ]")
+		pBar.Start()
+
+		var tracker streaming.ProgressTracker
+		tracker.Init(&machine)
+
+		sigchan := make(chan string, 1)
+		pauseRequest := make(chan bool, 1)
+		registerSignals(sigchan)
+
+		go func() {
+			for sig := range sigchan {
+				switch sig {
+				case "interrupt":
+					fmt.Fprintf(os.Stderr, "\nStopping...\n")
+					st.Stop()
+					os.Exit(5)
+				case "stop":
+					if *retractOnPause {
+						// The send loop retracts after the current move
+						select {
+						case pauseRequest <- true:
+							fmt.Fprintf(os.Stderr, "\nPausing after current move...\n")
+						default:
+						}
+						continue
+					}
+					st.Pause()
+					fmt.Fprintf(os.Stderr, "\nPaused. Press <ENTER> to continue")
+					reader := bufio.NewReader(os.Stdin)
+					_, _ = reader.ReadString('\n')
+					st.Start()
+					pBar.Update()
+				}
+			}
+		}()
+
+		if err := s.Header(); err != nil {
+			st.Stop()
+			fmt.Fprintf(os.Stderr, "Error: Could not send header: %s\n", err)
+			os.Exit(4)
+		}
+
+		var checkpoint *streaming.Checkpoint
+		if *checkpointFile != "" {
+			checkpoint = &streaming.Checkpoint{Path: *checkpointFile, Interval: time.Second, Depth: *checkpointDepth}
+		}
+
+		for idx := range machine.Positions {
+			select {
+			case <-pauseRequest:
+				if idx > 0 {
+					if err := retractPause(machine.Positions[idx-1]); err != nil {
+						st.Stop()
+						panic(err)
+					}
+					pBar.Update()
+				}
+			default:
+			}
+
+			err := export.HandlePositionAtIndex(&machine, idx, generators...)
+			for {
+				// The position was not completed, and must be handled again
+				if de, ok := err.(*streaming.DisconnectError); !ok || !de.Reconnected {
+					break
+				}
+				fmt.Fprintf(os.Stderr, "Reconnected, continuing\n")
+				err = export.HandlePositionAtIndex(&machine, idx, generators...)
+			}
+			if err != nil {
+				st.Stop()
+				if checkpoint != nil {
+					checkpoint.Flush()
+				}
+				switch err := err.(type) {
+				case *streaming.AlarmError:
+					fmt.Fprintf(os.Stderr, "\n%s\nClear the alarm with --unlock, or re-home with --home.\n", err)
+					os.Exit(4)
+				case *streaming.GrblError:
+					fmt.Fprintf(os.Stderr, "\n%s\n", err)
+					os.Exit(4)
+				case *streaming.DisconnectError:
+					fmt.Fprintf(os.Stderr, "\n%s\n", err)
+					if checkpoint != nil {
+						fmt.Fprintf(os.Stderr, "Continue the job with --resume.\n")
+					}
+					os.Exit(4)
+				}
+				panic(err)
+			}
+			if checkpoint != nil && idx >= resumeStart {
+				if err := checkpoint.Acknowledge(idx + resumeOffset); err != nil {
+					fmt.Fprintf(os.Stderr, "\nWarning: Could not write checkpoint: %s\n", err)
+				}
+			}
+			progress := tracker.Update(idx)
+			s.Notify(streaming.Event{Type: streaming.EventProgress, Progress: progress})
+			pBar.Postfix(fmt.Sprintf(" %s left", progress.Remaining.Round(time.Second)))
+			pBar.Increment()
+			pBar.Update()
+		}
+		if err := s.Footer(); err != nil {
+			st.Stop()
+			fmt.Fprintf(os.Stderr, "\nError: Could not send footer: %s\n", err)
+			os.Exit(4)
+		}
+		pBar.Finish()
+		pBar.Update()
+
+		if checkpoint != nil {
+			if err := checkpoint.Clear(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not remove checkpoint: %s\n", err)
 			}
-			pBar.Increment()
-			pBar.Update()
 		}
-		pBar.Finish()
-		pBar.Update()
 	}
 
 }
@@ -0,0 +1,215 @@
+package main
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/export"
+import "github.com/kennylevinsen/gocnc/streaming"
+
+import "bufio"
+import "strings"
+import "time"
+import "fmt"
+import "os"
+
+// Returns the modal state of the machine as gcode, such as "G1 G17 G21 G90
+// G94 F300 M3 S10000 M9 T1".
+func modalState(m *vm.Machine) string {
+	s := m.State
+	var w []string
+
+	switch s.MoveMode {
+	case vm.MoveModeRapid:
+		w = append(w, "G0")
+	case vm.MoveModeLinear:
+		w = append(w, "G1")
+	case vm.MoveModeCWArc:
+		w = append(w, "G2")
+	case vm.MoveModeCCWArc:
+		w = append(w, "G3")
+	case vm.MoveModeCubicSpline:
+		w = append(w, "G5")
+	case vm.MoveModeQuadraticSpline:
+		w = append(w, "G5.1")
+	default:
+		w = append(w, "G80")
+	}
+
+	switch m.MovePlane {
+	case vm.PlaneXY:
+		w = append(w, "G17")
+	case vm.PlaneXZ:
+		w = append(w, "G18")
+	case vm.PlaneYZ:
+		w = append(w, "G19")
+	}
+
+	if m.Imperial {
+		w = append(w, "G20")
+	} else {
+		w = append(w, "G21")
+	}
+	if m.AbsoluteMove {
+		w = append(w, "G90")
+	} else {
+		w = append(w, "G91")
+	}
+
+	switch s.FeedMode {
+	case vm.FeedModeInvTime:
+		w = append(w, "G93")
+	case vm.FeedModeUnitsMin:
+		w = append(w, "G94")
+	case vm.FeedModeUnitsRev:
+		w = append(w, "G95")
+	}
+	w = append(w, fmt.Sprintf("F%g", s.Feedrate))
+
+	switch {
+	case !s.SpindleEnabled:
+		w = append(w, "M5")
+	case s.SpindleClockwise:
+		w = append(w, "M3", fmt.Sprintf("S%g", s.SpindleSpeed))
+	default:
+		w = append(w, "M4", fmt.Sprintf("S%g", s.SpindleSpeed))
+	}
+
+	if !s.FloodCoolant && !s.MistCoolant {
+		w = append(w, "M9")
+	}
+	if s.MistCoolant {
+		w = append(w, "M7")
+	}
+	if s.FloodCoolant {
+		w = append(w, "M8")
+	}
+
+	if s.ToolIndex >= 0 {
+		w = append(w, fmt.Sprintf("T%d", s.ToolIndex))
+	}
+	return strings.Join(w, " ")
+}
+
+// Sets the position of the VM and the streamer to the work position reported
+// by Grbl, once it has stopped moving, as the machine may have been moved
+// since the last block, such as by jogging or homing from the keypad. The
+// work offsets known to the VM are added, as they are to its positions.
+func seedPosition(m *vm.Machine, s *streaming.GrblStreamer) error {
+	var status streaming.GrblStatus
+	for {
+		var err error
+		if status, err = s.Status(); err != nil {
+			return err
+		}
+		if status.State != "Run" && status.State != "Jog" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	pos := status.WorkPosition.Sum(m.CoordinateSystem.GetCoordinateSystem())
+	last := &m.Positions[len(m.Positions)-1]
+	last.X, last.Y, last.Z = pos.X, pos.Y, pos.Z
+	cp := s.GetPosition()
+	cp.X, cp.Y, cp.Z = pos.X, pos.Y, pos.Z
+	s.SetPosition(cp)
+	return nil
+}
+
+// Runs typed gcode through the VM and streams it to the device one block at
+// a time, printing the modal state and position after each.
+func mdi() {
+	if *device == "" && !*simulate {
+		fmt.Fprintf(os.Stderr, "Error: MDI requires a device, or --simulate\n")
+		os.Exit(1)
+	}
+
+	var m vm.Machine
+	m.Init()
+	for _, t := range *tools {
+		idx, tool, err := parseTool(t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		m.SetTool(idx, tool)
+	}
+	params, err := loadParameters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	parse := gcode.ParseWithParameters
+	if *lenientParse {
+		parse = gcode.ParseLenientWithParameters
+	}
+
+	st, s := newStreamer()
+	if err := st.Connect(*device, *baudrate); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Unable to connect to device: %s\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Fprintf(os.Stderr, "Type gcode to run it, one or more blocks per line, or q to quit.\n")
+	if *reprap {
+		fmt.Fprintf(os.Stderr, "Positions start at 0, 0, 0, so start with an absolute move.\n")
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "mdi> ")
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if l := strings.ToLower(line); l == "q" || l == "quit" {
+			return
+		}
+
+		doc, err := parse(line, params)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			continue
+		}
+
+		for _, b := range doc.Blocks {
+			// RepRap firmware does not answer status queries
+			if !*reprap {
+				if err := seedPosition(&m, s); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: Unable to read position: %s\n", err)
+					break
+				}
+			}
+
+			n := len(m.Positions)
+			diff, err := m.Execute(b)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				break
+			}
+
+			for idx := n; idx < len(m.Positions) && err == nil; idx++ {
+				err = export.HandlePositionAtIndex(&m, idx, s)
+				if de, ok := err.(*streaming.DisconnectError); ok && de.Reconnected {
+					fmt.Fprintf(os.Stderr, "Reconnected, continuing\n")
+					err = export.HandlePositionAtIndex(&m, idx, s)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				fmt.Fprintf(os.Stderr, "The machine may not be where the VM expects it to be.\n")
+				break
+			}
+
+			for _, c := range diff {
+				fmt.Fprintf(os.Stderr, "   %s\n", c)
+			}
+			pos := m.Positions[len(m.Positions)-1]
+			fmt.Fprintf(os.Stderr, "%s\n", modalState(&m))
+			fmt.Fprintf(os.Stderr, "X%g Y%g Z%g\n", pos.X, pos.Y, pos.Z)
+		}
+	}
+}
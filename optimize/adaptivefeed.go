@@ -0,0 +1,118 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+const (
+	// The lowest fraction of the programmed feedrate that feeds are reduced to
+	minFeedRatio = 0.1
+
+	// The smallest fraction of the feedrate worth slowing down by
+	minFeedReduction = 0.1
+)
+
+// Returns whether the position is a cutting move with a feedrate in units per minute.
+func feedMove(pos vm.Position) bool {
+	switch pos.State.MoveMode {
+	case vm.MoveModeLinear, vm.MoveModeCWArc, vm.MoveModeCCWArc:
+		return pos.State.FeedMode != vm.FeedModeInvTime && pos.State.Feedrate > 0
+	}
+	return false
+}
+
+// Returns the direction of the move from start to pos at its start and end.
+// The direction of arcs is their tangent in XY.
+func moveDirections(start, pos vm.Position) (vector.Vector, vector.Vector) {
+	tangent := func(p vm.Position) vector.Vector {
+		r := vector.Vector{p.X - pos.Center.X, p.Y - pos.Center.Y, 0}
+		if pos.State.MoveMode == vm.MoveModeCWArc {
+			return vector.Vector{r.Y, -r.X, 0}.Divide(r.Norm())
+		}
+		return vector.Vector{-r.Y, r.X, 0}.Divide(r.Norm())
+	}
+	if pos.State.MoveMode == vm.MoveModeCWArc || pos.State.MoveMode == vm.MoveModeCCWArc {
+		return tangent(start), tangent(pos)
+	}
+	d := pos.Vector().Diff(start.Vector())
+	d = d.Divide(d.Norm())
+	return d, d
+}
+
+// Returns the highest speed (mm/s) to pass a corner from direction in to
+// direction out at, by the junction deviation model used by Grbl.
+func junctionSpeed(in, out vector.Vector, acceleration, deviation float64) float64 {
+	sinHalf := math.Sqrt(0.5 * (1 + in.Dot(out)))
+	if sinHalf >= 1 {
+		return math.Inf(1)
+	}
+	return math.Sqrt(acceleration * deviation * sinHalf / (1 - sinHalf))
+}
+
+// Reduces the feedrate of arcs to keep the centripetal acceleration below
+// acceleration (mm/s²), and of moves into corners to the junction speed given
+// by the junction deviation (mm), as used by Grbl. Moves into corners are
+// split so only the part needed to brake from the programmed feedrate is
+// slowed down, and the programmed feedrate is restored after the corner.
+// Feedrates are reduced to no less than a tenth of the programmed, and only
+// when they would be reduced by more than a tenth.
+//
+// This helps controllers with little lookahead, which would otherwise overshoot
+// corners or stall. Moves in inverse time feed mode are left alone.
+func OptAdaptiveFeed(machine *vm.Machine, acceleration, deviation float64) {
+	if acceleration <= 0 {
+		return
+	}
+
+	positions := machine.Positions
+	npos := make([]vm.Position, 0, len(positions))
+	for idx, pos := range positions {
+		if idx == 0 || !feedMove(pos) {
+			npos = append(npos, pos)
+			continue
+		}
+		prev := positions[idx-1]
+		if pos.Vector() == prev.Vector() {
+			npos = append(npos, pos)
+			continue
+		}
+
+		programmed := pos.State.Feedrate
+		feed := programmed
+		arc := pos.State.MoveMode != vm.MoveModeLinear
+		if arc {
+			radius := math.Hypot(pos.X-pos.Center.X, pos.Y-pos.Center.Y)
+			feed = math.Min(feed, 60*math.Sqrt(acceleration*radius))
+		}
+
+		// Slow down into the corner at the end of the move
+		corner := feed
+		if idx+1 < len(positions) && feedMove(positions[idx+1]) && positions[idx+1].Vector() != pos.Vector() {
+			_, in := moveDirections(prev, pos)
+			out, _ := moveDirections(pos, positions[idx+1])
+			corner = math.Min(feed, 60*junctionSpeed(in, out, acceleration, deviation))
+		}
+		corner = math.Max(corner, programmed*minFeedRatio)
+		feed = math.Max(feed, programmed*minFeedRatio)
+		if feed > programmed*(1-minFeedReduction) {
+			feed = programmed
+		}
+
+		if corner < feed*(1-minFeedReduction) {
+			brake := (math.Pow(feed/60, 2) - math.Pow(corner/60, 2)) / (2 * acceleration)
+			d := pos.Vector().Diff(prev.Vector())
+			if length := d.Norm(); !arc && brake < length {
+				p := pos
+				p.State.Feedrate = feed
+				split := prev.Vector().Sum(d.Multiply((length - brake) / length))
+				p.X, p.Y, p.Z = split.X, split.Y, split.Z
+				npos = append(npos, p)
+			}
+			feed = corner
+		}
+
+		pos.State.Feedrate = feed
+		npos = append(npos, pos)
+	}
+	machine.Positions = npos
+}
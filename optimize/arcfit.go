@@ -0,0 +1,135 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+// The minimum number of segments to replace with an arc
+const minArcSegments = 3
+
+// Returns the center of the circle through three points in XY.
+func circleCenter(a, b, c vector.Vector) (vector.Vector, bool) {
+	d := 2 * (a.X*(b.Y-c.Y) + b.X*(c.Y-a.Y) + c.X*(a.Y-b.Y))
+	if d == 0 {
+		return vector.Vector{}, false
+	}
+	a2, b2, c2 := a.X*a.X+a.Y*a.Y, b.X*b.X+b.Y*b.Y, c.X*c.X+c.Y*c.Y
+	return vector.Vector{
+		(a2*(b.Y-c.Y) + b2*(c.Y-a.Y) + c2*(a.Y-b.Y)) / d,
+		(a2*(c.X-b.X) + b2*(a.X-c.X) + c2*(b.X-a.X)) / d,
+		0,
+	}, true
+}
+
+// Fits an arc to a chain of points, returning its center and whether it turns
+// clockwise. The points and the midpoints of the lines between them must lie
+// within tolerance of the arc, the lines must all turn the same way through
+// less than a full turn without closing it, and Z must change linearly along
+// the arc. Chains that are straight within tolerance do not fit. The lengths
+// along the arc are kept in lengths, which must hold a length per point.
+func fitArc(points []vector.Vector, lengths []float64, tolerance float64) (center vector.Vector, clockwise, ok bool) {
+	// Arcs ending where they start would be read as full circles
+	first, last := points[0], points[len(points)-1]
+	if math.Hypot(last.X-first.X, last.Y-first.Y) <= tolerance {
+		return
+	}
+	center, ok = circleCenter(first, points[len(points)/2], last)
+	if !ok {
+		return
+	}
+	radius := math.Hypot(first.X-center.X, first.Y-center.Y)
+	off := func(x, y float64) bool {
+		return math.Abs(math.Hypot(x-center.X, y-center.Y)-radius) > tolerance
+	}
+
+	var angle float64
+	lengths[0] = 0
+	for i := 1; i < len(points); i++ {
+		p1, p2 := points[i-1], points[i]
+		if off(p2.X, p2.Y) || off((p1.X+p2.X)/2, (p1.Y+p2.Y)/2) {
+			return center, false, false
+		}
+
+		a := math.Atan2(p2.Y-center.Y, p2.X-center.X) - math.Atan2(p1.Y-center.Y, p1.X-center.X)
+		if a > math.Pi {
+			a -= 2 * math.Pi
+		} else if a < -math.Pi {
+			a += 2 * math.Pi
+		}
+		if a == 0 || (angle != 0 && (a > 0) != (angle > 0)) {
+			return center, false, false
+		}
+		angle += a
+		lengths[i] = lengths[i-1] + math.Abs(a)*radius
+	}
+
+	if math.Abs(angle) >= 2*math.Pi || radius*(1-math.Cos(math.Min(math.Abs(angle), math.Pi)/2)) <= tolerance {
+		return center, false, false
+	}
+
+	for i, p := range points {
+		if math.Abs(first.Z+(last.Z-first.Z)*lengths[i]/lengths[len(points)-1]-p.Z) > tolerance {
+			return center, false, false
+		}
+	}
+	return center, angle < 0, true
+}
+
+// Replaces chains of linear moves that lie within tolerance of an arc in the
+// XY plane with arc moves. The moves of a chain must share the same state,
+// and at least 3 are required. Moves in inverse time feed mode are left
+// alone, as merging them would change their timing. The position stack is
+// filtered in place.
+func OptArcFit(machine *vm.Machine, tolerance float64) {
+	var (
+		positions = machine.Positions
+		npos      = positions[:0]
+		points    []vector.Vector
+		lengths   []float64
+	)
+	for idx := 0; idx < len(positions); idx++ {
+		pos := positions[idx]
+		if idx == 0 || pos.State.MoveMode != vm.MoveModeLinear || pos.State.FeedMode == vm.FeedModeInvTime {
+			npos = append(npos, pos)
+			continue
+		}
+
+		// Extend the chain for as long as it fits. The previous move is always kept
+		points = append(points[:0], npos[len(npos)-1].Vector(), pos.Vector())
+		lengths = append(lengths[:0], 0, 0)
+		var (
+			end       int
+			center    vector.Vector
+			clockwise bool
+		)
+		for next := idx + 1; next < len(positions) && positions[next].State == pos.State; next++ {
+			points = append(points, positions[next].Vector())
+			lengths = append(lengths, 0)
+			if len(points) <= minArcSegments {
+				continue
+			}
+			c, cw, ok := fitArc(points, lengths, tolerance)
+			if !ok {
+				break
+			}
+			end, center, clockwise = next, c, cw
+		}
+
+		if end == 0 {
+			npos = append(npos, pos)
+			continue
+		}
+
+		arc := positions[end]
+		arc.Line = pos.Line
+		arc.Center = center
+		if clockwise {
+			arc.State.MoveMode = vm.MoveModeCWArc
+		} else {
+			arc.State.MoveMode = vm.MoveModeCCWArc
+		}
+		npos = append(npos, arc)
+		idx = end
+	}
+	machine.Positions = npos
+}
@@ -0,0 +1,95 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+import "time"
+
+// A move taking the tool outside the heights used before an optimization pass.
+type Excursion struct {
+	Index int // Index of the position ending the move
+	Line  int // Line of the block that made the move, 0 if unknown
+	Z     float64
+	Rapid bool // Rapid move below the lowest rapid height used before
+}
+
+// The effect of an optimization pass on the position stack. Distances are in mm.
+type Audit struct {
+	Pass string
+
+	Moves, MovesAfter       int
+	Distance, DistanceAfter float64
+	Time, TimeAfter         time.Duration
+
+	// Moves below the lowest or above the highest position before the pass,
+	// and rapid moves below the lowest rapid move before the pass
+	Excursions []Excursion
+}
+
+// Returns the number of moves removed by the pass.
+func (a Audit) MovesRemoved() int {
+	return a.Moves - a.MovesAfter
+}
+
+// Returns the travel distance saved by the pass.
+func (a Audit) DistanceSaved() float64 {
+	return a.Distance - a.DistanceAfter
+}
+
+// Returns the estimated time saved by the pass.
+func (a Audit) TimeSaved() time.Duration {
+	return a.Time - a.TimeAfter
+}
+
+// Returns the travel distance of the position stack.
+func travelDistance(positions []vm.Position) float64 {
+	var dist float64
+	for idx := 1; idx < len(positions); idx++ {
+		pos := positions[idx]
+		switch pos.State.MoveMode {
+		case vm.MoveModeCWArc, vm.MoveModeCCWArc:
+			dist += vm.ArcLength(positions[idx-1], pos)
+		case vm.MoveModeNone, vm.MoveModeDwell:
+		default:
+			dist += pos.Vector().Diff(positions[idx-1].Vector()).Norm()
+		}
+	}
+	return dist
+}
+
+// Returns the lowest and highest Z of the position stack, and the lowest Z of
+// its rapid moves.
+func heights(positions []vm.Position) (min, max, rapid float64) {
+	min, max, rapid = math.Inf(1), math.Inf(-1), math.Inf(1)
+	for _, pos := range positions {
+		min, max = math.Min(min, pos.Z), math.Max(max, pos.Z)
+		if pos.State.MoveMode == vm.MoveModeRapid {
+			rapid = math.Min(rapid, pos.Z)
+		}
+	}
+	return
+}
+
+// Runs an optimization pass on the machine, comparing the position stack
+// before and after it.
+func AuditPass(machine *vm.Machine, name string, pass func()) Audit {
+	a := Audit{
+		Pass:     name,
+		Moves:    len(machine.Positions),
+		Distance: travelDistance(machine.Positions),
+		Time:     machine.ETA(),
+	}
+	min, max, rapid := heights(machine.Positions)
+
+	pass()
+
+	a.MovesAfter = len(machine.Positions)
+	a.DistanceAfter = travelDistance(machine.Positions)
+	a.TimeAfter = machine.ETA()
+	for idx, pos := range machine.Positions {
+		lowRapid := pos.State.MoveMode == vm.MoveModeRapid && pos.Z < rapid
+		if pos.Z < min || pos.Z > max || lowRapid {
+			a.Excursions = append(a.Excursions, Excursion{Index: idx, Line: pos.Line, Z: pos.Z, Rapid: lowRapid})
+		}
+	}
+	return a
+}
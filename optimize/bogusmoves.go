@@ -10,7 +10,7 @@ func OptBogusMoves(machine *vm.Machine) {
 	var (
 		lastvec vector.Vector
 		state   vector.Vector
-		npos    []vm.Position = make([]vm.Position, 0)
+		npos    []vm.Position = machine.Positions[:0]
 	)
 
 	for _, m := range machine.Positions {
@@ -22,7 +22,7 @@ func OptBogusMoves(machine *vm.Machine) {
 			continue
 		}
 
-		if d.X == 0 && d.Y == 0 && d.Z == 0 {
+		if machine.SamePoint(d, vector.Vector{}) {
 			// Why are we doing this again?!
 			continue
 		}
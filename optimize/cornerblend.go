@@ -0,0 +1,92 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+// The minimum change of direction to blend (radians)
+const minBlendAngle = 5 * math.Pi / 180
+
+// Returns the arc rounding the corner at b between the lines a-b and b-c, as
+// its start, end and center, such that it deviates at most tolerance from the
+// corner. The arc uses at most half of each line, so the arcs of neighbouring
+// corners do not overlap.
+func blendCorner(a, b, c vector.Vector, tolerance float64) (start, end, center vector.Vector, ccw, ok bool) {
+	d1, d2 := b.Diff(a), c.Diff(b)
+	l1, l2 := d1.Norm(), d2.Norm()
+	if l1 == 0 || l2 == 0 {
+		return
+	}
+	d1, d2 = d1.Divide(l1), d2.Divide(l2)
+
+	turn := math.Acos(math.Max(-1, math.Min(1, d1.Dot(d2))))
+	if turn < minBlendAngle {
+		return
+	}
+
+	// Half of the angle between the lines at the corner
+	half := (math.Pi - turn) / 2
+	radius := tolerance * math.Sin(half) / (1 - math.Sin(half))
+	dist := radius / math.Tan(half)
+	if limit := math.Min(l1, l2) / 2; dist > limit {
+		dist = limit
+		radius = dist * math.Tan(half)
+	}
+
+	start, end = b.Diff(d1.Multiply(dist)), b.Sum(d2.Multiply(dist))
+
+	// Arcs too short to export could be read back as full circles
+	if end.Diff(start).Norm() <= tolerance {
+		return
+	}
+
+	ccw = d1.Cross(d2).Z > 0
+	normal := vector.Vector{-d1.Y, d1.X, 0}
+	if !ccw {
+		normal = normal.Multiply(-1)
+	}
+	center = start.Sum(normal.Multiply(radius))
+	return start, end, center, ccw, true
+}
+
+// Rounds the corners between linear moves in the XY plane with arcs that
+// deviate at most tolerance from them, so controllers that stop at every
+// corner can keep moving. Both moves of a corner must have the same state and
+// height. Moves in inverse time feed mode are left alone, as splitting them
+// would change their timing.
+func OptCornerBlend(machine *vm.Machine, tolerance float64) {
+	positions := machine.Positions
+	npos := make([]vm.Position, 0, len(positions))
+	for idx, pos := range positions {
+		if idx == 0 || idx == len(positions)-1 || pos.State.MoveMode != vm.MoveModeLinear ||
+			pos.State.FeedMode == vm.FeedModeInvTime || positions[idx+1].State != pos.State {
+			npos = append(npos, pos)
+			continue
+		}
+
+		a, b, c := positions[idx-1].Vector(), pos.Vector(), positions[idx+1].Vector()
+		if !machine.Equal(a.Z, b.Z) || !machine.Equal(b.Z, c.Z) {
+			npos = append(npos, pos)
+			continue
+		}
+
+		start, end, center, ccw, ok := blendCorner(a, b, c, tolerance)
+		if !ok {
+			npos = append(npos, pos)
+			continue
+		}
+
+		line := pos
+		line.X, line.Y = start.X, start.Y
+		arc := pos
+		arc.X, arc.Y = end.X, end.Y
+		arc.Center = vector.Vector{center.X, center.Y, 0}
+		if ccw {
+			arc.State.MoveMode = vm.MoveModeCCWArc
+		} else {
+			arc.State.MoveMode = vm.MoveModeCWArc
+		}
+		npos = append(npos, line, arc)
+	}
+	machine.Positions = npos
+}
@@ -18,7 +18,7 @@ func OptDrillSpeed(machine *vm.Machine, feedrate float64, rapid bool) {
 		var depth float64
 		var found bool
 		for _, m := range drillStack {
-			if m.X == pos.X && m.Y == pos.Y {
+			if machine.SameXY(m.Vector(), pos.Vector()) {
 				if m.Z < depth {
 					depth = m.Z
 					found = true
@@ -53,7 +53,7 @@ func OptDrillSpeed(machine *vm.Machine, feedrate float64, rapid bool) {
 	}
 
 	for _, m := range machine.Positions {
-		if m.X == last.X && m.Y == last.Y && m.Z < last.Z && m.State.MoveMode == vm.MoveModeLinear {
+		if machine.SameXY(m.Vector(), last) && m.Z < last.Z && m.State.MoveMode == vm.MoveModeLinear {
 			posn, poso, shouldinsert := fastDrill(m)
 			if shouldinsert {
 				npos = append(npos, posn)
@@ -0,0 +1,77 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+
+// A pass removed as a repetition of earlier passes.
+type DuplicatePass struct {
+	vm.Operation     // Positions of the pass before it was removed
+	Line         int // Line of the block that made the first move of the pass, 0 if unknown
+}
+
+// A horizontal cutting segment, with its ends in canonical order.
+type segment struct {
+	x1, y1, x2, y2, z float64
+	tool              int
+}
+
+func newSegment(from, to vm.Position) segment {
+	if to.X < from.X || (to.X == from.X && to.Y < from.Y) {
+		from, to = to, from
+	}
+	return segment{from.X, from.Y, to.X, to.Y, to.Z, to.State.ToolIndex}
+}
+
+// Removes passes that only repeat cutting segments already cut at the same Z
+// with the same tool, in either direction, such as from CAM output that was
+// accidentally duplicated. Only passes with horizontal segments are
+// considered, and moves along Z, such as plunges, are disregarded when
+// comparing them. The removed passes are returned.
+//
+// The rapid moves around a removed pass are kept, with the tool moving
+// straight up to the height of the rapid move following the pass first.
+func OptDuplicatePasses(machine *vm.Machine) []DuplicatePass {
+	var (
+		removed []DuplicatePass
+		cut     = make(map[segment]bool)
+		npos    = make([]vm.Position, 0, len(machine.Positions))
+		last    int
+	)
+
+	for _, op := range machine.Operations() {
+		var segments []segment
+		for idx := op.Start; idx < op.End; idx++ {
+			from, to := machine.Positions[idx-1], machine.Positions[idx]
+			if to.State.MoveMode == vm.MoveModeLinear && machine.Equal(from.Z, to.Z) && !machine.SameXY(from.Vector(), to.Vector()) {
+				segments = append(segments, newSegment(from, to))
+			}
+		}
+
+		duplicate := len(segments) > 0
+		for _, s := range segments {
+			duplicate = duplicate && cut[s]
+		}
+		if !duplicate {
+			for _, s := range segments {
+				cut[s] = true
+			}
+			continue
+		}
+
+		removed = append(removed, DuplicatePass{Operation: op, Line: machine.Positions[op.Start].Line})
+		npos = append(npos, machine.Positions[last:op.Start]...)
+		last = op.End
+
+		// Move up before moving over to where the pass ended
+		if op.End < len(machine.Positions) {
+			cur, next := npos[len(npos)-1], machine.Positions[op.End]
+			if next.Z > cur.Z {
+				up := cur
+				up.State.MoveMode = vm.MoveModeRapid
+				up.Z = next.Z
+				npos = append(npos, up)
+			}
+		}
+	}
+	machine.Positions = append(npos, machine.Positions[last:]...)
+	return removed
+}
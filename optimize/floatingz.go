@@ -9,14 +9,15 @@ import "github.com/kennylevinsen/gocnc/vm"
 // are below minDistOverZ, the pair is left untouched. Otherwise, the first
 // position in the pair is removed, the movemode is set to rapid, and the
 // remaining position is paired up with the next position. This process
-// repeats until there are no positions left.
+// repeats until there are no positions left. The position stack is filtered
+// in place.
 func OptFloatingZ(machine *vm.Machine, minDistOverZ float64) {
 	mp := machine.Positions
 	if len(mp) == 0 {
 		return
 	}
 
-	npos := []vm.Position{mp[0]}
+	npos := mp[:1]
 	for i := 1; i < len(mp); i++ {
 		// We always append for the last position
 		if i == len(mp)-1 {
@@ -0,0 +1,174 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+// Smallest size of a cell (mm), so sets starting almost at the same point do
+// not spread over more cells than can be searched.
+const minGridCell = 1e-6
+
+// Largest number of cells along an axis, bounding the rings searched.
+const maxGridCells = 4096
+
+// A spatial hash of the starts of path sets in XY, for finding the nearest
+// remaining set without scanning them all.
+type setGrid struct {
+	sets    []pathSet
+	size    float64 // Size of a cell
+	minSize float64 // Smallest size of a cell
+	origin  vector.Vector
+	cells   map[[2]int][]int
+	left    int
+	built   int // Number of sets when the grid was built
+
+	// Bounds of the cells in use
+	min, max [2]int
+}
+
+// Returns a grid of the sets, with cells no smaller than tolerance.
+func newSetGrid(sets []pathSet, tolerance float64) *setGrid {
+	idx := make([]int, len(sets))
+	for i := range sets {
+		idx[i] = i
+	}
+	g := &setGrid{sets: sets, minSize: math.Max(tolerance, minGridCell)}
+	g.build(idx)
+	return g
+}
+
+// Fills the grid with the given sets, sizing the cells to hold about one set each.
+func (g *setGrid) build(idx []int) {
+	min, max := vector.Vector{math.Inf(1), math.Inf(1), 0}, vector.Vector{math.Inf(-1), math.Inf(-1), 0}
+	for _, i := range idx {
+		p := g.sets[i][0]
+		min.X, min.Y = math.Min(min.X, p.X), math.Min(min.Y, p.Y)
+		max.X, max.Y = math.Max(max.X, p.X), math.Max(max.Y, p.Y)
+	}
+
+	w, h := max.X-min.X, max.Y-min.Y
+	switch {
+	case w > 0 && h > 0:
+		g.size = math.Sqrt(w * h / float64(len(idx)))
+	case w > 0 || h > 0:
+		g.size = math.Max(w, h) / float64(len(idx))
+	default:
+		g.size = 1
+	}
+	g.size = math.Max(g.size, math.Max(g.minSize, math.Max(w, h)/maxGridCells))
+	g.origin = min
+
+	g.cells = make(map[[2]int][]int, len(idx))
+	g.left, g.built = len(idx), len(idx)
+	g.min = [2]int{math.MaxInt32, math.MaxInt32}
+	g.max = [2]int{math.MinInt32, math.MinInt32}
+	for _, i := range idx {
+		c := g.cell(g.sets[i][0].Vector())
+		g.cells[c] = append(g.cells[c], i)
+		for a := 0; a < 2; a++ {
+			if c[a] < g.min[a] {
+				g.min[a] = c[a]
+			}
+			if c[a] > g.max[a] {
+				g.max[a] = c[a]
+			}
+		}
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (g *setGrid) cell(v vector.Vector) [2]int {
+	return [2]int{int(math.Floor((v.X - g.origin.X) / g.size)), int(math.Floor((v.Y - g.origin.Y) / g.size))}
+}
+
+// Removes a set from the grid. The grid is rebuilt when few sets are left, so
+// the search does not have to cross many empty cells.
+func (g *setGrid) remove(i int) {
+	c := g.cell(g.sets[i][0].Vector())
+	cell := g.cells[c]
+	for k, j := range cell {
+		if j == i {
+			cell[k] = cell[len(cell)-1]
+			cell = cell[:len(cell)-1]
+			break
+		}
+	}
+	if len(cell) == 0 {
+		delete(g.cells, c)
+	} else {
+		g.cells[c] = cell
+	}
+	g.left--
+
+	if g.left > 0 && g.left < g.built/4 {
+		var idx []int
+		for _, cell := range g.cells {
+			idx = append(idx, cell...)
+		}
+		g.build(idx)
+	}
+}
+
+// Returns the remaining set starting nearest to p in XY, preferring the
+// shallowest and then the first of sets equally near, or -1 if none are left.
+func (g *setGrid) nearest(p vector.Vector) int {
+	if g.left == 0 {
+		return -1
+	}
+
+	best, dist := -1, math.Inf(1)
+	better := func(i int, d float64) bool {
+		switch {
+		case best == -1 || d < dist:
+			return true
+		case d > dist:
+			return false
+		case g.sets[i][0].Z != g.sets[best][0].Z:
+			return g.sets[i][0].Z > g.sets[best][0].Z
+		}
+		return i < best
+	}
+
+	// Rings closer than the cells in use are empty, and rings further out than all of them need not be searched
+	c := g.cell(p)
+	start, reach := 0, 0
+	for a := 0; a < 2; a++ {
+		start = maxInt(start, maxInt(g.min[a]-c[a], c[a]-g.max[a]))
+		reach = maxInt(reach, maxInt(c[a]-g.min[a], g.max[a]-c[a]))
+	}
+
+	visit := func(x, y int) {
+		if x < g.min[0] || x > g.max[0] || y < g.min[1] || y > g.max[1] {
+			return
+		}
+		for _, i := range g.cells[[2]int{x, y}] {
+			if d := xyDiff(p, g.sets[i][0].Vector()); better(i, d) {
+				best, dist = i, d
+			}
+		}
+	}
+
+	// Search rings of cells around p, until no nearer set can be found further out
+	for r := start; r <= reach; r++ {
+		if r == 0 {
+			visit(c[0], c[1])
+		}
+		for x := maxInt(c[0]-r, g.min[0]); r > 0 && x <= c[0]+r && x <= g.max[0]; x++ {
+			visit(x, c[1]-r)
+			visit(x, c[1]+r)
+		}
+		for y := maxInt(c[1]-r+1, g.min[1]); r > 0 && y < c[1]+r && y <= g.max[1]; y++ {
+			visit(c[0]-r, y)
+			visit(c[0]+r, y)
+		}
+		if best != -1 && dist < float64(r)*g.size {
+			break
+		}
+	}
+	return best
+}
@@ -0,0 +1,58 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "github.com/kennylevinsen/gocnc/vm"
+import "math/rand"
+import "testing"
+
+// Returns the remaining set starting nearest to p in XY, preferring the
+// shallowest and then the first of sets equally near, by going through them
+// all.
+func linearNearest(sets []pathSet, removed []bool, p vector.Vector) int {
+	best := -1
+	for i, s := range sets {
+		if removed[i] {
+			continue
+		}
+		if best == -1 {
+			best = i
+			continue
+		}
+		d, bd := xyDiff(p, s[0].Vector()), xyDiff(p, sets[best][0].Vector())
+		if d < bd || (d == bd && s[0].Z > sets[best][0].Z) {
+			best = i
+		}
+	}
+	return best
+}
+
+func TestSetGridMixedDepths(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	depths := []float64{-0.5, -1, -1.5, -3}
+
+	// Layers of a few pockets start at the same points, at different depths
+	var sets []pathSet
+	for k := 0; k < 500; k++ {
+		x, y := float64(r.Intn(40)), float64(r.Intn(40))
+		if k%5 == 0 {
+			x, y = x+r.Float64(), y+r.Float64()
+		}
+		sets = append(sets, pathSet{vm.Position{X: x, Y: y, Z: depths[r.Intn(len(depths))]}})
+	}
+
+	grid := newSetGrid(sets, 0.001)
+	removed := make([]bool, len(sets))
+	var p vector.Vector
+	for n := 0; n <= len(sets); n++ {
+		idx, expected := grid.nearest(p), linearNearest(sets, removed, p)
+		if idx != expected {
+			t.Fatalf("Set %d picked after %d sets, expected %d", idx, n, expected)
+		}
+		if idx == -1 {
+			break
+		}
+		grid.remove(idx)
+		removed[idx] = true
+		p = sets[idx][0].Vector()
+	}
+}
@@ -0,0 +1,136 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+
+// Moves the rapid moves straight down to idx, going back with step -1, or the
+// moves straight up from idx, with step 1, from the XY of pos to the given XY,
+// as the plunge or lift they lead to or from has been moved. Going back stops
+// at the top of a lift from a cut, such as between depth passes, which is
+// left where the cut ends.
+func moveVertical(machine *vm.Machine, idx, step int, pos vm.Position, x, y float64) {
+	positions := machine.Positions
+	for ; idx > 1 && idx < len(positions); idx += step {
+		p := &positions[idx]
+		if !machine.SameXY(p.Vector(), pos.Vector()) || (step < 0 && !rapidOrNone(*p)) {
+			break
+		}
+		if p.Z < positions[idx-step].Z {
+			break
+		}
+		if prev := positions[idx-1]; step < 0 && !rapidOrNone(prev) && machine.SameXY(prev.Vector(), p.Vector()) {
+			break
+		}
+		p.X, p.Y = x, y
+	}
+}
+
+// Inserts tangential arc lead-ins and lead-outs of radius on closed contours,
+// as found by Machine.Contours with side, so the tool enters and leaves the
+// contour on the side it cuts on, rather than marking the finished edge where
+// it plunges and lifts. The plunge is moved to the start of the lead-in, and
+// the lift to the end of the lead-out, along with the rapid moves straight
+// down into and up out of them.
+//
+// Lead-ins are only inserted where the contour is entered by a plunge from
+// a rapid move, and lead-outs where it is left by a move straight up.
+// Lead-ins and lead-outs that would cross the contour where it turns towards
+// the side, such as at the corners of pockets, are left out, as are contours
+// with cutter compensation, or cut on an unknown side. The arcs are cut with the state of the first and last move of the
+// contour, and need room on the side of the contour, which pockets smaller
+// than the lead-in do not have.
+func OptLeadInOut(machine *vm.Machine, radius float64, side func(int, vm.Operation) int) {
+	if radius <= 0 {
+		return
+	}
+
+	contours := machine.Contours(side)
+	for k := len(contours) - 1; k >= 0; k-- {
+		c := contours[k]
+		if c.Compensated || c.Side == vm.SideUnknown {
+			continue
+		}
+		left := c.Clockwise == (c.Side == vm.SideOutside)
+		normal := func(d vector.Vector) vector.Vector {
+			if left {
+				return vector.Vector{-d.Y, d.X, 0}
+			}
+			return vector.Vector{d.Y, -d.X, 0}
+		}
+		// Whether v from the start of the contour is on the side of direction d
+		onSide := func(d, v vector.Vector) bool {
+			cross := d.X*v.Y - d.Y*v.X
+			return (left && cross > 0) || (!left && cross < 0)
+		}
+		mode := vm.MoveModeCWArc
+		if left {
+			mode = vm.MoveModeCCWArc
+		}
+
+		positions := machine.Positions
+		start, last := positions[c.Start-1], positions[c.End-1]
+		first, _ := moveDirections(start, positions[c.Start])
+		_, final := moveDirections(positions[c.End-2], last)
+
+		// Lead-out, first, so the indexes of the lead-in stay the same
+		center := last.Vector().Sum(normal(final).Multiply(radius))
+		end := center.Sum(final.Multiply(radius))
+		if c.End < len(positions) && machine.SameXY(positions[c.End].Vector(), last.Vector()) && positions[c.End].Z > last.Z &&
+			final.Norm() > 0 && onSide(first, end.Diff(last.Vector())) {
+			out := last
+			out.State.MoveMode = mode
+			out.X, out.Y = end.X, end.Y
+			out.Center = vector.Vector{center.X, center.Y, 0}
+
+			moveVertical(machine, c.End, 1, last, end.X, end.Y)
+			positions = append(positions[:c.End], append([]vm.Position{out}, positions[c.End:]...)...)
+			machine.Positions = positions
+		}
+
+		// Lead-in
+		plunge := c.Start - 1
+		if plunge < 2 || start.State.MoveMode != vm.MoveModeLinear || !rapidOrNone(positions[plunge-1]) ||
+			!machine.SameXY(positions[plunge-1].Vector(), start.Vector()) || positions[plunge-1].Z <= start.Z {
+			continue
+		}
+		center = start.Vector().Sum(normal(first).Multiply(radius))
+		begin := center.Diff(first.Multiply(radius))
+		if first.Norm() == 0 || !onSide(final, begin.Diff(start.Vector())) {
+			continue
+		}
+
+		in := positions[c.Start]
+		in.State.MoveMode = mode
+		in.X, in.Y, in.Z = start.X, start.Y, start.Z
+		in.Center = vector.Vector{center.X, center.Y, 0}
+
+		moveVertical(machine, plunge-1, -1, start, begin.X, begin.Y)
+		positions[plunge].X, positions[plunge].Y = begin.X, begin.Y
+
+		// Rapid over to the start of the lead-in from where the moves down to
+		// it were left, such as the top of the lift of a previous pass
+		var over []vm.Position
+		if above := positions[plunge-1]; !machine.SameXY(above.Vector(), begin) {
+			above.State.MoveMode = vm.MoveModeRapid
+			above.X, above.Y = begin.X, begin.Y
+			above.Center = vector.Vector{}
+			over = append(over, above)
+		}
+
+		rest := append([]vm.Position{in}, positions[c.Start:]...)
+		leadIn := append(append(over, positions[plunge:c.Start]...), rest...)
+		machine.Positions = append(positions[:plunge], leadIn...)
+	}
+
+	// The rapids over to lead-ins are left in place where the lift before
+	// them has been moved to a lead-out
+	positions := machine.Positions[:1]
+	for _, p := range machine.Positions[1:] {
+		prev := positions[len(positions)-1]
+		if p.State.MoveMode == vm.MoveModeRapid && p.State == prev.State && machine.Equal(p.Vector().Diff(prev.Vector()).Norm(), 0) {
+			continue
+		}
+		positions = append(positions, p)
+	}
+	machine.Positions = positions
+}
@@ -9,7 +9,7 @@ import "github.com/kennylevinsen/gocnc/vector"
 func OptLiftSpeed(machine *vm.Machine) {
 	var last vector.Vector
 	for idx, m := range machine.Positions {
-		if m.X == last.X && m.Y == last.Y && m.Z > last.Z {
+		if machine.SameXY(m.Vector(), last) && m.Z > last.Z {
 			// We got a lift! Let's make it faster, shall we?
 			machine.Positions[idx].State.MoveMode = vm.MoveModeRapid
 		}
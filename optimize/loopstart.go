@@ -0,0 +1,69 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+
+// Returns whether the position is a rapid move, or no move at all.
+func rapidOrNone(pos vm.Position) bool {
+	return pos.State.MoveMode == vm.MoveModeRapid || pos.State.MoveMode == vm.MoveModeNone
+}
+
+// Moves the start of closed loops to their corner nearest to where the
+// previous operation ended, to shorten the rapid moves between them. A loop
+// is an operation consisting of a plunge followed by moves at a single depth
+// that return to where the plunge was.
+//
+// The rapid moves leading straight down into a rotated loop, and straight up
+// out of it, are moved along with its start. The cut itself is not changed.
+func OptLoopStart(machine *vm.Machine) {
+	positions := machine.Positions
+	cur := positions[0]
+	for _, op := range machine.Operations() {
+		if op.Start < 1 || op.End-op.Start < 3 {
+			cur = positions[op.End-1]
+			continue
+		}
+		prev, plunge, loop := positions[op.Start-1], positions[op.Start], positions[op.Start+1:op.End]
+		closed := plunge.State.MoveMode == vm.MoveModeLinear && machine.SameXY(plunge.Vector(), prev.Vector()) &&
+			plunge.Z < prev.Z && machine.SameXY(loop[len(loop)-1].Vector(), plunge.Vector())
+		for _, pos := range loop {
+			closed = closed && machine.Equal(pos.Z, plunge.Z) && pos.State.MoveMode != vm.MoveModeRapid &&
+				pos.State.MoveMode != vm.MoveModeNone && pos.State.MoveMode != vm.MoveModeDwell
+		}
+
+		// Find the corner nearest to where the tool is
+		best, dist := len(loop)-1, math.Inf(1)
+		for k, pos := range loop {
+			if d := math.Hypot(pos.X-cur.X, pos.Y-cur.Y); closed && d < dist {
+				best, dist = k, d
+			}
+		}
+		if !closed || best == len(loop)-1 {
+			cur = positions[op.End-1]
+			continue
+		}
+
+		x, y := plunge.X, plunge.Y
+		nx, ny := loop[best].X, loop[best].Y
+		rotated := append(append([]vm.Position(nil), loop[best+1:]...), loop[:best+1]...)
+		copy(loop, rotated)
+		positions[op.Start].X, positions[op.Start].Y = nx, ny
+
+		// Move the rapid moves straight down into and up out of the loop
+		for idx := op.Start - 1; idx > 1 && rapidOrNone(positions[idx]) && rapidOrNone(positions[idx-1]); idx-- {
+			p := &positions[idx]
+			if !machine.Equal(p.X, x) || !machine.Equal(p.Y, y) || p.Z > positions[idx-1].Z {
+				break
+			}
+			p.X, p.Y = nx, ny
+		}
+		for idx := op.End; idx < len(positions) && rapidOrNone(positions[idx]); idx++ {
+			p := &positions[idx]
+			if !machine.Equal(p.X, x) || !machine.Equal(p.Y, y) || p.Z < positions[idx-1].Z {
+				break
+			}
+			p.X, p.Y = nx, ny
+		}
+		cur = positions[op.End-1]
+	}
+}
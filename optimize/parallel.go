@@ -0,0 +1,77 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "runtime"
+import "sync"
+
+// Runs a pass over each operation, and over the moves between them,
+// concurrently on the given number of workers, or one per CPU if workers is
+// 0 or less. Each part is given to the pass as a machine of its own, starting
+// at the position the part is entered from, which the pass must leave as the
+// first position. Only passes that work on runs of moves within a single
+// operation, such as OptVector, OptSimplify and OptArcFit, can be run this way.
+//
+// As runs of moves are not joined across the start and end of operations, the
+// result can differ from running the pass over the whole machine.
+func OptParallel(machine *vm.Machine, workers int, pass func(*vm.Machine)) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	// Split the stack at the start and end of every operation
+	var bounds []int
+	for _, op := range machine.Operations() {
+		if op.Start > 0 && (len(bounds) == 0 || bounds[len(bounds)-1] != op.Start) {
+			bounds = append(bounds, op.Start)
+		}
+		if op.End < len(machine.Positions) {
+			bounds = append(bounds, op.End)
+		}
+	}
+	bounds = append(bounds, len(machine.Positions))
+
+	var (
+		parts = make([][]vm.Position, len(bounds))
+		jobs  = make(chan int)
+		wg    sync.WaitGroup
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				start := 0
+				if k > 0 {
+					start = bounds[k-1] - 1
+				}
+				part := &vm.Machine{
+					Positions: append([]vm.Position(nil), machine.Positions[start:bounds[k]]...),
+					Tools:     machine.Tools,
+					Tolerance: machine.Tolerance,
+				}
+				pass(part)
+				if k > 0 {
+					part.Positions = part.Positions[1:]
+				}
+				parts[k] = part.Positions
+			}
+		}()
+	}
+
+	for k := range bounds {
+		jobs <- k
+	}
+	close(jobs)
+	wg.Wait()
+
+	var n int
+	for _, part := range parts {
+		n += len(part)
+	}
+	npos := make([]vm.Position, 0, n)
+	for _, part := range parts {
+		npos = append(npos, part...)
+	}
+	machine.Positions = npos
+}
@@ -6,71 +6,106 @@ import "github.com/kennylevinsen/gocnc/vector"
 import "errors"
 import "fmt"
 
-// Reduces moves between paths.
-// It does this by scanning through position stack, grouping moves that move from >= Z0 to < Z0.
-// These moves are then sorted after closest to previous position, starting at X0 Y0,
-// and moves to groups recalculated as they are inserted in a new stack.
-// This optimization pass bails if the Z axis is moved simultaneously with any other axis,
-// or the input ends with the drill below Z0, in order to play it safe.
-// This pass is new, and therefore slightly experimental.
-func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
+// A sequence of moves below the top of the stock, from the plunge up to the lift.
+type pathSet []vm.Position
+
+// The feedrates of the plunges into the stock, by depth. Programs can plunge
+// at different feedrates, such as slower into deeper pockets or for
+// different tools, so all are kept.
+type plungeFeeds map[float64][]float64
+
+// Records the feedrate of a plunge to depth.
+func (p plungeFeeds) add(depth, feedrate float64) {
+	p[depth] = append(p[depth], feedrate)
+}
+
+// Returns the feedrate most used for plunges to depth, or for any plunge if
+// there were none to depth, preferring the lowest of equally used ones.
+// Returns 0 if no plunges were recorded.
+func (p plungeFeeds) at(depth float64) float64 {
+	count := func(feeds []float64) (feed float64) {
+		n := make(map[float64]int)
+		for _, f := range feeds {
+			n[f]++
+			if n[f] > n[feed] || (n[f] == n[feed] && f < feed) {
+				feed = f
+			}
 		}
-	}()
+		return feed
+	}
+	if feeds, ok := p[depth]; ok {
+		return count(feeds)
+	}
+	var all []float64
+	for _, feeds := range p {
+		all = append(all, feeds...)
+	}
+	return count(all)
+}
+
+// Returns the distance between two points in XY.
+func xyDiff(pos vector.Vector, cur vector.Vector) float64 {
+	j := cur.Diff(pos)
+	j.Z = 0
+	return j.Norm()
+}
 
-	type Set []vm.Position
+// Scans through the position stack, grouping moves that move from >= stockTop
+// to < stockTop, and returns the groups along with the detected safety height,
+// being the highest Z above stockTop, and the feedrates of the plunges.
+// Entries and exits moving in X or Y as well, such as ramps and helixes, are
+// kept whole in the group, which then starts or ends above the stock.
+// Panics on rapid moves in X or Y in the stock,
+// or the input ends with the drill below stockTop, in order to play it safe.
+func findPathSets(machine *vm.Machine, stockTop float64) (sets []pathSet, safetyHeight float64, feeds plungeFeeds) {
 	var (
 		lastx, lasty, lastz float64
-		sets                []Set = make([]Set, 0)
-		curSet              Set   = make(Set, 0)
-		safetyHeight        float64
-		drillSpeed          float64
+		setStart            int
 		sequenceStarted     bool = false
 	)
+	sets = make([]pathSet, 0)
+	feeds = make(plungeFeeds)
+	safetyHeight = stockTop
 
-	// Find grouped drills
-	for _, m := range machine.Positions {
-		if m.Z != lastz && (m.X != lastx || m.Y != lasty) {
-			panic("Complex z-motion detected")
-		}
+	// Find grouped drills. Sets are contiguous, so they refer to the position stack rather than copy it
+	for idx, m := range machine.Positions {
+		sameXY := machine.Equal(m.X, lastx) && machine.Equal(m.Y, lasty)
 
-		if m.X == lastx && m.Y == lasty {
-			if lastz >= 0 && m.Z < 0 {
-				// Down move
-				sequenceStarted = true
+		if !sameXY && m.Z < stockTop && m.State.MoveMode == vm.MoveModeRapid {
+			panic("Rapid move in stock detected")
+		}
 
-				// Set drill feedrate
-				if m.State.MoveMode == vm.MoveModeLinear && m.State.Feedrate > drillSpeed {
-					if drillSpeed != 0 {
-						panic("Multiple drill feedrates detected")
-					}
-					drillSpeed = m.State.Feedrate
-				}
-			} else if lastz < 0 && m.Z >= 0 {
-				// Up move - ignored in set
-				//curSet = append(curSet, m)
-				if sequenceStarted {
-					sets = append(sets, curSet)
-				}
-				sequenceStarted = false
-				curSet = make(Set, 0)
-				goto updateLast // Skip append
+		if lastz >= stockTop && m.Z < stockTop {
+			// Down move
+			sequenceStarted = true
+			setStart = idx
+			if !sameXY && idx > 0 {
+				// Ramp or helix - start the set where the entry starts
+				setStart = idx - 1
 			}
 
-		} else {
-			if m.Z < 0 && m.State.MoveMode == vm.MoveModeRapid {
-				panic("Rapid move in stock detected")
+			// Record the plunge feedrate
+			if m.State.MoveMode != vm.MoveModeRapid && m.State.Feedrate > 0 {
+				feeds.add(m.Z, m.State.Feedrate)
+			}
+		} else if lastz < stockTop && m.Z >= stockTop {
+			// Up move - ignored in set, unless it is cutting on the way out
+			if sequenceStarted {
+				end := idx
+				if !sameXY {
+					end = idx + 1
+				}
+				sets = append(sets, machine.Positions[setStart:end])
 			}
+			sequenceStarted = false
+			goto updateLast // Skip append
 		}
 
 		if sequenceStarted {
 			// Regular move
-			if m.Z > 0 {
+			if m.Z > stockTop {
 				panic("Move above stock detected")
 			}
-			curSet = append(curSet, m)
 		}
 
 	updateLast:
@@ -80,13 +115,17 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 		lastx, lasty, lastz = m.X, m.Y, m.Z
 	}
 
-	if safetyHeight == 0 {
+	if safetyHeight == stockTop {
 		panic("Unable to detect safety height")
-	} else if drillSpeed == 0 {
+	} else if len(feeds) == 0 {
 		panic("Unable to detect drill feedrate")
 	}
 
 	// If there was a final set without a proper lift
+	var curSet pathSet
+	if sequenceStarted {
+		curSet = machine.Positions[setStart:]
+	}
 	if len(curSet) == 1 {
 		p := curSet[0]
 		if p.Z != safetyHeight || lastz != safetyHeight || p.X != 0 || p.Y != 0 {
@@ -95,56 +134,33 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 	} else if len(curSet) > 0 {
 		panic("Incomplete final drill set")
 	}
+	return
+}
 
-	var (
-		curVec      vector.Vector
-		sortedSets  []Set = make([]Set, 0)
-		selectedSet int
-	)
-
-	// Stupid difference calculator
-	xyDiff := func(pos vector.Vector, cur vector.Vector) float64 {
-		j := cur.Diff(pos)
-		j.Z = 0
-		return j.Norm()
-	}
-
-	// Sort the sets after distance from current position
-	for len(sets) > 0 {
-		for idx := range sets {
-			if selectedSet == -1 {
-				selectedSet = idx
-			} else {
-				np := sets[idx][0]
-				pp := sets[selectedSet][0]
-				diff := xyDiff(np.Vector(), curVec)
-				other := xyDiff(pp.Vector(), curVec)
-				if diff < other {
-					selectedSet = idx
-				} else if np.Z > pp.Z {
-					selectedSet = idx
-				}
-			}
-		}
-		curVec = sets[selectedSet][0].Vector()
-		sortedSets = append(sortedSets, sets[selectedSet])
-		sets = append(sets[0:selectedSet], sets[selectedSet+1:]...)
-		selectedSet = -1
+// Reconstructs the position stack from sets in the given order, moving between
+// them at safety height unless they are within tolerance of each other. Sets
+// are plunged into at the feedrate of their own plunge, or that of other
+// plunges to the same depth if it was a rapid move, ramping down along their
+// first move if the machine has an EntryAngle.
+func rebuildPathSets(machine *vm.Machine, sets []pathSet, safetyHeight float64, feeds plungeFeeds, tolerance float64) {
+	size := 1
+	for _, m := range sets {
+		size += len(m) + 3
 	}
-
-	// Reconstruct new position stack from sorted sections
-	newPos := []vm.Position{machine.Positions[0]} // Origin
+	newPos := make([]vm.Position, 1, size)
+	newPos[0] = machine.Positions[0] // Origin
 
 	addPos := func(pos vm.Position) {
 		newPos = append(newPos, pos)
 	}
 
-	moveTo := func(pos vm.Position) {
+	moveTo := func(set pathSet) {
+		pos := set[0]
 		curPos := newPos[len(newPos)-1]
 
 		// Check if we should go to safety-height before moving
 		if xyDiff(curPos.Vector(), pos.Vector()) < tolerance {
-			if curPos.X != pos.X || curPos.Y != pos.Y {
+			if !machine.SameXY(curPos.Vector(), pos.Vector()) {
 				// If we're not 100% precise...
 				step1 := curPos
 				step1.State.MoveMode = vm.MoveModeLinear
@@ -162,19 +178,32 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 			step3 := step2
 			step3.Z = pos.Z
 			step3.State.MoveMode = vm.MoveModeLinear
-			step3.State.Feedrate = drillSpeed
+			step3.State.Feedrate = feeds.at(pos.Z)
+			if pos.State.MoveMode == vm.MoveModeLinear && pos.State.Feedrate > 0 {
+				step3.State.Feedrate = pos.State.Feedrate
+			}
 
 			addPos(step1)
 			addPos(step2)
+
+			// Single positions are drilled, so only paths are ramped into
+			if len(set) > 1 {
+				if ramp := machine.EntryRamp(step3, set[1], safetyHeight); ramp != nil {
+					for _, p := range ramp {
+						addPos(p)
+					}
+					return
+				}
+			}
 			addPos(step3)
 		}
 
 	}
 
-	for _, m := range sortedSets {
+	for _, m := range sets {
 		for idx, p := range m {
 			if idx == 0 {
-				moveTo(p)
+				moveTo(m)
 			} else {
 				addPos(p)
 			}
@@ -182,6 +211,40 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 	}
 
 	machine.Positions = newPos
+}
+
+// Reduces moves between paths.
+// It does this by scanning through position stack, grouping moves that move from >= stockTop to < stockTop,
+// stockTop being the Z of the top of the stock, usually 0.
+// These moves are then sorted after closest to previous position, starting at X0 Y0,
+// preferring the shallowest of sets equally close,
+// and moves to groups recalculated as they are inserted in a new stack.
+// Ramped and helical entries, and paths moving in X, Y and Z at once, are kept as they are.
+// This optimization pass bails on rapid moves in the stock other than straight down,
+// or if the input ends with the drill below stockTop, in order to play it safe.
+// This pass is new, and therefore slightly experimental.
+func OptPathGrouping(machine *vm.Machine, tolerance, stockTop float64) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	sets, safetyHeight, feeds := findPathSets(machine, stockTop)
+
+	// Sort the sets after distance from current position
+	var (
+		curVec     vector.Vector
+		sortedSets = make([]pathSet, 0, len(sets))
+		grid       = newSetGrid(sets, tolerance)
+	)
+	for idx := grid.nearest(curVec); idx != -1; idx = grid.nearest(curVec) {
+		grid.remove(idx)
+		curVec = sets[idx][0].Vector()
+		sortedSets = append(sortedSets, sets[idx])
+	}
+
+	rebuildPathSets(machine, sortedSets, safetyHeight, feeds, tolerance)
 
 	return nil
 }
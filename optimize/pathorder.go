@@ -0,0 +1,148 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+
+import "errors"
+import "fmt"
+
+// The minimum saving for a change to the tour to be applied (mm)
+const minTourImprovement = 1e-9
+
+// An open tour through path sets, starting at an origin.
+type tour struct {
+	origin vector.Vector
+	sets   []pathSet
+	order  []int
+}
+
+// Returns the end of the set at position k of the tour, or the origin if k
+// is before the start.
+func (t *tour) end(k int) vector.Vector {
+	if k < 0 {
+		return t.origin
+	}
+	set := t.sets[t.order[k]]
+	return set[len(set)-1].Vector()
+}
+
+// Returns the start of the set at position k of the tour.
+func (t *tour) start(k int) vector.Vector {
+	return t.sets[t.order[k]][0].Vector()
+}
+
+// Returns the distance from the end of the set at position a to the start of
+// the set at position b, or 0 if b is past the end of the tour.
+func (t *tour) cost(a, b int) float64 {
+	if b >= len(t.order) {
+		return 0
+	}
+	return xyDiff(t.end(a), t.start(b))
+}
+
+// Builds the initial tour by always moving to the nearest set.
+func (t *tour) nearestNeighbour(tolerance float64) {
+	grid := newSetGrid(t.sets, tolerance)
+	t.order = make([]int, 0, len(t.sets))
+	for idx := grid.nearest(t.origin); idx != -1; idx = grid.nearest(t.end(len(t.order) - 1)) {
+		grid.remove(idx)
+		t.order = append(t.order, idx)
+	}
+}
+
+// Applies the first improving reversal of a part of the tour. Sets are not
+// reversed themselves, so the moves within the reversed part are costed in
+// both directions.
+func (t *tour) twoOpt() bool {
+	n := len(t.order)
+	fwd, bwd := make([]float64, n), make([]float64, n)
+	for k := 1; k < n; k++ {
+		fwd[k] = fwd[k-1] + t.cost(k-1, k)
+		bwd[k] = bwd[k-1] + xyDiff(t.end(k), t.start(k-1))
+	}
+
+	for i := 0; i < n-1; i++ {
+		for j := i + 1; j < n; j++ {
+			before := xyDiff(t.end(i-1), t.start(i)) + fwd[j] - fwd[i] + t.cost(j, j+1)
+			after := xyDiff(t.end(i-1), t.start(j)) + bwd[j] - bwd[i]
+			if j+1 < n {
+				after += xyDiff(t.end(i), t.start(j+1))
+			}
+			if after < before-minTourImprovement {
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					t.order[a], t.order[b] = t.order[b], t.order[a]
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Applies the first improving move of a run of up to three sets to another
+// place in the tour.
+func (t *tour) orOpt() bool {
+	n := len(t.order)
+	for l := 1; l <= 3 && l < n; l++ {
+		for i := 0; i+l <= n; i++ {
+			last := i + l - 1
+			gain := xyDiff(t.end(i-1), t.start(i)) + t.cost(last, last+1)
+			if last+1 < n {
+				gain -= xyDiff(t.end(i-1), t.start(last+1))
+			}
+
+			for j := -1; j < n; j++ {
+				if j >= i-1 && j <= last {
+					continue
+				}
+				cost := xyDiff(t.end(j), t.start(i)) + t.cost(last, j+1)
+				if j+1 < n {
+					cost -= xyDiff(t.end(j), t.start(j+1))
+				}
+				if cost < gain-minTourImprovement {
+					run := append([]int(nil), t.order[i:last+1]...)
+					rest := append(append([]int(nil), t.order[:i]...), t.order[last+1:]...)
+					at := j + 1
+					if j > last {
+						at -= l
+					}
+					t.order = append(append(append([]int(nil), rest[:at]...), run...), rest[at:]...)
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Reduces moves between paths, like OptPathGrouping, but orders the paths by
+// improving a nearest neighbour tour with 2-opt and Or-opt moves until no
+// more improvements are found, or maxImprovements have been made, if above
+// 0. The result only depends on the program, not on the time it takes.
+// The same restrictions as for OptPathGrouping apply.
+func OptPathOrdering(machine *vm.Machine, tolerance, stockTop float64, maxImprovements int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	sets, safetyHeight, feeds := findPathSets(machine, stockTop)
+
+	t := tour{origin: machine.Positions[0].Vector(), sets: sets}
+	t.nearestNeighbour(tolerance)
+
+	for n := 0; maxImprovements <= 0 || n < maxImprovements; n++ {
+		if !t.twoOpt() && !t.orOpt() {
+			break
+		}
+	}
+
+	sorted := make([]pathSet, len(t.order))
+	for k, idx := range t.order {
+		sorted[k] = sets[idx]
+	}
+	rebuildPathSets(machine, sorted, safetyHeight, feeds, tolerance)
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+
+// Distance above the previous peck to rapid back down to (mm)
+const peckClearance = 0.25
+
+// Converts drills deeper than peckDepth into peck drilling, retracting to Z
+// retractHeight after every peck of at most peckDepth to clear chips, and
+// rapiding back down to just above the previous peck. A drill is a plunge
+// followed by a move back up along Z, and its depth is measured from Z0 or
+// where the plunge starts, whichever is lower.
+//
+// The pecks are expanded into moves rather than exported as G83, as the VM
+// does not run canned cycles, and exported code could not be verified.
+func OptPeckDrill(machine *vm.Machine, peckDepth, retractHeight float64) {
+	if peckDepth <= 0 {
+		return
+	}
+
+	positions := machine.Positions
+	npos := make([]vm.Position, 0, len(positions))
+	for idx, pos := range positions {
+		if idx == 0 || idx == len(positions)-1 {
+			npos = append(npos, pos)
+			continue
+		}
+		prev, next := positions[idx-1], positions[idx+1]
+		top := math.Min(prev.Z, 0)
+		if pos.State.MoveMode != vm.MoveModeLinear || !machine.SameXY(pos.Vector(), prev.Vector()) ||
+			!machine.SameXY(next.Vector(), pos.Vector()) || next.Z <= pos.Z || top-pos.Z <= peckDepth {
+			npos = append(npos, pos)
+			continue
+		}
+
+		pecks := int(math.Ceil((top - pos.Z) / peckDepth))
+		for k := 1; k <= pecks; k++ {
+			depth := math.Max(top-peckDepth*float64(k), pos.Z)
+			if k > 1 {
+				p := pos
+				p.State.MoveMode = vm.MoveModeRapid
+				p.Z = top - peckDepth*float64(k-1) + peckClearance
+				npos = append(npos, p)
+			}
+
+			p := pos
+			p.Z = depth
+			npos = append(npos, p)
+
+			if k < pecks {
+				p.State.MoveMode = vm.MoveModeRapid
+				p.Z = retractHeight
+				npos = append(npos, p)
+			}
+		}
+	}
+	machine.Positions = npos
+}
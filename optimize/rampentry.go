@@ -0,0 +1,57 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+
+// Replaces plunges into the stock with ramps down along the following move,
+// descending at most maxAngleDeg from horizontal. The ramp goes back and forth
+// along the move, ending where the plunge did. Where the following move is
+// not a linear move at the plunge depth, or shorter than 1mm, a helical entry
+// of helixDiameter is used instead, or of half the diameter of the tool if
+// helixDiameter is 0 and the tool is known. Drills, which are followed by a
+// move along Z, are left alone.
+//
+// The stock starts at stockTop, as given to OptPathGrouping, so the part of a
+// plunge above it is left straight. Ramps are cut with the state of the
+// plunge, including its feedrate.
+func OptRampEntry(machine *vm.Machine, maxAngleDeg, helixDiameter, stockTop float64) {
+	slope := math.Tan(maxAngleDeg * math.Pi / 180)
+	if slope <= 0 || math.IsInf(slope, 0) {
+		return
+	}
+
+	positions := machine.Positions
+	npos := make([]vm.Position, 0, len(positions))
+	for idx, pos := range positions {
+		if idx == 0 || idx == len(positions)-1 {
+			npos = append(npos, pos)
+			continue
+		}
+		prev, next := positions[idx-1], positions[idx+1]
+		if pos.State.MoveMode != vm.MoveModeLinear || !machine.SameXY(pos.Vector(), prev.Vector()) ||
+			pos.Z >= prev.Z || pos.Z >= stockTop || machine.SameXY(next.Vector(), pos.Vector()) {
+			npos = append(npos, pos)
+			continue
+		}
+
+		radius := helixDiameter / 2
+		if helixDiameter <= 0 {
+			tool, _ := machine.GetTool(pos.State.ToolIndex)
+			radius = tool.Diameter / 4
+		}
+		top := math.Min(prev.Z, stockTop)
+		entry := machine.RampEntry(pos, next, top, slope, radius)
+		if entry == nil {
+			npos = append(npos, pos)
+			continue
+		}
+
+		if prev.Z > top {
+			p := pos
+			p.Z = top
+			npos = append(npos, p)
+		}
+		npos = append(npos, entry...)
+	}
+	machine.Positions = npos
+}
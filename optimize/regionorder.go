@@ -0,0 +1,126 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "math"
+
+// Returns whether the rectangles, grown by margin, overlap in XY.
+func rectsOverlap(a, b vm.Box, margin float64) bool {
+	return a.Min.X-margin <= b.Max.X && b.Min.X-margin <= a.Max.X &&
+		a.Min.Y-margin <= b.Max.Y && b.Min.Y-margin <= a.Max.Y
+}
+
+// Returns the bounds of the positions, including the move into the first.
+func positionBounds(positions []vm.Position) vm.Box {
+	b := vm.Box{Min: positions[0].Vector(), Max: positions[0].Vector()}
+	for _, pos := range positions[1:] {
+		b.Min.X, b.Min.Y = math.Min(b.Min.X, pos.X), math.Min(b.Min.Y, pos.Y)
+		b.Max.X, b.Max.Y = math.Max(b.Max.X, pos.X), math.Max(b.Max.Y, pos.Y)
+	}
+	return b
+}
+
+// Reorders the operations of the position stack so that all operations in a
+// region, such as the passes of a contour at increasing depths, are completed
+// before moving on to the next region. Operations belong to the same region if
+// their bounds, grown by margin and the radius of the tool if known, overlap,
+// directly or through other operations. Regions are cut in the order they are
+// first entered, and operations within them in their original order.
+//
+// Only operations with the same tool and only rapid moves between them are
+// reordered. The tool moves between them at the highest height of those
+// rapid moves, and back down to where each operation was entered from.
+func OptRegionOrdering(machine *vm.Machine, margin float64) {
+	ops := machine.Operations()
+	positions := machine.Positions
+
+	// Split the operations into blocks that can be reordered
+	var blocks [][]vm.Operation
+	for idx, op := range ops {
+		if idx > 0 && op.Tool == ops[idx-1].Tool {
+			rapids := true
+			for _, pos := range positions[ops[idx-1].End:op.Start] {
+				rapids = rapids && pos.State.MoveMode == vm.MoveModeRapid
+			}
+			if rapids && op.Start > ops[idx-1].End {
+				blocks[len(blocks)-1] = append(blocks[len(blocks)-1], op)
+				continue
+			}
+		}
+		blocks = append(blocks, []vm.Operation{op})
+	}
+
+	npos := make([]vm.Position, 0, len(positions))
+	last := 0
+	for _, block := range blocks {
+		first, end := block[0].Start, block[len(block)-1].End
+		npos = append(npos, positions[last:first]...)
+		last = end
+		if len(block) < 3 {
+			npos = append(npos, positions[first:end]...)
+			continue
+		}
+
+		grow := margin
+		if tool, ok := machine.GetTool(block[0].Tool); ok {
+			grow += tool.Diameter / 2
+		}
+
+		// Group the operations into regions, in the order they are entered
+		bounds := make([]vm.Box, len(block))
+		region := make([]int, len(block))
+		safety := math.Inf(-1)
+		for i, op := range block {
+			bounds[i] = positionBounds(positions[op.Start-1 : op.End])
+			region[i] = i
+			for j := 0; j < i; j++ {
+				if rectsOverlap(bounds[i], bounds[j], grow) {
+					// Merge the regions into the earliest
+					from, to := region[i], region[j]
+					if from < to {
+						from, to = to, from
+					}
+					for k := 0; k <= i; k++ {
+						if region[k] == from {
+							region[k] = to
+						}
+					}
+				}
+			}
+			if i > 0 {
+				for _, pos := range positions[block[i-1].End:op.Start] {
+					safety = math.Max(safety, pos.Z)
+				}
+			}
+		}
+
+		npos = append(npos, positions[first:block[0].End]...)
+		for r := range block {
+			for i, op := range block {
+				if region[i] != r || i == 0 {
+					continue
+				}
+
+				// Move over at safety height, and down to where the operation was entered from
+				entry := positions[op.Start-1]
+				cur := npos[len(npos)-1]
+				up := entry
+				up.X, up.Y, up.Z = cur.X, cur.Y, safety
+				over := entry
+				over.Z = safety
+				npos = append(npos, up, over, entry)
+				npos = append(npos, positions[op.Start:op.End]...)
+			}
+		}
+
+		// The moves after the block start where its last operation ended
+		if end < len(positions) && npos[len(npos)-1] != positions[end-1] {
+			up := positions[end]
+			cur := npos[len(npos)-1]
+			up.State.MoveMode = vm.MoveModeRapid
+			up.X, up.Y, up.Z = cur.X, cur.Y, math.Max(safety, cur.Z)
+			npos = append(npos, up)
+		}
+	}
+	npos = append(npos, positions[last:]...)
+	machine.Positions = npos
+}
@@ -0,0 +1,55 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "errors"
+import "fmt"
+import "sort"
+
+// Returns the clearance heights of the position stack, in increasing order.
+// A clearance height is a height above Z0 that rapid moves travel across in
+// XY at.
+func ClearanceHeights(machine *vm.Machine) []float64 {
+	seen := make(map[float64]bool)
+	var heights []float64
+	for idx := 1; idx < len(machine.Positions); idx++ {
+		prev, pos := machine.Positions[idx-1], machine.Positions[idx]
+		if pos.State.MoveMode == vm.MoveModeRapid && pos.Z > 0 && machine.Equal(pos.Z, prev.Z) &&
+			!machine.SameXY(pos.Vector(), prev.Vector()) && !seen[pos.Z] {
+			seen[pos.Z] = true
+			heights = append(heights, pos.Z)
+		}
+	}
+	sort.Float64s(heights)
+	return heights
+}
+
+// Rewrites all clearance heights, as found by ClearanceHeights, to a single
+// height, and returns the heights found. Unlike Machine.SetSafetyHeight,
+// which only replaces the highest height between operations, this also
+// rewrites lower heights rapid moves travel across, such as retract heights.
+// The height must be above all other positions.
+func OptNormalizeSafeHeight(machine *vm.Machine, height float64) ([]float64, error) {
+	heights := ClearanceHeights(machine)
+	clearance := make(map[float64]bool)
+	for _, h := range heights {
+		clearance[h] = true
+	}
+
+	// Only rapid moves, and changes of state in between, are at clearance heights
+	travel := func(pos vm.Position) bool {
+		return clearance[pos.Z] && (pos.State.MoveMode == vm.MoveModeRapid || pos.State.MoveMode == vm.MoveModeNone)
+	}
+
+	for _, pos := range machine.Positions {
+		if !travel(pos) && pos.Z >= height {
+			return heights, errors.New(fmt.Sprintf("New safety height collides with move at height %g", pos.Z))
+		}
+	}
+
+	for idx, pos := range machine.Positions {
+		if travel(pos) {
+			machine.Positions[idx].Z = height
+		}
+	}
+	return heights, nil
+}
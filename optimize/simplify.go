@@ -0,0 +1,86 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+
+// Returns the distance from a point to the segment p1-p2.
+func pointSegmentDistance(p, p1, p2 vector.Vector) float64 {
+	d := p2.Diff(p1)
+	l := d.Dot(d)
+	if l == 0 {
+		return p.Diff(p1).Norm()
+	}
+	t := p.Diff(p1).Dot(d) / l
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	return p.Diff(p1.Sum(d.Multiply(t))).Norm()
+}
+
+// Marks the points between first and last to keep, by recursively keeping
+// the point farthest from the line between them while it is off by more than
+// tolerance.
+func simplify(points []vector.Vector, keep []bool, first, last int, tolerance float64) {
+	var (
+		dmax float64
+		imax int
+	)
+	for i := first + 1; i < last; i++ {
+		if d := pointSegmentDistance(points[i], points[first], points[last]); d > dmax {
+			dmax, imax = d, i
+		}
+	}
+	if dmax <= tolerance {
+		return
+	}
+	keep[imax] = true
+	simplify(points, keep, first, imax, tolerance)
+	simplify(points, keep, imax, last, tolerance)
+}
+
+// Simplifies runs of linear moves with identical state using the
+// Ramer-Douglas-Peucker algorithm, keeping only the moves needed for the path
+// to stay within tolerance of the original. Unlike OptVector, which only looks at three moves at
+// a time, the deviation is measured against the entire run. Moves in inverse
+// time feed mode are left alone, as removing them would change their timing.
+// The position stack is filtered in place.
+func OptSimplify(machine *vm.Machine, tolerance float64) {
+	var (
+		positions = machine.Positions
+		npos      = positions[:0]
+		points    []vector.Vector
+		keep      []bool
+	)
+	for idx := 0; idx < len(positions); {
+		pos := positions[idx]
+		if idx == 0 || pos.State.MoveMode != vm.MoveModeLinear || pos.State.FeedMode == vm.FeedModeInvTime {
+			npos = append(npos, pos)
+			idx++
+			continue
+		}
+
+		// The run starts where the previous move ended, which is always kept
+		end := idx + 1
+		for end < len(positions) && positions[end].State == pos.State {
+			end++
+		}
+		points = append(points[:0], npos[len(npos)-1].Vector())
+		keep = append(keep[:0], false)
+		for i := idx; i < end; i++ {
+			points = append(points, positions[i].Vector())
+			keep = append(keep, false)
+		}
+
+		keep[len(points)-1] = true
+		simplify(points, keep, 0, len(points)-1, tolerance)
+		for i := 1; i < len(points); i++ {
+			if keep[i] {
+				npos = append(npos, positions[idx-1+i])
+			}
+		}
+		idx = end
+	}
+	machine.Positions = npos
+}
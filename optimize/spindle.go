@@ -0,0 +1,48 @@
+package optimize
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "time"
+
+// Keeps the spindle running between operations where it is stopped for less
+// than idle, and started again in the same direction and at the same speed
+// with the same tool. Only stops spent on rapid moves are removed, so the
+// spindle is still stopped for toolchanges. Returns the number of stops
+// removed.
+func OptSpindleStops(machine *vm.Machine, idle time.Duration) int {
+	var (
+		removed int
+		etas    = machine.PositionETAs()
+		last    = -1 // Index of the last position with the spindle running
+	)
+
+	for idx, pos := range machine.Positions {
+		s := pos.State
+		if !s.SpindleEnabled {
+			continue
+		}
+
+		if last >= 0 && idx > last+1 {
+			running := machine.Positions[last].State
+			stopped := machine.Positions[last+1 : idx]
+			keep := running.SpindleClockwise == s.SpindleClockwise && machine.Equal(running.SpindleSpeed, s.SpindleSpeed) &&
+				running.ToolIndex == s.ToolIndex
+			var spent time.Duration
+			for i, p := range stopped {
+				keep = keep && p.State.ToolIndex == s.ToolIndex &&
+					(p.State.MoveMode == vm.MoveModeRapid || p.State.MoveMode == vm.MoveModeNone)
+				spent += etas[last+1+i]
+			}
+
+			if keep && spent < idle {
+				for i := range stopped {
+					stopped[i].State.SpindleEnabled = true
+					stopped[i].State.SpindleClockwise = s.SpindleClockwise
+					stopped[i].State.SpindleSpeed = s.SpindleSpeed
+				}
+				removed++
+			}
+		}
+		last = idx
+	}
+	return removed
+}
@@ -5,13 +5,14 @@ import "github.com/kennylevinsen/gocnc/vector"
 
 // Kills redundant partial moves.
 // Calculates the unit-vector, and kills all incremental moves between A and B.
+// The position stack is filtered in place.
 func OptVector(machine *vm.Machine, tolerance float64) {
 	var (
 		vec1, vec2, vec3 vector.Vector
 		ready            int
 		length1, length2 float64
 		lastMoveMode     int
-		npos             []vm.Position = make([]vm.Position, 0)
+		npos             []vm.Position = machine.Positions[:0]
 	)
 
 	for _, m := range machine.Positions {
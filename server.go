@@ -0,0 +1,656 @@
+package main
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/export"
+import "github.com/kennylevinsen/gocnc/streaming"
+import "golang.org/x/net/websocket"
+
+import "crypto/subtle"
+import "crypto/rand"
+import "encoding/json"
+import "encoding/hex"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "net"
+import "strconv"
+import "strings"
+import "errors"
+import "sync"
+import "time"
+import "math"
+import "fmt"
+import "os"
+
+// Constants for job states
+const (
+	jobHeld      = "held"
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobPaused    = "paused"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobStopped   = "stopped"
+	jobCancelled = "cancelled"
+)
+
+const (
+	// Maximum size of uploaded gcode
+	maxUploadSize = 64 << 20
+
+	// Events buffered per websocket client before dropping
+	clientBuffer = 256
+)
+
+// Names of the streaming event types, as sent to websocket clients
+var eventNames = map[int]string{
+	streaming.EventSent:         "sent",
+	streaming.EventAcknowledged: "acknowledged",
+	streaming.EventInfo:         "info",
+	streaming.EventError:        "error",
+	streaming.EventStatus:       "status",
+	streaming.EventProgress:     "progress",
+}
+
+// A job in the queue.
+type serverJob struct {
+	ID        int
+	Name      string
+	State     string
+	Error     string
+	Positions int
+	ETA       time.Duration
+	Progress  streaming.Progress
+	Created   time.Time
+
+	machine *vm.Machine
+	format  *export.Format // Format to stream with, if another than that of the server
+}
+
+// An event sent to websocket clients. Job is set for job state changes.
+type serverEvent struct {
+	Type     string
+	Line     string
+	Error    string
+	Status   streaming.GrblStatus
+	Progress streaming.Progress
+	Job      *serverJob
+}
+
+// Streams queued jobs to a single machine, controlled over HTTP.
+//
+// Jobs are run through the VM and the optimizations given on the
+// command-line when uploaded, and held until started, after which they are
+// streamed in order. Manual spindle, coolant and toolchange prompts are not
+// available, as there is no one at the terminal to answer them.
+//
+// Every request must carry the token, so that web pages cannot control the
+// machine through the browser of someone on the same host or network.
+type server struct {
+	streamer streaming.Streamer
+	grbl     *streaming.GrblStreamer
+	token    string
+
+	// Precision and format of the streamer, which jobs are checked with
+	precision int
+	format    *export.Format
+
+	// Held while using the connection
+	machineMutex sync.Mutex
+
+	// Protects the fields below
+	mutex     sync.Mutex
+	connected bool
+	jobs      []*serverJob
+	nextID    int
+	current   *serverJob
+	stopping  bool
+	status    streaming.GrblStatus
+	clients   map[chan serverEvent]bool
+
+	queue chan *serverJob
+}
+
+func (srv *server) Init() {
+	srv.streamer, srv.grbl = newStreamer()
+	srv.grbl.OnEvent = srv.streamEvent
+	srv.precision, srv.format = srv.grbl.Precision, srv.grbl.Format
+	srv.nextID = 1
+	srv.clients = make(map[chan serverEvent]bool)
+	srv.queue = make(chan *serverJob, 1024)
+}
+
+//
+// Events
+//
+
+// Forwards an event from the streamer to websocket clients.
+func (srv *server) streamEvent(e streaming.Event) {
+	ev := serverEvent{Type: eventNames[e.Type], Line: e.Line, Status: e.Status, Progress: e.Progress}
+	if e.Err != nil {
+		ev.Error = e.Err.Error()
+	}
+
+	srv.mutex.Lock()
+	switch e.Type {
+	case streaming.EventStatus:
+		srv.status = e.Status
+	case streaming.EventProgress:
+		if srv.current != nil {
+			srv.current.Progress = e.Progress
+		}
+	}
+	srv.mutex.Unlock()
+
+	srv.broadcast(ev)
+}
+
+// Announces the state of a job to websocket clients.
+func (srv *server) jobEvent(job *serverJob) {
+	srv.mutex.Lock()
+	j := *job
+	srv.mutex.Unlock()
+	srv.broadcast(serverEvent{Type: "job", Job: &j})
+}
+
+// Sends an event to all websocket clients, dropping it for clients that
+// are not keeping up.
+func (srv *server) broadcast(ev serverEvent) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for c := range srv.clients {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+func (srv *server) subscribe() chan serverEvent {
+	c := make(chan serverEvent, clientBuffer)
+	srv.mutex.Lock()
+	srv.clients[c] = true
+	srv.mutex.Unlock()
+	return c
+}
+
+func (srv *server) unsubscribe(c chan serverEvent) {
+	srv.mutex.Lock()
+	delete(srv.clients, c)
+	srv.mutex.Unlock()
+}
+
+//
+// Job handling
+//
+
+// Runs uploaded code through the VM, and holds it until started.
+func (srv *server) upload(name, code string) (*serverJob, error) {
+	params, err := loadParameters()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &vm.Machine{}
+	if _, err := prepare(m, []string{name}, []string{code}, params); err != nil {
+		return nil, err
+	}
+
+	if *verify {
+		if err := export.Verify(m, *precision, math.Pow(10, -float64(*precision))); err != nil {
+			return nil, err
+		}
+	}
+	check, err := srv.grbl.CheckJob(m, srv.precision, srv.format)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Incompatibility: %s", err))
+	}
+	for _, f := range check.Fixes {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", name, f)
+	}
+
+	srv.mutex.Lock()
+	job := &serverJob{
+		ID:        srv.nextID,
+		Name:      name,
+		State:     jobHeld,
+		Positions: len(m.Positions),
+		ETA:       m.ETA(),
+		Created:   time.Now(),
+		machine:   m,
+		format:    check.Format,
+	}
+	srv.nextID++
+	srv.jobs = append(srv.jobs, job)
+	srv.mutex.Unlock()
+
+	srv.jobEvent(job)
+	return job, nil
+}
+
+// Queues a held job to be streamed after those queued before it. Must be
+// called with mutex held.
+func (srv *server) start(job *serverJob) error {
+	if job.State != jobHeld {
+		return errors.New(fmt.Sprintf("Job is %s", job.State))
+	}
+	select {
+	case srv.queue <- job:
+	default:
+		return errors.New("Queue is full")
+	}
+	job.State = jobQueued
+	return nil
+}
+
+// Runs queued jobs in order.
+func (srv *server) run() {
+	for job := range srv.queue {
+		srv.runJob(job)
+	}
+}
+
+func (srv *server) runJob(job *serverJob) {
+	srv.machineMutex.Lock()
+	defer srv.machineMutex.Unlock()
+
+	srv.mutex.Lock()
+	if job.State != jobQueued {
+		srv.mutex.Unlock()
+		return
+	}
+	job.State = jobRunning
+	srv.current = job
+	srv.stopping = false
+	srv.mutex.Unlock()
+	srv.jobEvent(job)
+
+	err := srv.stream(job)
+
+	srv.mutex.Lock()
+	switch {
+	case srv.stopping:
+		// Stopping closes the connection
+		srv.connected = false
+		job.State = jobStopped
+	case err != nil:
+		job.State = jobFailed
+		job.Error = err.Error()
+	default:
+		job.State = jobDone
+	}
+	srv.current = nil
+	srv.mutex.Unlock()
+	srv.jobEvent(job)
+}
+
+// Connects to the machine if not already connected. Must be called with
+// machineMutex held.
+func (srv *server) connect() error {
+	srv.mutex.Lock()
+	connected := srv.connected
+	srv.mutex.Unlock()
+	if connected {
+		return nil
+	}
+	if err := srv.streamer.Connect(*device, *baudrate); err != nil {
+		return err
+	}
+	srv.setConnected(true)
+	return nil
+}
+
+func (srv *server) setConnected(connected bool) {
+	srv.mutex.Lock()
+	srv.connected = connected
+	srv.mutex.Unlock()
+}
+
+func (srv *server) isStopping() bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.stopping
+}
+
+// Streams a job, handling reconnects like the command-line does.
+func (srv *server) stream(job *serverJob) error {
+	if err := srv.connect(); err != nil {
+		return err
+	}
+
+	// Jobs start from a clean modal state, with the format they were checked for
+	srv.grbl.Init()
+	srv.grbl.Format = srv.format
+	if job.format != nil {
+		srv.grbl.Format = job.format
+	}
+	wt := &WaitGenerator{}
+	wt.Init()
+
+	var tracker streaming.ProgressTracker
+	tracker.Init(job.machine)
+
+	for idx := range job.machine.Positions {
+		if srv.isStopping() {
+			return nil
+		}
+
+		err := export.HandlePositionAtIndex(job.machine, idx, wt, srv.grbl)
+		for {
+			// The position was not completed, and must be handled again
+			if de, ok := err.(*streaming.DisconnectError); !ok || !de.Reconnected {
+				break
+			}
+			err = export.HandlePositionAtIndex(job.machine, idx, wt, srv.grbl)
+		}
+		if err != nil {
+			if _, ok := err.(*streaming.DisconnectError); ok {
+				srv.setConnected(false)
+			}
+			return err
+		}
+
+		srv.grbl.Notify(streaming.Event{Type: streaming.EventProgress, Progress: tracker.Update(idx)})
+	}
+	return nil
+}
+
+// Finds a job by ID.
+func (srv *server) job(id int) *serverJob {
+	for _, j := range srv.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+//
+// HTTP handlers
+//
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Lists jobs (GET), or uploads gcode as a held job (POST), named by the
+// "name" query parameter.
+func (srv *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		srv.mutex.Lock()
+		jobs := make([]serverJob, len(srv.jobs))
+		for idx, j := range srv.jobs {
+			jobs[idx] = *j
+		}
+		srv.mutex.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+	case "POST":
+		code, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not read upload: %s", err), http.StatusBadRequest)
+			return
+		}
+		job, err := srv.upload(r.URL.Query().Get("name"), string(code))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		srv.mutex.Lock()
+		j := *job
+		srv.mutex.Unlock()
+		writeJSON(w, http.StatusCreated, j)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Returns a job (GET), cancels it if held or queued and stops it if running
+// (DELETE), or starts it if held (POST to /jobs/<id>/start).
+func (srv *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	startJob := strings.HasSuffix(path, "/start")
+	id, err := strconv.Atoi(strings.TrimSuffix(path, "/start"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusNotFound)
+		return
+	}
+
+	srv.mutex.Lock()
+	job := srv.job(id)
+	if job == nil {
+		srv.mutex.Unlock()
+		http.Error(w, "No such job", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case startJob && r.Method == "POST":
+		err := srv.start(job)
+		j := *job
+		srv.mutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		srv.jobEvent(job)
+		writeJSON(w, http.StatusOK, j)
+	case startJob:
+		srv.mutex.Unlock()
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case r.Method == "GET":
+		j := *job
+		srv.mutex.Unlock()
+		writeJSON(w, http.StatusOK, j)
+	case r.Method == "DELETE":
+		switch job.State {
+		case jobHeld, jobQueued:
+			job.State = jobCancelled
+			srv.mutex.Unlock()
+			srv.jobEvent(job)
+		case jobRunning, jobPaused:
+			srv.mutex.Unlock()
+			srv.stop()
+		default:
+			srv.mutex.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		srv.mutex.Unlock()
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Stops the running job immediately.
+func (srv *server) stop() {
+	srv.mutex.Lock()
+	if srv.current == nil {
+		srv.mutex.Unlock()
+		return
+	}
+	srv.stopping = true
+	srv.mutex.Unlock()
+	srv.grbl.Stop()
+}
+
+// Handles feed hold (/pause), cycle start (/resume) and stop (/stop) of the running job.
+func (srv *server) handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	srv.mutex.Lock()
+	job := srv.current
+	if job == nil {
+		srv.mutex.Unlock()
+		http.Error(w, "No job running", http.StatusConflict)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/pause":
+		job.State = jobPaused
+		srv.mutex.Unlock()
+		srv.grbl.Pause()
+		srv.jobEvent(job)
+	case "/resume":
+		job.State = jobRunning
+		srv.mutex.Unlock()
+		srv.grbl.Start()
+		srv.jobEvent(job)
+	case "/stop":
+		srv.mutex.Unlock()
+		srv.stop()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Runs the homing cycle (/home) or clears an alarm lock (/unlock) between jobs.
+func (srv *server) handleMachine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	srv.mutex.Lock()
+	busy := srv.current != nil
+	srv.mutex.Unlock()
+	if busy {
+		http.Error(w, "A job is running", http.StatusConflict)
+		return
+	}
+
+	srv.machineMutex.Lock()
+	defer srv.machineMutex.Unlock()
+	err := srv.connect()
+	if err == nil {
+		if r.URL.Path == "/home" {
+			err = srv.grbl.Home()
+		} else {
+			err = srv.grbl.Unlock()
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the machine status, along with the running job. The status is
+// queried while idle, and otherwise the last known status is returned, as
+// it cannot be queried while streaming.
+func (srv *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	srv.mutex.Lock()
+	busy := srv.current != nil
+	srv.mutex.Unlock()
+
+	if !busy {
+		srv.machineMutex.Lock()
+		if srv.connect() == nil {
+			// Updates the status through streamEvent
+			_, _ = srv.grbl.Status()
+		}
+		srv.machineMutex.Unlock()
+	}
+
+	srv.mutex.Lock()
+	res := struct {
+		Status  streaming.GrblStatus
+		Version string
+		Job     *serverJob
+	}{Status: srv.status, Version: srv.grbl.Version.String()}
+	if srv.current != nil {
+		j := *srv.current
+		res.Job = &j
+	}
+	srv.mutex.Unlock()
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Streams events to a websocket client as JSON.
+func (srv *server) handleEvents(ws *websocket.Conn) {
+	c := srv.subscribe()
+	defer srv.unsubscribe(c)
+	for ev := range c {
+		if err := websocket.JSON.Send(ws, ev); err != nil {
+			return
+		}
+	}
+}
+
+// Wraps a handler to refuse requests without the token, given as a bearer
+// token in the Authorization header, or for the websocket, which browsers
+// cannot add headers to, in the "token" query parameter. Websockets opened
+// by pages of other hosts are refused as well.
+func (srv *server) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if r.URL.Path == "/events" {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			if t := r.URL.Query().Get("token"); t != "" {
+				token = t
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(srv.token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Serves the HTTP API on the given address until it fails. Addresses without
+// a host, such as ":8080", are served on localhost only.
+func serveHTTP(addr string) {
+	if *device == "" && !*simulate {
+		fmt.Fprintf(os.Stderr, "Error: Server mode requires a device\n")
+		os.Exit(1)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid address: %s\n", addr)
+		os.Exit(1)
+	}
+	if host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+
+	srv := &server{token: *serveToken}
+	if srv.token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not generate token: %s\n", err)
+			os.Exit(1)
+		}
+		srv.token = hex.EncodeToString(b)
+		fmt.Fprintf(os.Stderr, "Token: %s\n", srv.token)
+	}
+	srv.Init()
+	go srv.run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", srv.handleJobs)
+	mux.HandleFunc("/jobs/", srv.handleJob)
+	mux.HandleFunc("/pause", srv.handleControl)
+	mux.HandleFunc("/resume", srv.handleControl)
+	mux.HandleFunc("/stop", srv.handleControl)
+	mux.HandleFunc("/home", srv.handleMachine)
+	mux.HandleFunc("/unlock", srv.handleMachine)
+	mux.HandleFunc("/status", srv.handleStatus)
+	mux.Handle("/events", websocket.Handler(srv.handleEvents))
+
+	fmt.Fprintf(os.Stderr, "Serving on %s\n", addr)
+	if err := http.ListenAndServe(addr, srv.authorize(mux)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,206 @@
+package sim
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+import "errors"
+import "fmt"
+
+//
+// Cutting simulation
+//
+// Sweeps the tools of the tool table along the position stack through a
+// voxelized stock, removing material, and reports collisions with fixtures
+// and gouges below the floor
+//
+// Notes:
+//   Tools are cylinders, with a hemispherical tip for ball nose tools, that
+//   extend upwards from the tip by their length, or indefinitely if the
+//   length is 0. The tool holder and spindle are not modelled.
+//   Moves are sampled every half voxel, so features smaller than a voxel may
+//   be missed.
+//
+
+// The maximum number of voxels in a simulation
+const maxVoxels = 1 << 28
+
+// A move that brings the tool into a fixture.
+type Collision struct {
+	Index   int // Index of the position ending the move
+	Fixture int // Index of the fixture
+}
+
+// A move that cuts below the floor.
+type Gouge struct {
+	Index int     // Index of the position ending the move
+	Depth float64 // Distance below the floor
+}
+
+// The outcome of a simulation. Volumes are in mm³.
+type Result struct {
+	Collisions []Collision
+	Gouges     []Gouge
+	Removed    float64
+	Remaining  float64
+}
+
+type Simulation struct {
+	Stock      vm.Box
+	Resolution float64 // Size of a voxel
+	Fixtures   []vm.Box
+
+	// Lowest height the tool may cut to
+	Floor float64
+
+	// Diameter of tools missing from the tool table
+	DefaultDiameter float64
+
+	nx, ny, nz int
+	voxels     []bool
+}
+
+// Returns whether material is left at a point of the stock.
+func (s *Simulation) Material(x, y, z float64) bool {
+	i, j, k := s.cell(x, y, z)
+	if i < 0 || j < 0 || k < 0 || i >= s.nx || j >= s.ny || k >= s.nz {
+		return false
+	}
+	return s.voxels[(k*s.ny+j)*s.nx+i]
+}
+
+// Returns the voxel containing a point.
+func (s *Simulation) cell(x, y, z float64) (int, int, int) {
+	return int(math.Floor((x - s.Stock.Min.X) / s.Resolution)),
+		int(math.Floor((y - s.Stock.Min.Y) / s.Resolution)),
+		int(math.Floor((z - s.Stock.Min.Z) / s.Resolution))
+}
+
+// Returns the center of a voxel.
+func (s *Simulation) center(i, j, k int) (float64, float64, float64) {
+	return s.Stock.Min.X + (float64(i)+0.5)*s.Resolution,
+		s.Stock.Min.Y + (float64(j)+0.5)*s.Resolution,
+		s.Stock.Min.Z + (float64(k)+0.5)*s.Resolution
+}
+
+// Removes the material within the tool at the given tip position.
+func (s *Simulation) cut(p vector.Vector, t vm.Tool) {
+	radius := t.Diameter / 2
+	if p.Z > s.Stock.Max.Z || p.X+radius < s.Stock.Min.X || p.X-radius > s.Stock.Max.X ||
+		p.Y+radius < s.Stock.Min.Y || p.Y-radius > s.Stock.Max.Y {
+		return
+	}
+
+	i1, j1, k1 := s.cell(p.X-radius, p.Y-radius, p.Z)
+	i2, j2, k2 := s.cell(p.X+radius, p.Y+radius, p.Z+t.Length)
+	if t.Length == 0 {
+		k2 = s.nz - 1
+	}
+	i1, j1, k1 = int(math.Max(float64(i1), 0)), int(math.Max(float64(j1), 0)), int(math.Max(float64(k1), 0))
+	i2, j2, k2 = int(math.Min(float64(i2), float64(s.nx-1))), int(math.Min(float64(j2), float64(s.ny-1))), int(math.Min(float64(k2), float64(s.nz-1)))
+
+	for j := j1; j <= j2; j++ {
+		for i := i1; i <= i2; i++ {
+			x, y, _ := s.center(i, j, 0)
+			r2 := (x-p.X)*(x-p.X) + (y-p.Y)*(y-p.Y)
+			if r2 > radius*radius {
+				continue
+			}
+
+			// The lowest point of the tool at this distance from its axis
+			bottom := p.Z
+			if t.BallNose {
+				bottom += radius - math.Sqrt(radius*radius-r2)
+			}
+			for k := k1; k <= k2; k++ {
+				if _, _, z := s.center(i, j, k); z >= bottom {
+					s.voxels[(k*s.ny+j)*s.nx+i] = false
+				}
+			}
+		}
+	}
+}
+
+// Returns whether the tool at the given tip position intersects a box.
+func intersects(p vector.Vector, t vm.Tool, b vm.Box) bool {
+	if p.Z > b.Max.Z || (t.Length > 0 && p.Z+t.Length < b.Min.Z) {
+		return false
+	}
+	dx := math.Max(0, math.Max(b.Min.X-p.X, p.X-b.Max.X))
+	dy := math.Max(0, math.Max(b.Min.Y-p.Y, p.Y-b.Max.Y))
+	return dx*dx+dy*dy < t.Diameter*t.Diameter/4
+}
+
+// Runs the simulation of the position stack, starting from full stock.
+func (s *Simulation) Run(m *vm.Machine) (Result, error) {
+	var res Result
+	if s.Resolution <= 0 {
+		return res, errors.New("Resolution must be positive")
+	}
+	size := s.Stock.Max.Diff(s.Stock.Min)
+	if size.X <= 0 || size.Y <= 0 || size.Z <= 0 {
+		return res, errors.New("Stock must have a positive size")
+	}
+
+	s.nx = int(math.Ceil(size.X / s.Resolution))
+	s.ny = int(math.Ceil(size.Y / s.Resolution))
+	s.nz = int(math.Ceil(size.Z / s.Resolution))
+	if float64(s.nx)*float64(s.ny)*float64(s.nz) > maxVoxels {
+		return res, errors.New(fmt.Sprintf("Stock too large for a resolution of %g mm", s.Resolution))
+	}
+	s.voxels = make([]bool, s.nx*s.ny*s.nz)
+	for idx := range s.voxels {
+		s.voxels[idx] = true
+	}
+	total := len(s.voxels)
+
+	for idx := 1; idx < len(m.Positions); idx++ {
+		pos := m.Positions[idx]
+		from, to := m.Positions[idx-1].Vector(), pos.Vector()
+		tool, ok := m.GetTool(pos.State.ToolIndex)
+		if !ok {
+			tool = vm.Tool{Diameter: s.DefaultDiameter}
+		}
+
+		// Arcs are followed within a fraction of a voxel
+		path := []vector.Vector{to}
+		if pos.State.MoveMode == vm.MoveModeCWArc || pos.State.MoveMode == vm.MoveModeCCWArc {
+			path = vm.InterpolateArc(m.Positions[idx-1], pos, s.Resolution/4)
+		}
+
+		// Check every sample against the fixtures, reporting each once per move
+		hit := make([]bool, len(s.Fixtures))
+		start := from
+		for _, end := range path {
+			steps := int(math.Ceil(end.Diff(start).Norm() / (s.Resolution / 2)))
+			for step := 0; step <= steps; step++ {
+				p := end
+				if steps > 0 {
+					p = start.Sum(end.Diff(start).Multiply(float64(step) / float64(steps)))
+				}
+				for f, b := range s.Fixtures {
+					if !hit[f] && intersects(p, tool, b) {
+						hit[f] = true
+						res.Collisions = append(res.Collisions, Collision{Index: idx, Fixture: f})
+					}
+				}
+				s.cut(p, tool)
+			}
+			start = end
+		}
+
+		if depth := s.Floor - to.Z; depth > 0 && from != to {
+			res.Gouges = append(res.Gouges, Gouge{Index: idx, Depth: depth})
+		}
+	}
+
+	remaining := 0
+	for _, v := range s.voxels {
+		if v {
+			remaining++
+		}
+	}
+	volume := s.Resolution * s.Resolution * s.Resolution
+	res.Remaining = float64(remaining) * volume
+	res.Removed = float64(total-remaining) * volume
+	return res, nil
+}
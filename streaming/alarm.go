@@ -0,0 +1,140 @@
+package streaming
+
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// Grbl 1.1 alarm codes
+var grblAlarms = map[int]string{
+	1:  "Hard limit triggered. Machine position is likely lost, re-homing is recommended",
+	2:  "Motion target exceeds machine travel. Machine position retained, alarm may be unlocked",
+	3:  "Reset while in motion. Machine position is likely lost, re-homing is recommended",
+	4:  "Probe fail. Probe is not in the expected initial state",
+	5:  "Probe fail. Probe did not contact the workpiece within the programmed travel",
+	6:  "Homing fail. Reset during active homing cycle",
+	7:  "Homing fail. Safety door was opened during active homing cycle",
+	8:  "Homing fail. Cycle failed to clear limit switch when pulling off",
+	9:  "Homing fail. Could not find limit switch within search distance",
+	10: "Homing fail. Could not find second limit switch for self-squaring",
+}
+
+// Grbl 1.1 error codes
+var grblErrors = map[int]string{
+	1:  "Expected command letter",
+	2:  "Bad number format",
+	3:  "Invalid statement",
+	4:  "Value < 0",
+	5:  "Homing cycle not enabled",
+	6:  "Step pulse time must be greater than 3usec",
+	7:  "EEPROM read failed, restored to defaults",
+	8:  "'$' command only valid when idle",
+	9:  "G-code locked out during alarm or jog state",
+	10: "Soft limits require homing to be enabled",
+	11: "Line too long",
+	12: "Setting value exceeds maximum step rate",
+	13: "Safety door opened",
+	14: "Build info or startup line too long",
+	15: "Jog target exceeds machine travel",
+	16: "Invalid jog command",
+	17: "Laser mode requires PWM output",
+	20: "Unsupported command",
+	21: "Modal group violation",
+	22: "Undefined feed rate",
+	23: "Command requires an integer value",
+	24: "Multiple commands requiring axis words",
+	25: "Repeated word in block",
+	26: "No axis words found",
+	27: "Invalid line number",
+	28: "Missing P or L value",
+	29: "G59.x coordinate systems not supported",
+	30: "G53 requires G0 or G1",
+	31: "Unused axis words",
+	32: "G2/G3 arc has no axis words in plane",
+	33: "Invalid motion target",
+	34: "Invalid arc radius",
+	35: "G2/G3 arc is missing offset words in plane",
+	36: "Unused words in block",
+	37: "G43.1 offset only supported on the tool length axis",
+	38: "Tool number exceeds maximum supported value",
+}
+
+// An alarm raised by Grbl. Grbl locks out further commands until unlocked
+// ($X) or homed ($H).
+type AlarmError struct {
+	Code    int
+	Message string
+	Block   string
+}
+
+func (e *AlarmError) Error() string {
+	s := "Alarm"
+	if e.Code != 0 {
+		s += fmt.Sprintf(" %d", e.Code)
+	}
+	s += ": " + e.Message
+	if e.Block != "" {
+		s += fmt.Sprintf(", block: %s", e.Block)
+	}
+	return s
+}
+
+// An error reported by Grbl in response to a block.
+type GrblError struct {
+	Code    int
+	Message string
+	Block   string
+}
+
+func (e *GrblError) Error() string {
+	s := "Error"
+	if e.Code != 0 {
+		s += fmt.Sprintf(" %d", e.Code)
+	}
+	s += ": " + e.Message
+	if e.Block != "" {
+		s += fmt.Sprintf(", block: %s", e.Block)
+	}
+	return s
+}
+
+// Decodes "1" (Grbl 1.1) or "Hard limit" (Grbl 0.9) to a code and message.
+func decodeMessage(msg string, table map[int]string) (int, string) {
+	msg = strings.TrimSpace(msg)
+	code, err := strconv.Atoi(msg)
+	if err != nil {
+		return 0, msg
+	}
+	if m, ok := table[code]; ok {
+		return code, m
+	}
+	return code, "Unknown"
+}
+
+// Converts an error or alarm result to a typed error. Returns nil for other results.
+func resultError(res result, block string) error {
+	block = strings.TrimSpace(block)
+	switch res.level {
+	case "error":
+		code, msg := decodeMessage(res.message, grblErrors)
+		return &GrblError{Code: code, Message: msg, Block: block}
+	case "alarm":
+		code, msg := decodeMessage(res.message, grblAlarms)
+		return &AlarmError{Code: code, Message: msg, Block: block}
+	case "serial-error":
+		return errors.New(fmt.Sprintf("Serial error: %s, block: %s", res.message, block))
+	}
+	return nil
+}
+
+// Runs the homing cycle ($H). Blocks until homing completes.
+func (s *GrblStreamer) Home() error {
+	_, err := s.command("$H")
+	return err
+}
+
+// Clears an alarm lock ($X) without homing.
+func (s *GrblStreamer) Unlock() error {
+	_, err := s.command("$X")
+	return err
+}
@@ -0,0 +1,84 @@
+package streaming
+
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+import "errors"
+import "fmt"
+
+// Records the last acknowledged position index to a file, so that a job can
+// be resumed with vm.Machine.Resume after a power loss or crash.
+//
+// Controllers acknowledge a line once it is in their planner, not once it has
+// run, so the index recorded is Depth positions before the last acknowledged
+// one. Depth should be at least the number of blocks the planner holds, as
+// every position is sent as at least one block.
+//
+// To avoid hammering the disk on large programs, the file is written at most
+// once per Interval. Flush forces the latest index to disk.
+type Checkpoint struct {
+	Path     string
+	Interval time.Duration
+	Depth    int
+
+	index     int
+	written   int
+	lastWrite time.Time
+}
+
+// Records that the position at idx has been acknowledged by the controller.
+func (c *Checkpoint) Acknowledge(idx int) error {
+	c.index = idx - c.Depth
+	if c.index < 0 {
+		c.index = 0
+	}
+	if time.Since(c.lastWrite) < c.Interval {
+		return nil
+	}
+	return c.Flush()
+}
+
+// Writes the index of the latest acknowledged position, less Depth, to disk,
+// if it changed.
+func (c *Checkpoint) Flush() error {
+	if c.index == c.written && !c.lastWrite.IsZero() {
+		return nil
+	}
+
+	// Write to a temporary file and rename, so a crash never leaves a truncated checkpoint
+	tmp := c.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", c.index)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.Path); err != nil {
+		return err
+	}
+
+	c.written = c.index
+	c.lastWrite = time.Now()
+	return nil
+}
+
+// Removes the checkpoint file, such as after a job completed successfully.
+func (c *Checkpoint) Clear() error {
+	err := os.Remove(c.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Reads the position index to resume from from a checkpoint file.
+func ReadCheckpoint(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	idx, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid checkpoint file: %s", err))
+	}
+	return idx, nil
+}
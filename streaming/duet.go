@@ -0,0 +1,230 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/export"
+import "encoding/json"
+import "net/http"
+import "net/url"
+import "strings"
+import "errors"
+import "time"
+import "fmt"
+
+const (
+	// Time to wait for an answer to a request
+	duetRequestTimeout = 30 * time.Second
+
+	// Directory jobs are uploaded to
+	duetJobDir = "0:/gcodes/"
+
+	// Polls finding the board idle before a job is taken to have finished
+	// without it being seen running
+	duetStartPolls = 5
+)
+
+// A streamer for RepRapFirmware on Duet boards, over the HTTP interface of
+// the board (rr_connect, rr_upload, rr_gcode and rr_status). Rather than
+// streaming line by line, the whole job is exported with the DuetGenerator,
+// uploaded as a file, and started with M32, so the job does not depend on the
+// connection once started.
+//
+// Pause and Start use M25 and M24. Stop uses M112, which halts the board
+// until it is reset, as the other streamers stop the machine rather than just
+// the job.
+type DuetStreamer struct {
+	// Password of the board, empty if none is set
+	Password string
+
+	// Time to wait for an answer to a request (0 for the default)
+	Timeout time.Duration
+
+	// Lines put in at the start and end, and around tool changes
+	Macros export.Macros
+
+	// Precision of exported gcode, and formatting overriding it, if set
+	Precision int
+	Format    *export.Format
+
+	// M codes of coolant channels, vm.DefaultCoolantCodes if nil
+	CoolantCodes map[int]vm.CoolantCodes
+
+	base   string // URL of the board, such as "http://duet.local"
+	client *http.Client
+}
+
+// Returns the URL of a board, adding http:// if no scheme is given.
+func duetURL(address string) string {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return strings.TrimRight(address, "/")
+}
+
+// Sends a request, and decodes the JSON answer into v, if not nil.
+func (s *DuetStreamer) request(method, path string, query url.Values, body string, v interface{}) error {
+	if s.client == nil {
+		return errors.New("Not connected")
+	}
+	req, err := http.NewRequest(method, s.base+path+"?"+query.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Request to %s failed: %s", path, err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Request to %s failed: %s", path, res.Status))
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return errors.New(fmt.Sprintf("Invalid answer to %s: %s", path, err))
+	}
+	return nil
+}
+
+// Sends a line of gcode to the board.
+func (s *DuetStreamer) Send(code string) error {
+	return s.request("GET", "/rr_gcode", url.Values{"gcode": {code}}, "", nil)
+}
+
+// Takes the vm for a dry-run, to see if the states are compatible with
+// RepRapFirmware.
+func (s *DuetStreamer) Check(m *vm.Machine) error {
+	gen := export.DuetGenerator{}
+	gen.CoolantCodes = s.CoolantCodes
+	gen.Init()
+	return export.HandleAllPositions(m, &gen)
+}
+
+// Connects to the board at the address, such as "duet.local" or
+// "http://192.168.1.20". The baud rate is not used.
+func (s *DuetStreamer) Connect(address string, baud int) error {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = duetRequestTimeout
+	}
+	s.base = duetURL(address)
+	s.client = &http.Client{Timeout: timeout}
+
+	var res struct {
+		Err int `json:"err"`
+	}
+	query := url.Values{
+		"password": {s.Password},
+		"time":     {time.Now().Format("2006-01-02T15:04:05")},
+	}
+	if err := s.request("GET", "/rr_connect", query, "", &res); err != nil {
+		s.client = nil
+		return err
+	}
+	switch res.Err {
+	case 0:
+		return nil
+	case 1:
+		s.client = nil
+		return errors.New("Invalid password")
+	case 2:
+		s.client = nil
+		return errors.New("No more sessions available")
+	default:
+		s.client = nil
+		return errors.New(fmt.Sprintf("Connection refused with error %d", res.Err))
+	}
+}
+
+// Ends the session.
+func (s *DuetStreamer) Disconnect() error {
+	err := s.request("GET", "/rr_disconnect", url.Values{}, "", nil)
+	s.client = nil
+	return err
+}
+
+// Exports the positions of the vm, and uploads them as a job of the given
+// name.
+func (s *DuetStreamer) Upload(m *vm.Machine, name string) error {
+	gen := export.DuetGenerator{}
+	gen.Precision = s.Precision
+	gen.Format = s.Format
+	gen.Macros = s.Macros
+	gen.CoolantCodes = s.CoolantCodes
+	gen.Init()
+	if err := export.HandleAllPositions(m, &gen); err != nil {
+		return err
+	}
+
+	var res struct {
+		Err int `json:"err"`
+	}
+	query := url.Values{
+		"name": {duetJobDir + name},
+		"time": {time.Now().Format("2006-01-02T15:04:05")},
+	}
+	if err := s.request("POST", "/rr_upload", query, gen.Retrieve()+"\n", &res); err != nil {
+		return err
+	}
+	if res.Err != 0 {
+		return errors.New(fmt.Sprintf("Upload of %s failed with error %d", name, res.Err))
+	}
+	return nil
+}
+
+// Starts an uploaded job (M32).
+func (s *DuetStreamer) Run(name string) error {
+	return s.Send(fmt.Sprintf("M32 \"%s%s\"", duetJobDir, name))
+}
+
+// Returns the status of the board, as the letter reported by rr_status, such
+// as "I" for idle, "P" for running a job, "S" for paused and "H" for halted.
+func (s *DuetStreamer) Status() (string, error) {
+	var res struct {
+		Status string `json:"status"`
+	}
+	if err := s.request("GET", "/rr_status", url.Values{"type": {"1"}}, "", &res); err != nil {
+		return "", err
+	}
+	return res.Status, nil
+}
+
+// Polls the status at the interval until the board is idle, after a job has
+// been started. Returns an error if the board halts.
+func (s *DuetStreamer) Wait(interval time.Duration) error {
+	busy, idle := false, 0
+	for {
+		status, err := s.Status()
+		if err != nil {
+			return err
+		}
+		switch status {
+		case "H":
+			return errors.New("Board halted")
+		case "I":
+			// The job may not have started yet on the first polls
+			idle++
+			if busy || idle >= duetStartPolls {
+				return nil
+			}
+		default:
+			busy = true
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Stops the board (M112), which requires it to be reset.
+func (s *DuetStreamer) Stop() {
+	_ = s.Send("M112")
+}
+
+// Resumes a paused job (M24).
+func (s *DuetStreamer) Start() {
+	_ = s.Send("M24")
+}
+
+// Pauses the job (M25).
+func (s *DuetStreamer) Pause() {
+	_ = s.Send("M25")
+}
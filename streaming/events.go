@@ -0,0 +1,101 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "time"
+
+// Constants for event types
+const (
+	EventSent         = iota // A line was sent
+	EventAcknowledged = iota // A line was acknowledged ("ok")
+	EventInfo         = iota // Grbl sent an informational message
+	EventError        = iota // Grbl reported an error or alarm, or the connection failed
+	EventStatus       = iota // A status report was received
+	EventProgress     = iota // A position of the job was completed
+)
+
+// An event from the streamer, for embedding gocnc in GUIs and web frontends.
+// Only the fields relevant to the event type are set.
+type Event struct {
+	Type     int
+	Line     string // The line sent or acknowledged, or the info message
+	Err      error
+	Status   GrblStatus
+	Progress Progress
+}
+
+// Progress through a job.
+type Progress struct {
+	Index     int // Index of the last completed position
+	Total     int // Number of positions in the job
+	Percent   float64
+	Elapsed   time.Duration
+	Remaining time.Duration // Estimated time remaining
+}
+
+// Delivers an event to OnEvent, if set.
+func (s *GrblStreamer) Notify(e Event) {
+	if s.OnEvent != nil {
+		s.OnEvent(e)
+	}
+}
+
+// Returns a channel receiving all events, replacing OnEvent. Events are
+// dropped while the channel is full, so a slow consumer never stalls streaming.
+func (s *GrblStreamer) Events(size int) <-chan Event {
+	c := make(chan Event, size)
+	s.OnEvent = func(e Event) {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+	return c
+}
+
+// Tracks progress through a job, and estimates the remaining time.
+//
+// The estimate is based on vm.Machine.PositionETAs, corrected by how the
+// elapsed time compares to the estimate for the completed positions, as the
+// estimates ignore acceleration.
+type ProgressTracker struct {
+	estimates []time.Duration
+	total     time.Duration
+	passed    time.Duration // Estimate for all positions before next
+	done      time.Duration // Estimate for the positions completed since Init
+	next      int
+	start     time.Time
+}
+
+// Initializes the tracker for a job, and starts the clock.
+func (t *ProgressTracker) Init(m *vm.Machine) {
+	t.estimates = m.PositionETAs()
+	t.total, t.passed, t.done, t.next = 0, 0, 0, 0
+	for _, d := range t.estimates {
+		t.total += d
+	}
+	t.start = time.Now()
+}
+
+// Records that the position at idx has been completed, and returns the progress.
+// Positions must be completed in order, but may start past the first, such as
+// when resuming a job.
+func (t *ProgressTracker) Update(idx int) Progress {
+	p := Progress{Index: idx, Total: len(t.estimates), Elapsed: time.Since(t.start)}
+	if idx < 0 || idx >= len(t.estimates) {
+		return p
+	}
+
+	t.done += t.estimates[idx]
+	p.Percent = float64(idx+1) / float64(len(t.estimates)) * 100
+
+	for ; t.next <= idx; t.next++ {
+		t.passed += t.estimates[t.next]
+	}
+
+	remaining := t.total - t.passed
+	if t.done > 0 {
+		remaining = time.Duration(float64(remaining) * float64(p.Elapsed) / float64(t.done))
+	}
+	p.Remaining = remaining
+	return p
+}
@@ -4,8 +4,11 @@ import "io"
 import "bufio"
 import "github.com/kennylevinsen/goserial"
 import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/vector"
 import "github.com/kennylevinsen/gocnc/export"
+import "strings"
 import "errors"
+import "time"
 import "fmt"
 
 // A result struct used by serialReader
@@ -20,6 +23,42 @@ type GrblStreamer struct {
 	reader     *bufio.Reader
 	writer     *bufio.Writer
 	generator  *export.GrblGenerator
+
+	// Firmware version, as reported on connect
+	Version GrblVersion
+
+	// Time to wait for a response before polling the status, and declaring
+	// the connection lost if that is not answered either (0 to disable)
+	Timeout time.Duration
+
+	// Reconnection attempts on lost connection, and the delay before each
+	Retries    int
+	RetryDelay time.Duration
+
+	// Called when the connection is lost, before reconnecting
+	OnDisconnect func(error)
+
+	// Interval between TCP keepalive probes for network devices
+	KeepAlive time.Duration
+
+	// Called for lines sent and acknowledged, errors and status reports
+	OnEvent func(Event)
+
+	// Rewrite what Grbl does not support in Check and CheckJob, where
+	// possible, rather than rejecting it, and split lines too long for Grbl
+	// when sending them.
+	AutoFix bool
+
+	// Opens the connection, instead of a serial port
+	dial func(name string, baud int) (io.ReadWriteCloser, error)
+
+	name          string
+	baud          int
+	results       chan result
+	pendingStatus int
+	workOffset    *vector.Vector
+	stopped       bool
+	noStatusPoll  bool // Firmware does not answer "?", so timeouts are not checked with it
 }
 
 //
@@ -33,95 +72,258 @@ func serialReader(reader *bufio.Reader) result {
 		return result{"serial-error", fmt.Sprintf("%s", err)}
 	}
 	b := string(c)
-	if b == "ok\r\n" {
+	if t := strings.TrimSpace(b); t == "ok" || strings.HasPrefix(t, "ok ") {
 		return result{"ok", ""}
-	} else if len(b) >= 5 && b[:5] == "error" {
-		return result{"error", b[6 : len(b)-1]}
-	} else if len(b) >= 5 && b[:5] == "alarm" {
-		return result{"alarm", b[6 : len(b)-1]}
+	} else if len(b) >= 6 && strings.ToLower(b[:5]) == "error" {
+		return result{"error", strings.TrimSpace(b[6:])}
+	} else if len(b) >= 6 && strings.ToLower(b[:5]) == "alarm" {
+		return result{"alarm", strings.TrimSpace(b[6:])}
 	} else {
 		return result{"info", b[:len(b)-1]}
 	}
 }
 
+// Reads responses from Grbl until the connection fails.
+func readLoop(reader *bufio.Reader, results chan<- result) {
+	for {
+		res := serialReader(reader)
+		results <- res
+		if res.level == "serial-error" {
+			close(results)
+			return
+		}
+	}
+}
+
+// Awaits the next response, using the configured timeout.
+func (s *GrblStreamer) read() result {
+	return s.readTimeout(s.Timeout)
+}
+
+// Awaits the next response. If nothing arrives within timeout, a status
+// report is requested to tell a busy Grbl from a lost connection.
+func (s *GrblStreamer) readTimeout(timeout time.Duration) result {
+	polled := false
+	for {
+		var res result
+		var ok bool
+		if timeout <= 0 {
+			res, ok = <-s.results
+		} else {
+			select {
+			case res, ok = <-s.results:
+			case <-time.After(timeout):
+				if polled || s.noStatusPoll {
+					return result{"serial-error", "timeout"}
+				}
+				if _, err := s.serialPort.Write([]byte("?")); err != nil {
+					return result{"serial-error", fmt.Sprintf("%s", err)}
+				}
+				s.pendingStatus++
+				polled = true
+				continue
+			}
+		}
+
+		if !ok {
+			return result{"serial-error", "connection closed"}
+		}
+
+		// Answers to our own status requests only prove that Grbl is alive
+		if res.level == "info" && s.pendingStatus > 0 && strings.HasPrefix(strings.TrimSpace(res.message), "<") {
+			s.pendingStatus--
+			polled = false
+			continue
+		}
+		return res
+	}
+}
+
 func (s *GrblStreamer) handleRes(str string) {
 	// Look for a response
-	res := serialReader(s.reader)
+	res := s.read()
 
 	switch res.level {
-	case "error":
-		panic(fmt.Sprintf("Received error from CNC: %s, block: %s", res.message, str))
-	case "alarm":
-		panic(fmt.Sprintf("Received alarm from CNC: %s, block: %s", res.message, str))
+	case "serial-error":
+		err := resultError(res, str)
+		s.Notify(Event{Type: EventError, Line: strings.TrimSpace(str), Err: err})
+		s.connectionLost(err)
+	case "error", "alarm":
+		err := resultError(res, str)
+		s.Notify(Event{Type: EventError, Line: strings.TrimSpace(str), Err: err})
+		panic(err)
 	case "info":
+		s.Notify(Event{Type: EventInfo, Line: res.message})
 		fmt.Printf("\nReceived info from CNC: %s\n", res.message)
 	default:
+		s.Notify(Event{Type: EventAcknowledged, Line: strings.TrimSpace(str)})
 	}
 }
 
 func (s *GrblStreamer) Init() {
 	s.Write = func(str string) {
-		str += "\n"
-
-		_, err := s.writer.WriteString(str)
-		if err != nil {
-			panic(fmt.Sprintf("Error while sending data: %s", err))
+		if s.AutoFix && len(stripGrblLine(str)) > GrblLineLength {
+			// Checked by Check
+			if lines, err := SplitGrblLine(str); err == nil {
+				for _, l := range lines {
+					s.send(l)
+				}
+				return
+			}
 		}
-		err = s.writer.Flush()
-		if err != nil {
-			panic(fmt.Sprintf("Error while flushing writer: %s", err))
-		}
-		s.handleRes(str)
+		s.send(str)
 	}
 	s.GrblGenerator.Init()
 }
 
-// Takes the vm for a dry-run, to see if the states are compatible with Grbl.
-func (s *GrblStreamer) Check(m *vm.Machine) (err error) {
+// Sends a line, and handles the response.
+func (s *GrblStreamer) send(str string) {
+	str += "\n"
+
+	_, err := s.writer.WriteString(str)
+	if err == nil {
+		err = s.writer.Flush()
+	}
+	if err != nil {
+		s.connectionLost(errors.New(fmt.Sprintf("Error while sending data: %s", err)))
+	}
+	s.Notify(Event{Type: EventSent, Line: strings.TrimSpace(str)})
+	s.handleRes(str)
+}
+
+// Takes the vm for a dry-run, to see if the states are compatible with Grbl,
+// and that its lines fit in the line buffer of Grbl, as CheckJob does with the
+// precision of the streamer.
+func (s *GrblStreamer) Check(m *vm.Machine) error {
+	_, err := s.CheckJob(m, s.Precision, s.Format)
+	return err
+}
+
+// Takes the vm for a dry-run, to see if the states are compatible with Grbl,
+// and that its lines fit in the line buffer of Grbl, with numbers given with
+// precision and format. With AutoFix, what Grbl does not support is
+// rewritten where possible first, and long lines are split rather than
+// rejected. Errors of the export itself are returned along with the
+// incompatibilities, rather than left for streaming to run into. The streamer
+// is left unchanged, so programs can be checked while another is streamed.
+// Set the Format of the streamer to that of the job, if any, to stream it.
+func (s *GrblStreamer) CheckJob(m *vm.Machine, precision int, format *export.Format) (job GrblJob, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New(fmt.Sprintf("%s", r))
 		}
 	}()
-	gen := export.GrblGenerator{}
-	gen.Init()
-	gen.Write = func(string) {}
-	export.HandleAllPositions(m, &gen)
-	return nil
+	if s.AutoFix {
+		if err := s.fix(m, precision, format, &job); err != nil {
+			return job, err
+		}
+	}
+	if job.Format != nil {
+		format = job.Format
+	}
+
+	split := 0
+	gen := s.checkGenerator(precision, format, func(line string) {
+		if len(stripGrblLine(line)) <= GrblLineLength {
+			return
+		}
+		if !s.AutoFix {
+			panic(fmt.Sprintf("Line longer than the %d characters Grbl can take: %s", GrblLineLength, line))
+		}
+		if _, err := SplitGrblLine(line); err != nil {
+			panic(err)
+		}
+		split++
+	})
+	if err := export.HandleAllPositions(m, gen); err != nil {
+		return job, err
+	}
+	if split > 0 {
+		job.Fixes = append(job.Fixes, fmt.Sprintf("%d lines longer than %d characters split", split, GrblLineLength))
+	}
+	return job, nil
 }
 
-// Connect to a serial port at the given path and baudrate
-func (s *GrblStreamer) Connect(name string, baud int) error {
-	c := &serial.Config{Name: name, Baud: baud}
+// Opens the serial port or network connection, and starts reading responses.
+func (s *GrblStreamer) open(name string, baud int) error {
+	var port io.ReadWriteCloser
 	var err error
-	s.serialPort, err = serial.OpenPort(c)
+	switch {
+	case s.dial != nil:
+		port, err = s.dial(name, baud)
+	case isNetworkDevice(name):
+		port, err = s.dialTCP(name)
+	default:
+		port, err = serial.OpenPort(&serial.Config{Name: name, Baud: baud})
+	}
 	if err != nil {
 		return err
 	}
 
-	s.reader = bufio.NewReader(s.serialPort)
-	s.writer = bufio.NewWriter(s.serialPort)
+	s.serialPort = port
+	s.name, s.baud = name, baud
+	s.reader = bufio.NewReader(port)
+	s.writer = bufio.NewWriter(port)
+	s.results = make(chan result, 32)
+	s.pendingStatus = 0
+	s.workOffset = nil
+	s.stopped = false
+	go readLoop(s.reader, s.results)
+	return nil
+}
 
-	for {
-		c, err := s.reader.ReadBytes('\n')
-		m := string(c)
-		if len(m) == 26 && m[:5] == "Grbl " && m[9:] == " ['$' for help]\r\n" {
-			fmt.Printf("Grbl version %s initialized\n", m[5:9])
-			break
-		} else if m == "\r\n" {
-			continue
+// Parses the Grbl startup banner, such as "Grbl 1.1h ['$' for help]".
+func (s *GrblStreamer) parseBanner(line string) bool {
+	m := strings.TrimSpace(line)
+	if !strings.HasPrefix(m, "Grbl ") || !strings.HasSuffix(m, " ['$' for help]") {
+		return false
+	}
+
+	version := strings.TrimSpace(m[5 : len(m)-15])
+	var err error
+	if s.Version, err = ParseGrblVersion(version); err != nil {
+		fmt.Printf("Warning: Unknown Grbl version %s, disabling version dependent features\n", version)
+	}
+	fmt.Printf("Grbl version %s initialized\n", version)
+	return true
+}
+
+// Connect to a serial port at the given path and baudrate, or to a
+// serial-to-TCP bridge at "tcp://host:port".
+func (s *GrblStreamer) Connect(name string, baud int) error {
+	if err := s.open(name, baud); err != nil {
+		return err
+	}
+
+	if isNetworkDevice(name) {
+		// Grbl is not reset by connecting over the network, so there might
+		// not be a banner to read the version from
+		if err := s.resync(); err != nil {
+			return errors.New(fmt.Sprintf("Unable to detect initialized GRBL: %s", err))
+		}
+		if s.Version == (GrblVersion{}) {
+			s.queryVersion()
 		}
+		return nil
+	}
 
-		if err != nil {
+	for {
+		res := s.read()
+		switch res.level {
+		case "info":
+			if s.parseBanner(res.message) {
+				return nil
+			}
+		case "serial-error":
 			return errors.New("Unable to detect initialized GRBL")
 		}
 	}
-
-	return nil
 }
 
-// Raises a position alarm in Grbl. Works as emergency stop.
+// Raises a position alarm in Grbl. Works as emergency stop. The connection
+// is closed, and must be opened again with Connect.
 func (s *GrblStreamer) Stop() {
+	s.stopped = true
 	_, _ = s.serialPort.Write([]byte("\x18"))
 	s.serialPort.Close()
 }
@@ -0,0 +1,221 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "github.com/kennylevinsen/gocnc/export"
+import "strconv"
+import "strings"
+import "errors"
+import "math"
+import "fmt"
+
+//
+// Grbl compatibility fixes
+//
+// Programs for other controllers often use features Grbl lacks. With AutoFix,
+// CheckJob rewrites what it can rather than rejecting the program:
+//
+//   Feeds per revolution (G95) are converted to feeds per minute
+//   Coolant channels without M codes are left out
+//   The precision is lowered to what the number parser of Grbl can read
+//   Lines too long for the line buffer of Grbl are split
+//
+// Cutter compensation (G41/G42) is refused, as leaving it out would cut the
+// programmed path rather than the part. The changes made are listed in the
+// GrblJob returned, along with the format to stream the program with, as the
+// precision depends on the program.
+//
+
+// Longest line Grbl can take, leaving room for the terminator in its 80 byte
+// line buffer. Spaces and comments are not counted, as Grbl strips them.
+const GrblLineLength = 79
+
+// Number of digits Grbl reads of a number, ignoring the rest.
+const grblDigits = 8
+
+// Returns the line without spaces and comments, as Grbl buffers it.
+func stripGrblLine(line string) string {
+	var (
+		stripped []rune
+		comment  bool
+	)
+	for _, c := range line {
+		switch {
+		case comment:
+			comment = c != ')'
+		case c == '(':
+			comment = true
+		case c == ';':
+			return string(stripped)
+		case c != ' ' && c != '\t':
+			stripped = append(stripped, c)
+		}
+	}
+	return string(stripped)
+}
+
+// Returns whether the G code of a word takes the axis words of its block,
+// such as a motion or G10, so they must stay on the same line.
+func takesAxisWords(word string) bool {
+	switch word {
+	case "G0", "G00", "G1", "G01", "G2", "G02", "G3", "G03", "G4", "G04", "G10", "G28", "G28.1", "G30", "G30.1",
+		"G38.2", "G38.3", "G38.4", "G38.5", "G43.1", "G53", "G92", "G92.1":
+		return true
+	}
+	return false
+}
+
+// Splits a line too long for Grbl into lines that fit. The words of the move,
+// being the G codes taking axis words, the axis words and the feedrate, which
+// Grbl needs on the move in inverse time feed mode, are kept on one line.
+// The other words are put on lines before it, as Grbl runs them before the
+// move in any case, except for program stops (M0, M1, M2 and M30), which are
+// put after it. System commands cannot be split.
+func SplitGrblLine(line string) ([]string, error) {
+	stripped := stripGrblLine(line)
+	if len(stripped) <= GrblLineLength {
+		return []string{stripped}, nil
+	}
+	if strings.HasPrefix(stripped, "$") {
+		return nil, errors.New(fmt.Sprintf("System command longer than %d characters: %s", GrblLineLength, stripped))
+	}
+
+	var words []string
+	for idx := 0; idx < len(stripped); {
+		end := idx + 1
+		for end < len(stripped) && strings.IndexByte("+-.0123456789", stripped[end]) != -1 {
+			end++
+		}
+		words = append(words, strings.ToUpper(stripped[idx:end]))
+		idx = end
+	}
+
+	var before, move, after []string
+	for _, w := range words {
+		switch {
+		case strings.IndexByte("XYZIJKRPLF", w[0]) != -1 || takesAxisWords(w):
+			move = append(move, w)
+		case w == "M0", w == "M00", w == "M1", w == "M01", w == "M2", w == "M02", w == "M30":
+			after = append(after, w)
+		default:
+			before = append(before, w)
+		}
+	}
+	if m := strings.Join(move, ""); len(m) > GrblLineLength {
+		return nil, errors.New(fmt.Sprintf("Move longer than %d characters: %s", GrblLineLength, m))
+	}
+
+	// Packs words into as few lines as possible
+	pack := func(words []string) []string {
+		var lines []string
+		cur := ""
+		for _, w := range words {
+			if len(cur)+len(w) > GrblLineLength {
+				lines = append(lines, cur)
+				cur = ""
+			}
+			cur += w
+		}
+		if cur != "" {
+			lines = append(lines, cur)
+		}
+		return lines
+	}
+	lines := pack(before)
+	if len(move) > 0 {
+		lines = append(lines, strings.Join(move, ""))
+	}
+	return append(lines, pack(after)...), nil
+}
+
+// Returns the number of decimals that fit in the digits Grbl reads, for the
+// largest number of the program.
+func grblPrecision(m *vm.Machine) int {
+	var largest float64
+	for _, pos := range m.Positions {
+		for _, v := range []float64{pos.X, pos.Y, pos.Z, pos.Center.X, pos.Center.Y, pos.State.Feedrate, pos.State.SpindleSpeed} {
+			largest = math.Max(largest, math.Abs(v))
+		}
+	}
+	digits := len(strconv.FormatFloat(math.Floor(largest), 'f', 0, 64))
+	return int(math.Max(float64(grblDigits-digits), 0))
+}
+
+// A program checked for Grbl by CheckJob.
+type GrblJob struct {
+	Fixes  []string       // Changes made with AutoFix
+	Format *export.Format // Format to stream the program with, nil for the precision of the streamer
+}
+
+// Rewrites what Grbl does not support in the position stack, and lowers the
+// precision given by precision and format, recording the changes in the job.
+func (s *GrblStreamer) fix(m *vm.Machine, precision int, format *export.Format, job *GrblJob) error {
+	var perRev int
+	coolant := make(map[int]int)
+	for _, pos := range m.Positions {
+		if pos.State.FeedMode == vm.FeedModeUnitsRev {
+			perRev++
+		}
+	}
+	if perRev > 0 {
+		if err := m.FeedPerMinute(); err != nil {
+			return errors.New(fmt.Sprintf("Could not convert feeds per revolution: %s", err))
+		}
+		job.Fixes = append(job.Fixes, fmt.Sprintf("%d positions fed per revolution (G95) converted to feeds per minute", perRev))
+	}
+
+	for idx := range m.Positions {
+		state := &m.Positions[idx].State
+		for _, channel := range vm.CoolantChannels {
+			if _, ok := s.CoolantCodes[channel]; !ok && state.Coolant&channel != 0 {
+				state.Coolant &^= channel
+				coolant[channel]++
+			}
+		}
+	}
+	for _, channel := range vm.CoolantChannels {
+		if n := coolant[channel]; n > 0 {
+			job.Fixes = append(job.Fixes, fmt.Sprintf("%s coolant left out of %d positions, as it has no M code", vm.CoolantName(channel), n))
+		}
+	}
+
+	// The format is copied, as it may be shared with other generators
+	p := grblPrecision(m)
+	lowered := false
+	lower := func(q int) int {
+		if q > p {
+			lowered = true
+			return p
+		}
+		return q
+	}
+	f := export.NewFormat(precision)
+	if format != nil {
+		*f = *format
+	}
+	f.Precision = lower(f.Precision)
+	f.Precisions = make(map[rune]int)
+	if format != nil {
+		for address, q := range format.Precisions {
+			f.Precisions[address] = lower(q)
+		}
+	}
+	if lowered {
+		job.Format = f
+		job.Fixes = append(job.Fixes, fmt.Sprintf("Precision lowered to %d decimals, as Grbl reads %d digits of a number", p, grblDigits))
+	}
+	return nil
+}
+
+// Returns a dry-run generator with the settings of the streamer and the given
+// precision and format, writing to write.
+func (s *GrblStreamer) checkGenerator(precision int, format *export.Format, write func(string)) *export.GrblGenerator {
+	gen := &export.GrblGenerator{
+		Precision:    precision,
+		Format:       format,
+		Macros:       s.Macros,
+		CoolantCodes: s.CoolantCodes,
+	}
+	gen.Init()
+	gen.Write = write
+	return gen
+}
@@ -0,0 +1,112 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// Parses a probe report, such as "[PRB:0.000,0.000,-5.000:1]". Grbl 0.9
+// versions prior to 0.9j do not report success, in which case the probe is
+// assumed to have triggered.
+func ParseProbeResult(line string) (vector.Vector, bool, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[PRB:") || !strings.HasSuffix(line, "]") {
+		return vector.Vector{}, false, errors.New(fmt.Sprintf("Not a probe report: %s", line))
+	}
+	line = line[5 : len(line)-1]
+
+	success := true
+	if idx := strings.IndexRune(line, ':'); idx != -1 {
+		success = line[idx+1:] == "1"
+		line = line[:idx]
+	}
+
+	pos, err := parseVector(line)
+	return pos, success, err
+}
+
+// Probes towards Z by the given distance (G38.2), returning the machine
+// position where the probe triggered.
+func (s *GrblStreamer) ProbeZ(distance, feedrate float64) (vector.Vector, error) {
+	if err := s.RequireFeature(FeatureProbe); err != nil {
+		return vector.Vector{}, err
+	}
+
+	lines, err := s.command(fmt.Sprintf("G91G38.2Z%sF%s",
+		strconv.FormatFloat(distance, 'f', -1, 64), strconv.FormatFloat(feedrate, 'f', -1, 64)))
+	if err != nil {
+		return vector.Vector{}, err
+	}
+	if _, err := s.command("G90"); err != nil {
+		return vector.Vector{}, err
+	}
+
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "[PRB:") {
+			continue
+		}
+		pos, success, err := ParseProbeResult(l)
+		if err != nil {
+			return pos, err
+		}
+		if !success {
+			return pos, errors.New("Probe did not trigger")
+		}
+		return pos, nil
+	}
+	return vector.Vector{}, errors.New("No probe report received")
+}
+
+// A tool length probing routine using a touch plate at a fixed machine
+// position. The first measured tool is the reference, and the length of
+// later tools is applied as a dynamic tool length offset (G43.1) relative to
+// it.
+type ToolLengthProbe struct {
+	X, Y     float64 // Touch plate position (machine coordinates)
+	SafeZ    float64 // Height to travel to the touch plate at (machine coordinates)
+	Distance float64 // Maximum probing distance below SafeZ
+	Feedrate float64
+
+	// Machine Z of the reference tool on the touch plate
+	Reference    float64
+	HasReference bool
+}
+
+// Measures the current tool, and applies the tool length offset. Returns the
+// offset, which is 0 for the reference tool. The machine is left at SafeZ
+// above the touch plate.
+func (p *ToolLengthProbe) Measure(s *GrblStreamer) (float64, error) {
+	if err := s.RequireFeature(FeatureDynamicToolLength); err != nil {
+		return 0, err
+	}
+
+	safeZ := strconv.FormatFloat(p.SafeZ, 'f', -1, 64)
+	if _, err := s.command("G53G0Z" + safeZ); err != nil {
+		return 0, err
+	}
+	if _, err := s.command(fmt.Sprintf("G53G0X%sY%s",
+		strconv.FormatFloat(p.X, 'f', -1, 64), strconv.FormatFloat(p.Y, 'f', -1, 64))); err != nil {
+		return 0, err
+	}
+
+	pos, err := s.ProbeZ(-p.Distance, p.Feedrate)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := s.command("G53G0Z" + safeZ); err != nil {
+		return 0, err
+	}
+
+	if !p.HasReference {
+		p.Reference = pos.Z
+		p.HasReference = true
+	}
+
+	offset := pos.Z - p.Reference
+	if _, err := s.command("G43.1Z" + strconv.FormatFloat(offset, 'f', -1, 64)); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
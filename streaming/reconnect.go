@@ -0,0 +1,145 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/vm"
+import "strings"
+import "errors"
+import "time"
+import "fmt"
+
+const (
+	// Time to wait for Grbl to answer after reopening the port
+	reconnectTimeout = 5 * time.Second
+
+	// Interval between status polls while waiting for Grbl to settle
+	statusInterval = 100 * time.Millisecond
+
+	// Status reports to wait for a work coordinate offset
+	maxStatusPolls = 50
+
+	// Maximum position difference accepted after reconnecting (mm)
+	reconnectTolerance = 0.01
+)
+
+// An error for lost connections. If Reconnected is set, the connection was
+// restored and validated, but the block in progress was not acknowledged,
+// and must be sent again.
+type DisconnectError struct {
+	Err          error
+	Reconnected  bool
+	ReconnectErr error
+}
+
+func (e *DisconnectError) Error() string {
+	s := fmt.Sprintf("Connection lost: %s", e.Err)
+	if e.Reconnected {
+		s += ", reconnected"
+	} else if e.ReconnectErr != nil {
+		s += fmt.Sprintf(", unable to reconnect: %s", e.ReconnectErr)
+	}
+	return s
+}
+
+// Handles a lost connection by reconnecting, and panics with a DisconnectError.
+func (s *GrblStreamer) connectionLost(cause error) {
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(cause)
+	}
+	err := s.reconnect()
+	panic(&DisconnectError{Err: cause, Reconnected: err == nil, ReconnectErr: err})
+}
+
+// Reopens the serial port up to Retries times, and validates the state of Grbl.
+func (s *GrblStreamer) reconnect() error {
+	if s.Retries <= 0 {
+		return errors.New("Reconnection disabled")
+	}
+	if s.stopped {
+		return errors.New("Stopped")
+	}
+	s.serialPort.Close()
+
+	var err error
+	for attempt := 0; attempt < s.Retries; attempt++ {
+		time.Sleep(s.RetryDelay)
+		if err = s.open(s.name, s.baud); err != nil {
+			continue
+		}
+		if err = s.resync(); err != nil {
+			s.serialPort.Close()
+			continue
+		}
+		return s.validate()
+	}
+	return err
+}
+
+// Waits for Grbl to answer after reopening the port. Grbl either restarted,
+// and prints its banner, or is still running, and answers an empty line.
+func (s *GrblStreamer) resync() error {
+	if _, err := s.serialPort.Write([]byte("\n")); err != nil {
+		return err
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = reconnectTimeout
+	}
+	for {
+		res := s.readTimeout(timeout)
+		switch res.level {
+		case "ok":
+			return nil
+		case "info":
+			if s.parseBanner(res.message) {
+				return nil
+			}
+		case "serial-error":
+			return resultError(res, "")
+		}
+	}
+}
+
+// Verifies that Grbl is idle at the last acknowledged position after
+// reconnecting, as the job cannot be continued safely otherwise. The modal
+// state that Grbl forgets on restart is then reset, so that it is sent again.
+func (s *GrblStreamer) validate() error {
+	var status GrblStatus
+	for polls := 0; ; polls++ {
+		if polls == maxStatusPolls {
+			return errors.New("Unable to determine work position after reconnect")
+		}
+		var err error
+		if status, err = s.Status(); err != nil {
+			return err
+		}
+		// Wait for the planner to finish what it received before the drop
+		if status.State != "Run" && status.State != "Jog" && status.HasWorkOffset {
+			break
+		}
+		time.Sleep(statusInterval)
+	}
+
+	switch strings.ToLower(status.State) {
+	case "alarm":
+		return errors.New("Grbl is in alarm state after reconnect")
+	case "door", "hold":
+		return errors.New(fmt.Sprintf("Grbl is in %s state after reconnect", strings.ToLower(status.State)))
+	}
+
+	expected := s.GetPosition().Vector()
+	if status.WorkPosition.Diff(expected).Norm() > reconnectTolerance {
+		return errors.New(fmt.Sprintf("Position lost during reconnect: at %s, expected %s", status.WorkPosition, expected))
+	}
+
+	state := &s.Position.State
+	state.MoveMode = vm.MoveModeNone
+	state.FeedMode = -1
+	state.Feedrate = 0
+	state.SpindleEnabled = false
+	state.SpindleSpeed = 0
+	state.FloodCoolant = false
+	state.MistCoolant = false
+	state.Coolant = 0
+	s.ForceModeWrite = true
+	return nil
+}
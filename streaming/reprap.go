@@ -0,0 +1,230 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/export"
+import "strconv"
+import "strings"
+import "errors"
+import "sync"
+import "time"
+import "fmt"
+
+const (
+	// Time to wait for the "start" banner of a board that resets on connect
+	reprapStartTimeout = 3 * time.Second
+
+	// Times a line is sent again on request before giving up
+	maxResends = 10
+)
+
+// A streamer for RepRap firmware, such as Marlin and RepRapFirmware. Lines
+// are sent with line numbers and checksums, as in "N12 G1X10*87", and sent
+// again when the firmware asks for it with "Resend: 12" or "rs 12", so lines
+// corrupted on the serial connection are never executed.
+//
+// The response handling and code generation of GrblStreamer are shared, but
+// Grbl specific features, such as status reports, settings, probing and
+// reconnection, are not available. Pause and Start hold back lines on the
+// host, as the firmware has no feed hold.
+type RepRapStreamer struct {
+	GrblStreamer
+
+	lineNumber int      // Number of the last line sent
+	sent       []string // Lines sent, by line number
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	paused     bool
+}
+
+func (s *RepRapStreamer) Init() {
+	s.GrblStreamer.Init()
+	s.noStatusPoll = true
+	s.cond = sync.NewCond(&s.mutex)
+	s.Write = func(str string) {
+		s.mutex.Lock()
+		for s.paused {
+			s.cond.Wait()
+		}
+		s.mutex.Unlock()
+
+		s.lineNumber++
+		s.sent = append(s.sent, str)
+		s.send(s.lineNumber)
+	}
+}
+
+// Returns the line asked for by "Resend: 12" or "rs 12", and whether the
+// message is such a request.
+func parseResend(msg string) (int, bool) {
+	msg = strings.TrimSpace(msg)
+	var n string
+	switch {
+	case strings.HasPrefix(strings.ToLower(msg), "resend:"):
+		n = msg[7:]
+	case strings.HasPrefix(msg, "rs "):
+		n = msg[3:]
+	default:
+		return 0, false
+	}
+	line, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(n), "N")))
+	if err != nil {
+		return 0, false
+	}
+	return line, true
+}
+
+// Returns whether an error is about a corrupted or lost line, which the
+// firmware follows up with a resend request.
+func isLineError(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "last line") || strings.Contains(msg, "checksum") || strings.Contains(msg, "line number")
+}
+
+// Sends line n, along with any lines the firmware asks to be sent again,
+// until line n is acknowledged.
+func (s *RepRapStreamer) send(n int) {
+	resends := 0
+	for idx := n; idx <= n; {
+		line := export.NumberLine(idx, s.sent[idx])
+		_, err := s.writer.WriteString(line + "\n")
+		if err == nil {
+			err = s.writer.Flush()
+		}
+		if err != nil {
+			s.connectionLost(errors.New(fmt.Sprintf("Error while sending data: %s", err)))
+		}
+		s.Notify(Event{Type: EventSent, Line: line})
+
+		resend, ok := s.await(line)
+		if !ok {
+			idx++
+			continue
+		}
+		if resend < 0 || resend > idx {
+			panic(errors.New(fmt.Sprintf("Resend of line %d requested, but line %d was the last sent", resend, idx)))
+		}
+		resends++
+		if resends > maxResends {
+			panic(errors.New(fmt.Sprintf("Line %d was sent again %d times without success, block: %s", resend, maxResends, s.sent[resend])))
+		}
+		idx = resend
+	}
+}
+
+// Awaits the acknowledgement of a line. Returns the line to continue from,
+// and whether the firmware asked for lines to be sent again.
+func (s *RepRapStreamer) await(line string) (int, bool) {
+	var (
+		lineErr error
+		resend  = -1
+	)
+	for {
+		res := s.read()
+		switch res.level {
+		case "serial-error":
+			err := resultError(res, line)
+			s.Notify(Event{Type: EventError, Line: line, Err: err})
+			s.connectionLost(err)
+		case "error", "alarm":
+			err := resultError(res, line)
+			s.Notify(Event{Type: EventError, Line: line, Err: err})
+			if !isLineError(res.message) {
+				panic(err)
+			}
+			lineErr = err
+		case "info":
+			if n, ok := parseResend(res.message); ok {
+				resend = n
+				continue
+			}
+			s.Notify(Event{Type: EventInfo, Line: res.message})
+			if !strings.Contains(res.message, "busy:") {
+				fmt.Printf("\nReceived info from CNC: %s\n", res.message)
+			}
+		default:
+			if resend >= 0 {
+				return resend, true
+			}
+			if lineErr != nil {
+				panic(lineErr)
+			}
+			s.Notify(Event{Type: EventAcknowledged, Line: line})
+			return 0, false
+		}
+	}
+}
+
+// Handles a lost connection, which cannot be restored, as the firmware
+// state cannot be validated.
+func (s *RepRapStreamer) connectionLost(cause error) {
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(cause)
+	}
+	panic(&DisconnectError{Err: cause, ReconnectErr: errors.New("Reconnection not supported for RepRap firmware")})
+}
+
+// Connect to a serial port at the given path and baudrate, or to a
+// serial-to-TCP bridge at "tcp://host:port", and reset the line numbers.
+func (s *RepRapStreamer) Connect(name string, baud int) (err error) {
+	if err := s.open(name, baud); err != nil {
+		return err
+	}
+
+	// Boards reset by connecting print "start" when ready, others nothing
+	for {
+		res := s.readTimeout(reprapStartTimeout)
+		if res.level == "serial-error" || strings.TrimSpace(res.message) == "start" {
+			break
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("Unable to reset line numbers: %s", r))
+		}
+	}()
+	s.lineNumber = 0
+	s.sent = []string{"M110 N0"}
+	s.send(0)
+	return nil
+}
+
+// Homes all axes (G28). Blocks until homing completes, which the firmware
+// answers with "busy:" messages in the meantime.
+func (s *RepRapStreamer) Home() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+	s.Write("G28")
+	return nil
+}
+
+// RepRap firmware has no alarm lock, so there is nothing to unlock.
+func (s *RepRapStreamer) Unlock() error {
+	return errors.New("RepRap firmware has no alarm lock to clear")
+}
+
+// Issues an emergency stop (M112). The connection is closed, and must be
+// opened again with Connect.
+func (s *RepRapStreamer) Stop() {
+	s.stopped = true
+	_, _ = s.serialPort.Write([]byte("M112\n"))
+	s.serialPort.Close()
+	s.Start()
+}
+
+// Continues sending lines after Pause.
+func (s *RepRapStreamer) Start() {
+	s.mutex.Lock()
+	s.paused = false
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+}
+
+// Holds back further lines. Moves already sent are completed.
+func (s *RepRapStreamer) Pause() {
+	s.mutex.Lock()
+	s.paused = true
+	s.mutex.Unlock()
+}
@@ -0,0 +1,101 @@
+package streaming
+
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// A Grbl setting ($x=val).
+type GrblSetting struct {
+	ID          int
+	Value       float64
+	Description string
+}
+
+// Exports the setting in the format accepted by Grbl ($x=val).
+func (g GrblSetting) String() string {
+	return fmt.Sprintf("$%d=%s", g.ID, strconv.FormatFloat(g.Value, 'f', -1, 64))
+}
+
+// Parses a setting line, such as "$0=10" or "$0=10 (step pulse, usec)".
+func ParseGrblSetting(line string) (GrblSetting, error) {
+	var s GrblSetting
+	line = strings.TrimSpace(line)
+	if len(line) < 4 || line[0] != '$' {
+		return s, errors.New(fmt.Sprintf("Not a setting: %s", line))
+	}
+
+	eq := strings.IndexRune(line, '=')
+	if eq == -1 {
+		return s, errors.New(fmt.Sprintf("Not a setting: %s", line))
+	}
+
+	id, err := strconv.Atoi(line[1:eq])
+	if err != nil {
+		return s, errors.New(fmt.Sprintf("Invalid setting id: %s", line))
+	}
+
+	val := line[eq+1:]
+	if idx := strings.IndexRune(val, '('); idx != -1 {
+		s.Description = strings.TrimSuffix(strings.TrimSpace(val[idx+1:]), ")")
+		val = val[:idx]
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return s, errors.New(fmt.Sprintf("Invalid setting value: %s", line))
+	}
+
+	s.ID = id
+	s.Value = v
+	return s, nil
+}
+
+// Sends a command line to Grbl, and collects all info responses until "ok".
+func (s *GrblStreamer) command(cmd string) ([]string, error) {
+	if _, err := s.writer.WriteString(cmd + "\n"); err != nil {
+		return nil, err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		res := s.read()
+		switch res.level {
+		case "ok":
+			return lines, nil
+		case "info":
+			if strings.TrimSpace(res.message) != "" {
+				lines = append(lines, strings.TrimSpace(res.message))
+			}
+		default:
+			return lines, resultError(res, cmd)
+		}
+	}
+}
+
+// Reads all settings from Grbl ($$).
+func (s *GrblStreamer) ReadSettings() ([]GrblSetting, error) {
+	lines, err := s.command("$$")
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []GrblSetting
+	for _, l := range lines {
+		setting, err := ParseGrblSetting(l)
+		if err != nil {
+			continue
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+// Writes a single setting to Grbl ($x=val).
+func (s *GrblStreamer) WriteSetting(id int, value float64) error {
+	_, err := s.command(GrblSetting{ID: id, Value: value}.String())
+	return err
+}
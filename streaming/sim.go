@@ -0,0 +1,394 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vector"
+import "io"
+import "strings"
+import "sync"
+import "time"
+import "fmt"
+
+// A streamer running against an in-memory model of Grbl instead of a serial
+// port, for tests and dry runs without hardware. Everything else, from
+// generators to response handling, is shared with GrblStreamer.
+//
+// The model acknowledges blocks into a planner buffer of BufferSize blocks,
+// which executes moves at their feedrate scaled by Speed, so a full buffer
+// holds back acknowledgements as on real hardware. It tracks positions
+// (absolute, incremental and G53), feedrates, dwells, probing, jogging, feed
+// hold and reset. Work offsets are always zero, and other blocks are
+// acknowledged without effect.
+type SimStreamer struct {
+	GrblStreamer
+
+	Latency    time.Duration // Delay before each response
+	BufferSize int           // Planner buffer size (blocks)
+	Speed      float64       // Execution speed relative to real time (0 for instant)
+	RapidRate  float64       // Rapid feedrate (mm/min)
+	Firmware   string        // Reported version, such as "1.1h"
+
+	mutex    sync.Mutex
+	received []string
+}
+
+// Initializes the streamer, and sets defaults for unset parameters.
+func (s *SimStreamer) Init() {
+	s.GrblStreamer.Init()
+	s.dial = s.dialSim
+	if s.BufferSize <= 0 {
+		s.BufferSize = 15
+	}
+	if s.RapidRate <= 0 {
+		s.RapidRate = 1000
+	}
+	if s.Firmware == "" {
+		s.Firmware = "1.1h"
+	}
+}
+
+// Returns all lines received by the simulated Grbl so far.
+func (s *SimStreamer) Received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// Starts a simulated Grbl, and returns the connection to it.
+func (s *SimStreamer) dialSim(name string, baud int) (io.ReadWriteCloser, error) {
+	version, err := ParseGrblVersion(s.Firmware)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &simDevice{
+		sim:    s,
+		legacy: !version.AtLeast(1, 1),
+		lines:  make(chan string, 128),
+	}
+	d.cond = sync.NewCond(&d.mutex)
+	d.hostIn, d.devOut = io.Pipe()
+	d.devIn, d.hostOut = io.Pipe()
+
+	go d.receive()
+	go d.process()
+	go d.execute()
+	return d, nil
+}
+
+//
+// Simulated Grbl
+//
+
+type simBlock struct {
+	target   vector.Vector
+	duration time.Duration
+}
+
+type simDevice struct {
+	sim    *SimStreamer
+	legacy bool
+
+	hostIn  *io.PipeReader
+	hostOut *io.PipeWriter
+	devIn   *io.PipeReader
+	devOut  *io.PipeWriter
+	lines   chan string
+
+	outMutex sync.Mutex
+
+	// Planner and machine state
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	queue  []*simBlock
+	hold   bool
+	closed bool
+	pos    vector.Vector
+
+	// Parser state
+	planned  vector.Vector
+	relative bool
+	rapid    bool
+	feed     float64
+}
+
+func (d *simDevice) Read(p []byte) (int, error) {
+	return d.hostIn.Read(p)
+}
+
+func (d *simDevice) Write(p []byte) (int, error) {
+	return d.hostOut.Write(p)
+}
+
+func (d *simDevice) Close() error {
+	d.mutex.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+
+	d.hostOut.Close()
+	d.devOut.Close()
+	return nil
+}
+
+// Sends a response line to the host.
+func (d *simDevice) respond(line string) {
+	d.outMutex.Lock()
+	defer d.outMutex.Unlock()
+	_, _ = d.devOut.Write([]byte(line + "\r\n"))
+}
+
+func (d *simDevice) banner() {
+	d.respond("")
+	d.respond(fmt.Sprintf("Grbl %s ['$' for help]", d.sim.Firmware))
+}
+
+// Reads from the host, handling real-time commands immediately and queueing lines.
+func (d *simDevice) receive() {
+	defer close(d.lines)
+	d.banner()
+
+	buf := make([]byte, 64)
+	line := ""
+	for {
+		n, err := d.devIn.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, c := range buf[:n] {
+			switch c {
+			case '?':
+				d.respond(d.status())
+			case '!':
+				d.mutex.Lock()
+				d.hold = true
+				d.mutex.Unlock()
+			case '~':
+				d.mutex.Lock()
+				d.hold = false
+				d.cond.Broadcast()
+				d.mutex.Unlock()
+			case 0x18:
+				d.mutex.Lock()
+				d.queue = nil
+				d.hold = false
+				d.planned = d.pos
+				d.cond.Broadcast()
+				d.mutex.Unlock()
+				d.banner()
+			case 0x85:
+				d.mutex.Lock()
+				d.queue = nil
+				d.planned = d.pos
+				d.cond.Broadcast()
+				d.mutex.Unlock()
+			case '\r':
+			case '\n':
+				d.lines <- line
+				line = ""
+			default:
+				line += string(c)
+			}
+		}
+	}
+}
+
+// Parses and plans lines one at a time, acknowledging each once planned.
+func (d *simDevice) process() {
+	for line := range d.lines {
+		d.sim.mutex.Lock()
+		d.sim.received = append(d.sim.received, line)
+		d.sim.mutex.Unlock()
+
+		if d.sim.Latency > 0 {
+			time.Sleep(d.sim.Latency)
+		}
+
+		for _, r := range d.handle(strings.ToUpper(strings.TrimSpace(line))) {
+			d.respond(r)
+		}
+	}
+}
+
+// Executes planned blocks in order.
+func (d *simDevice) execute() {
+	for {
+		d.mutex.Lock()
+		for (len(d.queue) == 0 || d.hold) && !d.closed {
+			d.cond.Wait()
+		}
+		if d.closed {
+			d.mutex.Unlock()
+			return
+		}
+		b := d.queue[0]
+		d.mutex.Unlock()
+
+		if d.sim.Speed > 0 {
+			time.Sleep(time.Duration(float64(b.duration) / d.sim.Speed))
+		}
+
+		d.mutex.Lock()
+		// The queue may have been flushed by a reset meanwhile
+		if len(d.queue) > 0 && d.queue[0] == b {
+			d.pos = b.target
+			d.queue = d.queue[1:]
+		}
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+	}
+}
+
+// Formats a status report.
+func (d *simDevice) status() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	state := "Idle"
+	if d.hold {
+		state = "Hold"
+	} else if len(d.queue) > 0 {
+		state = "Run"
+	}
+
+	p := fmt.Sprintf("%.3f,%.3f,%.3f", d.pos.X, d.pos.Y, d.pos.Z)
+	if d.legacy {
+		return fmt.Sprintf("<%s,MPos:%s,WPos:%s>", state, p, p)
+	}
+	return fmt.Sprintf("<%s|MPos:%s|FS:%g,0|WCO:0.000,0.000,0.000>", state, p, d.feed)
+}
+
+// Adds a block to the planner, waiting for room.
+func (d *simDevice) plan(b *simBlock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for len(d.queue) >= d.sim.BufferSize && !d.closed {
+		d.cond.Wait()
+	}
+	d.queue = append(d.queue, b)
+	d.planned = b.target
+	d.cond.Broadcast()
+}
+
+// Waits for the planner to finish all blocks.
+func (d *simDevice) synchronize() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for len(d.queue) > 0 && !d.closed {
+		d.cond.Wait()
+	}
+}
+
+func (d *simDevice) errorResponse(code int, legacy string) string {
+	if d.legacy {
+		return "error: " + legacy
+	}
+	return fmt.Sprintf("error:%d", code)
+}
+
+// Handles a line, returning the responses.
+func (d *simDevice) handle(line string) []string {
+	switch {
+	case line == "":
+		return []string{"ok"}
+	case line == "$$":
+		return []string{"$0=10", "$1=25", "$100=250", "$101=250", "$102=250",
+			fmt.Sprintf("$110=%g", d.sim.RapidRate), fmt.Sprintf("$111=%g", d.sim.RapidRate),
+			fmt.Sprintf("$112=%g", d.sim.RapidRate), "ok"}
+	case line == "$G":
+		gc := "G0 G54 G17 G21 G90 G94 M5 M9 T0 F0 S0"
+		if d.legacy {
+			return []string{"[" + gc + "]", "ok"}
+		}
+		return []string{"[GC:" + gc + "]", "ok"}
+	case line == "$H":
+		d.synchronize()
+		d.mutex.Lock()
+		d.pos, d.planned = vector.Vector{}, vector.Vector{}
+		d.mutex.Unlock()
+		return []string{"ok"}
+	case strings.HasPrefix(line, "$J="):
+		// Jogging does not affect the modal state
+		relative, rapid, feed := d.relative, d.rapid, d.feed
+		d.rapid = false
+		res := d.gcode(line[3:])
+		d.relative, d.rapid, d.feed = relative, rapid, feed
+		return res
+	case line[0] == '$':
+		return []string{"ok"}
+	}
+	return d.gcode(line)
+}
+
+// Plans a gcode block, returning the responses.
+func (d *simDevice) gcode(line string) []string {
+	doc, err := gcode.Parse(line)
+	if err != nil || len(doc.Blocks) != 1 {
+		return []string{d.errorResponse(1, "Expected command letter")}
+	}
+	b := doc.Blocks[0]
+
+	if b.HasWord('G', 0) {
+		d.rapid = true
+	}
+	// Arcs are timed by their chord
+	if b.HasWord('G', 1) || b.HasWord('G', 2) || b.HasWord('G', 3) || b.HasWord('G', 38.2) {
+		d.rapid = false
+	}
+	if b.HasWord('G', 90) {
+		d.relative = false
+	}
+	if b.HasWord('G', 91) {
+		d.relative = true
+	}
+	if f, err := b.GetWord('F'); err == nil {
+		d.feed = f
+	}
+
+	if b.HasWord('G', 4) {
+		p := b.GetWordDefault('P', 0)
+		d.plan(&simBlock{target: d.planned, duration: time.Duration(p * float64(time.Second))})
+		return []string{"ok"}
+	}
+
+	// Blocks that take axis words without moving
+	if b.HasWord('G', 10) || b.HasWord('G', 92) || b.HasWord('G', 43.1) || b.HasWord('G', 28.1) || b.HasWord('G', 30.1) {
+		return []string{"ok"}
+	}
+
+	if !b.IncludesOneOf('X', 'Y', 'Z') {
+		return []string{"ok"}
+	}
+
+	target := d.planned
+	for _, axis := range []struct {
+		addr rune
+		val  *float64
+	}{{'X', &target.X}, {'Y', &target.Y}, {'Z', &target.Z}} {
+		v, err := b.GetWord(axis.addr)
+		if err != nil {
+			continue
+		}
+		if d.relative && !b.HasWord('G', 53) {
+			*axis.val += v
+		} else {
+			*axis.val = v
+		}
+	}
+
+	rate := d.sim.RapidRate
+	if !d.rapid {
+		if d.feed <= 0 {
+			return []string{d.errorResponse(22, "Undefined feed rate")}
+		}
+		rate = d.feed
+	}
+	dist := target.Diff(d.planned).Norm()
+	d.plan(&simBlock{target: target, duration: time.Duration(dist / rate * float64(time.Minute))})
+
+	if b.HasWord('G', 38.2) {
+		// Probing synchronizes, and reports where the probe triggered
+		d.synchronize()
+		return []string{fmt.Sprintf("[PRB:%.3f,%.3f,%.3f:1]", target.X, target.Y, target.Z), "ok"}
+	}
+	return []string{"ok"}
+}
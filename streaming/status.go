@@ -0,0 +1,170 @@
+package streaming
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// A Grbl status report.
+type GrblStatus struct {
+	State           string
+	MachinePosition vector.Vector
+	WorkPosition    vector.Vector
+
+	// Offset between machine and work position, if known
+	WorkOffset    vector.Vector
+	HasWorkOffset bool
+}
+
+func parseVector(s string) (vector.Vector, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < 3 {
+		return vector.Vector{}, errors.New(fmt.Sprintf("Invalid position: %s", s))
+	}
+	var v [3]float64
+	for idx := range v {
+		f, err := strconv.ParseFloat(parts[idx], 64)
+		if err != nil {
+			return vector.Vector{}, errors.New(fmt.Sprintf("Invalid position: %s", s))
+		}
+		v[idx] = f
+	}
+	return vector.Vector{X: v[0], Y: v[1], Z: v[2]}, nil
+}
+
+// Parses a status report, such as "<Idle|MPos:1.000,2.000,3.000|FS:0,0>" (Grbl 1.1)
+// or "<Idle,MPos:1.000,2.000,3.000,WPos:0.000,0.000,0.000>" (Grbl 0.9).
+//
+// Grbl 1.1 reports either the machine or work position, along with the work
+// coordinate offset (WCO) at intervals. The missing position is calculated
+// when the offset is present, and otherwise left equal to the reported one.
+// GrblStreamer.Status fills it in from earlier reports.
+func ParseGrblStatus(report string) (GrblStatus, error) {
+	var status GrblStatus
+	report = strings.TrimSpace(report)
+	if len(report) < 2 || report[0] != '<' || report[len(report)-1] != '>' {
+		return status, errors.New(fmt.Sprintf("Not a status report: %s", report))
+	}
+	report = report[1 : len(report)-1]
+
+	if !strings.Contains(report, "|") {
+		// Grbl 0.9 separates both fields and values with comma
+		for _, label := range []string{"MPos:", "WPos:", "Buf:", "RX:", "Ln:", "F:", "Lim:", "Ctl:"} {
+			report = strings.Replace(report, ","+label, "|"+label, 1)
+		}
+	}
+
+	var (
+		hasMPos, hasWPos, hasWCO bool
+		wco                      vector.Vector
+		err                      error
+	)
+
+	fields := strings.Split(report, "|")
+	status.State = fields[0]
+	if idx := strings.IndexRune(status.State, ':'); idx != -1 {
+		// Substates, such as "Hold:0"
+		status.State = status.State[:idx]
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "MPos:"):
+			status.MachinePosition, err = parseVector(f[5:])
+			hasMPos = true
+		case strings.HasPrefix(f, "WPos:"):
+			status.WorkPosition, err = parseVector(f[5:])
+			hasWPos = true
+		case strings.HasPrefix(f, "WCO:"):
+			wco, err = parseVector(f[4:])
+			hasWCO = true
+		}
+		if err != nil {
+			return status, err
+		}
+	}
+
+	switch {
+	case hasMPos && hasWPos:
+		status.WorkOffset = status.MachinePosition.Diff(status.WorkPosition)
+		status.HasWorkOffset = true
+	case hasMPos && !hasWPos:
+		status.WorkPosition = status.MachinePosition
+		if hasWCO {
+			status.WorkPosition = status.MachinePosition.Diff(wco)
+		}
+	case hasWPos && !hasMPos:
+		status.MachinePosition = status.WorkPosition
+		if hasWCO {
+			status.MachinePosition = status.WorkPosition.Sum(wco)
+		}
+	case !hasMPos && !hasWPos:
+		return status, errors.New(fmt.Sprintf("No position in status report: %s", report))
+	}
+
+	if hasWCO {
+		status.WorkOffset = wco
+		status.HasWorkOffset = true
+	}
+
+	return status, nil
+}
+
+// Queries the machine status ("?"). Must not be used while streaming.
+//
+// Grbl 1.1 only reports the work coordinate offset at intervals, so the
+// last reported offset is used to complete reports without it.
+func (s *GrblStreamer) Status() (GrblStatus, error) {
+	if _, err := s.serialPort.Write([]byte("?")); err != nil {
+		return GrblStatus{}, err
+	}
+	for {
+		res := s.read()
+		switch res.level {
+		case "info":
+			m := strings.TrimSpace(res.message)
+			if !strings.HasPrefix(m, "<") {
+				continue
+			}
+			status, err := ParseGrblStatus(m)
+			if err != nil {
+				return status, err
+			}
+			if status.HasWorkOffset {
+				offset := status.WorkOffset
+				s.workOffset = &offset
+			} else if s.workOffset != nil {
+				status.WorkOffset = *s.workOffset
+				status.HasWorkOffset = true
+				if strings.Contains(m, "MPos:") {
+					status.WorkPosition = status.MachinePosition.Diff(*s.workOffset)
+				} else {
+					status.MachinePosition = status.WorkPosition.Sum(*s.workOffset)
+				}
+			}
+			s.Notify(Event{Type: EventStatus, Status: status})
+			return status, nil
+		case "serial-error":
+			return GrblStatus{}, resultError(res, "?")
+		}
+	}
+}
+
+// Queries the active coordinate system ($G), returned as 1 for G54 through 6 for G59.
+func (s *GrblStreamer) ActiveCoordinateSystem() (int, error) {
+	lines, err := s.command("$G")
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range lines {
+		l = strings.Trim(l, "[]")
+		l = strings.TrimPrefix(l, "GC:")
+		for _, w := range strings.Fields(l) {
+			if len(w) == 3 && w[:2] == "G5" && w[2] >= '4' && w[2] <= '9' {
+				return int(w[2]-'4') + 1, nil
+			}
+		}
+	}
+	return 0, errors.New("Unable to determine active coordinate system")
+}
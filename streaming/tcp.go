@@ -0,0 +1,33 @@
+package streaming
+
+import "io"
+import "net"
+import "strings"
+import "time"
+
+const (
+	// Prefix for device names that are network addresses, such as "tcp://host:port"
+	tcpPrefix = "tcp://"
+
+	// Time to wait for a network connection to be established
+	tcpDialTimeout = 10 * time.Second
+
+	// Default interval between TCP keepalive probes
+	defaultKeepAlive = 30 * time.Second
+)
+
+// Tests if a device name refers to a serial-to-TCP bridge, such as ser2net or ESP3D.
+func isNetworkDevice(name string) bool {
+	return strings.HasPrefix(name, tcpPrefix)
+}
+
+// Connects to a serial-to-TCP bridge. Keepalive probes are enabled, so that
+// a bridge that disappears without closing the connection is detected.
+func (s *GrblStreamer) dialTCP(name string) (io.ReadWriteCloser, error) {
+	keepAlive := s.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = defaultKeepAlive
+	}
+	d := net.Dialer{Timeout: tcpDialTimeout, KeepAlive: keepAlive}
+	return d.Dial("tcp", strings.TrimPrefix(name, tcpPrefix))
+}
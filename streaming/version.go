@@ -0,0 +1,161 @@
+package streaming
+
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// Constants for firmware dependent features
+const (
+	FeatureDynamicToolLength = iota
+	FeatureProbe             = iota
+	FeatureJogging           = iota
+	FeatureWorkZero          = iota
+)
+
+// Minimum Grbl version for each feature
+var grblFeatures = map[int]struct {
+	name         string
+	major, minor int
+}{
+	FeatureDynamicToolLength: {"dynamic tool length offset (G43.1)", 0, 9},
+	FeatureProbe:             {"probing (G38.2)", 0, 9},
+	FeatureJogging:           {"jogging ($J)", 1, 1},
+	FeatureWorkZero:          {"setting work zero (G10 L20)", 0, 9},
+}
+
+// A Grbl firmware version, such as "1.1h".
+type GrblVersion struct {
+	Major int
+	Minor int
+	Build string
+}
+
+func (v GrblVersion) String() string {
+	return fmt.Sprintf("%d.%d%s", v.Major, v.Minor, v.Build)
+}
+
+// Parses a Grbl version, such as "0.9j" or "1.1h".
+func ParseGrblVersion(s string) (GrblVersion, error) {
+	var v GrblVersion
+	dot := strings.IndexRune(s, '.')
+	if dot == -1 {
+		return v, errors.New(fmt.Sprintf("Invalid Grbl version: %s", s))
+	}
+
+	major, err := strconv.Atoi(s[:dot])
+	if err != nil {
+		return v, errors.New(fmt.Sprintf("Invalid Grbl version: %s", s))
+	}
+
+	end := dot + 1
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	minor, err := strconv.Atoi(s[dot+1 : end])
+	if err != nil {
+		return v, errors.New(fmt.Sprintf("Invalid Grbl version: %s", s))
+	}
+
+	v.Major, v.Minor, v.Build = major, minor, s[end:]
+	return v, nil
+}
+
+// Tests if the version is the given version or newer.
+func (v GrblVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// Tests if the version supports a feature.
+func (v GrblVersion) Supports(feature int) bool {
+	f, ok := grblFeatures[feature]
+	if !ok {
+		return false
+	}
+	return v.AtLeast(f.major, f.minor)
+}
+
+// An error for features not supported by the connected firmware.
+type UnsupportedError struct {
+	Feature string
+	Version GrblVersion
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("Grbl %s does not support %s", e.Version, e.Feature)
+}
+
+// Queries the firmware version ($I), for when the startup banner was missed.
+// Grbl 1.1 answers "[VER:1.1h.20190825:]", and Grbl 0.9 "[0.9j.20160726:]".
+func (s *GrblStreamer) queryVersion() {
+	lines, err := s.command("$I")
+	if err != nil {
+		fmt.Printf("Warning: Unable to query Grbl version, disabling version dependent features\n")
+		return
+	}
+	for _, l := range lines {
+		l = strings.TrimPrefix(strings.Trim(l, "[]"), "VER:")
+		parts := strings.Split(l, ".")
+		if len(parts) < 2 {
+			continue
+		}
+		if v, err := ParseGrblVersion(parts[0] + "." + parts[1]); err == nil {
+			s.Version = v
+			fmt.Printf("Grbl version %s initialized\n", v)
+			return
+		}
+	}
+	fmt.Printf("Warning: Unknown Grbl version, disabling version dependent features\n")
+}
+
+// Tests if the connected firmware supports a feature.
+func (s *GrblStreamer) Supports(feature int) bool {
+	return s.Version.Supports(feature)
+}
+
+// Returns an UnsupportedError if the connected firmware does not support a feature.
+func (s *GrblStreamer) RequireFeature(feature int) error {
+	if s.Supports(feature) {
+		return nil
+	}
+	return &UnsupportedError{Feature: grblFeatures[feature].name, Version: s.Version}
+}
+
+// Jogs the machine relative to its current position. Uses $J on firmware that
+// supports it, and falls back to incremental G1 moves on older firmware.
+func (s *GrblStreamer) Jog(x, y, z, feedrate float64) error {
+	axes := ""
+	for _, a := range []struct {
+		addr rune
+		val  float64
+	}{{'X', x}, {'Y', y}, {'Z', z}} {
+		if a.val != 0 {
+			axes += fmt.Sprintf("%c%s", a.addr, strconv.FormatFloat(a.val, 'f', -1, 64))
+		}
+	}
+	if axes == "" {
+		return nil
+	}
+	feed := strconv.FormatFloat(feedrate, 'f', -1, 64)
+
+	if s.Supports(FeatureJogging) {
+		_, err := s.command(fmt.Sprintf("$J=G91%sF%s", axes, feed))
+		return err
+	}
+
+	// Older firmware: restore absolute mode afterwards, as programs expect it
+	if _, err := s.command(fmt.Sprintf("G91G1%sF%s", axes, feed)); err != nil {
+		return err
+	}
+	_, err := s.command("G90")
+	return err
+}
+
+// Cancels an active jog. Only supported by firmware with real-time jog cancel.
+func (s *GrblStreamer) JogCancel() error {
+	if err := s.RequireFeature(FeatureJogging); err != nil {
+		return err
+	}
+	_, err := s.serialPort.Write([]byte{0x85})
+	return err
+}
@@ -0,0 +1,93 @@
+package streaming
+
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// Sets the work zero of the given axes ("X", "XY", "XYZ", ...) to the current
+// position, by updating the active coordinate system. Uses G10 L20 where
+// supported, and otherwise G10 L2 with the reported machine position.
+func (s *GrblStreamer) Zero(axes string) error {
+	axes = strings.ToUpper(axes)
+	for _, a := range axes {
+		if a != 'X' && a != 'Y' && a != 'Z' {
+			return errors.New(fmt.Sprintf("Invalid axis: %c", a))
+		}
+	}
+	if axes == "" {
+		return nil
+	}
+
+	if s.Supports(FeatureWorkZero) {
+		cmd := "G10L20P0"
+		for _, a := range axes {
+			cmd += string(a) + "0"
+		}
+		_, err := s.command(cmd)
+		return err
+	}
+
+	status, err := s.Status()
+	if err != nil {
+		return err
+	}
+	cs, err := s.ActiveCoordinateSystem()
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("G10L2P%d", cs)
+	for _, a := range axes {
+		var v float64
+		switch a {
+		case 'X':
+			v = status.MachinePosition.X
+		case 'Y':
+			v = status.MachinePosition.Y
+		case 'Z':
+			v = status.MachinePosition.Z
+		}
+		cmd += string(a) + strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	_, err = s.command(cmd)
+	return err
+}
+
+// Sets a temporary work zero of the given axes with G92, leaving the
+// coordinate systems untouched. The offset is lost on reset.
+func (s *GrblStreamer) ZeroTemporary(axes string) error {
+	axes = strings.ToUpper(axes)
+	cmd := "G92"
+	for _, a := range axes {
+		if a != 'X' && a != 'Y' && a != 'Z' {
+			return errors.New(fmt.Sprintf("Invalid axis: %c", a))
+		}
+		cmd += string(a) + "0"
+	}
+	if axes == "" {
+		return nil
+	}
+	_, err := s.command(cmd)
+	return err
+}
+
+// Sets the X work zero to the current position.
+func (s *GrblStreamer) ZeroX() error {
+	return s.Zero("X")
+}
+
+// Sets the Y work zero to the current position.
+func (s *GrblStreamer) ZeroY() error {
+	return s.Zero("Y")
+}
+
+// Sets the Z work zero to the current position.
+func (s *GrblStreamer) ZeroZ() error {
+	return s.Zero("Z")
+}
+
+// Sets the work zero of all axes to the current position.
+func (s *GrblStreamer) ZeroAll() error {
+	return s.Zero("XYZ")
+}
@@ -47,6 +47,14 @@ func (v Vector) Divide(d float64) Vector {
 	}
 }
 
+func (v Vector) Multiply(m float64) Vector {
+	return Vector{
+		X: v.X * m,
+		Y: v.Y * m,
+		Z: v.Z * m,
+	}
+}
+
 func (v Vector) String() string {
 	return fmt.Sprintf("Vector{X: %f, Y: %f, Z: %f}", v.X, v.Y, v.Z)
 }
@@ -0,0 +1,220 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+// A move of a contour offset sideways, being a line through P along the unit
+// vector D, or a circle around C of radius R for arc moves.
+type offsetMove struct {
+	Arc  bool
+	P, D vector.Vector
+	C    vector.Vector
+	R    float64
+}
+
+// Returns the direction of the move from start to pos in XY at its start and
+// end, which for arcs is their tangent.
+func tangents(start, pos Position) (vector.Vector, vector.Vector) {
+	tangent := func(p Position) vector.Vector {
+		r := vector.Vector{p.X - pos.Center.X, p.Y - pos.Center.Y, 0}
+		if pos.State.MoveMode == MoveModeCWArc {
+			return vector.Vector{r.Y, -r.X, 0}.Divide(r.Norm())
+		}
+		return vector.Vector{-r.Y, r.X, 0}.Divide(r.Norm())
+	}
+	if pos.State.MoveMode == MoveModeCWArc || pos.State.MoveMode == MoveModeCCWArc {
+		return tangent(start), tangent(pos)
+	}
+	d := vector.Vector{pos.X - start.X, pos.Y - start.Y, 0}
+	return d.Divide(d.Norm()), d.Divide(d.Norm())
+}
+
+// Returns the normal on the left of a direction in XY.
+func leftNormal(d vector.Vector) vector.Vector {
+	return vector.Vector{-d.Y, d.X, 0}
+}
+
+// Returns the point where two offset moves cross nearest to near, and whether
+// they cross at all.
+func (a offsetMove) cross(b offsetMove, near vector.Vector) (vector.Vector, bool) {
+	nearest := func(p1, p2 vector.Vector) vector.Vector {
+		if p1.Diff(near).Norm() <= p2.Diff(near).Norm() {
+			return p1
+		}
+		return p2
+	}
+
+	switch {
+	case !a.Arc && !b.Arc:
+		denom := a.D.X*b.D.Y - a.D.Y*b.D.X
+		if math.Abs(denom) < 1e-12 {
+			return vector.Vector{}, false
+		}
+		w := b.P.Diff(a.P)
+		return a.P.Sum(a.D.Multiply((w.X*b.D.Y - w.Y*b.D.X) / denom)), true
+	case a.Arc && b.Arc:
+		d := b.C.Diff(a.C)
+		dist := d.Norm()
+		if dist == 0 || dist > a.R+b.R || dist < math.Abs(a.R-b.R) {
+			return vector.Vector{}, false
+		}
+		along := (a.R*a.R - b.R*b.R + dist*dist) / (2 * dist)
+		h := math.Sqrt(math.Max(a.R*a.R-along*along, 0))
+		mid := a.C.Sum(d.Multiply(along / dist))
+		perp := leftNormal(d).Multiply(h / dist)
+		return nearest(mid.Sum(perp), mid.Diff(perp)), true
+	case a.Arc:
+		a, b = b, a
+	}
+
+	// Line a and circle b
+	f := a.P.Diff(b.C)
+	half := f.Dot(a.D)
+	disc := half*half - (f.Dot(f) - b.R*b.R)
+	if disc < 0 {
+		return vector.Vector{}, false
+	}
+	root := math.Sqrt(disc)
+	return nearest(a.P.Sum(a.D.Multiply(-half+root)), a.P.Sum(a.D.Multiply(-half-root))), true
+}
+
+// Offsets the closed contours, as found by Contours with side, by allowance
+// in XY, leaving allowance of material on the edge they cut if positive, or
+// cutting that much further into it if negative, such as for a spring pass.
+// Corners the contour is moved away from are rounded with arcs, and the moves
+// at corners it is moved into are cut short where they cross.
+//
+// The contour is reached from and left at its original start with a move
+// straight to the side, so the moves into and out of it are kept as they are.
+// Contours cut on an unknown side are left alone, as are contours the offset
+// would turn inside out, such as pockets with too tight corners or moves
+// shorter than the allowance. Returns the number of contours offset, and the
+// number left alone as they would be turned inside out.
+func (vm *Machine) OffsetContours(allowance float64, side func(int, Operation) int) (offset, failed int) {
+	if allowance == 0 {
+		return 0, 0
+	}
+
+	contours := vm.Contours(side)
+	for k := len(contours) - 1; k >= 0; k-- {
+		c := contours[k]
+		if c.Side == SideUnknown {
+			continue
+		}
+
+		// The offset, positive to the left of the contour
+		left := c.Clockwise == (c.Side == SideOutside)
+		dist := allowance
+		if !left {
+			dist = -allowance
+		}
+
+		loop, ok := vm.offsetLoop(c, dist)
+		if !ok {
+			failed++
+			continue
+		}
+
+		positions := append([]Position(nil), vm.Positions[:c.Start]...)
+		positions = append(positions, loop...)
+		vm.Positions = append(positions, vm.Positions[c.End:]...)
+		offset++
+	}
+	return offset, failed
+}
+
+// Returns the moves of the contour offset by dist to the left, starting and
+// ending at its original start, and whether the offset could be made.
+func (vm *Machine) offsetLoop(c Contour, dist float64) ([]Position, bool) {
+	n := c.End - c.Start
+	moves := make([]offsetMove, n)
+	ins, outs := make([]vector.Vector, n), make([]vector.Vector, n)
+	for i := 0; i < n; i++ {
+		from, to := vm.Positions[c.Start+i-1], vm.Positions[c.Start+i]
+		d, end := tangents(from, to)
+		ins[(i+1)%n], outs[i] = end, d
+		switch to.State.MoveMode {
+		case MoveModeCWArc, MoveModeCCWArc:
+			_, _, radius := arcAngles(from, to)
+			if to.State.MoveMode == MoveModeCCWArc {
+				radius -= dist
+			} else {
+				radius += dist
+			}
+			if radius <= vm.Tolerance {
+				return nil, false
+			}
+			moves[i] = offsetMove{Arc: true, C: vector.Vector{to.Center.X, to.Center.Y, 0}, R: radius}
+		default:
+			p := vector.Vector{from.X, from.Y, 0}.Sum(leftNormal(d).Multiply(dist))
+			moves[i] = offsetMove{P: p, D: d}
+		}
+	}
+
+	// The offset corners, where the moves end and start, and whether the
+	// contour is moved away from the corner
+	var (
+		ends, starts = make([]vector.Vector, n), make([]vector.Vector, n)
+		round        = make([]bool, n)
+	)
+	for j := 0; j < n; j++ {
+		corner := vm.Positions[c.Start+j-1]
+		v := vector.Vector{corner.X, corner.Y, 0}
+		turn := ins[j].X*outs[j].Y - ins[j].Y*outs[j].X
+		switch {
+		case ins[j].Dot(outs[j]) > 1-1e-9:
+			starts[j] = v.Sum(leftNormal(outs[j]).Multiply(dist))
+			ends[j] = starts[j]
+		case (dist > 0) == (turn < 0):
+			ends[j] = v.Sum(leftNormal(ins[j]).Multiply(dist))
+			starts[j] = v.Sum(leftNormal(outs[j]).Multiply(dist))
+			round[j] = true
+		default:
+			p, ok := moves[(j+n-1)%n].cross(moves[j], v)
+			if !ok {
+				return nil, false
+			}
+			starts[j], ends[j] = p, p
+		}
+	}
+
+	start := vm.Positions[c.Start-1]
+	first := vm.Positions[c.Start]
+	link := func(v vector.Vector) Position {
+		p := first
+		p.State.MoveMode = MoveModeLinear
+		p.X, p.Y, p.Z = v.X, v.Y, start.Z
+		p.Center = vector.Vector{}
+		return p
+	}
+
+	loop := []Position{link(starts[0])}
+	for i := 0; i < n; i++ {
+		orig := vm.Positions[c.Start+i]
+		from, to := starts[i], ends[(i+1)%n]
+		if !moves[i].Arc && to.Diff(from).Dot(moves[i].D) <= 0 {
+			// The move would run backwards
+			return nil, false
+		}
+
+		p := orig
+		p.X, p.Y = to.X, to.Y
+		if moves[i].Arc {
+			p.Center = moves[i].C
+		}
+		loop = append(loop, p)
+
+		if j := (i + 1) % n; round[j] {
+			corner := vm.Positions[c.Start+j-1]
+			p := orig
+			p.X, p.Y = starts[j].X, starts[j].Y
+			p.Center = vector.Vector{corner.X, corner.Y, 0}
+			p.State.MoveMode = MoveModeCCWArc
+			if dist > 0 {
+				p.State.MoveMode = MoveModeCWArc
+			}
+			loop = append(loop, p)
+		}
+	}
+	return append(loop, link(vector.Vector{start.X, start.Y, 0})), true
+}
@@ -0,0 +1,47 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+// Returns the start angle, swept angle and radius of the arc move from start
+// to pos. The swept angle is negative for clockwise arcs.
+func arcAngles(start, pos Position) (theta, angle, radius float64) {
+	c := pos.Center
+	theta = math.Atan2(start.Y-c.Y, start.X-c.X)
+	angle = math.Atan2(pos.Y-c.Y, pos.X-c.X) - theta
+	if pos.State.MoveMode == MoveModeCWArc && angle > 0 {
+		angle -= 2 * math.Pi
+	} else if pos.State.MoveMode == MoveModeCCWArc && angle < 0 {
+		angle += 2 * math.Pi
+	}
+	radius = math.Hypot(start.X-c.X, start.Y-c.Y)
+	return
+}
+
+// Returns the length of the arc move from start to pos, including Z travel.
+func ArcLength(start, pos Position) float64 {
+	_, angle, radius := arcAngles(start, pos)
+	return math.Hypot(angle*radius, pos.Z-start.Z)
+}
+
+// Returns points along the arc move from start to pos, ending at pos, such
+// that the lines between them deviate at most maxDeviation from the arc.
+func InterpolateArc(start, pos Position, maxDeviation float64) []vector.Vector {
+	theta, angle, radius := arcAngles(start, pos)
+
+	steps := 1
+	if maxDeviation > 0 && maxDeviation < radius {
+		steps = int(math.Ceil(math.Abs(angle / (2 * math.Acos(1-maxDeviation/radius)))))
+	}
+
+	points := make([]vector.Vector, 0, steps)
+	for i := 1; i < steps; i++ {
+		a := theta + angle*float64(i)/float64(steps)
+		points = append(points, vector.Vector{
+			pos.Center.X + radius*math.Cos(a),
+			pos.Center.Y + radius*math.Sin(a),
+			start.Z + (pos.Z-start.Z)*float64(i)/float64(steps),
+		})
+	}
+	return append(points, pos.Vector())
+}
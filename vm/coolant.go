@@ -0,0 +1,139 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+//
+// Coolant channels
+//
+// Besides flood and mist coolant (M8 and M7), machines often have accessories
+// switched like coolant, such as an air blast or dust extraction on routers.
+// These are kept in State.Coolant as a set of channels, each turned on and off
+// by the M codes in CoolantCodes of the machine. M9 turns all channels off,
+// along with flood and mist coolant.
+//
+// The M codes of a channel take precedence over the standard meaning of a
+// code, so M7 can be used for an air blast on machines without mist coolant.
+//
+
+// Constants for coolant channels, which are bits of State.Coolant
+const (
+	CoolantAir     = 1 << iota // Air blast
+	CoolantVacuum  = 1 << iota // Dust extraction
+	CoolantSpindle = 1 << iota // Coolant through the spindle
+	CoolantTHC     = 1 << iota // Torch height control of plasma cutters
+)
+
+// All coolant channels, in the order they are switched.
+var CoolantChannels = []int{CoolantAir, CoolantVacuum, CoolantSpindle, CoolantTHC}
+
+var coolantNames = map[int]string{
+	CoolantAir:     "air",
+	CoolantVacuum:  "vacuum",
+	CoolantSpindle: "spindle",
+	CoolantTHC:     "thc",
+}
+
+// M codes turning a coolant channel on and off.
+type CoolantCodes struct {
+	On  float64
+	Off float64
+}
+
+// Returns the M codes of channels common to several controllers: M73/M74 for
+// the air blast and M88/M89 for coolant through the spindle, as on Haas
+// controllers. Dust extraction and torch height control have no common codes.
+func DefaultCoolantCodes() map[int]CoolantCodes {
+	return map[int]CoolantCodes{
+		CoolantAir:     {On: 73, Off: 74},
+		CoolantSpindle: {On: 88, Off: 89},
+	}
+}
+
+// Returns the name of a coolant channel, such as "air".
+func CoolantName(channel int) string {
+	if name, ok := coolantNames[channel]; ok {
+		return name
+	}
+	return fmt.Sprintf("channel %d", channel)
+}
+
+// Returns the names of the channels of a set, such as "air, vacuum", or
+// "none" for the empty set.
+func CoolantSetName(set int) string {
+	var names []string
+	for _, channel := range CoolantChannels {
+		if set&channel != 0 {
+			names = append(names, CoolantName(channel))
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// Parses a coolant channel by name, and its M codes, such as "air" and
+// "M73,M74".
+func ParseCoolantCodes(name, codes string) (int, CoolantCodes, error) {
+	channel := -1
+	for c, n := range coolantNames {
+		if n == strings.ToLower(strings.TrimSpace(name)) {
+			channel = c
+		}
+	}
+	if channel == -1 {
+		return 0, CoolantCodes{}, errors.New(fmt.Sprintf("Unknown coolant channel: %s", name))
+	}
+
+	parts := strings.Split(codes, ",")
+	if len(parts) != 2 {
+		return 0, CoolantCodes{}, errors.New(fmt.Sprintf("Expected on and off codes for %s coolant, got: %s", name, codes))
+	}
+	var m [2]float64
+	for idx, p := range parts {
+		p = strings.ToUpper(strings.TrimSpace(p))
+		if len(p) < 2 || p[0] != 'M' {
+			return 0, CoolantCodes{}, errors.New(fmt.Sprintf("Invalid M code: %s", p))
+		}
+		n, err := strconv.ParseFloat(p[1:], 64)
+		if err != nil {
+			return 0, CoolantCodes{}, errors.New(fmt.Sprintf("Invalid M code: %s", p))
+		}
+		m[idx] = n
+	}
+	return channel, CoolantCodes{On: m[0], Off: m[1]}, nil
+}
+
+// Turns coolant channels on and off for the M codes of the block found in
+// CoolantCodes.
+func (vm *Machine) setCoolantChannels(stmt *gcode.Block) {
+	if len(vm.CoolantCodes) == 0 {
+		return
+	}
+	for _, n := range append([]gcode.Node(nil), stmt.Nodes...) {
+		w, ok := n.(*gcode.Word)
+		if !ok || w.Address != 'M' {
+			continue
+		}
+		for _, channel := range CoolantChannels {
+			codes, ok := vm.CoolantCodes[channel]
+			if !ok {
+				continue
+			}
+			switch w.Command {
+			case codes.On:
+				vm.State.Coolant |= channel
+			case codes.Off:
+				vm.State.Coolant &^= channel
+			default:
+				continue
+			}
+			stmt.Remove(w)
+			break
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package vm
 
 import "github.com/kennylevinsen/gocnc/vector"
+import "fmt"
+import "math"
 
 type CoordinateSystem struct {
 	coordinateSystems       []vector.Vector
+	rotations               []float64
 	offset                  vector.Vector
 	offsetEnabled           bool
 	currentCoordinateSystem int
@@ -14,6 +17,9 @@ func (c *CoordinateSystem) expandIfNecessary(s int) {
 	for len(c.coordinateSystems) <= s {
 		c.coordinateSystems = append(c.coordinateSystems, vector.Vector{})
 	}
+	for len(c.rotations) <= s {
+		c.rotations = append(c.rotations, 0)
+	}
 }
 
 func (c *CoordinateSystem) SelectCoordinateSystem(s int) {
@@ -26,6 +32,43 @@ func (c *CoordinateSystem) SetCoordinateSystem(x, y, z float64, s int) {
 	c.coordinateSystems[s] = vector.Vector{x, y, z}
 }
 
+// Sets the rotation of a coordinate system about its origin in the XY plane,
+// in degrees counterclockwise.
+func (c *CoordinateSystem) SetRotation(r float64, s int) {
+	c.expandIfNecessary(s)
+	c.rotations[s] = r
+}
+
+// Returns the rotation of the coordinate system in use, in degrees.
+func (c *CoordinateSystem) GetRotation() float64 {
+	c.expandIfNecessary(c.currentCoordinateSystem)
+	if c.override {
+		return 0
+	}
+	return c.rotations[c.currentCoordinateSystem]
+}
+
+// Rotates x, y by r degrees counterclockwise.
+func rotateXY(x, y, r float64) (float64, float64) {
+	if r == 0 {
+		return x, y
+	}
+	sin, cos := math.Sincos(r * math.Pi / 180)
+	return x*cos - y*sin, x*sin + y*cos
+}
+
+// Rotates a distance in program coordinates into machine coordinates.
+func (c *CoordinateSystem) RotateXY(x, y float64) (float64, float64) {
+	return rotateXY(x, y, c.GetRotation())
+}
+
+// Converts a position in machine coordinates to program coordinates.
+func (c *CoordinateSystem) ToProgram(v vector.Vector) vector.Vector {
+	v = v.Diff(c.GetCoordinateSystem())
+	v.X, v.Y = rotateXY(v.X, v.Y, -c.GetRotation())
+	return v
+}
+
 func (c *CoordinateSystem) SetOffset(x, y, z float64) {
 	c.offset.X = x
 	c.offset.Y = y
@@ -62,12 +105,8 @@ func (c *CoordinateSystem) ApplyCoordinateSystem(x, y, z float64) (float64, floa
 		return x, y, z
 	}
 
-	c.expandIfNecessary(c.currentCoordinateSystem)
-	v := c.coordinateSystems[c.currentCoordinateSystem]
-
-	if c.offsetEnabled {
-		v = v.Sum(c.offset)
-	}
+	v := c.GetCoordinateSystem()
+	x, y = c.RotateXY(x, y)
 
 	x += v.X
 	y += v.Y
@@ -91,3 +130,48 @@ func (c *CoordinateSystem) OverrideActive() bool {
 func (c *CoordinateSystem) OffsetActive() bool {
 	return c.offsetEnabled
 }
+
+// The offset and rotation of a work coordinate system.
+type WorkOffset struct {
+	Name     string // G54 to G59.3
+	Offset   vector.Vector
+	Rotation float64 // Degrees counterclockwise in the XY plane
+}
+
+// The work coordinate systems of a machine, and the G92 offset applied on
+// top of the active one.
+type Offsets struct {
+	Systems       []WorkOffset // G54 to G59.3, in order
+	Offset        vector.Vector
+	OffsetEnabled bool
+	Active        int // 1 for G54 to 9 for G59.3, 0 if none was selected
+}
+
+// Returns the name of a coordinate system, such as G54 or G59.1.
+func coordinateSystemName(s int) string {
+	if s <= 6 {
+		return fmt.Sprintf("G%d", 53+s)
+	}
+	return fmt.Sprintf("G59.%d", s-6)
+}
+
+// Returns the coordinate systems G54 to G59.3, the G92 offset and the active
+// coordinate system.
+func (vm *Machine) CoordinateSystems() Offsets {
+	c := &vm.CoordinateSystem
+	c.expandIfNecessary(9)
+	o := Offsets{
+		Systems:       make([]WorkOffset, 0, 9),
+		Offset:        c.offset,
+		OffsetEnabled: c.offsetEnabled,
+		Active:        c.currentCoordinateSystem,
+	}
+	for s := 1; s <= 9; s++ {
+		o.Systems = append(o.Systems, WorkOffset{
+			Name:     coordinateSystemName(s),
+			Offset:   c.coordinateSystems[s],
+			Rotation: c.rotations[s],
+		})
+	}
+	return o
+}
@@ -0,0 +1,41 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+
+//
+// Canned cycle retract modes
+//
+// Canned cycles move to the hole at the height they start from, rapid down
+// to the R plane, cut, and retract. With G98, they retract to the height the
+// cycle started from, or the R plane if that is higher, so the tool clears
+// clamps between holes. With G99, they retract to the R plane, which is
+// faster on flat stock.
+//
+
+// Constants for canned cycle retract modes
+const (
+	RetractModeInitial = iota // G98
+	RetractModeRPlane  = iota // G99
+)
+
+func (vm *Machine) setRetractMode(stmt *gcode.Block) {
+	if w, err := stmt.GetModalGroup("cannedCyclesModeGroup"); err == nil {
+		if w != nil {
+			if w.Address != 'G' {
+				unknownCommand("cannedCyclesModeGroup", w)
+			}
+
+			switch w.Command {
+			case 98:
+				vm.RetractMode = RetractModeInitial
+			case 99:
+				vm.RetractMode = RetractModeRPlane
+			default:
+				unknownCommand("cannedCyclesModeGroup", w)
+			}
+			stmt.Remove(w)
+		}
+	} else {
+		propagate(err)
+	}
+}
@@ -0,0 +1,181 @@
+package vm
+
+import "math"
+
+// Constants for the side of a contour the tool cuts on
+const (
+	SideUnknown = iota
+	SideOutside = iota // Around the outside, as for a profile
+	SideInside  = iota // Inside, as for a pocket or hole
+)
+
+// Constants for milling direction
+const (
+	CutDirectionUnknown      = iota
+	CutDirectionClimb        = iota
+	CutDirectionConventional = iota
+)
+
+// A closed loop of cutting moves at a single depth.
+type Contour struct {
+	Operation   int  // Index of the operation, as in Operations
+	Start       int  // Index of the first move, which starts at the position before it
+	End         int  // Index after the last move, which ends where the first move started
+	Clockwise   bool // Whether the loop runs clockwise, seen from above
+	Compensated bool // Whether the side is given by cutter compensation
+	Side        int
+	Direction   int
+}
+
+// Returns the area enclosed by the moves of the loop from start to end,
+// positive if it runs counter-clockwise. Arc moves are included with the
+// area between their chord and the arc.
+func (vm *Machine) loopArea(start, end int) (area float64) {
+	for idx := start; idx < end; idx++ {
+		from, to := vm.Positions[idx-1], vm.Positions[idx]
+		area += (from.X*to.Y - to.X*from.Y) / 2
+		if to.State.MoveMode != MoveModeCWArc && to.State.MoveMode != MoveModeCCWArc {
+			continue
+		}
+		_, angle, radius := arcAngles(from, to)
+		if angle == 0 && vm.SameXY(from.Vector(), to.Vector()) {
+			// Full circle
+			angle = 2 * math.Pi
+			if to.State.MoveMode == MoveModeCWArc {
+				angle = -angle
+			}
+		}
+		a := math.Abs(angle)
+		area += math.Copysign(radius*radius*(a-math.Sin(a))/2, angle)
+	}
+	return area
+}
+
+// Finds the closed loops at a single depth in each operation, and determines
+// their milling direction. The side of the loop the tool cuts on is taken
+// from cutter compensation where the loop is compensated, and from side,
+// which returns SideOutside, SideInside or SideUnknown for an operation,
+// otherwise. Side may be nil. The direction is unknown where the side is, or
+// the spindle is not running.
+//
+// Climb milling has the tool on the left of the material with the spindle
+// running clockwise, as with G41, and on the right with it running
+// counter-clockwise.
+func (vm *Machine) Contours(side func(int, Operation) int) []Contour {
+	var contours []Contour
+	for opIdx, op := range vm.Operations() {
+		start := -1
+		for idx := op.Start; idx <= op.End; idx++ {
+			flat := false
+			if idx < op.End && idx > 0 {
+				mode := vm.Positions[idx].State.MoveMode
+				flat = (mode == MoveModeLinear || mode == MoveModeCWArc || mode == MoveModeCCWArc) &&
+					vm.Equal(vm.Positions[idx].Z, vm.Positions[idx-1].Z)
+			}
+			if flat && start == -1 {
+				start = idx
+			}
+			if flat || start == -1 {
+				continue
+			}
+
+			end := idx
+			c, ok := vm.contour(opIdx, op, start, end, side)
+			if ok {
+				contours = append(contours, c)
+			}
+			start = -1
+		}
+	}
+	return contours
+}
+
+// Returns the contour of the run of moves from start to end, if they form a
+// closed loop around an area.
+func (vm *Machine) contour(opIdx int, op Operation, start, end int, side func(int, Operation) int) (Contour, bool) {
+	if end-start < 2 || !vm.SameXY(vm.Positions[start-1].Vector(), vm.Positions[end-1].Vector()) {
+		return Contour{}, false
+	}
+	area := vm.loopArea(start, end)
+	if vm.Equal(area, 0) {
+		return Contour{}, false
+	}
+
+	c := Contour{Operation: opIdx, Start: start, End: end, Clockwise: area < 0}
+	state := vm.Positions[start].State
+
+	// Whether the tool is on the left of the path
+	var left bool
+	switch state.CutterCompensation {
+	case CutCompModeOuter:
+		c.Compensated, left = true, true
+	case CutCompModeInner:
+		c.Compensated, left = true, false
+	default:
+		if side != nil {
+			c.Side = side(opIdx, op)
+		}
+		switch c.Side {
+		case SideOutside:
+			left = c.Clockwise
+		case SideInside:
+			left = !c.Clockwise
+		default:
+			return c, true
+		}
+	}
+
+	if left == c.Clockwise {
+		c.Side = SideOutside
+	} else {
+		c.Side = SideInside
+	}
+	if !state.SpindleEnabled {
+		return c, true
+	}
+	if left == state.SpindleClockwise {
+		c.Direction = CutDirectionClimb
+	} else {
+		c.Direction = CutDirectionConventional
+	}
+	return c, true
+}
+
+// Reverses the direction the loop of the contour is cut in, keeping where it
+// starts. Each move keeps its state, with arcs turned the other way.
+func (vm *Machine) ReverseContour(c Contour) {
+	loop := make([]Position, 0, c.End-c.Start)
+	for idx := c.End - 1; idx >= c.Start; idx-- {
+		pos := vm.Positions[idx]
+		prev := vm.Positions[idx-1]
+		pos.X, pos.Y, pos.Z = prev.X, prev.Y, prev.Z
+		switch pos.State.MoveMode {
+		case MoveModeCWArc:
+			pos.State.MoveMode = MoveModeCCWArc
+		case MoveModeCCWArc:
+			pos.State.MoveMode = MoveModeCWArc
+		}
+		loop = append(loop, pos)
+	}
+	copy(vm.Positions[c.Start:c.End], loop)
+}
+
+// Reverses the contours that are known to be cut in the other direction,
+// using side as for Contours. Contours cut with cutter compensation are left
+// alone, as reversing them needs the compensation and its lead-in changed.
+// Returns the number of contours reversed, and the number left alone due to
+// cutter compensation.
+func (vm *Machine) SetCutDirection(direction int, side func(int, Operation) int) (reversed, compensated int) {
+	for _, c := range vm.Contours(side) {
+		if c.Direction == CutDirectionUnknown || c.Direction == direction {
+			continue
+		}
+		if c.Compensated {
+			compensated++
+			continue
+		}
+		vm.ReverseContour(c)
+		reversed++
+	}
+	return reversed, compensated
+}
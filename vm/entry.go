@@ -0,0 +1,94 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+//
+// Entries
+//
+// Plunging straight into the stock loads an end mill along its axis, which
+// many cannot cut with. Entries instead descend gradually, either back and
+// forth along the move that follows them, or in a helix beside it. Entries
+// made by Resume and SelectOperations, and thereby SplitByTool, and by the
+// path grouping and ordering optimizations, are made this way if EntryAngle
+// is set, and optimize.OptRampEntry uses the same entries for the plunges of
+// a program.
+//
+
+// The shortest move to ramp along, rather than entering helically (mm)
+const minRampLength = 1
+
+// Returns the moves entering the stock from top straight above pos down to
+// pos, descending at most slope (height over length). The moves go back and
+// forth along next, the move following pos, if it is a linear move at the
+// depth of pos and at least 1mm long. Otherwise, they make half turns around
+// a center at radius beside pos, if radius is above 0. Returns nil if neither
+// is possible. The moves have the state of pos, including its feedrate.
+func (vm *Machine) RampEntry(pos, next Position, top, slope, radius float64) []Position {
+	depth := top - pos.Z
+	dir := vector.Vector{next.X - pos.X, next.Y - pos.Y, 0}
+	length := dir.Norm()
+
+	var entry []Position
+	if next.State.MoveMode == MoveModeLinear && vm.Equal(next.Z, pos.Z) && length >= minRampLength {
+		// Back and forth along the following move, an even number of times
+		legs := int(math.Ceil(depth / slope / length))
+		legs += legs % 2
+		leg := dir.Multiply(depth / slope / float64(legs) / length)
+		for k := 1; k <= legs; k++ {
+			p := pos
+			if k%2 == 1 {
+				p.X, p.Y = pos.X+leg.X, pos.Y+leg.Y
+			}
+			p.Z = top - depth*float64(k)/float64(legs)
+			entry = append(entry, p)
+		}
+	} else if radius > 0 {
+		// Half turns around a center beside the plunge, an even number of times
+		turns := int(math.Ceil(depth / (math.Pi * radius * slope)))
+		turns += turns % 2
+		for k := 1; k <= turns; k++ {
+			p := pos
+			p.State.MoveMode = MoveModeCCWArc
+			p.Center = vector.Vector{pos.X + radius, pos.Y, 0}
+			if k%2 == 1 {
+				p.X = pos.X + 2*radius
+			}
+			p.Z = top - depth*float64(k)/float64(turns)
+			entry = append(entry, p)
+		}
+	}
+	return entry
+}
+
+// Returns the radius of helical entries with the tool of a state: half of
+// EntryDiameter if set, or a quarter of the diameter of the tool, which is 0
+// if the tool is unknown.
+func (vm *Machine) entryRadius(state State) float64 {
+	if vm.EntryDiameter > 0 {
+		return vm.EntryDiameter / 2
+	}
+	tool, _ := vm.GetTool(state.ToolIndex)
+	return tool.Diameter / 4
+}
+
+// Returns the moves from safety height down to approach, followed by next,
+// with the state of approach, ramping into the stock from StockTop if
+// EntryAngle is set. Returns nil to feed straight down instead.
+func (vm *Machine) EntryRamp(approach, next Position, safetyHeight float64) []Position {
+	slope := math.Tan(vm.EntryAngle * math.Pi / 180)
+	if slope <= 0 || math.IsInf(slope, 0) || approach.Z >= vm.StockTop {
+		return nil
+	}
+	top := math.Min(safetyHeight, vm.StockTop)
+	entry := vm.RampEntry(approach, next, top, slope, vm.entryRadius(approach.State))
+	if entry == nil {
+		return nil
+	}
+	if safetyHeight > top {
+		p := approach
+		p.Z = top
+		entry = append([]Position{p}, entry...)
+	}
+	return entry
+}
@@ -0,0 +1,44 @@
+package vm
+
+// A move leaving the travel of the machine.
+type EnvelopeViolation struct {
+	Index int    // Index of the position ending the move
+	Line  int    // Line of the block that made the move, 0 if unknown
+	Axes  string // Axes the move leaves the travel in, such as "XZ"
+}
+
+// Checks all moves against the travel of the machine, given as a box in the
+// coordinates of the positions. Arcs are checked along their full extent.
+// The tool itself is not taken into account, as the travel is that of the
+// spindle. Blocks are flagged once, like arcs made of several positions.
+// The first position is where the VM starts, rather than a move,
+// so the first move is only checked at its end.
+func (vm *Machine) CheckEnvelope(envelope Box) []EnvelopeViolation {
+	var (
+		res      []EnvelopeViolation
+		lastLine int
+	)
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		b := Box{Min: pos.Vector(), Max: pos.Vector()}
+		if idx > 1 {
+			b = moveBounds(vm.Positions[idx-1], vm.Positions[idx])
+		}
+
+		var axes string
+		if b.Min.X < envelope.Min.X || b.Max.X > envelope.Max.X {
+			axes += "X"
+		}
+		if b.Min.Y < envelope.Min.Y || b.Max.Y > envelope.Max.Y {
+			axes += "Y"
+		}
+		if b.Min.Z < envelope.Min.Z || b.Max.Z > envelope.Max.Z {
+			axes += "Z"
+		}
+		if axes != "" && (pos.Line == 0 || pos.Line != lastLine) {
+			lastLine = pos.Line
+			res = append(res, EnvelopeViolation{Index: idx, Line: pos.Line, Axes: axes})
+		}
+	}
+	return res
+}
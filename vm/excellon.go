@@ -0,0 +1,265 @@
+package vm
+
+import "bufio"
+import "io"
+import "math"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// Settings for drilling imported holes. Lengths are in mm.
+type DrillSettings struct {
+	SafetyHeight float64 // Height to move between holes at
+	Depth        float64 // Depth to drill to (negative)
+	Feedrate     float64 // Plunge feedrate (mm/min)
+	SpindleSpeed float64 // Spindle speed (RPM, <= 0 to leave the spindle off)
+}
+
+// Excellon coordinate format
+type excellonFormat struct {
+	imperial      bool
+	leadingZeros  bool // Leading zeros are kept, and trailing zeros suppressed
+	integerDigits int
+	decimalDigits int
+	incremental   bool
+}
+
+// Parses a coordinate, in mm.
+func (f *excellonFormat) coordinate(s string) (float64, error) {
+	var v float64
+	if strings.ContainsRune(s, '.') {
+		var err error
+		if v, err = strconv.ParseFloat(s, 64); err != nil {
+			return 0, err
+		}
+	} else {
+		sign := 1.0
+		if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+			if s[0] == '-' {
+				sign = -1
+			}
+			s = s[1:]
+		}
+		if f.leadingZeros {
+			// Restore the suppressed trailing zeros
+			for len(s) < f.integerDigits+f.decimalDigits {
+				s += "0"
+			}
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		v = sign * float64(i) / math.Pow(10, float64(f.decimalDigits))
+	}
+
+	if f.imperial {
+		v *= 25.4
+	}
+	return v, nil
+}
+
+// Sets the units, and the default format for them.
+func (f *excellonFormat) setUnits(imperial bool) {
+	f.imperial = imperial
+	if imperial {
+		f.integerDigits, f.decimalDigits = 2, 4
+	} else {
+		f.integerDigits, f.decimalDigits = 3, 3
+	}
+}
+
+// Parses a unit declaration, such as "METRIC,LZ,000.000" or "INCH,TZ".
+func (f *excellonFormat) units(line string) {
+	parts := strings.Split(line, ",")
+	f.setUnits(parts[0] == "INCH")
+	for _, p := range parts[1:] {
+		switch {
+		case p == "LZ":
+			f.leadingZeros = true
+		case p == "TZ":
+			f.leadingZeros = false
+		case strings.Trim(p, "0.") == "" && strings.ContainsRune(p, '.'):
+			dot := strings.IndexRune(p, '.')
+			f.integerDigits, f.decimalDigits = dot, len(p)-dot-1
+		}
+	}
+}
+
+// Splits a line into its words, such as "T1C0.8" into "T1" and "C0.8".
+func excellonWords(line string) []string {
+	var words []string
+	for idx := 0; idx < len(line); {
+		end := idx + 1
+		for end < len(line) && (line[end] < 'A' || line[end] > 'Z') {
+			end++
+		}
+		words = append(words, line[idx:end])
+		idx = end
+	}
+	return words
+}
+
+// Imports an Excellon drill file, drilling every hole with a plunge and a
+// retract to safety height. Each drill is a tool, changed to on first use,
+// and added to the tool table with its diameter unless already defined.
+//
+// Only drilling is supported. Routing and repeat commands are rejected.
+func (vm *Machine) ImportExcellon(r io.Reader, s DrillSettings) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	var f excellonFormat
+	f.setUnits(false)
+
+	header := false
+	tool := -1
+	x, y := vm.curPos().X, vm.curPos().Y
+
+	scanner := bufio.NewScanner(r)
+lines:
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		vm.line = lineNum
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if idx := strings.IndexRune(line, ';'); idx != -1 {
+			line = strings.TrimSpace(line[:idx])
+		}
+
+		fail := func(format string, args ...interface{}) error {
+			return errors.New(fmt.Sprintf("line %d: %s", lineNum, fmt.Sprintf(format, args...)))
+		}
+
+		switch {
+		case line == "":
+			continue
+		case line == "M48":
+			header = true
+			continue
+		case line == "%" || line == "M95":
+			header = false
+			continue
+		case line == "M30" || line == "M00":
+			break lines
+		case strings.HasPrefix(line, "METRIC") || strings.HasPrefix(line, "INCH"):
+			f.units(line)
+			continue
+		case line == "M71":
+			f.setUnits(false)
+			continue
+		case line == "M72":
+			f.setUnits(true)
+			continue
+		case line == "ICI" || line == "ICI,ON" || line == "G91":
+			f.incremental = true
+			continue
+		case line == "ICI,OFF" || line == "G90":
+			f.incremental = false
+			continue
+		case line == "G05" || line == "G5":
+			// Drill mode is the only mode supported
+			continue
+		case strings.HasPrefix(line, "G00") || strings.HasPrefix(line, "G01") || line == "M15" || line == "M16":
+			return fail("Routing is not supported: %s", line)
+		case line[0] == 'R':
+			return fail("Repeat commands are not supported: %s", line)
+		}
+
+		words := excellonWords(line)
+		switch words[0][0] {
+		case 'T':
+			t, err := strconv.Atoi(words[0][1:])
+			if err != nil {
+				return fail("Invalid tool: %s", line)
+			}
+			for _, w := range words[1:] {
+				if w[0] != 'C' {
+					continue
+				}
+				d, err := strconv.ParseFloat(w[1:], 64)
+				if err != nil {
+					return fail("Invalid tool diameter: %s", line)
+				}
+				if f.imperial {
+					d *= 25.4
+				}
+				if _, ok := vm.GetTool(t); !ok {
+					vm.SetTool(t, Tool{Diameter: d})
+				}
+			}
+			if !header {
+				tool = t
+			}
+		case 'X', 'Y':
+			if header {
+				continue
+			}
+			if tool <= 0 {
+				return fail("Hole without a selected tool: %s", line)
+			}
+			nx, ny := x, y
+			for _, w := range words {
+				v, err := f.coordinate(w[1:])
+				if err != nil {
+					return fail("Invalid coordinate: %s", line)
+				}
+				switch w[0] {
+				case 'X':
+					if f.incremental {
+						nx += v
+					} else {
+						nx = v
+					}
+				case 'Y':
+					if f.incremental {
+						ny += v
+					} else {
+						ny = v
+					}
+				}
+			}
+			x, y = nx, ny
+			vm.drill(x, y, tool, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Retract and stop the spindle
+	cur := vm.curPos()
+	vm.State.MoveMode = MoveModeRapid
+	vm.move(cur.X, cur.Y, s.SafetyHeight)
+	vm.State.SpindleEnabled = false
+	vm.finalize()
+	return nil
+}
+
+// Drills a hole, changing tool first if necessary.
+func (vm *Machine) drill(x, y float64, tool int, s DrillSettings) {
+	cur := vm.curPos()
+	vm.State.MoveMode = MoveModeRapid
+	if cur.Z != s.SafetyHeight {
+		vm.move(cur.X, cur.Y, s.SafetyHeight)
+	}
+
+	if vm.State.ToolIndex != tool {
+		vm.State.NextToolIndex = tool
+		vm.State.ToolIndex = tool
+	}
+	if s.SpindleSpeed > 0 {
+		vm.State.SpindleEnabled = true
+		vm.State.SpindleClockwise = true
+		vm.State.SpindleSpeed = s.SpindleSpeed
+	}
+
+	vm.move(x, y, s.SafetyHeight)
+	vm.State.MoveMode = MoveModeLinear
+	vm.State.Feedrate = s.Feedrate
+	vm.move(x, y, s.Depth)
+	vm.State.MoveMode = MoveModeRapid
+	vm.move(x, y, s.SafetyHeight)
+}
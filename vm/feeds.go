@@ -0,0 +1,106 @@
+package vm
+
+import "math"
+import "fmt"
+
+// Recommended cutting parameters of a material, for carbide tools.
+type Material struct {
+	ChiploadRatio float64 // Recommended feed per tooth as a fraction of the tool diameter
+	SurfaceSpeed  float64 // Maximum recommended surface speed (m/min)
+}
+
+// Rough recommendations for common materials. These are only meant to catch
+// feeds and speeds that are far off, such as from unit errors.
+var Materials = map[string]Material{
+	"wood":      {ChiploadRatio: 0.04, SurfaceSpeed: 600},
+	"mdf":       {ChiploadRatio: 0.035, SurfaceSpeed: 500},
+	"plastic":   {ChiploadRatio: 0.02, SurfaceSpeed: 300},
+	"aluminium": {ChiploadRatio: 0.008, SurfaceSpeed: 300},
+	"brass":     {ChiploadRatio: 0.006, SurfaceSpeed: 150},
+	"steel":     {ChiploadRatio: 0.004, SurfaceSpeed: 80},
+}
+
+// A run of moves with a feed or speed far from the recommended.
+type FeedWarning struct {
+	Index int // Index of the first position of the run
+	Count int // Number of positions in the run
+	Line  int // Line of the block that made the first move, 0 if unknown
+	Tool  int
+
+	Chipload            float64 // Feed per tooth (mm)
+	RecommendedChipload float64 // mm
+	Reason              string
+}
+
+// Checks the chipload of every cutting move against the recommended for the
+// material, warning about those off by more than factor in either direction,
+// or above it for plunges. The surface speed is checked against the maximum
+// recommended in the same way. Consecutive moves with the same tool, feed and
+// speed are reported as a single run.
+//
+// Moves with tools missing from the tool table, or missing a diameter or
+// flute count, are not checked. Neither are moves with the spindle stopped or
+// in inverse time feed mode.
+func (vm *Machine) CheckFeeds(m Material, factor float64) []FeedWarning {
+	var res []FeedWarning
+	var last *State
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		s := pos.State
+		if s.MoveMode != MoveModeLinear {
+			last = nil
+			continue
+		}
+
+		// Extend the previous run
+		if last != nil && last.ToolIndex == s.ToolIndex && last.Feedrate == s.Feedrate &&
+			last.SpindleSpeed == s.SpindleSpeed && last.FeedMode == s.FeedMode {
+			res[len(res)-1].Count++
+			continue
+		}
+		last = nil
+
+		tool, ok := vm.GetTool(s.ToolIndex)
+		if !ok || tool.Diameter <= 0 || tool.Flutes <= 0 || !s.SpindleEnabled || s.SpindleSpeed <= 0 {
+			continue
+		}
+
+		var chipload float64
+		switch s.FeedMode {
+		case FeedModeInvTime:
+			continue
+		case FeedModeUnitsRev:
+			chipload = s.Feedrate / float64(tool.Flutes)
+		default:
+			chipload = s.Feedrate / (s.SpindleSpeed * float64(tool.Flutes))
+		}
+
+		w := FeedWarning{
+			Index:               idx,
+			Count:               1,
+			Line:                pos.Line,
+			Tool:                s.ToolIndex,
+			Chipload:            chipload,
+			RecommendedChipload: m.ChiploadRatio * tool.Diameter,
+		}
+		surfaceSpeed := math.Pi * tool.Diameter * s.SpindleSpeed / 1000
+
+		// Plunges are usually fed slower, so only check that they are not too fast
+		prev := vm.Positions[idx-1]
+		plunge := pos.X == prev.X && pos.Y == prev.Y
+
+		switch {
+		case chipload > w.RecommendedChipload*factor:
+			w.Reason = fmt.Sprintf("feed per tooth %.4f mm is more than %g times the recommended %.4f mm", chipload, factor, w.RecommendedChipload)
+		case chipload < w.RecommendedChipload/factor && !plunge:
+			w.Reason = fmt.Sprintf("feed per tooth %.4f mm is less than 1/%g of the recommended %.4f mm", chipload, factor, w.RecommendedChipload)
+		case m.SurfaceSpeed > 0 && surfaceSpeed > m.SurfaceSpeed*factor:
+			w.Reason = fmt.Sprintf("surface speed %.0f m/min is more than %g times the recommended %.0f m/min", surfaceSpeed, factor, m.SurfaceSpeed)
+		default:
+			continue
+		}
+		res = append(res, w)
+		last = &vm.Positions[idx].State
+	}
+	return res
+}
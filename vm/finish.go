@@ -0,0 +1,146 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+import "sort"
+import "fmt"
+
+// Surface finish estimate for a single operation.
+type FinishEstimate struct {
+	Operation      Operation
+	Feedrate       float64 // Dominant cutting feedrate (mm/min)
+	SpindleSpeed   float64 // RPM
+	FeedPerTooth   float64 // mm, 0 if unknown
+	Stepover       float64 // mm, 0 if it could not be inferred
+	ScallopHeight  float64 // mm, from stepover
+	FeedMarkHeight float64 // mm, from feed per tooth
+	Poor           bool
+	Reasons        []string
+}
+
+// Below this chipload, the tool rubs rather than cuts
+const minFeedPerTooth = 0.005
+
+// Estimates surface finish for each operation, flagging operations expected
+// to deviate more than maxDeviation (mm) from the intended surface, or that
+// rub rather than cut.
+//
+// Stepover is inferred from adjacent parallel passes, such as in raster
+// surfacing. Scallop height is calculated for ball nose tools, where the
+// stepover leaves cusps. Feed marks are calculated from feed per tooth.
+// Values that require tool information are left at 0 for tools missing from
+// the tool table.
+func (vm *Machine) EstimateFinish(maxDeviation float64) []FinishEstimate {
+	var estimates []FinishEstimate
+	for _, op := range vm.Operations() {
+		est := FinishEstimate{Operation: op}
+		est.Feedrate, est.SpindleSpeed = vm.dominantFeed(op)
+		est.Stepover = vm.inferStepover(op)
+
+		tool, ok := vm.GetTool(op.Tool)
+		if ok && tool.Diameter > 0 {
+			r := tool.Diameter / 2
+
+			if tool.BallNose && est.Stepover > 0 && est.Stepover < tool.Diameter {
+				est.ScallopHeight = r - math.Sqrt(r*r-math.Pow(est.Stepover/2, 2))
+			}
+
+			if tool.Flutes > 0 && est.SpindleSpeed > 0 && est.Feedrate > 0 {
+				est.FeedPerTooth = est.Feedrate / (est.SpindleSpeed * float64(tool.Flutes))
+				est.FeedMarkHeight = est.FeedPerTooth * est.FeedPerTooth / (8 * r)
+			}
+		}
+
+		if est.ScallopHeight > maxDeviation {
+			est.Reasons = append(est.Reasons, fmt.Sprintf("scallop height %.4f mm exceeds %.4f mm", est.ScallopHeight, maxDeviation))
+		}
+		if est.FeedMarkHeight > maxDeviation {
+			est.Reasons = append(est.Reasons, fmt.Sprintf("feed marks of %.4f mm exceed %.4f mm", est.FeedMarkHeight, maxDeviation))
+		}
+		if est.FeedPerTooth > 0 && est.FeedPerTooth < minFeedPerTooth {
+			est.Reasons = append(est.Reasons, fmt.Sprintf("feed per tooth %.4f mm is likely to rub", est.FeedPerTooth))
+		}
+		est.Poor = len(est.Reasons) > 0
+
+		estimates = append(estimates, est)
+	}
+	return estimates
+}
+
+// Finds the feedrate and spindle speed covering the most distance in the operation.
+func (vm *Machine) dominantFeed(op Operation) (float64, float64) {
+	type key struct{ feed, speed float64 }
+	dist := make(map[key]float64)
+
+	for idx := op.Start; idx < op.End; idx++ {
+		if idx == 0 {
+			continue
+		}
+		pos := vm.Positions[idx]
+		if pos.State.MoveMode != MoveModeLinear {
+			continue
+		}
+		k := key{pos.State.Feedrate, pos.State.SpindleSpeed}
+		dist[k] += pos.Vector().Diff(vm.Positions[idx-1].Vector()).Norm()
+	}
+
+	var best key
+	var bestDist float64
+	for k, d := range dist {
+		if d > bestDist || (d == bestDist && k.feed > best.feed) {
+			best, bestDist = k, d
+		}
+	}
+	return best.feed, best.speed
+}
+
+// Infers stepover as the median distance between consecutive parallel passes.
+// Passes shorter than a quarter of the longest are considered connecting moves.
+func (vm *Machine) inferStepover(op Operation) float64 {
+	type pass struct {
+		start, dir vector.Vector
+		length     float64
+	}
+	var passes []pass
+	var longest float64
+
+	for idx := op.Start; idx < op.End; idx++ {
+		if idx == 0 || vm.Positions[idx].State.MoveMode != MoveModeLinear {
+			continue
+		}
+		a, b := vm.Positions[idx-1].Vector(), vm.Positions[idx].Vector()
+		d := b.Diff(a)
+		l := d.Norm()
+		if l == 0 {
+			continue
+		}
+		passes = append(passes, pass{a, d.Divide(l), l})
+		if l > longest {
+			longest = l
+		}
+	}
+
+	var distances []float64
+	var last *pass
+	for idx := range passes {
+		p := &passes[idx]
+		if p.length < longest/4 {
+			continue
+		}
+		if last != nil && math.Abs(p.dir.Dot(last.dir)) > 0.999 {
+			// Perpendicular distance from the start of this pass to the line of the last
+			rel := p.start.Diff(last.start)
+			along := last.dir.Multiply(rel.Dot(last.dir))
+			if d := rel.Diff(along).Norm(); d > 0 {
+				distances = append(distances, d)
+			}
+		}
+		last = p
+	}
+
+	if len(distances) == 0 {
+		return 0
+	}
+	sort.Float64s(distances)
+	return distances[len(distances)/2]
+}
@@ -0,0 +1,195 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+import "errors"
+import "fmt"
+
+// Returns the box grown to include a point.
+func (b Box) Extend(v vector.Vector) Box {
+	b.Min = vector.Vector{math.Min(b.Min.X, v.X), math.Min(b.Min.Y, v.Y), math.Min(b.Min.Z, v.Z)}
+	b.Max = vector.Vector{math.Max(b.Max.X, v.X), math.Max(b.Max.Y, v.Y), math.Max(b.Max.Z, v.Z)}
+	return b
+}
+
+// Returns the smallest box containing both boxes.
+func (b Box) Union(o Box) Box {
+	return b.Extend(o.Min).Extend(o.Max)
+}
+
+// Returns the bounds of the move from start to pos, including the points
+// where arc moves cross the X and Y axes of their center.
+func moveBounds(start, pos Position) Box {
+	b := Box{Min: start.Vector(), Max: start.Vector()}.Extend(pos.Vector())
+	if pos.State.MoveMode != MoveModeCWArc && pos.State.MoveMode != MoveModeCCWArc {
+		return b
+	}
+
+	theta, angle, radius := arcAngles(start, pos)
+	for q := 0; q < 4; q++ {
+		a := float64(q) * math.Pi / 2
+		var swept float64
+		if angle > 0 {
+			swept = math.Mod(a-theta+4*math.Pi, 2*math.Pi)
+		} else {
+			swept = math.Mod(theta-a+4*math.Pi, 2*math.Pi)
+		}
+		if swept < math.Abs(angle) {
+			b = b.Extend(vector.Vector{pos.Center.X + radius*math.Cos(a), pos.Center.Y + radius*math.Sin(a), pos.Z})
+		}
+	}
+	return b
+}
+
+// Returns the bounds of all positions, including the full extent of arc
+// moves. Unlike Info, the origin is only included if a position is there.
+func (vm *Machine) Bounds() Box {
+	if len(vm.Positions) == 0 {
+		return Box{}
+	}
+	b := Box{Min: vm.Positions[0].Vector(), Max: vm.Positions[0].Vector()}
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		b = b.Union(moveBounds(vm.Positions[idx-1], vm.Positions[idx]))
+	}
+	return b
+}
+
+// Returns the bounds of the cutting moves made with each tool, by tool
+// index, including where each move starts. Rapid moves are not included, so
+// the bounds are those of the material touched by the center of the tool.
+func (vm *Machine) ToolBounds() map[int]Box {
+	bounds := make(map[int]Box)
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		if pos.State.MoveMode == MoveModeRapid || pos.State.MoveMode == MoveModeNone {
+			continue
+		}
+		mb := moveBounds(vm.Positions[idx-1], pos)
+		if b, ok := bounds[pos.State.ToolIndex]; ok {
+			mb = b.Union(mb)
+		}
+		bounds[pos.State.ToolIndex] = mb
+	}
+	return bounds
+}
+
+// Returns the bounds of an operation, including where it is entered from.
+func (vm *Machine) OperationBounds(op Operation) Box {
+	b := Box{Min: vm.Positions[op.Start].Vector(), Max: vm.Positions[op.Start].Vector()}
+	if op.Start > 0 {
+		b = moveBounds(vm.Positions[op.Start-1], vm.Positions[op.Start])
+	}
+	for idx := op.Start + 1; idx < op.End; idx++ {
+		b = b.Union(moveBounds(vm.Positions[idx-1], vm.Positions[idx]))
+	}
+	return b
+}
+
+// The deepest Z reached in each cell of a grid in XY.
+type DepthMap struct {
+	Min        vector.Vector // Corner of the first cell
+	Cell       float64       // Size of a cell
+	Cols, Rows int
+	Depth      []float64 // Deepest Z by cell, row by row, or +Inf where nothing is cut
+}
+
+// Returns the deepest Z reached in the cell containing x, y, and whether
+// anything is cut there.
+func (d DepthMap) At(x, y float64) (float64, bool) {
+	col, row := int(math.Floor((x-d.Min.X)/d.Cell)), int(math.Floor((y-d.Min.Y)/d.Cell))
+	if col < 0 || col >= d.Cols || row < 0 || row >= d.Rows {
+		return math.Inf(1), false
+	}
+	z := d.Depth[row*d.Cols+col]
+	return z, !math.IsInf(z, 1)
+}
+
+// Returns the deepest Z reached by cutting moves in each cell of a grid of
+// the given cell size. Moves are followed in steps of half a cell, and the
+// tool is taken to cover its radius around its center where its diameter is
+// known from the tool table. The cell size must be above 0.
+func (vm *Machine) DepthMap(cell float64) (DepthMap, error) {
+	if !(cell > 0) || math.IsInf(cell, 1) {
+		return DepthMap{}, errors.New(fmt.Sprintf("Invalid depth map cell size: %g", cell))
+	}
+
+	var (
+		bounds Box
+		first  = true
+		radius = make(map[int]float64)
+	)
+	for index, b := range vm.ToolBounds() {
+		if t, ok := vm.GetTool(index); ok {
+			r := t.Diameter / 2
+			radius[index] = r
+			b.Min.X, b.Min.Y, b.Max.X, b.Max.Y = b.Min.X-r, b.Min.Y-r, b.Max.X+r, b.Max.Y+r
+		}
+		if first {
+			bounds, first = b, false
+		} else {
+			bounds = bounds.Union(b)
+		}
+	}
+
+	d := DepthMap{
+		Min:  vector.Vector{bounds.Min.X, bounds.Min.Y, 0},
+		Cell: cell,
+		Cols: int(math.Floor((bounds.Max.X-bounds.Min.X)/cell)) + 1,
+		Rows: int(math.Floor((bounds.Max.Y-bounds.Min.Y)/cell)) + 1,
+	}
+	d.Depth = make([]float64, d.Cols*d.Rows)
+	for idx := range d.Depth {
+		d.Depth[idx] = math.Inf(1)
+	}
+
+	// Marks the cells within r of p
+	mark := func(p vector.Vector, r float64) {
+		c0 := int(math.Floor((p.X - r - d.Min.X) / cell))
+		c1 := int(math.Floor((p.X + r - d.Min.X) / cell))
+		r0 := int(math.Floor((p.Y - r - d.Min.Y) / cell))
+		r1 := int(math.Floor((p.Y + r - d.Min.Y) / cell))
+		for row := r0; row <= r1; row++ {
+			for col := c0; col <= c1; col++ {
+				if col < 0 || col >= d.Cols || row < 0 || row >= d.Rows {
+					continue
+				}
+				// Distance from p to the nearest point of the cell
+				cx := math.Max(d.Min.X+float64(col)*cell, math.Min(p.X, d.Min.X+float64(col+1)*cell))
+				cy := math.Max(d.Min.Y+float64(row)*cell, math.Min(p.Y, d.Min.Y+float64(row+1)*cell))
+				if math.Hypot(cx-p.X, cy-p.Y) > r {
+					continue
+				}
+				if i := row*d.Cols + col; p.Z < d.Depth[i] {
+					d.Depth[i] = p.Z
+				}
+			}
+		}
+	}
+
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		start, pos := vm.Positions[idx-1], vm.Positions[idx]
+		if pos.State.MoveMode == MoveModeRapid || pos.State.MoveMode == MoveModeNone {
+			continue
+		}
+		r := radius[pos.State.ToolIndex]
+
+		points := []vector.Vector{pos.Vector()}
+		if pos.State.MoveMode == MoveModeCWArc || pos.State.MoveMode == MoveModeCCWArc {
+			points = InterpolateArc(start, pos, cell/4)
+		}
+		last := start.Vector()
+		mark(last, r)
+		for _, p := range points {
+			diff := p.Diff(last)
+			steps := int(math.Ceil(math.Hypot(diff.X, diff.Y) / (cell / 2)))
+			for s := 1; s <= steps; s++ {
+				mark(last.Sum(diff.Multiply(float64(s)/float64(steps))), r)
+			}
+			if steps == 0 {
+				mark(p, r)
+			}
+			last = p
+		}
+	}
+	return d, nil
+}
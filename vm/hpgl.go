@@ -0,0 +1,169 @@
+package vm
+
+import "io"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// HPGL plotter units per mm
+const hpglUnitsPerMM = 40
+
+// Settings for imported pen moves. Lengths are in mm.
+type PenSettings struct {
+	UpHeight   float64 // Height to move at with the pen up
+	DownHeight float64 // Height to cut or draw at with the pen down
+	Feedrate   float64 // Feedrate with the pen down (mm/min)
+}
+
+// Splits HPGL into instructions, such as "PU0,0;PD100,0" into "PU0,0" and
+// "PD100,0". Terminators are optional, as a mnemonic starts a new instruction.
+func hpglInstructions(code string) []string {
+	var res []string
+	for idx := 0; idx < len(code); {
+		c := code[idx]
+		if c < 'A' || c > 'Z' || idx+1 >= len(code) || code[idx+1] < 'A' || code[idx+1] > 'Z' {
+			idx++
+			continue
+		}
+
+		// Labels end at ETX, and may contain anything
+		if code[idx:idx+2] == "LB" {
+			end := strings.IndexByte(code[idx:], 0x03)
+			if end == -1 {
+				break
+			}
+			idx += end + 1
+			continue
+		}
+
+		end := idx + 2
+		for end < len(code) && !(code[end] >= 'A' && code[end] <= 'Z') && code[end] != ';' {
+			end++
+		}
+		res = append(res, strings.TrimSpace(code[idx:end]))
+		idx = end
+	}
+	return res
+}
+
+// Parses the coordinate pairs of an instruction, in mm.
+func hpglPoints(params string) ([][2]float64, error) {
+	fields := strings.FieldsFunc(params, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+	if len(fields)%2 != 0 {
+		return nil, errors.New(fmt.Sprintf("Odd number of coordinates: %s", params))
+	}
+
+	var points [][2]float64
+	for idx := 0; idx < len(fields); idx += 2 {
+		x, err := strconv.ParseFloat(fields[idx], 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid coordinate: %s", fields[idx]))
+		}
+		y, err := strconv.ParseFloat(fields[idx+1], 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid coordinate: %s", fields[idx+1]))
+		}
+		points = append(points, [2]float64{x / hpglUnitsPerMM, y / hpglUnitsPerMM})
+	}
+	return points, nil
+}
+
+// Imports HPGL, as used by pen plotters and vinyl cutters. Pen up moves are
+// rapids at the up height, and pen down moves are linear moves at the down
+// height. Selecting a pen (SP) changes to the tool of the same number.
+//
+// Only PU, PD, PA, PR, SP and IN are interpreted. Other instructions, such as
+// labels and line types, are ignored.
+func (vm *Machine) ImportHPGL(r io.Reader, s PenSettings) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	relative := false
+	down := false
+	x, y := vm.curPos().X, vm.curPos().Y
+
+	// Pen up to start
+	vm.State.MoveMode = MoveModeRapid
+	vm.move(x, y, s.UpHeight)
+
+	for _, inst := range hpglInstructions(strings.ToUpper(string(code))) {
+		mnemonic, params := inst[:2], inst[2:]
+		switch mnemonic {
+		case "IN":
+			relative = false
+		case "PA":
+			relative = false
+		case "PR":
+			relative = true
+		case "SP":
+			pen := 0
+			if p := strings.TrimSpace(params); p != "" {
+				if pen, err = strconv.Atoi(p); err != nil {
+					return errors.New(fmt.Sprintf("Invalid pen: %s", inst))
+				}
+			}
+			if pen > 0 && pen != vm.State.ToolIndex {
+				vm.penUp(x, y, s)
+				down = false
+				vm.State.NextToolIndex = pen
+				vm.State.ToolIndex = pen
+			}
+			continue
+		case "PU":
+			if down {
+				vm.penUp(x, y, s)
+				down = false
+			}
+		case "PD":
+			if !down {
+				vm.State.MoveMode = MoveModeLinear
+				vm.State.Feedrate = s.Feedrate
+				vm.move(x, y, s.DownHeight)
+				down = true
+			}
+		default:
+			continue
+		}
+
+		points, err := hpglPoints(params)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", inst, err))
+		}
+		for _, p := range points {
+			if relative {
+				x, y = x+p[0], y+p[1]
+			} else {
+				x, y = p[0], p[1]
+			}
+			if down {
+				vm.move(x, y, s.DownHeight)
+			} else {
+				vm.move(x, y, s.UpHeight)
+			}
+		}
+	}
+
+	vm.penUp(x, y, s)
+	vm.finalize()
+	return nil
+}
+
+// Lifts the pen, leaving the move mode at rapid.
+func (vm *Machine) penUp(x, y float64, s PenSettings) {
+	vm.State.MoveMode = MoveModeRapid
+	if vm.curPos().Z != s.UpHeight {
+		vm.move(x, y, s.UpHeight)
+	}
+}
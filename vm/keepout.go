@@ -0,0 +1,137 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+// Maximum deviation from arc moves when checking them against zones
+const arcCheckDeviation = 0.01
+
+// An axis-aligned box. Lengths are in mm.
+type Box struct {
+	Min, Max vector.Vector
+}
+
+// A move passing through a keep-out zone.
+type KeepOutViolation struct {
+	Index int // Index of the position ending the move
+	Line  int // Line of the block that made the move, 0 if unknown
+	Zone  int // Index of the zone
+}
+
+// Clips the segment p1-p2 to the rectangle of the box in XY, returning
+// whether any of it is inside.
+func clipsRect(p1, p2 vector.Vector, b Box) bool {
+	t0, t1 := 0.0, 1.0
+	d := p2.Diff(p1)
+	edges := [4][2]float64{
+		{-d.X, p1.X - b.Min.X},
+		{d.X, b.Max.X - p1.X},
+		{-d.Y, p1.Y - b.Min.Y},
+		{d.Y, b.Max.Y - p1.Y},
+	}
+	for _, e := range edges {
+		p, q := e[0], e[1]
+		if p == 0 {
+			if q < 0 {
+				return false
+			}
+			continue
+		}
+		t := q / p
+		if p < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+	}
+	return t0 <= t1
+}
+
+// Returns the distance in XY from a point to the rectangle of the box.
+func rectDistance(p vector.Vector, b Box) float64 {
+	dx := math.Max(0, math.Max(b.Min.X-p.X, p.X-b.Max.X))
+	dy := math.Max(0, math.Max(b.Min.Y-p.Y, p.Y-b.Max.Y))
+	return math.Hypot(dx, dy)
+}
+
+// Returns the distance in XY from a point to the segment p1-p2.
+func segmentDistance(p, p1, p2 vector.Vector) float64 {
+	dx, dy := p2.X-p1.X, p2.Y-p1.Y
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((p.X-p1.X)*dx+(p.Y-p1.Y)*dy)/l))
+	}
+	return math.Hypot(p.X-(p1.X+t*dx), p.Y-(p1.Y+t*dy))
+}
+
+// Returns whether a tool of the given radius moving from p1 to p2 passes
+// through the box. The tool reaches up from its tip, so only the part of the
+// move below the top of the box matters.
+func passesThrough(p1, p2 vector.Vector, radius float64, b Box) bool {
+	// Clip the move to below the top of the box
+	switch {
+	case p1.Z >= b.Max.Z && p2.Z >= b.Max.Z:
+		return false
+	case p1.Z >= b.Max.Z:
+		p1 = p1.Sum(p2.Diff(p1).Multiply((p1.Z - b.Max.Z) / (p1.Z - p2.Z)))
+	case p2.Z >= b.Max.Z:
+		p2 = p1.Sum(p2.Diff(p1).Multiply((p1.Z - b.Max.Z) / (p1.Z - p2.Z)))
+	}
+
+	if clipsRect(p1, p2, b) {
+		return true
+	}
+	if radius <= 0 {
+		return false
+	}
+	if rectDistance(p1, b) < radius || rectDistance(p2, b) < radius {
+		return true
+	}
+	corners := []vector.Vector{
+		{b.Min.X, b.Min.Y, 0}, {b.Max.X, b.Min.Y, 0},
+		{b.Min.X, b.Max.Y, 0}, {b.Max.X, b.Max.Y, 0},
+	}
+	for _, c := range corners {
+		if segmentDistance(c, p1, p2) < radius {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks all moves against keep-out zones, such as vises and hold-down
+// clamps. Arcs are checked along their interpolated segments, and flagged
+// once per zone like any other block.
+//
+// The tool is a cylinder with the diameter from the tool table, or a point if
+// the tool is undefined, reaching up from its tip. Moves below a zone are
+// therefore flagged as passing through it, as the tool would have to.
+func (vm *Machine) CheckKeepOut(zones []Box) []KeepOutViolation {
+	var res []KeepOutViolation
+	lastLine := make([]int, len(zones))
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		pos := vm.Positions[idx]
+		tool, _ := vm.GetTool(pos.State.ToolIndex)
+
+		path := []vector.Vector{pos.Vector()}
+		if pos.State.MoveMode == MoveModeCWArc || pos.State.MoveMode == MoveModeCCWArc {
+			path = InterpolateArc(vm.Positions[idx-1], pos, arcCheckDeviation)
+		}
+
+		for z, b := range zones {
+			if pos.Line != 0 && pos.Line == lastLine[z] {
+				continue
+			}
+			start := vm.Positions[idx-1].Vector()
+			for _, end := range path {
+				if passesThrough(start, end, tool.Diameter/2, b) {
+					res = append(res, KeepOutViolation{Index: idx, Line: pos.Line, Zone: z})
+					lastLine[z] = pos.Line
+					break
+				}
+				start = end
+			}
+		}
+	}
+	return res
+}
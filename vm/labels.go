@@ -0,0 +1,66 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "regexp"
+import "strings"
+
+//
+// Operation labels
+//
+// CAM posts name operations in comments on lines of their own, such as
+// "(Pocket 3)" or "(T2 finishing)". The last such comment is kept in
+// State.Label and carried by the positions that follow, which keeps
+// optimizations that merge moves of the same state within an operation, and
+// lets Operations name them.
+//
+// Only comments recognised as naming an operation are labels: those starting
+// with the kind of operation, optionally after the tool and "2D" or "3D",
+// and those given as "Operation: name" or "OP1: name". Other comments, such
+// as the tool and setup notes of the header, comments sharing a block with
+// other words, such as "G0 Z5 (retract)", and active comments, such as
+// "(MSG, Change tool)", are not labels.
+//
+
+// The kinds of operation starting a label, matched as prefixes, so "rough"
+// covers "roughing" too.
+var operationKinds = []string{
+	"adaptive", "bore", "boring", "carv", "chamfer", "clearing", "contour",
+	"cutout", "deburr", "drill", "engrav", "fac", "finish", "helical",
+	"morph", "outline", "parallel", "pencil", "pocket", "profil", "radial",
+	"rough", "scallop", "slot", "spiral", "thread", "trace", "v-carv",
+}
+
+var (
+	kindLabel  = regexp.MustCompile(`^(?i)(T\d+\s+)?([23]D\s*)?(` + strings.Join(operationKinds, "|") + `)`)
+	namedLabel = regexp.MustCompile(`^(?i)OP(ERATION)?\s*\d*\s*:\s*(.+)$`)
+)
+
+// Returns the label of a comment, or an empty string if it is not one.
+func commentLabel(c *gcode.Comment) string {
+	label := strings.TrimSpace(c.Content)
+	if m := namedLabel.FindStringSubmatch(label); m != nil {
+		return strings.TrimSpace(m[2])
+	}
+	if kindLabel.MatchString(label) {
+		return label
+	}
+	return ""
+}
+
+// Sets the label from blocks consisting only of comments, using the first
+// comment that is a label.
+func (vm *Machine) setLabel(stmt *gcode.Block) {
+	var label string
+	for _, n := range stmt.Nodes {
+		c, ok := n.(*gcode.Comment)
+		if !ok {
+			return
+		}
+		if label == "" {
+			label = commentLabel(c)
+		}
+	}
+	if label != "" {
+		vm.State.Label = label
+	}
+}
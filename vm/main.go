@@ -7,7 +7,9 @@ import (
 )
 import "github.com/kennylevinsen/gocnc/vector"
 import "fmt"
+import "strings"
 import "errors"
+import "math"
 
 //
 // The CNC interpreter/"vm"
@@ -19,7 +21,9 @@ import "errors"
 //   G02   - cw arc
 //   G03   - ccw arc
 //   G04   - dwell
-//   G10L2 - set coordinate system offsets
+//   G05   - cubic spline
+//   G05.1 - quadratic spline
+//   G10L2 - set coordinate system offsets and rotation
 //   G17   - xy arc plane
 //   G18   - xz arc plane
 //   G19   - yz arc plane
@@ -54,6 +58,8 @@ import "errors"
 //   G93   - inverse feed mode
 //   G94   - units per minute feed mode
 //   G95   - units per revolution feed mode
+//   G98   - canned cycle retract to initial Z
+//   G99   - canned cycle retract to R plane
 //
 //   M02 - end of program
 //   M03 - spindle enable clockwise
@@ -62,7 +68,7 @@ import "errors"
 //   M06 - toolchange
 //   M07 - mist coolant enable
 //   M08 - flood coolant enable
-//   M09 - coolant disable
+//   M09 - coolant disable, including coolant channels
 //   M30 - end of program
 //
 //   F - feedrate
@@ -71,6 +77,7 @@ import "errors"
 //   T - tool
 //   X, Y, Z - cartesian movement
 //   I, J, K - arc center definition
+//   R - arc radius
 //
 // Notes:
 //   Cutter compensation is just passed to machine
@@ -100,6 +107,10 @@ const (
 	MoveModeCWArc  = iota
 	MoveModeCCWArc = iota
 	MoveModeDwell  = iota
+
+	// Spline moves are only a VM state, and are approximated by linear moves
+	MoveModeCubicSpline     = iota
+	MoveModeQuadraticSpline = iota
 )
 
 // Constants for plane selection
@@ -123,6 +134,31 @@ const (
 	CutCompModeInner = iota
 )
 
+// The tool length index of a dynamic tool length offset (G43.1), which is
+// given by State.ToolLengthOffset rather than by the tool table.
+const ToolLengthDynamic = -2
+
+// Constants for the unit of dwell times given with G4 P
+const (
+	DwellSeconds      = iota
+	DwellMilliseconds = iota
+)
+
+// Parses a dwell unit, "s" for seconds or "ms" for milliseconds.
+func ParseDwellUnit(unit string) (int, error) {
+	switch strings.ToLower(unit) {
+	case "s":
+		return DwellSeconds, nil
+	case "ms":
+		return DwellMilliseconds, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Invalid dwell unit: %s", unit))
+}
+
+// Dwells that are likely given in the other unit: whole seconds from this
+// many up, and fractions of milliseconds.
+const dwellWarnSeconds = 60
+
 // Move state
 type State struct {
 	Feedrate           float64
@@ -133,11 +169,15 @@ type State struct {
 	SpindleClockwise   bool
 	FloodCoolant       bool
 	MistCoolant        bool
+	Coolant            int // Coolant channels turned on, as Coolant* bits
 	ToolIndex          int
+	ToolSet            bool // The tool was set by M61 rather than changed by M6
 	NextToolIndex      int
 	ToolLengthIndex    int
+	ToolLengthOffset   float64 // Dynamic tool length offset in Z (mm)
 	CutterCompensation int
 	DwellTime          float64
+	Label              string // Name of the operation, from the last label comment
 }
 
 // NewState returns an initialized State.
@@ -155,6 +195,8 @@ func NewState() State {
 type Position struct {
 	State   State
 	X, Y, Z float64
+	Line    int           // Line of the block that made the move, 0 if unknown
+	Center  vector.Vector // Center of arc moves, which are in the XY plane
 }
 
 func (p Position) Vector() vector.Vector {
@@ -180,13 +222,42 @@ type Machine struct {
 	StoredPos1 vector.Vector
 	StoredPos2 vector.Vector
 
+	// Tool table
+	Tools map[int]Tool
+
+	// M codes of coolant channels
+	CoolantCodes map[int]CoolantCodes
+
 	// Arc settings
 	MaxArcDeviation  float64
 	MinArcLineLength float64
 
+	// Tolerance of comparisons of positions and states (mm, 0 for exact)
+	Tolerance float64
+
+	// Entries into the stock made by Resume and SelectOperations, ramping in
+	// at most EntryAngle from horizontal (degrees, 0 to feed straight down),
+	// with helices of EntryDiameter (mm, half the tool diameter if 0), from
+	// the top of the stock at StockTop
+	EntryAngle    float64
+	EntryDiameter float64
+	StockTop      float64
+
 	// Options
 	IgnoreBlockDelete   bool
 	AllowRemainingWords bool
+	KeepArcs            bool // Keep single turn arcs in the XY plane as arc moves
+	DwellUnit           int  // Unit of G4 P, seconds unless set to DwellMilliseconds
+
+	// Line of the block being run
+	line int
+
+	// Second control point of the last cubic spline, if the last move was one
+	splineControl vector.Vector
+	splineValid   bool
+
+	// Canned cycle retract mode
+	RetractMode int
 }
 
 //
@@ -288,6 +359,19 @@ func (vm *Machine) toolChange(stmt *gcode.Block) {
 					panic("Toolchange attempted without a defined tool")
 				}
 				vm.State.ToolIndex = vm.State.NextToolIndex
+				vm.State.ToolSet = false
+			case 61:
+				// Sets the tool in the spindle, without a toolchange
+				q, err := stmt.GetWord('Q')
+				if err != nil {
+					panic("Setting the tool (M61) requires a Q word")
+				}
+				if q < 0 || q != math.Floor(q) {
+					panic(fmt.Sprintf("Invalid tool for M61: Q%g", q))
+				}
+				vm.State.ToolIndex = int(q)
+				vm.State.ToolSet = true
+				stmt.RemoveAddress('Q')
 			default:
 				unknownCommand("toolChangeGroup", w)
 			}
@@ -342,6 +426,7 @@ func (vm *Machine) setCoolant(stmt *gcode.Block) {
 			case 9:
 				vm.State.MistCoolant = false
 				vm.State.FloodCoolant = false
+				vm.State.Coolant = 0
 			default:
 				unknownCommand("coolantGroup", w)
 			}
@@ -457,9 +542,25 @@ func (vm *Machine) setToolLength(stmt *gcode.Block) {
 				} else {
 					vm.State.ToolLengthIndex = vm.State.ToolIndex
 				}
+				vm.State.ToolLengthOffset = 0
 				stmt.RemoveAddress('H')
+			case 43.1:
+				if stmt.IncludesOneOf('X', 'Y') {
+					panic("Dynamic tool length offset (G43.1) is only supported in Z")
+				}
+				z, err := stmt.GetWord('Z')
+				if err != nil {
+					panic("Dynamic tool length offset (G43.1) requires a Z word")
+				}
+				if vm.Imperial {
+					z *= 25.4
+				}
+				vm.State.ToolLengthIndex = ToolLengthDynamic
+				vm.State.ToolLengthOffset = z
+				stmt.RemoveAddress('Z')
 			case 49:
 				vm.State.ToolLengthIndex = 0
+				vm.State.ToolLengthOffset = 0
 			default:
 				unknownCommand("toolLengthGroup", w)
 			}
@@ -556,6 +657,98 @@ func (vm *Machine) setArcDistanceMode(stmt *gcode.Block) {
 	}
 }
 
+// Returns the tool length offset in effect, from the tool table (G43) or
+// given directly (G43.1).
+func (vm *Machine) activeToolLength() float64 {
+	switch idx := vm.State.ToolLengthIndex; {
+	case idx == ToolLengthDynamic:
+		return vm.State.ToolLengthOffset
+	case idx > 0:
+		t, _ := vm.GetTool(idx)
+		return t.Length
+	}
+	return 0
+}
+
+// Sets a tool table entry from G10 L1 Pn [R] [Z], or with relative set, from
+// G10 L10 Pn [R] [Z], with the length calculated such that the current
+// position would be at the given Z with the offset of the tool in effect.
+func (vm *Machine) setToolTable(stmt *gcode.Block, relative bool) {
+	p, err := stmt.GetWord('P')
+	if err != nil || p < 1 || p != math.Floor(p) {
+		invalidCommand("nonModalGroup", "tool table configuration", "P word not a tool number")
+	}
+	if stmt.IncludesOneOf('X', 'Y') {
+		invalidCommand("nonModalGroup", "tool table configuration", "Only Z offsets (tool lengths) are supported")
+	}
+
+	tool, _ := vm.GetTool(int(p))
+	r, _, z := vm.axesToMetric(stmt.GetWordDefault('R', 0), 0, stmt.GetWordDefault('Z', 0))
+	if stmt.IncludesOneOf('R') {
+		tool.Diameter = 2 * r
+	}
+	if stmt.IncludesOneOf('Z') {
+		if relative {
+			// Positions are those of the tool tip, with the offset in effect
+			pos, offset := vm.curPos(), vm.CoordinateSystem.GetCoordinateSystem()
+			z = pos.Z - offset.Z + vm.activeToolLength() - z
+		}
+		tool.Length = z
+	}
+	vm.SetTool(int(p), tool)
+	stmt.RemoveAddress('P', 'R', 'Z')
+}
+
+// Sets a coordinate system from G10 L20 Pn [X] [Y] [Z], such that the current
+// position is at the given coordinates in it. P0 is the coordinate system in
+// use.
+func (vm *Machine) setCoordinateSystemAt(stmt *gcode.Block) {
+	p, err := stmt.GetWord('P')
+	if err != nil || p < 0 || p != math.Floor(p) {
+		invalidCommand("nonModalGroup", "coordinate system configuration", "P word not a coordinate system")
+	}
+	c := &vm.CoordinateSystem
+	cs := int(p)
+	if cs == 0 {
+		cs = c.currentCoordinateSystem
+	}
+	c.expandIfNecessary(cs)
+
+	var offset vector.Vector
+	if c.offsetEnabled {
+		offset = c.offset
+	}
+	// Axes that are not given are left as they are
+	v := c.coordinateSystems[cs]
+	x, y, z := vm.axesToMetric(stmt.GetWordDefault('X', 0), stmt.GetWordDefault('Y', 0), stmt.GetWordDefault('Z', 0))
+	pos := vm.curPos().Vector().Diff(offset)
+	if stmt.IncludesOneOf('X') {
+		v.X = pos.X - x
+	}
+	if stmt.IncludesOneOf('Y') {
+		v.Y = pos.Y - y
+	}
+	if stmt.IncludesOneOf('Z') {
+		v.Z = pos.Z - z
+	}
+	if r := c.rotations[cs]; r != 0 && stmt.IncludesOneOf('X', 'Y') {
+		// The axes of a rotated coordinate system are not independent, so
+		// the one that is not given keeps its coordinate in it.
+		old := c.coordinateSystems[cs]
+		px, py := rotateXY(pos.X-old.X, pos.Y-old.Y, -r)
+		if stmt.IncludesOneOf('X') {
+			px = x
+		}
+		if stmt.IncludesOneOf('Y') {
+			py = y
+		}
+		px, py = rotateXY(px, py, r)
+		v.X, v.Y = pos.X-px, pos.Y-py
+	}
+	c.SetCoordinateSystem(v.X, v.Y, v.Z, cs)
+	stmt.RemoveAddress('P', 'X', 'Y', 'Z')
+}
+
 func (vm *Machine) nonModals(stmt *gcode.Block) {
 	if w, err := stmt.GetModalGroup("nonModalGroup"); err == nil {
 		if w != nil {
@@ -569,7 +762,7 @@ func (vm *Machine) nonModals(stmt *gcode.Block) {
 					if val < 0 {
 						invalidCommand("nonModalGroup", "dwell", "P word negative")
 					}
-					vm.dwell(val)
+					vm.dwell(vm.dwellSeconds(val))
 				} else {
 					invalidCommand("nonModalGroup", "dwell", "P word not specified or specified multiple times")
 				}
@@ -577,7 +770,10 @@ func (vm *Machine) nonModals(stmt *gcode.Block) {
 
 			case 10:
 				if val, err := stmt.GetWord('L'); err == nil {
-					if val == 2 {
+					switch val {
+					case 1, 10:
+						vm.setToolTable(stmt, val == 10)
+					case 2:
 						// Set coordinate system offsets
 						if cs, err := stmt.GetWord('P'); err == nil {
 							cs := int(cs)
@@ -585,11 +781,16 @@ func (vm *Machine) nonModals(stmt *gcode.Block) {
 							x, y, z = vm.axesToMetric(x, y, z)
 
 							vm.CoordinateSystem.SetCoordinateSystem(x, y, z, cs)
-							stmt.RemoveAddress('X', 'Y', 'Z')
+							if r, err := stmt.GetWord('R'); err == nil {
+								vm.CoordinateSystem.SetRotation(r, cs)
+							}
+							stmt.RemoveAddress('X', 'Y', 'Z', 'R')
 						} else {
 							invalidCommand("nonModalGroup", "coordinate system configuration", "P word not specified or specified multiple times")
 						}
 						stmt.RemoveAddress('P')
+					case 20:
+						vm.setCoordinateSystemAt(stmt)
 					}
 				} else {
 					invalidCommand("nonModalGroup", "G10 configuration", "L word not specified or specified multiple times")
@@ -682,6 +883,10 @@ func (vm *Machine) setMoveMode(stmt *gcode.Block) {
 				vm.State.MoveMode = MoveModeCWArc
 			case 3:
 				vm.State.MoveMode = MoveModeCCWArc
+			case 5:
+				vm.State.MoveMode = MoveModeCubicSpline
+			case 5.1:
+				vm.State.MoveMode = MoveModeQuadraticSpline
 			case 80:
 				vm.State.MoveMode = MoveModeNone
 			default:
@@ -714,13 +919,39 @@ func (vm *Machine) performMove(stmt *gcode.Block) {
 		if s.MoveMode == MoveModeCWArc || s.MoveMode == MoveModeCCWArc {
 			invalidCommand("motionGroup", "arc", "Coordinate override attempted for arc")
 		}
+
+		if s.MoveMode == MoveModeCubicSpline || s.MoveMode == MoveModeQuadraticSpline {
+			invalidCommand("motionGroup", "spline", "Coordinate override attempted for spline")
+		}
 	}
 
+	// Only a cubic spline can continue from the last one
+	continues := vm.splineValid
+	vm.splineValid = false
+
 	if s.MoveMode == MoveModeCWArc || s.MoveMode == MoveModeCCWArc {
 		// Arc
 		newX, newY, newZ, newI, newJ, newK := vm.calcPos(*stmt)
+		if r, err := stmt.GetWord('R'); err == nil {
+			if stmt.IncludesOneOf('I', 'J', 'K') {
+				invalidCommand("motionGroup", "arc", "Both radius (R) and center (I, J, K) specified")
+			}
+			if vm.Imperial {
+				r *= 25.4
+			}
+			newI, newJ, newK = vm.radiusCenter(newX, newY, newZ, r)
+		}
 		vm.arc(newX, newY, newZ, newI, newJ, newK, stmt.GetWordDefault('P', 1))
-		stmt.RemoveAddress('X', 'Y', 'Z', 'I', 'J', 'K', 'P')
+		stmt.RemoveAddress('X', 'Y', 'Z', 'I', 'J', 'K', 'R', 'P')
+
+	} else if s.MoveMode == MoveModeCubicSpline || s.MoveMode == MoveModeQuadraticSpline {
+		// Spline
+		if vm.MovePlane != PlaneXY {
+			invalidCommand("motionGroup", "spline", "Spline attempted outside the XY plane")
+		}
+		newX, newY, newZ, _, _, _ := vm.calcPos(*stmt)
+		vm.spline(newX, newY, newZ, vm.splineControls(stmt, newX, newY, continues))
+		stmt.RemoveAddress('X', 'Y', 'Z', 'I', 'J', 'P', 'Q')
 
 	} else if s.MoveMode == MoveModeLinear || s.MoveMode == MoveModeRapid {
 		// Line
@@ -785,14 +1016,19 @@ func (vm *Machine) run(stmt gcode.Block) (err error) {
 		}
 	}()
 
+	// Words are removed as they are handled, which must not change the document
+	stmt.Nodes = append([]gcode.Node(nil), stmt.Nodes...)
+
 	vm.lineNumber(&stmt)
 	vm.programName(&stmt)
+	vm.setLabel(&stmt)
 	vm.feedRateMode(&stmt)
 	vm.feedRate(&stmt)
 	vm.spindleSpeed(&stmt)
 	vm.nextTool(&stmt)
 	vm.toolChange(&stmt)
 	vm.setSpindle(&stmt)
+	vm.setCoolantChannels(&stmt)
 	vm.setCoolant(&stmt)
 	vm.setPolarMode(&stmt)
 	vm.setPlane(&stmt)
@@ -802,6 +1038,7 @@ func (vm *Machine) run(stmt gcode.Block) (err error) {
 	vm.setCoordinateSystem(&stmt)
 	vm.setDistanceMode(&stmt)
 	vm.setArcDistanceMode(&stmt)
+	vm.setRetractMode(&stmt)
 	vm.nonModals(&stmt)
 	vm.setMoveMode(&stmt)
 	vm.performMove(&stmt)
@@ -814,7 +1051,10 @@ func (vm *Machine) run(stmt gcode.Block) (err error) {
 
 // Ensure that machine state is correct after execution
 func (vm *Machine) finalize() {
-	if vm.State != vm.curPos().State {
+	// A label after the last move names no moves
+	state := vm.State
+	state.Label = vm.curPos().State.Label
+	if state != vm.curPos().State {
 		vm.State.MoveMode = MoveModeNone
 		curPos := vm.curPos()
 		vm.move(curPos.X, curPos.Y, curPos.Z)
@@ -823,16 +1063,43 @@ func (vm *Machine) finalize() {
 
 // Process AST
 func (vm *Machine) Process(doc *gcode.Document) (err error) {
+	if err := vm.process(doc, 0); err != nil {
+		return err
+	}
+	vm.finalize()
+	return nil
+}
+
+// Process several programs one after another, such as roughing and finishing
+// posted separately. The tool, offsets, spindle and the rest of the state
+// carry over from one program to the next, and a program end (M2, M30) only
+// ends the program it is in. Lines are numbered as if the programs were one,
+// so the first line of the second program follows the last of the first.
+func (vm *Machine) ProcessAll(docs ...*gcode.Document) (err error) {
+	offset := 0
+	for idx, doc := range docs {
+		vm.Completed = false
+		if err := vm.process(doc, offset); err != nil {
+			return errors.New(fmt.Sprintf("program %d, %s", idx+1, err))
+		}
+		offset += len(doc.Blocks)
+	}
+	vm.finalize()
+	return nil
+}
+
+// Runs the blocks of a document, numbering lines after offset.
+func (vm *Machine) process(doc *gcode.Document, offset int) error {
 	for idx, b := range doc.Blocks {
 		if b.BlockDelete && vm.IgnoreBlockDelete {
 			continue
 		}
 
+		vm.line = offset + idx + 1
 		if err := vm.run(b); err != nil {
 			return errors.New(fmt.Sprintf("line %d: %s", idx+1, err))
 		}
 	}
-	vm.finalize()
 	return nil
 }
 
@@ -844,9 +1111,13 @@ func (vm *Machine) Init() {
 	vm.AbsoluteMove = true
 	vm.AbsoluteArc = false
 	vm.MovePlane = PlaneXY
+	vm.RetractMode = RetractModeInitial
 	vm.MaxArcDeviation = 0.002
 	vm.MinArcLineLength = 0.01
+	vm.Tolerance = DefaultTolerance
+	vm.CoolantCodes = DefaultCoolantCodes()
 	vm.IgnoreBlockDelete = false
+	vm.line = 0
 }
 
 //
@@ -866,11 +1137,15 @@ func (m *Position) Dump() {
 		fmt.Printf("Clockwise arc\n")
 	case MoveModeCCWArc:
 		fmt.Printf("Counterclockwise arc\n")
+	case MoveModeCubicSpline:
+		fmt.Printf("Cubic spline\n")
+	case MoveModeQuadraticSpline:
+		fmt.Printf("Quadratic spline\n")
 	}
 	fmt.Printf("   Tool: %d, Tool length: %d, Next tool: %d\n", m.State.ToolIndex, m.State.ToolLengthIndex, m.State.NextToolIndex)
 	fmt.Printf("   Feedrate: %g\n", m.State.Feedrate)
 	fmt.Printf("   Spindle: %t, clockwise: %t, speed: %g\n", m.State.SpindleEnabled, m.State.SpindleClockwise, m.State.SpindleSpeed)
-	fmt.Printf("   Mist coolant: %t, flood coolant: %t\n", m.State.MistCoolant, m.State.FloodCoolant)
+	fmt.Printf("   Mist coolant: %t, flood coolant: %t, channels: %s\n", m.State.MistCoolant, m.State.FloodCoolant, CoolantSetName(m.State.Coolant))
 	fmt.Printf("   X: %f, Y: %f, Z: %f\n", m.X, m.Y, m.Z)
 }
 
@@ -0,0 +1,36 @@
+package vm
+
+// A contiguous run of cutting moves with a single tool, between rapid moves.
+type Operation struct {
+	Start int // Index of the first position
+	End   int // Index after the last position
+	Tool  int
+	Label string // Label of the positions, empty if unlabelled
+}
+
+// Splits the position stack into operations. Each operation consists of the
+// non-rapid moves between two rapid moves, toolchanges or changes of label.
+func (vm *Machine) Operations() []Operation {
+	var (
+		ops     []Operation
+		current *Operation
+	)
+
+	for idx, pos := range vm.Positions {
+		cutting := pos.State.MoveMode != MoveModeRapid && pos.State.MoveMode != MoveModeNone
+		if current != nil && (!cutting || pos.State.ToolIndex != current.Tool || pos.State.Label != current.Label) {
+			current.End = idx
+			ops = append(ops, *current)
+			current = nil
+		}
+		if cutting && current == nil {
+			current = &Operation{Start: idx, Tool: pos.State.ToolIndex, Label: pos.State.Label}
+		}
+	}
+
+	if current != nil {
+		current.End = len(vm.Positions)
+		ops = append(ops, *current)
+	}
+	return ops
+}
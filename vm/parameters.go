@@ -0,0 +1,79 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vector"
+
+// LinuxCNC persistent parameter numbers
+const (
+	ParamProbe                  = 5061
+	ParamStoredPos1             = 5161
+	ParamStoredPos2             = 5181
+	ParamOffsetEnabled          = 5210
+	ParamOffset                 = 5211
+	ParamCoordinateSystem       = 5220
+	ParamCoordinateSystemBase   = 5221
+	ParamCoordinateSystemStride = 20
+	ParamCoordinateSystemR      = 9
+)
+
+func paramVector(p *gcode.Parameters, base int) vector.Vector {
+	return vector.Vector{X: p.GetNumbered(base), Y: p.GetNumbered(base + 1), Z: p.GetNumbered(base + 2)}
+}
+
+func setParamVector(p *gcode.Parameters, base int, v vector.Vector) {
+	p.Numbered[base] = v.X
+	p.Numbered[base+1] = v.Y
+	p.Numbered[base+2] = v.Z
+}
+
+// Initializes coordinate systems, G92 offsets and stored positions from
+// LinuxCNC-numbered parameters, such as those read from a .var file.
+func (vm *Machine) LoadParameters(p *gcode.Parameters) {
+	c := &vm.CoordinateSystem
+	for cs := 1; cs <= 9; cs++ {
+		v := paramVector(p, ParamCoordinateSystemBase+(cs-1)*ParamCoordinateSystemStride)
+		c.SetCoordinateSystem(v.X, v.Y, v.Z, cs)
+		c.SetRotation(p.GetNumbered(ParamCoordinateSystemBase+(cs-1)*ParamCoordinateSystemStride+ParamCoordinateSystemR), cs)
+	}
+
+	v := paramVector(p, ParamOffset)
+	c.SetOffset(v.X, v.Y, v.Z)
+	if p.GetNumbered(ParamOffsetEnabled) != 0 {
+		c.EnableOffset()
+	} else {
+		c.DisableOffset()
+	}
+
+	if cs := int(p.GetNumbered(ParamCoordinateSystem)); cs >= 1 && cs <= 9 {
+		c.SelectCoordinateSystem(cs)
+	}
+
+	vm.StoredPos1 = paramVector(p, ParamStoredPos1)
+	vm.StoredPos2 = paramVector(p, ParamStoredPos2)
+}
+
+// Stores coordinate systems, G92 offsets and stored positions into
+// LinuxCNC-numbered parameters, such as for writing a .var file.
+// Other parameters, such as probe results, are left untouched.
+func (vm *Machine) StoreParameters(p *gcode.Parameters) {
+	c := &vm.CoordinateSystem
+	for cs := 1; cs <= 9; cs++ {
+		c.expandIfNecessary(cs)
+		setParamVector(p, ParamCoordinateSystemBase+(cs-1)*ParamCoordinateSystemStride, c.coordinateSystems[cs])
+		p.Numbered[ParamCoordinateSystemBase+(cs-1)*ParamCoordinateSystemStride+ParamCoordinateSystemR] = c.rotations[cs]
+	}
+
+	setParamVector(p, ParamOffset, c.offset)
+	if c.offsetEnabled {
+		p.Numbered[ParamOffsetEnabled] = 1
+	} else {
+		p.Numbered[ParamOffsetEnabled] = 0
+	}
+
+	if c.currentCoordinateSystem >= 1 {
+		p.Numbered[ParamCoordinateSystem] = float64(c.currentCoordinateSystem)
+	}
+
+	setParamVector(p, ParamStoredPos1, vm.StoredPos1)
+	setParamVector(p, ParamStoredPos2, vm.StoredPos2)
+}
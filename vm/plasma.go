@@ -0,0 +1,172 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "errors"
+
+// Settings for plasma cutting. Heights are in mm.
+type PlasmaSettings struct {
+	PierceHeight   float64 // Height to light the torch and pierce at
+	CutHeight      float64 // Height to cut at
+	TravelHeight   float64 // Lowest height of rapid moves between cuts
+	PierceDelay    float64 // Seconds to wait at pierce height after lighting the torch
+	PierceFeedrate float64 // Feedrate from pierce height to cut height (mm/min, <= 0 for that of the cut)
+	THC            bool    // Turn torch height control (CoolantTHC) on while cutting
+}
+
+// Converts the program for a plasma cutter, with the spindle as the torch.
+// The torch is lit for each cut, being a run of feed moves with the spindle
+// running, and put out after it, regardless of where the program starts and
+// stops the spindle, so milling programs running the spindle throughout can
+// be used as well as those stopping it between cuts.
+//
+// Each cut is started by moving to pierce height, lighting the torch and
+// waiting for it to pierce, then feeding down to cut height, where the whole
+// cut is made. The torch lifts to travel height after it, and rapid moves
+// are kept at or above travel height. Plunges and lifts along Z in the cuts
+// are left out, as are dwells while the torch is out, such as those waiting
+// for the spindle or a pierce of the program. Programs cutting a contour in
+// several passes are cut that many times, so they are best posted with one.
+//
+// With THC, torch height control is turned on for the cutting moves, after
+// the torch reaches cut height, and off before it is put out. The machine
+// needs M codes for CoolantTHC to export it. Returns the number of pierces.
+func (vm *Machine) Plasma(s PlasmaSettings) (int, error) {
+	if s.PierceHeight < s.CutHeight {
+		return 0, errors.New("Pierce height cannot be below cut height")
+	}
+	if s.TravelHeight < s.PierceHeight {
+		return 0, errors.New("Travel height cannot be below pierce height")
+	}
+	if len(vm.Positions) == 0 {
+		return 0, nil
+	}
+
+	var (
+		positions = []Position{vm.Positions[0]}
+		lit       bool
+		pierces   int
+	)
+	last := func() Position {
+		return positions[len(positions)-1]
+	}
+	// Adds a position at the current one, changing only the state
+	stay := func(state State) {
+		p := last()
+		p.State = state
+		p.Center = vector.Vector{}
+		positions = append(positions, p)
+	}
+	// Adds a move from the current position, keeping its state
+	moveTo := func(mode int, x, y, z float64) {
+		p := last()
+		p.State.MoveMode = mode
+		p.X, p.Y, p.Z = x, y, z
+		p.Center = vector.Vector{}
+		positions = append(positions, p)
+	}
+	// Turns torch height control off, puts out the torch and lifts to travel
+	// height
+	putOut := func() {
+		state := last().State
+		state.MoveMode = MoveModeNone
+		if state.Coolant&CoolantTHC != 0 {
+			state.Coolant &^= CoolantTHC
+			stay(state)
+		}
+		state.SpindleEnabled = false
+		stay(state)
+		if cur := last(); cur.Z < s.TravelHeight {
+			moveTo(MoveModeRapid, cur.X, cur.Y, s.TravelHeight)
+		}
+		lit = false
+	}
+
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		prev, pos := vm.Positions[idx-1], vm.Positions[idx]
+		mode := pos.State.MoveMode
+		cut := pos.State.SpindleEnabled && (mode == MoveModeLinear || mode == MoveModeCWArc || mode == MoveModeCCWArc)
+
+		switch {
+		case cut && mode == MoveModeLinear && vm.SameXY(prev.Vector(), pos.Vector()):
+			// Plunges and lifts
+			continue
+		case mode == MoveModeNone || mode == MoveModeDwell:
+			if mode == MoveModeDwell && !lit {
+				continue
+			}
+			// Changes the state where the torch is
+			cur := last()
+			pos.X, pos.Y, pos.Z = cur.X, cur.Y, cur.Z
+			pos.State.SpindleEnabled = lit
+			if !lit || !s.THC {
+				pos.State.Coolant &^= CoolantTHC
+			} else {
+				pos.State.Coolant |= CoolantTHC
+			}
+			positions = append(positions, pos)
+			continue
+		case !cut:
+			if lit {
+				putOut()
+			}
+			pos.State.SpindleEnabled = false
+			pos.State.Coolant &^= CoolantTHC
+			if mode == MoveModeRapid && pos.Z < s.TravelHeight {
+				pos.Z = s.TravelHeight
+			}
+			positions = append(positions, pos)
+			continue
+		}
+
+		if !lit {
+			// Pierce at the start of the cut
+			cur := last()
+			if !vm.SameXY(cur.Vector(), prev.Vector()) {
+				if cur.Z < s.TravelHeight {
+					moveTo(MoveModeRapid, cur.X, cur.Y, s.TravelHeight)
+				}
+				moveTo(MoveModeRapid, prev.X, prev.Y, last().Z)
+			}
+			if cur := last(); !vm.Equal(cur.Z, s.PierceHeight) {
+				moveTo(MoveModeRapid, cur.X, cur.Y, s.PierceHeight)
+			}
+
+			state := pos.State
+			state.MoveMode = MoveModeNone
+			state.Coolant &^= CoolantTHC
+			stay(state)
+			if s.PierceDelay > 0 {
+				state.MoveMode = MoveModeDwell
+				state.DwellTime = s.PierceDelay
+				stay(state)
+			}
+			if !vm.Equal(s.PierceHeight, s.CutHeight) {
+				down := last()
+				down.State = state
+				down.State.MoveMode = MoveModeLinear
+				down.State.DwellTime = 0
+				if s.PierceFeedrate > 0 {
+					down.State.Feedrate = s.PierceFeedrate
+				}
+				down.Z = s.CutHeight
+				positions = append(positions, down)
+			}
+			lit = true
+			pierces++
+		}
+
+		pos.Z = s.CutHeight
+		if s.THC {
+			pos.State.Coolant |= CoolantTHC
+		} else {
+			pos.State.Coolant &^= CoolantTHC
+		}
+		positions = append(positions, pos)
+	}
+	if lit {
+		putOut()
+	}
+
+	vm.Positions = positions
+	return pierces, nil
+}
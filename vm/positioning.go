@@ -1,7 +1,9 @@
 package vm
 
 import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vector"
 import "math"
+import "log"
 import "fmt"
 
 // Converts the arguments to mm if necessary
@@ -24,7 +26,7 @@ func (vm *Machine) move(x, y, z float64) {
 	if math.IsNaN(x) || math.IsNaN(y) || math.IsNaN(z) {
 		panic("Internal failure: Move attempted with NaN value")
 	}
-	pos := Position{vm.State, x, y, z}
+	pos := Position{State: vm.State, X: x, Y: y, Z: z, Line: vm.line}
 	vm.Positions = append(vm.Positions, pos)
 }
 
@@ -83,6 +85,31 @@ func (vm *Machine) calcPos(stmt gcode.Block) (newX, newY, newZ, newI, newJ, newK
 		}
 	}
 
+	// In a rotated coordinate system, X and Y are given along its rotated
+	// axes, and an axis that is not given keeps its program coordinate.
+	rotated := vm.CoordinateSystem.GetRotation() != 0
+	if rotated && stmt.IncludesOneOf('X', 'Y') {
+		x, y := stmt.GetWordDefault('X', 0), stmt.GetWordDefault('Y', 0)
+		if vm.Imperial {
+			x *= 25.4
+			y *= 25.4
+		}
+		if !vm.AbsoluteMove {
+			x, y = vm.CoordinateSystem.RotateXY(x, y)
+			newX, newY = pos.X+x, pos.Y+y
+		} else {
+			p := vm.CoordinateSystem.ToProgram(pos.Vector())
+			if stmt.IncludesOneOf('X') {
+				p.X = x
+			}
+			if stmt.IncludesOneOf('Y') {
+				p.Y = y
+			}
+			x, y = vm.CoordinateSystem.RotateXY(p.X, p.Y)
+			newX, newY = x+coordinateSystem.X, y+coordinateSystem.Y
+		}
+	}
+
 	newI = stmt.GetWordDefault('I', 0.0)
 	newJ = stmt.GetWordDefault('J', 0.0)
 	newK = stmt.GetWordDefault('K', 0.0)
@@ -93,19 +120,78 @@ func (vm *Machine) calcPos(stmt gcode.Block) (newX, newY, newZ, newI, newJ, newK
 		newK *= 25.4
 	}
 
+	if rotated {
+		newI, newJ = vm.CoordinateSystem.RotateXY(newI, newJ)
+	}
+
 	if !vm.AbsoluteArc {
 		newI += pos.X
 		newJ += pos.Y
 		newK += pos.Z
 	} else {
+		// Absolute centers are in the coordinate system, K included, and the
+		// end point is already offset above
 		newI += coordinateSystem.X
 		newJ += coordinateSystem.Y
-		newZ += coordinateSystem.Z
+		newK += coordinateSystem.Z
 	}
 
 	return newX, newY, newZ, newI, newJ, newK
 }
 
+// Calculates the center of a radius format arc to x, y, z, as absolute I, J
+// and K. A positive radius gives the arc of up to half a circle, and a
+// negative radius the longer one. Radii too small to reach the end point are
+// accepted as half a circle if they are off by no more than the deviation
+// allowed for center format arcs.
+func (vm *Machine) radiusCenter(x, y, z, r float64) (i, j, k float64) {
+	var (
+		sp             Position = vm.curPos()
+		s1, s2, e1, e2 float64
+	)
+
+	switch vm.MovePlane {
+	case PlaneXY:
+		s1, s2, e1, e2 = sp.X, sp.Y, x, y
+	case PlaneXZ:
+		s1, s2, e1, e2 = sp.Z, sp.X, z, x
+	case PlaneYZ:
+		s1, s2, e1, e2 = sp.Y, sp.Z, y, z
+	}
+
+	if r == 0 {
+		panic("Invalid arc statement: Zero radius")
+	}
+	if s1 == e1 && s2 == e2 {
+		panic("Invalid arc statement: Full circle with radius format")
+	}
+
+	// The center is on the bisector of the chord, to the left of it for
+	// short counter-clockwise and long clockwise arcs
+	half := math.Hypot(e1-s1, e2-s2) / 2
+	h := 0.0
+	if rDiff := half - math.Abs(r); rDiff > 0 {
+		if (rDiff > 0.005 && rDiff/half*100 > 0.1) || rDiff > 0.5 {
+			panic(fmt.Sprintf("Arc radius %f too small to reach end point %f away", math.Abs(r), 2*half))
+		}
+	} else {
+		h = math.Sqrt(r*r - half*half)
+	}
+	if (vm.State.MoveMode == MoveModeCWArc) == (r > 0) {
+		h = -h
+	}
+	c1 := (s1+e1)/2 - h*(e2-s2)/(2*half)
+	c2 := (s2+e2)/2 + h*(e1-s1)/(2*half)
+
+	switch vm.MovePlane {
+	case PlaneXZ:
+		return c2, sp.Y, c1
+	case PlaneYZ:
+		return sp.X, c1, c2
+	}
+	return c1, c2, sp.Z
+}
+
 // Calculates an approximate arc from the provided statement
 func (vm *Machine) arc(x, y, z, i, j, k, rotations float64) {
 	var (
@@ -164,6 +250,14 @@ func (vm *Machine) arc(x, y, z, i, j, k, rotations float64) {
 		panic(fmt.Sprintf("Radius deviation of %f percent and %f mm", deviation, rDiff))
 	}
 
+	// Full circles are left to the approximation, which makes them no-ops
+	if vm.KeepArcs && vm.MovePlane == PlaneXY && rotations == 1 && (x != sp.X || y != sp.Y) {
+		state := vm.State
+		state.MoveMode = oldState
+		vm.Positions = append(vm.Positions, Position{State: state, X: x, Y: y, Z: z, Line: vm.line, Center: vector.Vector{i, j, 0}})
+		return
+	}
+
 	// Some preparatory math
 	theta1 := math.Atan2((s2 - c2), (s1 - c1))
 	theta2 := math.Atan2((e2 - c2), (e1 - c1))
@@ -213,6 +307,21 @@ func (vm *Machine) arc(x, y, z, i, j, k, rotations float64) {
 	add(e1, e2, e3)
 }
 
+// Converts the P word of a dwell to seconds, warning about values that look
+// like they are given in the other unit.
+func (vm *Machine) dwellSeconds(p float64) float64 {
+	if vm.DwellUnit == DwellMilliseconds {
+		if p != math.Floor(p) {
+			log.Printf("WARNING: Line %d: dwell of P%g milliseconds has a fraction of a millisecond, and may be given in seconds", vm.line, p)
+		}
+		return p / 1000
+	}
+	if p >= dwellWarnSeconds && p == math.Floor(p) {
+		log.Printf("WARNING: Line %d: dwell of P%g seconds is unusually long, and may be given in milliseconds", vm.line, p)
+	}
+	return p
+}
+
 func (vm *Machine) dwell(seconds float64) {
 	curPos := vm.curPos()
 	curPos.State.DwellTime = seconds
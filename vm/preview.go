@@ -0,0 +1,109 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "fmt"
+
+// A change to the machine state, from Old to New.
+type StateChange struct {
+	Name     string // Name of the field, such as "Feedrate" or "Imperial"
+	Old, New interface{}
+}
+
+func (c StateChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Name, c.Old, c.New)
+}
+
+// The changes a block makes to the machine state, other than the position.
+type StateDiff []StateChange
+
+// Returns the change to the named field, and whether it changed.
+func (d StateDiff) Get(name string) (StateChange, bool) {
+	for _, c := range d {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return StateChange{}, false
+}
+
+// Returns the changes from the state of vm to that of n.
+func (vm *Machine) diff(n *Machine) StateDiff {
+	var d StateDiff
+	compare := func(name string, old, new interface{}) {
+		if old != new {
+			d = append(d, StateChange{name, old, new})
+		}
+	}
+
+	o, s := vm.State, n.State
+	compare("Feedrate", o.Feedrate, s.Feedrate)
+	compare("SpindleSpeed", o.SpindleSpeed, s.SpindleSpeed)
+	compare("MoveMode", o.MoveMode, s.MoveMode)
+	compare("FeedMode", o.FeedMode, s.FeedMode)
+	compare("SpindleEnabled", o.SpindleEnabled, s.SpindleEnabled)
+	compare("SpindleClockwise", o.SpindleClockwise, s.SpindleClockwise)
+	compare("FloodCoolant", o.FloodCoolant, s.FloodCoolant)
+	compare("MistCoolant", o.MistCoolant, s.MistCoolant)
+	compare("Coolant", o.Coolant, s.Coolant)
+	compare("ToolIndex", o.ToolIndex, s.ToolIndex)
+	compare("ToolSet", o.ToolSet, s.ToolSet)
+	compare("NextToolIndex", o.NextToolIndex, s.NextToolIndex)
+	compare("ToolLengthIndex", o.ToolLengthIndex, s.ToolLengthIndex)
+	compare("ToolLengthOffset", o.ToolLengthOffset, s.ToolLengthOffset)
+	compare("CutterCompensation", o.CutterCompensation, s.CutterCompensation)
+	compare("Label", o.Label, s.Label)
+
+	compare("Completed", vm.Completed, n.Completed)
+	compare("Imperial", vm.Imperial, n.Imperial)
+	compare("AbsoluteMove", vm.AbsoluteMove, n.AbsoluteMove)
+	compare("AbsoluteArc", vm.AbsoluteArc, n.AbsoluteArc)
+	compare("MovePlane", vm.MovePlane, n.MovePlane)
+	oc, nc := vm.CoordinateSystem, n.CoordinateSystem
+	compare("CoordinateSystem", oc.currentCoordinateSystem, nc.currentCoordinateSystem)
+	compare("WorkOffset", oc.GetCoordinateSystem(), nc.GetCoordinateSystem())
+	compare("OffsetEnabled", oc.OffsetActive(), nc.OffsetActive())
+	compare("StoredPos1", vm.StoredPos1, n.StoredPos1)
+	compare("StoredPos2", vm.StoredPos2, n.StoredPos2)
+	compare("RetractMode", vm.RetractMode, n.RetractMode)
+	return d
+}
+
+// Runs a block against a copy of the machine, and returns the changes it
+// would make to the state, and the moves it would add, without changing the
+// machine. The moves have line 0, as the block is not part of the program.
+func (vm *Machine) Preview(block gcode.Block) (StateDiff, []Position, error) {
+	// Positions are only appended, so the copy can share the stack
+	n := len(vm.Positions)
+	c := vm.cloneWith(vm.Positions[:n:n])
+	c.line = 0
+	if err := c.run(block); err != nil {
+		return nil, nil, err
+	}
+	return vm.diff(c), c.Positions[n:], nil
+}
+
+// Runs a block, such as one typed in by hand, as the next block of the
+// program, and returns the changes it made to the state. Unlike Process, the
+// modal state is kept for the next block, and state changes without a move,
+// such as starting the spindle, are added as a position without a move. The
+// machine is left unchanged if the block fails.
+func (vm *Machine) Execute(block gcode.Block) (StateDiff, error) {
+	n := len(vm.Positions)
+	c := vm.cloneWith(vm.Positions[:n:n])
+	c.line++
+	if err := c.run(block); err != nil {
+		return nil, err
+	}
+
+	cp := c.curPos()
+	state := c.State
+	state.MoveMode, state.DwellTime = cp.State.MoveMode, cp.State.DwellTime
+	if state != cp.State {
+		state.MoveMode, state.DwellTime = MoveModeNone, 0
+		c.Positions = append(c.Positions, Position{State: state, X: cp.X, Y: cp.Y, Z: cp.Z, Line: c.line})
+	}
+
+	diff := vm.diff(c)
+	*vm = *c
+	return diff, nil
+}
@@ -0,0 +1,159 @@
+package vm
+
+import "math"
+import "time"
+
+// Estimated time, by what it is spent on.
+type Times struct {
+	Cutting    time.Duration
+	Rapid      time.Duration
+	Dwell      time.Duration
+	ToolChange time.Duration
+}
+
+// Returns the total time.
+func (t Times) Total() time.Duration {
+	return t.Cutting + t.Rapid + t.Dwell + t.ToolChange
+}
+
+// Estimated time spent with a tool.
+type ToolReport struct {
+	Tool int
+	Times
+}
+
+// Estimated time of an operation, including the moves leading up to it.
+type OperationReport struct {
+	Operation
+	Times
+}
+
+// Distances travelled, by kind of move (mm).
+type Distances struct {
+	Cutting float64
+	Rapid   float64
+}
+
+// The cutting distance at depths from Max down to Min, with Max not included.
+type DepthBin struct {
+	Min, Max float64 // Z (mm)
+	Distance float64 // mm
+}
+
+// The height of the bins of the depth histogram of a report (mm).
+const DepthBinHeight = 1
+
+// Estimated time of a job, in total, per tool and per operation, along with
+// the distances travelled, the number of plunges and a histogram of the depths
+// cut at.
+type Report struct {
+	Times
+	Tools      []ToolReport // In the order the tools are first used
+	Operations []OperationReport
+	Distance   Distances
+	Plunges    int        // Cutting moves straight down into the stock (below Z0)
+	Depths     []DepthBin // From the top down, without empty bins at either end
+}
+
+// Adds the time of a position.
+func (t *Times) add(pos Position, pt positionTime) {
+	t.ToolChange += pt.ToolChange
+	t.Dwell += pt.Dwell
+	if pos.State.MoveMode == MoveModeRapid {
+		t.Rapid += pt.Move
+	} else {
+		t.Cutting += pt.Move
+	}
+}
+
+// Tests if the move from cur to next cuts straight down.
+func (vm *Machine) isPlunge(cur, next Position) bool {
+	return next.State.MoveMode == MoveModeLinear && vm.SameXY(cur.Vector(), next.Vector()) && next.Z < cur.Z
+}
+
+// Sums the distances of the moves, counts the plunges, and bins the cutting
+// distance by the deepest point of each move.
+func (vm *Machine) distances(r *Report) {
+	var (
+		bins     = make(map[int]float64)
+		lo, hi   int
+		plunging bool
+	)
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		prev, pos := vm.Positions[idx-1], vm.Positions[idx]
+		switch pos.State.MoveMode {
+		case MoveModeRapid:
+			r.Distance.Rapid += moveDistance(prev, pos)
+			plunging = false
+			continue
+		case MoveModeLinear, MoveModeCWArc, MoveModeCCWArc:
+		default:
+			continue
+		}
+
+		dist := moveDistance(prev, pos)
+		r.Distance.Cutting += dist
+
+		plunge := vm.isPlunge(prev, pos)
+		if plunge && !plunging && pos.Z < 0 {
+			r.Plunges++
+		}
+		plunging = plunge
+
+		bin := int(math.Floor(math.Min(prev.Z, pos.Z) / DepthBinHeight))
+		if len(bins) == 0 || bin < lo {
+			lo = bin
+		}
+		if len(bins) == 0 || bin > hi {
+			hi = bin
+		}
+		bins[bin] += dist
+	}
+
+	if len(bins) == 0 {
+		return
+	}
+	for bin := hi; bin >= lo; bin-- {
+		r.Depths = append(r.Depths, DepthBin{
+			Min:      float64(bin) * DepthBinHeight,
+			Max:      float64(bin+1) * DepthBinHeight,
+			Distance: bins[bin],
+		})
+	}
+}
+
+// Attributes the estimated runtime of the job to tools and operations, as
+// split by Operations. The rapid moves and toolchanges between operations
+// count towards the operation that follows them, and those after the last
+// operation towards the last operation.
+func (vm *Machine) Report() Report {
+	var r Report
+	ops := vm.Operations()
+	for _, op := range ops {
+		r.Operations = append(r.Operations, OperationReport{Operation: op})
+	}
+
+	tools := make(map[int]int)
+	op := 0
+	for idx, pt := range vm.positionTimes() {
+		pos := vm.Positions[idx]
+		r.Times.add(pos, pt)
+
+		t, ok := tools[pos.State.ToolIndex]
+		if !ok {
+			t = len(r.Tools)
+			tools[pos.State.ToolIndex] = t
+			r.Tools = append(r.Tools, ToolReport{Tool: pos.State.ToolIndex})
+		}
+		r.Tools[t].Times.add(pos, pt)
+
+		for op < len(ops)-1 && idx >= ops[op].End {
+			op++
+		}
+		if len(ops) > 0 {
+			r.Operations[op].Times.add(pos, pt)
+		}
+	}
+	vm.distances(&r)
+	return r
+}
@@ -0,0 +1,123 @@
+package vm
+
+import "errors"
+import "fmt"
+
+// Rewrites the position stack to continue a job at the given position index,
+// such as after a power loss or a broken tool.
+//
+// The state at index (tool, spindle, coolant, feed) is restored as returned
+// by StateAt.
+//
+// The machine is assumed to be at an unknown position. The new stack
+// retracts to safety height, traverses to the start of the move at index,
+// restores spindle and coolant, and feeds down to the starting depth, or
+// ramps down if EntryAngle is set, before continuing with the remaining
+// positions.
+//
+// Returns the index in the new stack at which the original position index is
+// found, so that callers can map indexes back to the original program.
+func (vm *Machine) Resume(index int) (int, error) {
+	if index <= 0 || index >= len(vm.Positions) {
+		return 0, errors.New(fmt.Sprintf("Resume index %d out of range (1-%d)", index, len(vm.Positions)-1))
+	}
+
+	origin := vm.Positions[0]
+	entry, err := vm.entry(origin, index, vm.FindSafetyHeight())
+	if err != nil {
+		return 0, err
+	}
+
+	// The skipped positions make room for the new ones, if there are enough of them
+	n := len(entry) + 1
+	if index >= n {
+		vm.Positions = vm.Positions[index-n:]
+		copy(vm.Positions, append([]Position{origin}, entry...))
+		return n, nil
+	}
+
+	npos := make([]Position, 0, len(vm.Positions)-index+n)
+	npos = append(npos, origin)
+	npos = append(npos, entry...)
+	npos = append(npos, vm.Positions[index:]...)
+	vm.Positions = npos
+
+	return n, nil
+}
+
+// Returns state with the spindle and coolant stopped, for rapid moves around
+// the job. The spindle speed is cleared, as generators only issue it with the
+// spindle running, and would otherwise take it as set when it is restarted.
+func idleState(state State) State {
+	state.MoveMode = MoveModeRapid
+	state.SpindleEnabled = false
+	state.SpindleSpeed = 0
+	state.FloodCoolant = false
+	state.MistCoolant = false
+	state.Coolant = 0
+	state.DwellTime = 0
+	return state
+}
+
+// Returns the moves from the position from to the start of the move at index:
+// a retract to safety height and a traverse with everything stopped, and an
+// approach down to the start with the state at index restored, ramping into
+// the stock if EntryAngle is set.
+func (vm *Machine) entry(from Position, index int, safetyHeight float64) ([]Position, error) {
+	start := vm.Positions[index-1]
+	state, err := vm.StateAt(index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retract and traverse with everything stopped
+	idle := idleState(state)
+	retract := Position{State: idle, X: from.X, Y: from.Y, Z: safetyHeight}
+	traverse := Position{State: idle, X: start.X, Y: start.Y, Z: safetyHeight}
+
+	// Restore state and feed down to the start of the move
+	approach := Position{State: state, X: start.X, Y: start.Y, Z: start.Z}
+	if start.Z < safetyHeight {
+		approach.State.MoveMode = MoveModeLinear
+	} else {
+		approach.State.MoveMode = MoveModeRapid
+	}
+	if ramp := vm.EntryRamp(approach, vm.Positions[index], safetyHeight); ramp != nil {
+		return append([]Position{retract, traverse}, ramp...), nil
+	}
+	return []Position{retract, traverse, approach}, nil
+}
+
+// Returns the modal state in effect for the move to the position at index:
+// tool, tool length offset, spindle, coolant, feed mode and feedrate. As
+// every position carries the complete modal state, it is taken from the
+// position itself, except for dwells, which are not part of the state, and
+// keep the move mode of the move before them. Coordinate system offsets are
+// already applied to the position stack, and need no further handling.
+func (vm *Machine) StateAt(index int) (State, error) {
+	if index < 0 || index >= len(vm.Positions) {
+		return State{}, errors.New(fmt.Sprintf("Position index %d out of range (0-%d)", index, len(vm.Positions)-1))
+	}
+
+	state := vm.Positions[index].State
+	state.DwellTime = 0
+	for idx := index; state.MoveMode == MoveModeDwell; idx-- {
+		if idx == 0 {
+			state.MoveMode = MoveModeNone
+		} else {
+			state.MoveMode = vm.Positions[idx-1].State.MoveMode
+		}
+	}
+	return state, nil
+}
+
+// Returns the index of the first position made by the block at line, or by
+// a later block if it made none, for restarting a program at a line.
+func (vm *Machine) IndexAtLine(line int) (int, error) {
+	for idx, pos := range vm.Positions {
+		if pos.Line >= line && pos.Line > 0 {
+			return idx, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("No moves at or after line %d", line))
+}
@@ -0,0 +1,96 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "errors"
+
+// Rewrites the position stack to run only the operations for which keep
+// returns true, given the index of the operation in Operations and the
+// operation itself, such as to recut a single pocket or to run the work of
+// one tool.
+//
+// Runs of kept operations that follow each other in the program keep the
+// moves between them. Before the others, the tool retracts to safety height
+// and traverses to the start of the operation with everything stopped, and
+// the state of the operation (tool, spindle, coolant, feed) is restored as the
+// tool feeds down, as when resuming a job. After the last, the tool retracts
+// to safety height with the spindle and coolant stopped.
+func (vm *Machine) SelectOperations(keep func(int, Operation) bool) error {
+	safetyHeight := vm.FindSafetyHeight()
+	npos := []Position{vm.Positions[0]}
+	ops := vm.Operations()
+
+	selected := false
+	for idx := 0; idx < len(ops); idx++ {
+		if !keep(idx, ops[idx]) {
+			continue
+		}
+		start := ops[idx].Start
+		for idx+1 < len(ops) && keep(idx+1, ops[idx+1]) {
+			idx++
+		}
+
+		entry, err := vm.entry(npos[len(npos)-1], start, safetyHeight)
+		if err != nil {
+			return err
+		}
+		npos = append(npos, entry...)
+		npos = append(npos, vm.Positions[start:ops[idx].End]...)
+		selected = true
+	}
+	if !selected {
+		return errors.New("No operations selected")
+	}
+
+	last := npos[len(npos)-1]
+	npos = append(npos, Position{State: idleState(last.State), X: last.X, Y: last.Y, Z: safetyHeight})
+	vm.Positions = npos
+	return nil
+}
+
+// The job of a single tool, split from a program by SplitByTool.
+type ToolJob struct {
+	Tool    int
+	Machine *Machine
+}
+
+// Splits the job into a job per tool, in the order the tools are first used,
+// for running with all toolchanges between jobs. Each job runs the
+// operations of its tool as selected by SelectOperations, and returns to the
+// home position at the end if it is set, such as to X0 Y0 Z0.
+func (vm *Machine) SplitByTool(home *vector.Vector) ([]ToolJob, error) {
+	var jobs []ToolJob
+	seen := make(map[int]bool)
+	for _, op := range vm.Operations() {
+		if seen[op.Tool] {
+			continue
+		}
+		seen[op.Tool] = true
+
+		tool := op.Tool
+		m := vm.Clone()
+		if err := m.SelectOperations(func(_ int, op Operation) bool { return op.Tool == tool }); err != nil {
+			return nil, err
+		}
+		if home != nil {
+			m.ReturnTo(*home, true, true)
+		}
+		jobs = append(jobs, ToolJob{Tool: tool, Machine: m})
+	}
+	if len(jobs) == 0 {
+		return nil, errors.New("No operations to split")
+	}
+	return jobs, nil
+}
+
+// Returns the position stack running the jobs one after another.
+func JoinJobs(jobs []ToolJob) []Position {
+	var positions []Position
+	for idx, job := range jobs {
+		if idx == 0 {
+			positions = append(positions, job.Machine.Positions...)
+		} else {
+			positions = append(positions, job.Machine.Positions[1:]...)
+		}
+	}
+	return positions
+}
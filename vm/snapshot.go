@@ -0,0 +1,47 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+
+// A saved copy of a machine, to roll back to with Machine.Restore.
+type Snapshot struct {
+	machine *Machine
+}
+
+// Returns a deep copy of the machine, including its position stack,
+// coordinate systems, tool table and coolant codes, which can be changed
+// without affecting the original.
+func (vm *Machine) Clone() *Machine {
+	return vm.cloneWith(append([]Position(nil), vm.Positions...))
+}
+
+// Returns a deep copy of the machine, other than using the given position stack.
+func (vm *Machine) cloneWith(positions []Position) *Machine {
+	c := *vm
+	c.Positions = positions
+	c.CoordinateSystem.coordinateSystems = append([]vector.Vector(nil), vm.CoordinateSystem.coordinateSystems...)
+	c.CoordinateSystem.rotations = append([]float64(nil), vm.CoordinateSystem.rotations...)
+	if vm.Tools != nil {
+		c.Tools = make(map[int]Tool, len(vm.Tools))
+		for index, t := range vm.Tools {
+			c.Tools[index] = t
+		}
+	}
+	if vm.CoolantCodes != nil {
+		c.CoolantCodes = make(map[int]CoolantCodes, len(vm.CoolantCodes))
+		for channel, codes := range vm.CoolantCodes {
+			c.CoolantCodes[channel] = codes
+		}
+	}
+	return &c
+}
+
+// Saves the machine, such as before trying an optimization or transform.
+func (vm *Machine) Snapshot() Snapshot {
+	return Snapshot{vm.Clone()}
+}
+
+// Rolls the machine back to a snapshot. A snapshot can be restored any number
+// of times.
+func (vm *Machine) Restore(s Snapshot) {
+	*vm = *s.machine.Clone()
+}
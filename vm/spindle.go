@@ -0,0 +1,74 @@
+package vm
+
+import "math"
+
+// A range of spindle speeds (RPM), such as that of a spindle, or of a gear or
+// VFD setting of one.
+type SpindleRange struct {
+	Min, Max float64
+}
+
+// A spindle speed outside the ranges of the machine.
+type SpindleViolation struct {
+	Index   int     // Index of the first position with the speed
+	Line    int     // Line of the block that made the move, 0 if unknown
+	Speed   float64 // RPM
+	Nearest float64 // Nearest speed within a range (RPM)
+}
+
+// Returns the speed within the ranges nearest to speed, and whether speed is
+// within one already.
+func nearestSpindleSpeed(speed float64, ranges []SpindleRange) (float64, bool) {
+	nearest, dist := speed, math.Inf(1)
+	for _, r := range ranges {
+		s := math.Min(math.Max(speed, r.Min), r.Max)
+		if s == speed {
+			return speed, true
+		}
+		if d := math.Abs(s - speed); d < dist {
+			nearest, dist = s, d
+		}
+	}
+	return nearest, false
+}
+
+// Checks the speed of every position with the spindle running against the
+// ranges, which may leave gaps between them, such as between the gears of a
+// spindle. Each change to a speed outside the ranges is reported once. With
+// clamp set, such speeds are replaced by the nearest speed within a range.
+func (vm *Machine) CheckSpindleSpeeds(ranges []SpindleRange, clamp bool) []SpindleViolation {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	var (
+		res  []SpindleViolation
+		last = math.NaN() // Last speed outside the ranges
+	)
+	for idx := range vm.Positions {
+		s := &vm.Positions[idx].State
+		if !s.SpindleEnabled {
+			last = math.NaN()
+			continue
+		}
+
+		nearest, ok := nearestSpindleSpeed(s.SpindleSpeed, ranges)
+		if ok {
+			last = math.NaN()
+			continue
+		}
+		if s.SpindleSpeed != last {
+			res = append(res, SpindleViolation{
+				Index:   idx,
+				Line:    vm.Positions[idx].Line,
+				Speed:   s.SpindleSpeed,
+				Nearest: nearest,
+			})
+			last = s.SpindleSpeed
+		}
+		if clamp {
+			s.SpindleSpeed = nearest
+		}
+	}
+	return res
+}
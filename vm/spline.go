@@ -0,0 +1,122 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+//
+// Spline moves
+//
+// G5 moves along a cubic Bezier curve in the XY plane, with I and J giving
+// the first control point relative to the start, and P and Q the second
+// relative to the end. I and J can be left out when continuing from another
+// G5, in which case the curves join smoothly. G5.1 moves along a quadratic
+// Bezier curve, with I and J giving the control point relative to the start.
+//
+// Splines are approximated by linear moves within MaxArcDeviation, like arcs,
+// with Z moving linearly along the curve.
+//
+
+// The maximum depth of spline subdivision, limiting a spline to 2^16 moves
+const maxSplineDepth = 16
+
+// Returns the control points of the spline move of the statement to x, y,
+// in absolute coordinates.
+func (vm *Machine) splineControls(stmt *gcode.Block, x, y float64, continues bool) []vector.Vector {
+	sp := vm.curPos()
+	scale := 1.0
+	if vm.Imperial {
+		scale = 25.4
+	}
+
+	// Retrieves an offset given by a pair of words, which must be given together
+	offset := func(a, b rune) (vector.Vector, bool) {
+		u, errU := stmt.GetWord(a)
+		v, errV := stmt.GetWord(b)
+		if errU != nil && errV != nil {
+			return vector.Vector{}, false
+		}
+		if errU != nil || errV != nil {
+			invalidCommand("motionGroup", "spline", string(a)+" and "+string(b)+" words must be given together")
+		}
+		return vector.Vector{u * scale, v * scale, 0}, true
+	}
+
+	if vm.State.MoveMode == MoveModeQuadraticSpline {
+		c, ok := offset('I', 'J')
+		if !ok {
+			invalidCommand("motionGroup", "spline", "I and J words not specified")
+		}
+		return []vector.Vector{{sp.X + c.X, sp.Y + c.Y, 0}}
+	}
+
+	pq, ok := offset('P', 'Q')
+	if !ok {
+		invalidCommand("motionGroup", "spline", "P and Q words not specified")
+	}
+
+	var c1 vector.Vector
+	if ij, ok := offset('I', 'J'); ok {
+		c1 = vector.Vector{sp.X + ij.X, sp.Y + ij.Y, 0}
+	} else if continues {
+		// Mirror the second control point of the last spline
+		c1 = vector.Vector{2*sp.X - vm.splineControl.X, 2*sp.Y - vm.splineControl.Y, 0}
+	} else {
+		invalidCommand("motionGroup", "spline", "I and J words not specified, and not continuing a G5 spline")
+	}
+
+	c2 := vector.Vector{x + pq.X, y + pq.Y, 0}
+	vm.splineControl = c2
+	vm.splineValid = true
+	return []vector.Vector{c1, c2}
+}
+
+// Evaluates the Bezier curve through the points at t, by de Casteljau's algorithm.
+func bezier(points []vector.Vector, t float64) vector.Vector {
+	p := append([]vector.Vector(nil), points...)
+	for n := len(p) - 1; n > 0; n-- {
+		for idx := 0; idx < n; idx++ {
+			p[idx] = p[idx].Sum(p[idx+1].Diff(p[idx]).Multiply(t))
+		}
+	}
+	return p[0]
+}
+
+// Approximates a spline move to x, y, z through the given control points.
+func (vm *Machine) spline(x, y, z float64, controls []vector.Vector) {
+	sp := vm.curPos()
+	if math.IsNaN(x) || math.IsNaN(y) || math.IsNaN(z) {
+		panic("Internal failure: Spline attempted with NaN value")
+	}
+
+	// Ensure that we work on linear moves
+	oldState := vm.State.MoveMode
+	vm.State.MoveMode = MoveModeLinear
+	defer func() {
+		vm.State.MoveMode = oldState
+	}()
+
+	points := []vector.Vector{{sp.X, sp.Y, 0}}
+	points = append(points, controls...)
+	points = append(points, vector.Vector{x, y, 0})
+
+	// Splits the curve from t0 to t1 until it is within the deviation of a
+	// straight line, or too short to be split further
+	var subdivide func(t0, t1 float64, p0, p1 vector.Vector, depth int)
+	subdivide = func(t0, t1 float64, p0, p1 vector.Vector, depth int) {
+		tm := (t0 + t1) / 2
+		pm := bezier(points, tm)
+		length := math.Hypot(pm.X-p0.X, pm.Y-p0.Y) + math.Hypot(p1.X-pm.X, p1.Y-pm.Y)
+		if depth < maxSplineDepth && length >= 2*vm.MinArcLineLength {
+			for _, f := range []float64{0.25, 0.5, 0.75} {
+				if segmentDistance(bezier(points, t0+(t1-t0)*f), p0, p1) > vm.MaxArcDeviation {
+					subdivide(t0, tm, p0, pm, depth+1)
+					subdivide(tm, t1, pm, p1, depth+1)
+					return
+				}
+			}
+		}
+		vm.move(p1.X, p1.Y, sp.Z+(z-sp.Z)*t1)
+	}
+	subdivide(0, 1, points[0], points[len(points)-1], 0)
+}
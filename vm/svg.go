@@ -0,0 +1,677 @@
+package vm
+
+import "encoding/xml"
+import "io"
+import "math"
+import "strconv"
+import "strings"
+import "errors"
+import "fmt"
+
+// Settings for cutting imported SVG paths. Lengths are in mm.
+type SVGSettings struct {
+	SafetyHeight   float64 // Height to move between paths at
+	Depth          float64 // Depth to cut to (negative)
+	Stepdown       float64 // Maximum depth of each pass (<= 0 for a single pass)
+	Feedrate       float64 // Cutting feedrate (mm/min)
+	PlungeFeedrate float64 // Plunge feedrate (mm/min)
+	SpindleSpeed   float64 // Spindle speed (RPM, <= 0 to leave the spindle off)
+	Tolerance      float64 // Maximum deviation of the cut from curves
+	Scale          float64 // mm per user unit (<= 0 to take it from the document)
+}
+
+// A 2D affine transform, mapping x, y to a*x + c*y + e, b*x + d*y + f.
+type svgTransform [6]float64
+
+var svgIdentity = svgTransform{1, 0, 0, 1, 0, 0}
+
+// Returns the transform applying o first, then t.
+func (t svgTransform) then(o svgTransform) svgTransform {
+	return svgTransform{
+		t[0]*o[0] + t[2]*o[1], t[1]*o[0] + t[3]*o[1],
+		t[0]*o[2] + t[2]*o[3], t[1]*o[2] + t[3]*o[3],
+		t[0]*o[4] + t[2]*o[5] + t[4], t[1]*o[4] + t[3]*o[5] + t[5],
+	}
+}
+
+func (t svgTransform) apply(p [2]float64) [2]float64 {
+	return [2]float64{t[0]*p[0] + t[2]*p[1] + t[4], t[1]*p[0] + t[3]*p[1] + t[5]}
+}
+
+// Returns how much the transform scales lengths, on average.
+func (t svgTransform) scale() float64 {
+	return math.Sqrt(math.Abs(t[0]*t[3] - t[1]*t[2]))
+}
+
+// Splits a list of numbers separated by commas and whitespace, such as
+// "1,2 3-4", into numbers.
+func svgNumbers(s string) ([]float64, error) {
+	var res []float64
+	p := svgParser{s: s}
+	for p.skip(); p.idx < len(p.s); p.skip() {
+		v, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// Parses a transform attribute, such as "translate(10) scale(2)".
+func svgParseTransform(s string) (svgTransform, error) {
+	t := svgIdentity
+	for _, part := range strings.Split(s, ")") {
+		part = strings.Trim(part, " \t\r\n,")
+		if part == "" {
+			continue
+		}
+		idx := strings.IndexByte(part, '(')
+		if idx == -1 {
+			return t, errors.New(fmt.Sprintf("Invalid transform: %s", s))
+		}
+		name := strings.TrimSpace(part[:idx])
+		v, err := svgNumbers(part[idx+1:])
+		if err != nil {
+			return t, errors.New(fmt.Sprintf("Invalid transform: %s", s))
+		}
+
+		var o svgTransform
+		switch {
+		case name == "matrix" && len(v) == 6:
+			copy(o[:], v)
+		case name == "translate" && len(v) == 1:
+			o = svgTransform{1, 0, 0, 1, v[0], 0}
+		case name == "translate" && len(v) == 2:
+			o = svgTransform{1, 0, 0, 1, v[0], v[1]}
+		case name == "scale" && len(v) == 1:
+			o = svgTransform{v[0], 0, 0, v[0], 0, 0}
+		case name == "scale" && len(v) == 2:
+			o = svgTransform{v[0], 0, 0, v[1], 0, 0}
+		case name == "rotate" && (len(v) == 1 || len(v) == 3):
+			a := v[0] * math.Pi / 180
+			o = svgTransform{math.Cos(a), math.Sin(a), -math.Sin(a), math.Cos(a), 0, 0}
+			if len(v) == 3 {
+				o = svgTransform{1, 0, 0, 1, v[1], v[2]}.then(o).then(svgTransform{1, 0, 0, 1, -v[1], -v[2]})
+			}
+		case name == "skewX" && len(v) == 1:
+			o = svgTransform{1, 0, math.Tan(v[0] * math.Pi / 180), 1, 0, 0}
+		case name == "skewY" && len(v) == 1:
+			o = svgTransform{1, math.Tan(v[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return t, errors.New(fmt.Sprintf("Invalid transform: %s", s))
+		}
+		t = t.then(o)
+	}
+	return t, nil
+}
+
+// Parses a length with an absolute unit into mm. Returns false for lengths
+// that are missing or relative.
+func svgLength(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	units := map[string]float64{"mm": 1, "cm": 10, "in": 25.4, "pt": 25.4 / 72, "pc": 25.4 / 6, "px": 25.4 / 96}
+	unit := 25.4 / 96
+	for suffix, mm := range units {
+		if strings.HasSuffix(s, suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, suffix)), mm
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * unit, true
+}
+
+// A flattened path, in mm.
+type svgPath struct {
+	points [][2]float64
+	closed bool
+}
+
+// Parser of path data and number lists.
+type svgParser struct {
+	s   string
+	idx int
+}
+
+// Skips whitespace and commas.
+func (p *svgParser) skip() {
+	for p.idx < len(p.s) && strings.IndexByte(" \t\r\n,", p.s[p.idx]) != -1 {
+		p.idx++
+	}
+}
+
+// Parses a number, which ends where it can no longer continue, so "1.5.5"
+// is 1.5 and .5, and "1-2" is 1 and -2.
+func (p *svgParser) number() (float64, error) {
+	p.skip()
+	start := p.idx
+	if p.idx < len(p.s) && (p.s[p.idx] == '-' || p.s[p.idx] == '+') {
+		p.idx++
+	}
+	dot, exp := false, false
+	for p.idx < len(p.s) {
+		c := p.s[p.idx]
+		switch {
+		case c >= '0' && c <= '9':
+		case c == '.' && !dot && !exp:
+			dot = true
+		case (c == 'e' || c == 'E') && !exp && p.idx > start:
+			exp = true
+			if p.idx+1 < len(p.s) && (p.s[p.idx+1] == '-' || p.s[p.idx+1] == '+') {
+				p.idx++
+			}
+		default:
+			goto done
+		}
+		p.idx++
+	}
+done:
+	v, err := strconv.ParseFloat(p.s[start:p.idx], 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid number at %d: %s", start, p.s))
+	}
+	return v, nil
+}
+
+// Parses an arc flag, which need not be separated from what follows.
+func (p *svgParser) flag() (bool, error) {
+	p.skip()
+	if p.idx < len(p.s) && (p.s[p.idx] == '0' || p.s[p.idx] == '1') {
+		p.idx++
+		return p.s[p.idx-1] == '1', nil
+	}
+	return false, errors.New(fmt.Sprintf("Invalid arc flag at %d: %s", p.idx, p.s))
+}
+
+// Returns whether a number follows, repeating the last command.
+func (p *svgParser) more() bool {
+	p.skip()
+	return p.idx < len(p.s) && strings.IndexByte("0123456789.-+", p.s[p.idx]) != -1
+}
+
+// Flattens shapes into paths, with curves split into lines deviating at most
+// tolerance from them.
+type svgFlattener struct {
+	transform svgTransform
+	tolerance float64 // In user units
+	paths     []svgPath
+	current   *svgPath
+}
+
+func (f *svgFlattener) moveTo(p [2]float64) {
+	f.paths = append(f.paths, svgPath{points: [][2]float64{f.transform.apply(p)}})
+	f.current = &f.paths[len(f.paths)-1]
+}
+
+func (f *svgFlattener) lineTo(p [2]float64) {
+	f.current.points = append(f.current.points, f.transform.apply(p))
+}
+
+func (f *svgFlattener) close() {
+	if f.current != nil && len(f.current.points) > 1 {
+		f.current.closed = true
+	}
+}
+
+// Flattens a cubic bezier from p0, by subdividing it until its control points
+// are within tolerance of its chord.
+func (f *svgFlattener) cubic(p0, p1, p2, p3 [2]float64, depth int) {
+	dist := func(p [2]float64) float64 {
+		dx, dy := p3[0]-p0[0], p3[1]-p0[1]
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			return math.Hypot(p[0]-p0[0], p[1]-p0[1])
+		}
+		return math.Abs((p[0]-p0[0])*dy-(p[1]-p0[1])*dx) / l
+	}
+	if depth >= 16 || math.Max(dist(p1), dist(p2)) <= f.tolerance {
+		f.lineTo(p3)
+		return
+	}
+	mid := func(a, b [2]float64) [2]float64 { return [2]float64{(a[0] + b[0]) / 2, (a[1] + b[1]) / 2} }
+	p01, p12, p23 := mid(p0, p1), mid(p1, p2), mid(p2, p3)
+	p012, p123 := mid(p01, p12), mid(p12, p23)
+	m := mid(p012, p123)
+	f.cubic(p0, p01, p012, m, depth+1)
+	f.cubic(m, p123, p23, p3, depth+1)
+}
+
+// Flattens an elliptical arc from p0 to p, given as in SVG path data.
+func (f *svgFlattener) arc(p0 [2]float64, rx, ry, rotation float64, large, sweep bool, p [2]float64) {
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 || p0 == p {
+		f.lineTo(p)
+		return
+	}
+
+	// Find the center, as in the SVG implementation notes
+	phi := rotation * math.Pi / 180
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	dx, dy := (p0[0]-p[0])/2, (p0[1]-p[1])/2
+	x1, y1 := cos*dx+sin*dy, -sin*dx+cos*dy
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	k := math.Sqrt(math.Max(num/den, 0))
+	if large == sweep {
+		k = -k
+	}
+	cx1, cy1 := k*rx*y1/ry, -k*ry*x1/rx
+	cx, cy := cos*cx1-sin*cy1+(p0[0]+p[0])/2, sin*cx1+cos*cy1+(p0[1]+p[1])/2
+
+	angle := func(ux, uy float64) float64 { return math.Atan2(uy, ux) }
+	theta := angle((x1-cx1)/rx, (y1-cy1)/ry)
+	delta := angle((-x1-cx1)/rx, (-y1-cy1)/ry) - theta
+	if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	} else if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	}
+
+	r := math.Max(rx, ry)
+	step := math.Pi / 2
+	if f.tolerance < r {
+		step = 2 * math.Acos(1-f.tolerance/r)
+	}
+	n := int(math.Ceil(math.Abs(delta) / step))
+	for i := 1; i < n; i++ {
+		a := theta + delta*float64(i)/float64(n)
+		ex, ey := rx*math.Cos(a), ry*math.Sin(a)
+		f.lineTo([2]float64{cos*ex - sin*ey + cx, sin*ex + cos*ey + cy})
+	}
+	f.lineTo(p)
+}
+
+// Flattens path data.
+func (f *svgFlattener) path(d string) error {
+	p := svgParser{s: d}
+	var (
+		cur, start, ctrl [2]float64
+		cmd, last        byte
+	)
+	for p.skip(); p.idx < len(p.s); p.skip() {
+		if c := p.s[p.idx]; strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) != -1 {
+			cmd = c
+			p.idx++
+		} else if cmd == 0 || cmd == 'Z' || cmd == 'z' {
+			return errors.New(fmt.Sprintf("Invalid path data at %d: %s", p.idx, d))
+		}
+
+		rel := cmd >= 'a'
+		point := func() ([2]float64, error) {
+			x, err := p.number()
+			if err != nil {
+				return cur, err
+			}
+			y, err := p.number()
+			if err != nil {
+				return cur, err
+			}
+			if rel {
+				return [2]float64{cur[0] + x, cur[1] + y}, nil
+			}
+			return [2]float64{x, y}, nil
+		}
+		reflect := func(prev ...byte) [2]float64 {
+			for _, c := range prev {
+				if last == c || last == c+'a'-'A' {
+					return [2]float64{2*cur[0] - ctrl[0], 2*cur[1] - ctrl[1]}
+				}
+			}
+			return cur
+		}
+
+		var err error
+		upper := cmd &^ 0x20
+		if upper != 'Z' && upper != 'M' && f.current == nil {
+			f.moveTo(cur)
+		}
+		switch upper {
+		case 'M':
+			if cur, err = point(); err == nil {
+				start = cur
+				f.moveTo(cur)
+				// Further pairs are lines
+				if rel {
+					cmd = 'l'
+				} else {
+					cmd = 'L'
+				}
+			}
+		case 'L':
+			if cur, err = point(); err == nil {
+				f.lineTo(cur)
+			}
+		case 'H', 'V':
+			var v float64
+			if v, err = p.number(); err == nil {
+				i := 0
+				if upper == 'V' {
+					i = 1
+				}
+				if rel {
+					cur[i] += v
+				} else {
+					cur[i] = v
+				}
+				f.lineTo(cur)
+			}
+		case 'C', 'S':
+			var c1, c2, end [2]float64
+			if upper == 'C' {
+				c1, err = point()
+			} else {
+				c1 = reflect('C', 'S')
+			}
+			if err == nil {
+				c2, err = point()
+			}
+			if err == nil {
+				end, err = point()
+			}
+			if err == nil {
+				f.cubic(cur, c1, c2, end, 0)
+				cur, ctrl = end, c2
+			}
+		case 'Q', 'T':
+			var c, end [2]float64
+			if upper == 'Q' {
+				c, err = point()
+			} else {
+				c = reflect('Q', 'T')
+			}
+			if err == nil {
+				end, err = point()
+			}
+			if err == nil {
+				// As the cubic with the same curve
+				c1 := [2]float64{cur[0] + 2*(c[0]-cur[0])/3, cur[1] + 2*(c[1]-cur[1])/3}
+				c2 := [2]float64{end[0] + 2*(c[0]-end[0])/3, end[1] + 2*(c[1]-end[1])/3}
+				f.cubic(cur, c1, c2, end, 0)
+				cur, ctrl = end, c
+			}
+		case 'A':
+			var rx, ry, rot float64
+			var large, sweep bool
+			var end [2]float64
+			if rx, err = p.number(); err == nil {
+				if ry, err = p.number(); err == nil {
+					if rot, err = p.number(); err == nil {
+						if large, err = p.flag(); err == nil {
+							if sweep, err = p.flag(); err == nil {
+								end, err = point()
+							}
+						}
+					}
+				}
+			}
+			if err == nil {
+				f.arc(cur, rx, ry, rot, large, sweep, end)
+				cur = end
+			}
+		case 'Z':
+			f.close()
+			cur = start
+			f.current = nil
+		}
+		if err != nil {
+			return err
+		}
+		last = cmd
+
+		// Commands other than close repeat while numbers follow
+		if upper != 'Z' && !p.more() {
+			cmd = 0
+		}
+	}
+	return nil
+}
+
+// Returns the value of an attribute.
+func svgAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Returns the values of numeric attributes, which are 0 if missing.
+func svgAttrs(e xml.StartElement, names ...string) ([]float64, error) {
+	res := make([]float64, len(names))
+	for i, name := range names {
+		s := strings.TrimSpace(svgAttr(e, name))
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSuffix(s, "px"), 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid %s of %s: %s", name, e.Name.Local, s))
+		}
+		res[i] = v
+	}
+	return res, nil
+}
+
+// Flattens a shape element.
+func (f *svgFlattener) shape(e xml.StartElement) error {
+	switch e.Name.Local {
+	case "path":
+		return f.path(svgAttr(e, "d"))
+	case "line":
+		v, err := svgAttrs(e, "x1", "y1", "x2", "y2")
+		if err != nil {
+			return err
+		}
+		f.moveTo([2]float64{v[0], v[1]})
+		f.lineTo([2]float64{v[2], v[3]})
+	case "polyline", "polygon":
+		v, err := svgNumbers(svgAttr(e, "points"))
+		if err != nil || len(v) < 4 || len(v)%2 != 0 {
+			return errors.New(fmt.Sprintf("Invalid points of %s", e.Name.Local))
+		}
+		f.moveTo([2]float64{v[0], v[1]})
+		for i := 2; i < len(v); i += 2 {
+			f.lineTo([2]float64{v[i], v[i+1]})
+		}
+		if e.Name.Local == "polygon" {
+			f.close()
+		}
+	case "rect":
+		v, err := svgAttrs(e, "x", "y", "width", "height")
+		if err != nil {
+			return err
+		}
+		f.moveTo([2]float64{v[0], v[1]})
+		f.lineTo([2]float64{v[0] + v[2], v[1]})
+		f.lineTo([2]float64{v[0] + v[2], v[1] + v[3]})
+		f.lineTo([2]float64{v[0], v[1] + v[3]})
+		f.close()
+	case "circle", "ellipse":
+		v, err := svgAttrs(e, "cx", "cy", "r", "rx", "ry")
+		if err != nil {
+			return err
+		}
+		rx, ry := v[3], v[4]
+		if e.Name.Local == "circle" {
+			rx, ry = v[2], v[2]
+		}
+		start := [2]float64{v[0] + rx, v[1]}
+		f.moveTo(start)
+		f.arc(start, rx, ry, 0, false, true, [2]float64{v[0] - rx, v[1]})
+		f.arc([2]float64{v[0] - rx, v[1]}, rx, ry, 0, false, true, start)
+		f.close()
+	}
+	f.current = nil
+	return nil
+}
+
+// Imports the paths and shapes of an SVG drawing, cutting along each at the
+// depth in passes of at most the stepdown. Closed paths are cut around and
+// around, and open paths back and forth. Curves are split into lines within
+// the tolerance. The tool follows the paths themselves, so use
+// Machine.OffsetContours to cut beside closed paths, such as for board
+// outlines.
+//
+// The drawing is scaled to mm by its width and viewBox, unless the scale is
+// given, and flipped so its bottom left corner is at X0 Y0. Lines, rects
+// without rounded corners, circles, ellipses, polylines, polygons and paths
+// are cut. Text, images, styles and the contents of defs are ignored.
+func (vm *Machine) ImportSVG(r io.Reader, s SVGSettings) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	if s.Tolerance <= 0 {
+		return errors.New("Tolerance must be positive")
+	}
+
+	var (
+		transforms []svgTransform
+		skip       int // Depth within elements that are not drawn
+		paths      []svgPath
+	)
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch e := token.(type) {
+		case xml.StartElement:
+			if skip > 0 || e.Name.Local == "defs" || e.Name.Local == "clipPath" || e.Name.Local == "mask" ||
+				e.Name.Local == "symbol" || e.Name.Local == "marker" || e.Name.Local == "pattern" {
+				skip++
+				continue
+			}
+
+			t := svgIdentity
+			if len(transforms) == 0 {
+				if e.Name.Local != "svg" {
+					return errors.New("Not an SVG drawing")
+				}
+				t = svgDocumentTransform(e, s.Scale)
+			} else {
+				t = transforms[len(transforms)-1]
+			}
+			if a := svgAttr(e, "transform"); a != "" {
+				o, err := svgParseTransform(a)
+				if err != nil {
+					return err
+				}
+				t = t.then(o)
+			}
+			transforms = append(transforms, t)
+
+			f := svgFlattener{transform: t, tolerance: s.Tolerance / t.scale()}
+			if err := f.shape(e); err != nil {
+				return err
+			}
+			paths = append(paths, f.paths...)
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+			} else if len(transforms) > 0 {
+				transforms = transforms[:len(transforms)-1]
+			}
+		}
+	}
+
+	var levels []float64
+	if s.Stepdown > 0 {
+		for z := -s.Stepdown; z > s.Depth; z -= s.Stepdown {
+			levels = append(levels, z)
+		}
+	}
+	levels = append(levels, s.Depth)
+
+	cur := vm.curPos()
+	vm.State.MoveMode = MoveModeRapid
+	vm.move(cur.X, cur.Y, s.SafetyHeight)
+	if s.SpindleSpeed > 0 {
+		vm.State.SpindleEnabled = true
+		vm.State.SpindleClockwise = true
+		vm.State.SpindleSpeed = s.SpindleSpeed
+	}
+
+	for _, p := range paths {
+		if len(p.points) < 2 {
+			continue
+		}
+		vm.State.MoveMode = MoveModeRapid
+		vm.move(p.points[0][0], p.points[0][1], s.SafetyHeight)
+
+		points := p.points
+		if p.closed && points[len(points)-1] != points[0] {
+			points = append(points, points[0])
+		}
+		for _, z := range levels {
+			vm.State.MoveMode = MoveModeLinear
+			vm.State.Feedrate = s.PlungeFeedrate
+			vm.move(points[0][0], points[0][1], z)
+			vm.State.Feedrate = s.Feedrate
+			for _, pt := range points[1:] {
+				vm.move(pt[0], pt[1], z)
+			}
+
+			// Open paths are cut back along themselves at the next depth
+			if !p.closed {
+				reversed := make([][2]float64, len(points))
+				for i, pt := range points {
+					reversed[len(points)-1-i] = pt
+				}
+				points = reversed
+			}
+		}
+		end := vm.curPos()
+		vm.State.MoveMode = MoveModeRapid
+		vm.move(end.X, end.Y, s.SafetyHeight)
+	}
+
+	// Stop the spindle
+	vm.State.SpindleEnabled = false
+	vm.finalize()
+	return nil
+}
+
+// Returns the transform of the root element, from user units to mm, with the
+// bottom left corner at the origin and Y up.
+func svgDocumentTransform(e xml.StartElement, scale float64) svgTransform {
+	var vb []float64
+	if a := svgAttr(e, "viewBox"); a != "" {
+		if v, err := svgNumbers(a); err == nil && len(v) == 4 && v[2] > 0 && v[3] > 0 {
+			vb = v
+		}
+	}
+	width, hasWidth := svgLength(svgAttr(e, "width"))
+	height, hasHeight := svgLength(svgAttr(e, "height"))
+
+	if scale <= 0 {
+		scale = 25.4 / 96
+		if vb != nil && hasWidth {
+			scale = width / vb[2]
+		}
+	}
+
+	// Flip around the bottom of the drawing, which is 0 if unknown
+	var minX, minY, bottom float64
+	switch {
+	case vb != nil:
+		minX, minY, bottom = vb[0], vb[1], vb[3]*scale
+	case hasHeight:
+		bottom = height / (25.4 / 96) * scale
+	}
+	return svgTransform{scale, 0, 0, -scale, -minX * scale, bottom + minY*scale}
+}
@@ -0,0 +1,15 @@
+(Tool table, dynamic tool length and work offsets set from the position)
+G21 G90 G40
+G10 L1 P1 R3 Z25
+M61 Q1
+G43 H1
+G0 X0 Y0 Z10
+G10 L10 P2 Z0
+G10 L20 P2 X0 Y0 Z0
+G55
+G0 X5 Y5
+G43.1 Z-1.5
+G1 Z-1 F100
+G49
+G0 Z10
+M30
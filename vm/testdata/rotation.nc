@@ -0,0 +1,13 @@
+(Square in a coordinate system rotated by 30 degrees)
+G21 G90 G17 G40
+G10 L2 P1 X10 Y10 R30
+G54
+G0 Z5
+G0 X0 Y0
+G1 Z-1 F200
+G1 X20
+G1 Y20
+G3 X0 Y20 I-10 J0
+G1 Y0
+G0 Z5
+M30
@@ -0,0 +1,42 @@
+package vm
+
+import "github.com/kennylevinsen/gocnc/vector"
+import "math"
+
+//
+// Tolerance
+//
+// Coordinates, feedrates and speeds go through unit conversions, offsets and
+// arc and optimization arithmetic, which leaves float noise, such as 1.0 ending
+// up as 0.9999999999999999. Comparing them exactly puts in words that do not
+// change anything, and misses moves that should be merged. Comparisons of
+// positions and states are instead made within a tolerance, set on the
+// Machine for the optimization passes, and by export.Tolerance for the
+// generators.
+//
+
+// The default tolerance, far below the resolution of any machine, yet above
+// the noise of float64 arithmetic on coordinates of a few metres.
+const DefaultTolerance = 1e-9
+
+// Returns whether a and b are equal within the tolerance.
+func Near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+// Returns whether a and b are equal within the tolerance of the machine.
+func (vm *Machine) Equal(a, b float64) bool {
+	return Near(a, b, vm.Tolerance)
+}
+
+// Returns whether two points are in the same place in XY within the
+// tolerance of the machine.
+func (vm *Machine) SameXY(a, b vector.Vector) bool {
+	return vm.Equal(a.X, b.X) && vm.Equal(a.Y, b.Y)
+}
+
+// Returns whether two points are in the same place within the tolerance of
+// the machine.
+func (vm *Machine) SamePoint(a, b vector.Vector) bool {
+	return vm.SameXY(a, b) && vm.Equal(a.Z, b.Z)
+}
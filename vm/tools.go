@@ -0,0 +1,23 @@
+package vm
+
+// A tool table entry. Lengths are in mm.
+type Tool struct {
+	Diameter float64
+	Length   float64
+	Flutes   int
+	BallNose bool
+}
+
+// Retrieves a tool from the tool table, and whether it was defined.
+func (vm *Machine) GetTool(index int) (Tool, bool) {
+	t, ok := vm.Tools[index]
+	return t, ok
+}
+
+// Sets a tool table entry.
+func (vm *Machine) SetTool(index int, t Tool) {
+	if vm.Tools == nil {
+		vm.Tools = make(map[int]Tool)
+	}
+	vm.Tools[index] = t
+}
@@ -1,15 +1,26 @@
 package vm
 
+import "github.com/kennylevinsen/gocnc/vector"
 import "errors"
 import "fmt"
 import "math"
+import "sort"
 import "time"
 
 // Flips the X and Y axes of all moves
 func (vm *Machine) FlipXY() {
 	for idx := range vm.Positions {
-		pos := vm.Positions[idx]
-		vm.Positions[idx].X, vm.Positions[idx].Y = pos.Y, pos.X
+		pos := &vm.Positions[idx]
+		pos.X, pos.Y = pos.Y, pos.X
+		pos.Center.X, pos.Center.Y = pos.Center.Y, pos.Center.X
+
+		// Mirroring reverses the direction of arcs
+		switch pos.State.MoveMode {
+		case MoveModeCWArc:
+			pos.State.MoveMode = MoveModeCCWArc
+		case MoveModeCCWArc:
+			pos.State.MoveMode = MoveModeCWArc
+		}
 	}
 }
 
@@ -22,6 +33,20 @@ func (vm *Machine) LimitFeedrate(feed float64) {
 	}
 }
 
+// Set the feedrate of all plunges into the stock, being linear moves straight
+// down to below Z0. Returns the number of plunges changed.
+func (vm *Machine) SetPlungeFeed(feed float64) (n int) {
+	for idx := 1; idx < len(vm.Positions); idx++ {
+		cur, next := vm.Positions[idx-1], vm.Positions[idx]
+		if !vm.isPlunge(cur, next) || next.Z >= 0 {
+			continue
+		}
+		vm.Positions[idx].State.Feedrate = feed
+		n++
+	}
+	return n
+}
+
 // Increase feedrate
 func (vm *Machine) FeedrateMultiplier(feedMultiplier float64) {
 	for idx := range vm.Positions {
@@ -35,9 +60,40 @@ func (vm *Machine) MoveMultiplier(moveMultiplier float64) {
 		vm.Positions[idx].X *= moveMultiplier
 		vm.Positions[idx].Y *= moveMultiplier
 		vm.Positions[idx].Z *= moveMultiplier
+		vm.Positions[idx].Center = vm.Positions[idx].Center.Multiply(moveMultiplier)
 	}
 }
 
+// Converts feeds per revolution (G95) to feeds per minute (G94) at the
+// programmed spindle speed, for controllers without G95, such as Grbl.
+// Positions other than cutting moves keep the last feed when the spindle is
+// stopped. Returns an error for cutting moves fed per revolution with the
+// spindle stopped, as they have no equivalent feed per minute.
+func (vm *Machine) FeedPerMinute() error {
+	last := 0.0
+	for idx := range vm.Positions {
+		pos := &vm.Positions[idx]
+		s := &pos.State
+		if s.FeedMode != FeedModeUnitsRev {
+			last = s.Feedrate
+			continue
+		}
+
+		switch {
+		case s.SpindleEnabled && s.SpindleSpeed > 0:
+			last = s.Feedrate * s.SpindleSpeed
+		case s.MoveMode == MoveModeLinear, s.MoveMode == MoveModeCWArc, s.MoveMode == MoveModeCCWArc:
+			if pos.Line > 0 {
+				return errors.New(fmt.Sprintf("line %d: feed per revolution with the spindle stopped", pos.Line))
+			}
+			return errors.New(fmt.Sprintf("position %d: feed per revolution with the spindle stopped", idx))
+		}
+		s.Feedrate = last
+		s.FeedMode = FeedModeUnitsMin
+	}
+	return nil
+}
+
 // Enforce spindle mode
 func (vm *Machine) EnforceSpindle(enabled, clockwise bool, speed float64) {
 	for idx := range vm.Positions {
@@ -47,6 +103,53 @@ func (vm *Machine) EnforceSpindle(enabled, clockwise bool, speed float64) {
 	}
 }
 
+// Inserts dwells for the spindle to reach speed after it is started, sped up
+// or reversed, of secondsPer1000 seconds for every 1000 RPM it has to gain.
+// As the spindle can ramp up during rapids, a dwell is only put in before the
+// first cutting move after the change, and is shortened by dwells already in
+// the program, such as those put in by CAM after M3. Returns the number of
+// dwells inserted.
+func (vm *Machine) SpindleRamp(secondsPer1000 float64) int {
+	var (
+		positions []Position
+		inserted  int
+		wait      float64
+		last      = NewState()
+	)
+
+	for idx, pos := range vm.Positions {
+		s := pos.State
+		if !s.SpindleEnabled {
+			wait = 0
+		} else if !last.SpindleEnabled || last.SpindleClockwise != s.SpindleClockwise {
+			wait += s.SpindleSpeed / 1000 * secondsPer1000
+		} else if s.SpindleSpeed > last.SpindleSpeed {
+			wait += (s.SpindleSpeed - last.SpindleSpeed) / 1000 * secondsPer1000
+		}
+		last = s
+
+		switch s.MoveMode {
+		case MoveModeDwell:
+			wait = math.Max(wait-s.DwellTime, 0)
+		case MoveModeLinear, MoveModeCWArc, MoveModeCCWArc:
+			if wait > 0 && idx > 0 {
+				dwell := vm.Positions[idx-1]
+				dwell.State = s
+				dwell.State.MoveMode = MoveModeDwell
+				dwell.State.DwellTime = wait
+				dwell.Line = pos.Line
+				positions = append(positions, dwell)
+				inserted++
+			}
+			wait = 0
+		}
+		positions = append(positions, pos)
+	}
+
+	vm.Positions = positions
+	return inserted
+}
+
 // Detect the highest Z position
 func (vm *Machine) FindSafetyHeight() float64 {
 	var maxz float64
@@ -58,108 +161,132 @@ func (vm *Machine) FindSafetyHeight() float64 {
 	return maxz
 }
 
-// Set safety-height.
-// Scans for the highest position on the Y axis, and afterwards replaces all instances
-// of this position with the requested height.
-func (vm *Machine) SetSafetyHeight(height float64) error {
-	// Ensure we detected the highest point in the script - we don't want any collisions
+// The moves at a clearance height rewritten by SetSafetyHeight.
+type ClearanceChange struct {
+	Height float64 // Clearance height the moves were at
+	Moves  int     // Number of positions moved to the new height
+}
 
-	maxz := vm.FindSafetyHeight()
-	nextz := 0.0
-	for _, m := range vm.Positions {
-		if m.Z < maxz && m.Z > nextz {
-			nextz = m.Z
+// Set safety-height.
+// Classifies the clearance moves of the job, which are the rapid moves between
+// the operations found by Operations at the highest Z above Z0 reached
+// between them, and moves them to the requested height. Programs using
+// several clearance heights, such as a higher one between tools, have all of
+// them replaced, while retract heights and other moves are left alone. The
+// height must be above all moves that are not clearance moves.
+// Returns the changes made, by clearance height in increasing order.
+func (vm *Machine) SetSafetyHeight(height float64) ([]ClearanceChange, error) {
+	clearance := make([]bool, len(vm.Positions))
+	travel := func(pos Position) bool {
+		return pos.State.MoveMode == MoveModeRapid || pos.State.MoveMode == MoveModeNone
+	}
+	classify := func(start, end int) {
+		var (
+			maxz  float64
+			found bool
+		)
+		for idx := start; idx < end; idx++ {
+			if pos := vm.Positions[idx]; travel(pos) && pos.Z > maxz {
+				maxz, found = pos.Z, true
+			}
+		}
+		if !found {
+			return
+		}
+		for idx := start; idx < end; idx++ {
+			if pos := vm.Positions[idx]; travel(pos) && vm.Equal(pos.Z, maxz) {
+				clearance[idx] = true
+			}
 		}
 	}
 
-	if height <= nextz {
-		return errors.New(fmt.Sprintf("New safety height collides with lower feed height of %g", nextz))
+	start := 0
+	for _, op := range vm.Operations() {
+		classify(start, op.Start)
+		start = op.End
+	}
+	classify(start, len(vm.Positions))
+
+	// Ensure the new height is above everything else - we don't want any collisions
+	for idx, pos := range vm.Positions {
+		if !clearance[idx] && pos.Z >= height {
+			return nil, errors.New(fmt.Sprintf("New safety height collides with move at height %g", pos.Z))
+		}
 	}
 
 	// Apply the changes
-	var lastx, lasty float64
-	for idx, m := range vm.Positions {
-		if lastx == m.X && lasty == m.Y && m.Z == maxz {
+	moves := make(map[float64]int)
+	for idx, pos := range vm.Positions {
+		if clearance[idx] && pos.Z != height {
+			moves[pos.Z]++
 			vm.Positions[idx].Z = height
 		}
-		lastx, lasty = m.X, m.Y
 	}
-	return nil
+
+	var changes []ClearanceChange
+	for z, n := range moves {
+		changes = append(changes, ClearanceChange{Height: z, Moves: n})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Height < changes[j].Height
+	})
+	return changes, nil
 }
 
 // Ensure return to X0 Y0 Z0.
 // Simply adds a what is necessary to move back to X0 Y0 Z0.
 func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
-	var maxz float64
+	vm.ReturnTo(vector.Vector{}, disableSpindle, disableCoolant)
+}
+
+// Ensure return to a position, such as a parking position clear of the
+// stock. The position is in the coordinates of the positions, which are
+// exported as work coordinates, not with G53. The tool rises to the highest
+// Z of the job, or of the position if higher, before moving over it, and
+// then moves down to it.
+func (vm *Machine) ReturnTo(target vector.Vector, disableSpindle, disableCoolant bool) {
+	if len(vm.Positions) == 0 {
+		return
+	}
+	maxz := target.Z
 	for _, m := range vm.Positions {
 		if m.Z > maxz {
 			maxz = m.Z
 		}
 	}
-	if len(vm.Positions) == 0 {
-		return
-	}
+
 	lastPos := vm.Positions[len(vm.Positions)-1]
-	if lastPos.X == 0 && lastPos.Y == 0 && lastPos.Z == 0 {
-		if disableSpindle {
-			lastPos.State.SpindleEnabled = false
-		}
-		if disableCoolant {
-			lastPos.State.MistCoolant = false
-			lastPos.State.FloodCoolant = false
-		}
-		vm.Positions[len(vm.Positions)-1] = lastPos
-		return
-	} else if lastPos.X == 0 && lastPos.Y == 0 && lastPos.Z != 0 {
-		lastPos.Z = 0
-		lastPos.State.MoveMode = MoveModeRapid
-		if disableSpindle {
-			lastPos.State.SpindleEnabled = false
+	var moves []Position
+	move := lastPos
+	move.State.MoveMode = MoveModeRapid
+	if !vm.SameXY(lastPos.Vector(), target) {
+		if !vm.Equal(move.Z, maxz) {
+			move.Z = maxz
+			moves = append(moves, move)
 		}
-		if disableCoolant {
-			lastPos.State.MistCoolant = false
-			lastPos.State.FloodCoolant = false
-		}
-		vm.Positions = append(vm.Positions, lastPos)
-		return
-	} else if lastPos.Z == maxz {
-		move1 := lastPos
-		move1.X = 0
-		move1.Y = 0
-		move1.State.MoveMode = MoveModeRapid
-		move2 := move1
-		move2.Z = 0
-		if disableSpindle {
-			move2.State.SpindleEnabled = false
-		}
-		if disableCoolant {
-			move2.State.MistCoolant = false
-			move2.State.FloodCoolant = false
-		}
-		vm.Positions = append(vm.Positions, move1)
-		vm.Positions = append(vm.Positions, move2)
-		return
-	} else {
-		move1 := lastPos
-		move1.Z = maxz
-		move1.State.MoveMode = MoveModeRapid
-		move2 := move1
-		move2.X = 0
-		move2.Y = 0
-		move3 := move2
-		move3.Z = 0
-		if disableSpindle {
-			move3.State.SpindleEnabled = false
-		}
-		if disableCoolant {
-			move3.State.MistCoolant = false
-			move3.State.FloodCoolant = false
-		}
-		vm.Positions = append(vm.Positions, move1)
-		vm.Positions = append(vm.Positions, move2)
-		vm.Positions = append(vm.Positions, move3)
-		return
+		move.X, move.Y = target.X, target.Y
+		moves = append(moves, move)
+	}
+	if !vm.Equal(move.Z, target.Z) {
+		move.Z = target.Z
+		moves = append(moves, move)
 	}
+
+	if len(moves) == 0 {
+		// Already there, so only stop the spindle and coolant
+		vm.Positions = vm.Positions[:len(vm.Positions)-1]
+		moves = append(moves, lastPos)
+	}
+	last := &moves[len(moves)-1]
+	if disableSpindle {
+		last.State.SpindleEnabled = false
+	}
+	if disableCoolant {
+		last.State.MistCoolant = false
+		last.State.FloodCoolant = false
+		last.State.Coolant = 0
+	}
+	vm.Positions = append(vm.Positions, moves...)
 }
 
 // Generate move information
@@ -199,16 +326,48 @@ func (vm *Machine) Info() (minx, miny, minz, maxx, maxy, maxz float64, feedrates
 
 // Estimate runtime for job
 func (m *Machine) ETA() time.Duration {
+	var eta time.Duration
+	for _, d := range m.PositionETAs() {
+		eta += d
+	}
+	return eta
+}
+
+// Estimate runtime for each position, including toolchanges and dwells.
+func (m *Machine) PositionETAs() []time.Duration {
+	etas := make([]time.Duration, len(m.Positions))
+	for idx, t := range m.positionTimes() {
+		etas[idx] = t.ToolChange + t.Move + t.Dwell
+	}
+	return etas
+}
+
+// Returns the distance travelled by the move from start to pos, along the arc
+// for arc moves.
+func moveDistance(start, pos Position) float64 {
+	if pos.State.MoveMode == MoveModeCWArc || pos.State.MoveMode == MoveModeCCWArc {
+		return ArcLength(start, pos)
+	}
+	return pos.Vector().Diff(start.Vector()).Norm()
+}
+
+// Estimated time of a position, by what it is spent on
+type positionTime struct {
+	ToolChange, Move, Dwell time.Duration
+}
+
+// Estimate runtime for each position, split into toolchange, move and dwell.
+func (m *Machine) positionTimes() []positionTime {
 	lastTool := -1
 	lastToolSuggestion := -1
-	var eta time.Duration
+	times := make([]positionTime, len(m.Positions))
 	var lx, ly, lz float64
-	for _, pos := range m.Positions {
-		if pos.State.ToolIndex != lastTool {
+	for idx, pos := range m.Positions {
+		if pos.State.ToolIndex != lastTool && !pos.State.ToolSet {
 			if pos.State.ToolIndex == lastToolSuggestion {
-				eta += 5 * time.Second
+				times[idx].ToolChange = 5 * time.Second
 			} else {
-				eta += 10 * time.Second
+				times[idx].ToolChange = 10 * time.Second
 			}
 		}
 		lastTool = pos.State.ToolIndex
@@ -230,14 +389,12 @@ func (m *Machine) ETA() time.Duration {
 			// This is silly, but it gives something to calculate with
 			feed *= 8
 		case MoveModeDwell:
-			eta += time.Duration(pos.State.DwellTime) * time.Second
+			times[idx].Dwell = time.Duration(pos.State.DwellTime) * time.Second
 			continue
 		}
-		dx, dy, dz := pos.X-lx, pos.Y-ly, pos.Z-lz
+		dist := moveDistance(Position{X: lx, Y: ly, Z: lz}, pos)
 		lx, ly, lz = pos.X, pos.Y, pos.Z
-
-		dist := math.Sqrt(math.Pow(dx, 2) + math.Pow(dy, 2) + math.Pow(dz, 2))
-		eta += time.Duration(dist/feed) * time.Microsecond
+		times[idx].Move = time.Duration(dist/feed) * time.Microsecond
 	}
-	return eta
+	return times
 }
@@ -0,0 +1,179 @@
+package vm_test
+
+import "github.com/kennylevinsen/gocnc/gcode"
+import "github.com/kennylevinsen/gocnc/gocnctest"
+import "github.com/kennylevinsen/gocnc/vm"
+import "path/filepath"
+import "math"
+import "testing"
+
+const epsilon = 1e-9
+
+// Runs a program through a fresh machine.
+func process(t *testing.T, code string) *vm.Machine {
+	t.Helper()
+	doc, err := gcode.Parse(code)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+	var m vm.Machine
+	m.Init()
+	if err := m.Process(doc); err != nil {
+		t.Fatalf("VM failed: %s", err)
+	}
+	return &m
+}
+
+// Returns the last position of a machine.
+func last(m *vm.Machine) vm.Position {
+	return m.Positions[len(m.Positions)-1]
+}
+
+// Fails unless the position is at x, y, z.
+func expectAt(t *testing.T, pos vm.Position, x, y, z float64) {
+	t.Helper()
+	if math.Abs(pos.X-x) > epsilon || math.Abs(pos.Y-y) > epsilon || math.Abs(pos.Z-z) > epsilon {
+		t.Errorf("Position X%g Y%g Z%g, expected X%g Y%g Z%g", pos.X, pos.Y, pos.Z, x, y, z)
+	}
+}
+
+func TestSetTool(t *testing.T) {
+	m := process(t, "G0 X1\nM61 Q3\nG0 X2\n")
+	pos := last(m)
+	if pos.State.ToolIndex != 3 || !pos.State.ToolSet {
+		t.Errorf("Tool %d (set: %t), expected tool 3 set", pos.State.ToolIndex, pos.State.ToolSet)
+	}
+
+	m = process(t, "T4 M6\nG0 X1\n")
+	if pos := last(m); pos.State.ToolIndex != 4 || pos.State.ToolSet {
+		t.Errorf("Tool %d (set: %t), expected tool 4 changed", pos.State.ToolIndex, pos.State.ToolSet)
+	}
+}
+
+func TestSetToolInvalid(t *testing.T) {
+	for _, code := range []string{"M61\n", "M61 Q-1\n", "M61 Q1.5\n"} {
+		doc, err := gcode.Parse(code)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err)
+		}
+		var m vm.Machine
+		m.Init()
+		if err := m.Process(doc); err == nil {
+			t.Errorf("%q accepted", code)
+		}
+	}
+}
+
+func TestDynamicToolLength(t *testing.T) {
+	m := process(t, "G43.1 Z-1.5\nG0 X1\n")
+	if s := last(m).State; s.ToolLengthIndex != vm.ToolLengthDynamic || s.ToolLengthOffset != -1.5 {
+		t.Errorf("Tool length index %d offset %g, expected dynamic offset -1.5", s.ToolLengthIndex, s.ToolLengthOffset)
+	}
+
+	m = process(t, "G20\nG43.1 Z0.1\nG0 X1\n")
+	if s := last(m).State; math.Abs(s.ToolLengthOffset-2.54) > epsilon {
+		t.Errorf("Tool length offset %g, expected 2.54", s.ToolLengthOffset)
+	}
+
+	m = process(t, "G43.1 Z-1.5\nG49\nG0 X1\n")
+	if s := last(m).State; s.ToolLengthIndex != 0 || s.ToolLengthOffset != 0 {
+		t.Errorf("Tool length index %d offset %g after G49, expected none", s.ToolLengthIndex, s.ToolLengthOffset)
+	}
+}
+
+func TestToolTable(t *testing.T) {
+	m := process(t, "G10 L1 P2 R3 Z25\n")
+	if tool, ok := m.GetTool(2); !ok || tool.Diameter != 6 || tool.Length != 25 {
+		t.Errorf("Tool 2 %+v (defined: %t), expected diameter 6 and length 25", tool, ok)
+	}
+
+	// The length puts the current position at the given Z
+	m = process(t, "G10 L1 P1 Z25\nG43 H1\nG0 Z10\nG10 L10 P2 Z4\n")
+	if tool, _ := m.GetTool(2); math.Abs(tool.Length-31) > epsilon {
+		t.Errorf("Tool 2 length %g, expected 31", tool.Length)
+	}
+	if tool, _ := m.GetTool(1); tool.Length != 25 {
+		t.Errorf("Tool 1 length %g changed, expected 25", tool.Length)
+	}
+}
+
+func TestCoordinateSystemAt(t *testing.T) {
+	m := process(t, "G40\nG0 X10 Y5 Z3\nG10 L20 P2 X1 Y0\nG55\nG0 X0 Y0\n")
+	expectAt(t, last(m), 9, 5, 3)
+
+	// P0 is the coordinate system in use
+	m = process(t, "G40\nG0 X10 Y5 Z3\nG10 L20 P0 Z0\nG0 Z1\n")
+	expectAt(t, last(m), 10, 5, 4)
+
+	// A rotated coordinate system keeps the coordinate of the axis not given
+	m = process(t, "G40\nG10 L2 P1 R90\nG54\nG0 X2 Y3\nG10 L20 P1 X0\nG0 X0 Y3\n")
+	expectAt(t, last(m), -3, 2, 0)
+}
+
+func TestRotation(t *testing.T) {
+	m := process(t, "G40\nG10 L2 P1 X10 Y10 R90\nG54\nG0 X0 Y0\nG0 X5\nG0 Y5\n")
+	expectAt(t, m.Positions[len(m.Positions)-2], 10, 15, 0)
+	expectAt(t, last(m), 5, 15, 0)
+
+	// Incremental moves are rotated too
+	m = process(t, "G40\nG10 L2 P1 R90\nG54\nG91\nG0 X5\n")
+	expectAt(t, last(m), 0, 5, 0)
+
+	// So are arc centers
+	m = process(t, "G40\nG10 L2 P1 R90\nG54\nG0 X10\nG3 X-10 I-10 J0\n")
+	if pos := last(m); math.Abs(pos.X) > epsilon || math.Abs(pos.Y+10) > epsilon {
+		t.Errorf("Arc ends at X%g Y%g, expected X0 Y-10", pos.X, pos.Y)
+	}
+}
+
+func TestAbsoluteArcOffset(t *testing.T) {
+	// Absolute centers, K included, are offset like the end point, once
+	for _, plane := range []string{"G18\nG2 X10 Z0 I5 K0\n", "G19\nG2 Y10 Z0 J5 K0\n"} {
+		m := process(t, "G40\nG10 L2 P1 Z-10\nG54\nG90.1\nG0 X0 Y0 Z0\n"+plane)
+		end := last(m)
+		if math.Abs(end.Z+10) > epsilon || math.Abs(end.X+end.Y-10) > epsilon {
+			t.Errorf("%q ends at X%g Y%g Z%g, expected 10 along the arc at Z-10", plane, end.X, end.Y, end.Z)
+		}
+		for _, pos := range m.Positions[2:] {
+			if r := math.Hypot(pos.X+pos.Y-5, pos.Z+10); math.Abs(r-5) > 1e-3 {
+				t.Errorf("%q passes X%g Y%g Z%g, %g from the center, expected 5", plane, pos.X, pos.Y, pos.Z, r)
+				break
+			}
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	m := process(t, "(T1 D=6 flat end mill)\n(Pocket 3)\nG1 X1 F100\n(T2 finishing)\nG1 X2\n(Operation: Holes)\nG1 X3\n")
+	for idx, label := range []string{"Pocket 3", "T2 finishing", "Holes"} {
+		if l := m.Positions[idx+1].State.Label; l != label {
+			t.Errorf("Position %d labelled %q, expected %q", idx+1, l, label)
+		}
+	}
+
+	// Other comments neither label nor split operations
+	m = process(t, "(Contour1)\nG1 X1 F100\n(Check the clamps)\n(MSG, Contour)\nG1 X2\n")
+	if ops := m.Operations(); len(ops) != 1 || ops[0].Label != "Contour1" {
+		t.Errorf("Operations %+v, expected one labelled Contour1", ops)
+	}
+
+	// A trailing label adds no position
+	m = process(t, "G1 X1 F100\n(Pocket 4)\n")
+	if len(m.Positions) != 2 {
+		t.Errorf("%d positions, expected 2", len(m.Positions))
+	}
+}
+
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := gocnctest.Pipeline{
+		Setup:     func(m *vm.Machine) { m.KeepArcs = true },
+		Precision: 4,
+	}
+	for _, f := range files {
+		p.GoldenFile(t, f, 1e-4)
+	}
+}